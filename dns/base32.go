@@ -0,0 +1,38 @@
+package dns
+
+import (
+	"encoding/base32"
+	"fmt"
+	"strings"
+)
+
+// Base32StdAlphabet is the alphabet of standard base32 (RFC 4648), with which
+// the client encodes data in query names and the server decodes it, unless
+// both are given another alphabet with their -base32-alphabet options.
+const Base32StdAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+// NewBase32Encoding returns a base32 encoding without padding that uses
+// alphabet. alphabet must consist of 32 letters and digits, no two of which are
+// the same without regard to case, because DNS names are compared without
+// regard to case and resolvers may change the case of the names they forward.
+// The returned encoding uses the upper-case form of alphabet: the client
+// converts encoded names to lower case before sending them, and the server
+// converts names to upper case before decoding them.
+func NewBase32Encoding(alphabet string) (*base32.Encoding, error) {
+	if len(alphabet) != 32 {
+		return nil, fmt.Errorf("alphabet must have 32 characters, not %d", len(alphabet))
+	}
+	alphabet = strings.ToUpper(alphabet)
+	seen := make(map[byte]bool)
+	for i := 0; i < len(alphabet); i++ {
+		c := alphabet[i]
+		if !('A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return nil, fmt.Errorf("alphabet may contain only letters and digits, not %+q", c)
+		}
+		if seen[c] {
+			return nil, fmt.Errorf("alphabet contains %+q more than once", c)
+		}
+		seen[c] = true
+	}
+	return base32.NewEncoding(alphabet).WithPadding(base32.NoPadding), nil
+}
@@ -0,0 +1,37 @@
+package dns
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNewBase32Encoding(t *testing.T) {
+	for _, test := range []struct {
+		alphabet string
+		ok       bool
+	}{
+		{Base32StdAlphabet, true},
+		{"0123456789abcdefghijklmnopqrstuv", true},
+		{"0123456789ABCDEFGHIJKLMNOPQRSTU", false},
+		{"0123456789ABCDEFGHIJKLMNOPQRSTUVW", false},
+		{"0123456789ABCDEFGHIJKLMNOPQRSTU-", false},
+		{"0123456789ABCDEFGHIJKLMNOPQRSTUu", false},
+	} {
+		enc, err := NewBase32Encoding(test.alphabet)
+		if test.ok != (err == nil) {
+			t.Errorf("%+q: got error %v, expected ok=%v", test.alphabet, err, test.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		// Encoding and decoding round-trip, even after a change of case.
+		input := []byte("\x00\x01\x02hello\xff")
+		encoded := strings.ToLower(enc.EncodeToString(input))
+		decoded, err := enc.DecodeString(strings.ToUpper(encoded))
+		if err != nil || !bytes.Equal(decoded, input) {
+			t.Errorf("%+q: decoded %+q, error %v", test.alphabet, decoded, err)
+		}
+	}
+}
@@ -44,18 +44,30 @@ var (
 
 const (
 	// https://tools.ietf.org/html/rfc1035#section-3.2.2
+	RRTypeA   = 1
+	RRTypeNS  = 2
+	RRTypeSOA = 6
+	RRTypeMX  = 15
 	RRTypeTXT = 16
+	// https://tools.ietf.org/html/rfc3596#section-2.1
+	RRTypeAAAA = 28
 	// https://tools.ietf.org/html/rfc6891#section-6.1.1
 	RRTypeOPT = 41
+	// https://tools.ietf.org/html/draft-ietf-dnsop-svcb-https-02#section-11.1
+	RRTypeSVCB  = 64
+	RRTypeHTTPS = 65
 
 	// https://tools.ietf.org/html/rfc1035#section-3.2.4
-	ClassIN = 1
+	ClassIN    = 1
+	ClassCHAOS = 3
 
 	// https://tools.ietf.org/html/rfc1035#section-4.1.1
 	RcodeNoError         = 0  // a.k.a. NOERROR
 	RcodeFormatError     = 1  // a.k.a. FORMERR
+	RcodeServerFailure   = 2  // a.k.a. SERVFAIL
 	RcodeNameError       = 3  // a.k.a. NXDOMAIN
 	RcodeNotImplemented  = 4  // a.k.a. NOTIMPL
+	RcodeRefused         = 5  // a.k.a. REFUSED
 	ExtendedRcodeBadVers = 16 // a.k.a. BADVERS
 )
 
@@ -157,6 +169,25 @@ func (msg *Message) Rcode() uint16 {
 	return msg.Flags & 0x000f
 }
 
+// EncodeOPTTTL packs the TTL field of an OPT RR from an RCODE, an EDNS version,
+// and the EDNS flags (DO and Z). Only the upper 8 bits of the 12-bit extended
+// RCODE go in the TTL; the lower 4 bits belong in the message header's RCODE
+// field, which the caller must set separately.
+//
+// https://tools.ietf.org/html/rfc6891#section-6.1.3
+func EncodeOPTTTL(rcode uint16, version uint8, flags uint16) uint32 {
+	return uint32((rcode>>4)&0xff)<<24 | uint32(version)<<16 | uint32(flags)
+}
+
+// DecodeOPTTTL unpacks the TTL field of an OPT RR into the upper 8 bits of the
+// extended RCODE (already shifted into place, so that they may be ORed with the
+// header's RCODE), the EDNS version, and the EDNS flags.
+//
+// https://tools.ietf.org/html/rfc6891#section-6.1.3
+func DecodeOPTTTL(ttl uint32) (rcodeHigh uint16, version uint8, flags uint16) {
+	return uint16(ttl>>24) << 4, uint8(ttl >> 16), uint16(ttl)
+}
+
 // Question represents the question section of a message.
 //
 // https://tools.ietf.org/html/rfc1035#section-4.1.2
@@ -553,3 +584,41 @@ func EncodeRDataTXT(p []byte) []byte {
 	buf.Write(p)
 	return buf.Bytes()
 }
+
+// EncodeRDataNS encodes a name as NSDNAME, as appropriate for the RDATA of a
+// resource record with TYPE=NS. The name is written in full, without
+// compression.
+//
+// https://tools.ietf.org/html/rfc1035#section-3.3.11
+func EncodeRDataNS(name Name) []byte {
+	builder := newMessageBuilder()
+	builder.WriteName(name)
+	return builder.Bytes()
+}
+
+// EncodeRDataSOA encodes the fields of the RDATA of a resource record with
+// TYPE=SOA. The names are written in full, without compression.
+//
+// https://tools.ietf.org/html/rfc1035#section-3.3.13
+func EncodeRDataSOA(mname, rname Name, serial, refresh, retry, expire, minimum uint32) []byte {
+	// Use a separate builder for each name, so that rname is not
+	// compressed against mname.
+	var buf bytes.Buffer
+	buf.Write(EncodeRDataNS(mname))
+	buf.Write(EncodeRDataNS(rname))
+	for _, v := range []uint32{serial, refresh, retry, expire, minimum} {
+		binary.Write(&buf, binary.BigEndian, v)
+	}
+	return buf.Bytes()
+}
+
+// EncodeRDataMX encodes a preference and a name as the RDATA of a resource
+// record with TYPE=MX. The name is written in full, without compression.
+//
+// https://tools.ietf.org/html/rfc1035#section-3.3.9
+func EncodeRDataMX(preference uint16, exchange Name) []byte {
+	builder := newMessageBuilder()
+	binary.Write(&builder.w, binary.BigEndian, preference)
+	builder.WriteName(exchange)
+	return builder.Bytes()
+}
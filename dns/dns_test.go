@@ -537,3 +537,83 @@ func TestRDataTXTRoundTrip(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodeRDataNS(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		encoded []byte
+	}{
+		{".", []byte("\x00")},
+		{"ns.example.com", []byte("\x02ns\x07example\x03com\x00")},
+		// No compression even when suffixes repeat.
+		{"com.com", []byte("\x03com\x03com\x00")},
+	} {
+		name, err := ParseName(test.name)
+		if err != nil {
+			panic(err)
+		}
+		encoded := EncodeRDataNS(name)
+		if !bytes.Equal(encoded, test.encoded) {
+			t.Errorf("%+q returned %+q, expected %+q", test.name, encoded, test.encoded)
+		}
+	}
+}
+
+func TestOPTTTL(t *testing.T) {
+	for _, test := range []struct {
+		rcode   uint16
+		version uint8
+		flags   uint16
+		ttl     uint32
+	}{
+		{RcodeNoError, 0, 0x0000, 0x00000000},
+		// The low 4 bits of the RCODE are not in the TTL.
+		{RcodeRefused, 0, 0x0000, 0x00000000},
+		// BADVERS.
+		{ExtendedRcodeBadVers, 0, 0x0000, 0x01000000},
+		// DO set.
+		{RcodeNoError, 0, 0x8000, 0x00008000},
+		{ExtendedRcodeBadVers, 0, 0x8000, 0x01008000},
+		// The largest extended RCODE, a version, and all flags.
+		{0xfff, 1, 0xffff, 0xff01ffff},
+		{0x123, 255, 0x8001, 0x12ff8001},
+	} {
+		ttl := EncodeOPTTTL(test.rcode, test.version, test.flags)
+		if ttl != test.ttl {
+			t.Errorf("%+v: encoded %#08x", test, ttl)
+		}
+		rcodeHigh, version, flags := DecodeOPTTTL(ttl)
+		if rcodeHigh != test.rcode&0xff0 || version != test.version || flags != test.flags {
+			t.Errorf("%+v: decoded %#x %d %#04x", test, rcodeHigh, version, flags)
+		}
+	}
+}
+
+func TestEncodeRDataMX(t *testing.T) {
+	name, err := ParseName("mail.example.com")
+	if err != nil {
+		panic(err)
+	}
+	encoded := EncodeRDataMX(10, name)
+	expected := []byte("\x00\x0a\x04mail\x07example\x03com\x00")
+	if !bytes.Equal(encoded, expected) {
+		t.Errorf("returned %+q, expected %+q", encoded, expected)
+	}
+}
+
+func TestEncodeRDataSOA(t *testing.T) {
+	mname, err := ParseName("ns.example.com")
+	if err != nil {
+		panic(err)
+	}
+	rname, err := ParseName("hostmaster.example.com")
+	if err != nil {
+		panic(err)
+	}
+	encoded := EncodeRDataSOA(mname, rname, 1, 2, 3, 4, 5)
+	expected := []byte("\x02ns\x07example\x03com\x00\x0ahostmaster\x07example\x03com\x00" +
+		"\x00\x00\x00\x01\x00\x00\x00\x02\x00\x00\x00\x03\x00\x00\x00\x04\x00\x00\x00\x05")
+	if !bytes.Equal(encoded, expected) {
+		t.Errorf("returned %+q, expected %+q", encoded, expected)
+	}
+}
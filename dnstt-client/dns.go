@@ -35,7 +35,10 @@ const (
 	pollDelayMultiplier = 2.0
 )
 
-// base32Encoding is a base32 encoding without padding.
+// base32Encoding is a base32 encoding without padding, with the alphabet that
+// the server expects in query names.
+//
+// Control this value with the -base32-alphabet command-line option.
 var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
 
 // DNSPacketConn provides a packet-sending and -receiving interface over various
@@ -32,6 +32,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -45,6 +46,32 @@ import (
 // smux streams will be closed after this much time without receiving data.
 const idleTimeout = 10 * time.Minute
 
+// The longest stream tag that dnstt-server accepts.
+const maxStreamTagLen = 32
+
+// If not nil, a tag to send at the beginning of every stream, for a server
+// that uses the -stream-tags option. An empty, non-nil tag sends a tag of
+// length 0.
+//
+// Control this value with the -stream-tag command-line option.
+var streamTag []byte = nil
+
+// The Noise cipher suite to use, one of noise.Suites. The server accepts any of
+// them.
+//
+// Control this value with the -noise-suite command-line option.
+var noiseSuite = noise.DefaultSuite
+
+// validNoiseSuite returns true if suite is one of noise.Suites.
+func validNoiseSuite(suite string) bool {
+	for _, s := range noise.Suites {
+		if s == suite {
+			return true
+		}
+	}
+	return false
+}
+
 // dnsNameCapacity returns the number of bytes remaining for encoded data after
 // including domain in a DNS name.
 func dnsNameCapacity(domain dns.Name) int {
@@ -75,16 +102,33 @@ func readKeyFromFile(filename string) ([]byte, error) {
 	return noise.ReadKey(f)
 }
 
-func handle(local *net.TCPConn, sess *smux.Session, conv uint32) error {
+// openStream opens a new stream in sess and sends tag on it, if tag is not nil.
+func openStream(sess *smux.Session, conv uint32, tag []byte) (*smux.Stream, error) {
 	stream, err := sess.OpenStream()
 	if err != nil {
-		return fmt.Errorf("session %08x opening stream: %v", conv, err)
+		return nil, fmt.Errorf("session %08x opening stream: %v", conv, err)
 	}
+	log.Printf("begin stream %08x:%d", conv, stream.ID())
+
+	if tag != nil {
+		// A length octet followed by the tag.
+		_, err := stream.Write(append([]byte{byte(len(tag))}, tag...))
+		if err != nil {
+			log.Printf("end stream %08x:%d", conv, stream.ID())
+			stream.Close()
+			return nil, fmt.Errorf("stream %08x:%d writing tag: %v", conv, stream.ID(), err)
+		}
+	}
+
+	return stream, nil
+}
+
+// handle copies data between local and stream, then closes stream.
+func handle(local *net.TCPConn, stream *smux.Stream, conv uint32) error {
 	defer func() {
 		log.Printf("end stream %08x:%d", conv, stream.ID())
 		stream.Close()
 	}()
-	log.Printf("begin stream %08x:%d", conv, stream.ID())
 
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -115,7 +159,7 @@ func handle(local *net.TCPConn, sess *smux.Session, conv uint32) error {
 	}()
 	wg.Wait()
 
-	return err
+	return nil
 }
 
 func run(pubkey []byte, domain dns.Name, localAddr *net.TCPAddr, remoteAddr net.Addr, pconn net.PacketConn) error {
@@ -158,7 +202,7 @@ func run(pubkey []byte, domain dns.Name, localAddr *net.TCPAddr, remoteAddr net.
 	}
 
 	// Put a Noise channel on top of the KCP conn.
-	rw, err := noise.NewClient(conn, pubkey)
+	rw, err := noise.NewClientSuite(conn, pubkey, noiseSuite)
 	if err != nil {
 		return err
 	}
@@ -173,6 +217,12 @@ func run(pubkey []byte, domain dns.Name, localAddr *net.TCPAddr, remoteAddr net.
 	}
 	defer sess.Close()
 
+	open := func() (*smux.Stream, error) { return openStream(sess, conn.GetConv(), streamTag) }
+	if predial > 0 {
+		spares := newSpareStreams(sess, conn.GetConv(), streamTag, predial, predialMaxAge)
+		open = spares.Get
+	}
+
 	for {
 		local, err := ln.Accept()
 		if err != nil {
@@ -183,7 +233,12 @@ func run(pubkey []byte, domain dns.Name, localAddr *net.TCPAddr, remoteAddr net.
 		}
 		go func() {
 			defer local.Close()
-			err := handle(local.(*net.TCPConn), sess, conn.GetConv())
+			stream, err := open()
+			if err != nil {
+				log.Printf("handle: %v", err)
+				return
+			}
+			err = handle(local.(*net.TCPConn), stream, conn.GetConv())
 			if err != nil {
 				log.Printf("handle: %v", err)
 			}
@@ -192,10 +247,12 @@ func run(pubkey []byte, domain dns.Name, localAddr *net.TCPAddr, remoteAddr net.
 }
 
 func main() {
+	var base32Alphabet string
 	var dohURL string
 	var dotAddr string
 	var pubkeyFilename string
 	var pubkeyString string
+	var streamTagString string
 	var udpAddr string
 
 	flag.Usage = func() {
@@ -209,10 +266,14 @@ Examples:
 `, os.Args[0])
 		flag.PrintDefaults()
 	}
+	flag.StringVar(&base32Alphabet, "base32-alphabet", dns.Base32StdAlphabet, "32 letters and digits to encode query names with, instead of the standard base32 alphabet (the server must use the same)")
 	flag.StringVar(&dohURL, "doh", "", "URL of DoH resolver")
 	flag.StringVar(&dotAddr, "dot", "", "address of DoT resolver")
+	flag.StringVar(&noiseSuite, "noise-suite", noiseSuite, fmt.Sprintf("Noise cipher suite, one of %s", strings.Join(noise.Suites, ", ")))
+	flag.IntVar(&predial, "predial", predial, "keep this many streams open in advance of local connections")
 	flag.StringVar(&pubkeyString, "pubkey", "", fmt.Sprintf("server public key (%d hex digits)", noise.KeyLen*2))
 	flag.StringVar(&pubkeyFilename, "pubkey-file", "", "read server public key from file")
+	flag.StringVar(&streamTagString, "stream-tag", "", fmt.Sprintf("send this tag (up to %d bytes) at the start of every stream, for a server using -stream-tags", maxStreamTagLen))
 	flag.StringVar(&udpAddr, "udp", "", "address of UDP DNS resolver")
 	flag.Parse()
 
@@ -233,6 +294,29 @@ Examples:
 		os.Exit(1)
 	}
 
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "stream-tag" {
+			streamTag = []byte(streamTagString)
+		}
+	})
+	if !validNoiseSuite(noiseSuite) {
+		fmt.Fprintf(os.Stderr, "-noise-suite must be one of %s\n", strings.Join(noise.Suites, ", "))
+		os.Exit(1)
+	}
+	base32Encoding, err = dns.NewBase32Encoding(base32Alphabet)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -base32-alphabet: %v\n", err)
+		os.Exit(1)
+	}
+	if predial < 0 {
+		fmt.Fprintf(os.Stderr, "-predial must not be negative\n")
+		os.Exit(1)
+	}
+	if len(streamTag) > maxStreamTagLen {
+		fmt.Fprintf(os.Stderr, "-stream-tag may be at most %d bytes\n", maxStreamTagLen)
+		os.Exit(1)
+	}
+
 	var pubkey []byte
 	if pubkeyFilename != "" && pubkeyString != "" {
 		fmt.Fprintf(os.Stderr, "only one of -pubkey and -pubkey-file may be used\n")
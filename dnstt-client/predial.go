@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// The number of streams to open in advance of local connections, so that the
+// server has already connected to its upstream by the time a local
+// connection arrives.
+//
+// Control this value with the -predial command-line option.
+var predial = 0
+
+// A pre-opened stream that has waited this long for a local connection is
+// closed rather than used, because the upstream may have given up on it. A
+// server with -first-byte-timeout shorter than this closes spare streams
+// itself, before they reach this age.
+const predialMaxAge = 30 * time.Second
+
+// spareStream is a stream opened in advance, and the time it was opened.
+type spareStream struct {
+	stream *smux.Stream
+	opened time.Time
+}
+
+// spareStreams keeps a number of streams open in advance in an smux session.
+// dnstt-server connects to its upstream as soon as a stream is opened, so
+// taking a spare stream, rather than opening a new one, hides the latency of
+// opening the stream and of the server's upstream connection. The server
+// needs no special support for this.
+type spareStreams struct {
+	sess   *smux.Session
+	conv   uint32
+	tag    []byte
+	maxAge time.Duration
+	ch     chan spareStream
+	// One element for every spare stream that is open or being opened.
+	// Its capacity bounds the number of spare streams; the stream being
+	// opened counts, so that there are never more than that many.
+	slots chan struct{}
+}
+
+// newSpareStreams starts a goroutine that keeps n streams open in sess, each
+// with tag sent as by openStream, opening a new one whenever one is taken with
+// Get. The goroutine stops, and closes spares.ch, when opening a stream fails,
+// for example because the session is closed.
+func newSpareStreams(sess *smux.Session, conv uint32, tag []byte, n int, maxAge time.Duration) *spareStreams {
+	spares := &spareStreams{
+		sess:   sess,
+		conv:   conv,
+		tag:    tag,
+		maxAge: maxAge,
+		ch:     make(chan spareStream, n),
+		slots:  make(chan struct{}, n),
+	}
+	go func() {
+		defer close(spares.ch)
+		for {
+			// Wait for a stream to be taken before opening
+			// another.
+			spares.slots <- struct{}{}
+			stream, err := openStream(sess, conv, tag)
+			if err != nil {
+				log.Printf("predial: %v", err)
+				return
+			}
+			spares.ch <- spareStream{stream, time.Now()}
+		}
+	}()
+	return spares
+}
+
+// Get returns a spare stream if one is available, closing any that are older
+// than maxAge, or else opens a new stream.
+func (spares *spareStreams) Get() (*smux.Stream, error) {
+	for {
+		select {
+		case spare, ok := <-spares.ch:
+			if !ok {
+				return openStream(spares.sess, spares.conv, spares.tag)
+			}
+			<-spares.slots
+			if age := time.Since(spare.opened); age >= spares.maxAge {
+				log.Printf("end stream %08x:%d (unused for %v)", spares.conv, spare.stream.ID(), age)
+				spare.stream.Close()
+				continue
+			}
+			return spare.stream, nil
+		default:
+			return openStream(spares.sess, spares.conv, spares.tag)
+		}
+	}
+}
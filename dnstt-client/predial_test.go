@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// smuxPair returns the client and server ends of an smux session.
+func smuxPair(t *testing.T) (*smux.Session, *smux.Session) {
+	c1, c2 := net.Pipe()
+	config := smux.DefaultConfig()
+	config.Version = 2
+	client, err := smux.Client(c1, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := smux.Server(c2, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// acceptStream accepts a stream in sess, with a timeout.
+func acceptStream(t *testing.T, sess *smux.Session) *smux.Stream {
+	t.Helper()
+	sess.SetDeadline(time.Now().Add(5 * time.Second))
+	stream, err := sess.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+func TestSpareStreams(t *testing.T) {
+	client, server := smuxPair(t)
+	defer server.Close()
+
+	// The spare streams are opened, and tagged, before anyone asks for
+	// them.
+	const n = 2
+	spares := newSpareStreams(client, 0, []byte("tag"), n, time.Hour)
+	var accepted []*smux.Stream
+	for i := 0; i < n; i++ {
+		stream := acceptStream(t, server)
+		var buf [4]byte
+		if _, err := io.ReadFull(stream, buf[:]); err != nil || string(buf[:]) != "\x03tag" {
+			t.Fatalf("stream %d: got tag %+q, %v", i, buf, err)
+		}
+		accepted = append(accepted, stream)
+	}
+
+	// No more than n are opened.
+	server.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if extra, err := server.AcceptStream(); err == nil {
+		t.Fatalf("stream %d opened beyond the %d spares", extra.ID(), n)
+	}
+	server.SetDeadline(time.Time{})
+
+	// Get returns the oldest spare, and another is opened to replace it.
+	stream, err := spares.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.ID() != accepted[0].ID() {
+		t.Errorf("got stream %d, expected %d", stream.ID(), accepted[0].ID())
+	}
+	acceptStream(t, server)
+
+	// Closing the session stops the goroutine, which closes spares.ch.
+	client.Close()
+	for range spares.ch {
+	}
+}
+
+func TestSpareStreamsMaxAge(t *testing.T) {
+	client, server := smuxPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	const maxAge = 50 * time.Millisecond
+	spares := newSpareStreams(client, 0, nil, 1, maxAge)
+	stale := acceptStream(t, server)
+	time.Sleep(2 * maxAge)
+
+	// Get closes the stale spare rather than returning it.
+	stream, err := spares.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.ID() == stale.ID() {
+		t.Fatalf("Get returned a stale stream")
+	}
+	stale.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf [1]byte
+	if _, err := stale.Read(buf[:]); err != io.EOF {
+		t.Errorf("stale stream was not closed: %v", err)
+	}
+}
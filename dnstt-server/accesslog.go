@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+)
+
+// accessLogTimeFormat is the timestamp format of the Common Log Format.
+const accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogger writes one line for every response, in a format modeled on the
+// Common Log Format of web servers:
+//
+//	ADDR IDENT - [TIME] "QTYPE NAME" RCODE SIZE TC
+//
+// IDENT, the field that in the Common Log Format is the remote identity, is the
+// server's -instance-id, or "-" if it has none. NAME is the question name, or
+// by default a keyed hash of it; QTYPE and RCODE are mnemonics where known;
+// SIZE is the number of bytes sent; and TC is "TC" if the response was
+// truncated or "-" otherwise. Its methods are safe to call from multiple
+// goroutines.
+type accessLogger struct {
+	w io.Writer
+	// Identifies this server in every line, if not empty.
+	ident string
+	// If true, log question names as they are, rather than hashed.
+	names bool
+	// A random key for hashing question names, so that the hashes of
+	// the same name can be matched up within one log, but not across
+	// restarts, and cannot be reversed by hashing guessed names.
+	key  []byte
+	lock sync.Mutex
+}
+
+// newAccessLogger returns an accessLogger that writes to w, with ident, if not
+// empty, in the IDENT field. If names is true, it logs question names rather
+// than hashes of them.
+func newAccessLogger(w io.Writer, ident string, names bool) (*accessLogger, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLogger{w: w, ident: ident, names: names, key: key}, nil
+}
+
+// Log writes a line for a response resp of size bytes that was sent to addr
+// at time now.
+func (l *accessLogger) Log(now time.Time, addr net.Addr, resp *dns.Message, size int, truncated bool) error {
+	qtype, name := "-", "-"
+	if len(resp.Question) == 1 {
+		question := resp.Question[0]
+		qtype = rrTypeString(question.Type)
+		if l.names {
+			name = escapeName(question.Name)
+		} else {
+			name = l.hashName(question.Name)
+		}
+	}
+	tc := "-"
+	if truncated {
+		tc = "TC"
+	}
+	ident := "-"
+	if l.ident != "" {
+		ident = l.ident
+	}
+	line := fmt.Sprintf("%s %s - [%s] \"%s %s\" %s %d %s\n",
+		addr, ident, now.Format(accessLogTimeFormat), qtype, name, rcodeString(extendedRcode(resp)), size, tc)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, err := io.WriteString(l.w, line)
+	return err
+}
+
+// hashName returns a hex-encoded keyed hash of the case-folded name.
+func (l *accessLogger) hashName(name dns.Name) string {
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write(bytes.ToLower([]byte(name.String())))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// escapeName returns the presentation form of name. Spaces, control
+// characters, non-ASCII bytes, and the characters '"', '.', and '\\' within
+// labels are escaped as \DDD.
+// https://tools.ietf.org/html/rfc4343#section-2.1
+func escapeName(name dns.Name) string {
+	if len(name) == 0 {
+		return "."
+	}
+	var buf bytes.Buffer
+	for i, label := range name {
+		if i > 0 {
+			buf.WriteByte('.')
+		}
+		for _, b := range label {
+			if b <= ' ' || b >= 0x7f || b == '"' || b == '\\' || b == '.' {
+				fmt.Fprintf(&buf, "\\%03d", b)
+			} else {
+				buf.WriteByte(b)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// extendedRcode returns the full RCODE of resp, including the upper bits
+// carried in its OPT RR, if any.
+// https://tools.ietf.org/html/rfc6891#section-6.1.3
+func extendedRcode(resp *dns.Message) uint16 {
+	rcode := resp.Rcode()
+	for _, rr := range resp.Additional {
+		if rr.Type == dns.RRTypeOPT {
+			rcode |= uint16(rr.TTL>>24) << 4
+			break
+		}
+	}
+	return rcode
+}
+
+// rrTypeString returns the mnemonic for the RR types the server deals with,
+// or the generic TYPEn form for others.
+// https://tools.ietf.org/html/rfc3597#section-5
+func rrTypeString(rrType uint16) string {
+	switch rrType {
+	case dns.RRTypeA:
+		return "A"
+	case dns.RRTypeNS:
+		return "NS"
+	case dns.RRTypeSOA:
+		return "SOA"
+	case dns.RRTypeMX:
+		return "MX"
+	case dns.RRTypeTXT:
+		return "TXT"
+	case dns.RRTypeAAAA:
+		return "AAAA"
+	case dns.RRTypeOPT:
+		return "OPT"
+	case dns.RRTypeSVCB:
+		return "SVCB"
+	case dns.RRTypeHTTPS:
+		return "HTTPS"
+	default:
+		return fmt.Sprintf("TYPE%d", rrType)
+	}
+}
+
+// rcodeString returns the mnemonic for rcode, or its number if it has none
+// that the server uses.
+func rcodeString(rcode uint16) string {
+	switch rcode {
+	case dns.RcodeNoError:
+		return "NOERROR"
+	case dns.RcodeFormatError:
+		return "FORMERR"
+	case dns.RcodeServerFailure:
+		return "SERVFAIL"
+	case dns.RcodeNameError:
+		return "NXDOMAIN"
+	case dns.RcodeNotImplemented:
+		return "NOTIMP"
+	case dns.RcodeRefused:
+		return "REFUSED"
+	case dns.ExtendedRcodeBadVers:
+		return "BADVERS"
+	default:
+		return fmt.Sprintf("RCODE%d", rcode)
+	}
+}
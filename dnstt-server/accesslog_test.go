@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestAccessLogger(t *testing.T) {
+	now := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	addr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 5353}
+	domain := mustParseName("t.example.com")
+
+	var buf bytes.Buffer
+	l, err := newAccessLogger(&buf, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Names are hashed, case-insensitively.
+	lower := nsQuery(mustParseName("www.t.example.com"))
+	upper := nsQuery(mustParseName("WWW.T.Example.COM"))
+	for _, query := range []*dns.Message{lower, upper} {
+		resp, _ := responseFor(query, domain)
+		if err := l.Log(now, addr, resp, 100, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %+q", buf.String())
+	}
+	pattern := regexp.MustCompile(`^192\.0\.2\.1:5353 - - \[02/Jan/2000:03:04:05 \+0000\] "NS ([0-9a-f]{16})" NXDOMAIN 100 -$`)
+	m0 := pattern.FindStringSubmatch(lines[0])
+	m1 := pattern.FindStringSubmatch(lines[1])
+	if m0 == nil || m1 == nil {
+		t.Fatalf("lines do not match pattern: %+q", lines)
+	}
+	if m0[1] != m1[1] {
+		t.Errorf("hashes differ by case: %s %s", m0[1], m1[1])
+	}
+	if strings.Contains(buf.String(), "www") {
+		t.Errorf("name appears in log: %+q", buf.String())
+	}
+
+	// Another logger uses a different key.
+	var buf2 bytes.Buffer
+	l2, _ := newAccessLogger(&buf2, "", false)
+	resp, _ := responseFor(lower, domain)
+	l2.Log(now, addr, resp, 100, false)
+	if m := pattern.FindStringSubmatch(strings.TrimSuffix(buf2.String(), "\n")); m == nil || m[1] == m0[1] {
+		t.Errorf("second logger: got %+q, expected a different hash than %s", buf2.String(), m0[1])
+	}
+}
+
+func TestAccessLoggerFields(t *testing.T) {
+	now := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	addr := turbotunnel.DummyAddr{}
+	domain := mustParseName("t.example.com")
+
+	badVers := tunnelQuery([]byte("CLIENTID"), domain)
+	badVers.Additional[0].TTL = 1 << 16
+	noQuestion := tunnelQuery([]byte("CLIENTID"), domain)
+	noQuestion.Question = nil
+	https := nsQuery(domain)
+	https.Question[0].Type = dns.RRTypeHTTPS
+
+	for _, test := range []struct {
+		query     *dns.Message
+		truncated bool
+		expected  string
+	}{
+		{nsQuery(mustParseName("www.t.example.com")), false, `"NS www.t.example.com" NXDOMAIN 50 -`},
+		{nsQuery(dns.Name{[]byte("a b\"c."), []byte("\x00\xff")}), true, `"NS a\032b\034c\046.\000\255" NXDOMAIN 50 TC`},
+		{https, false, `"HTTPS t.example.com" NXDOMAIN 50 -`},
+		{badVers, false, `"TXT ` + badVers.Question[0].Name.String() + `" BADVERS 50 -`},
+		{noQuestion, false, `"- -" FORMERR 50 -`},
+	} {
+		var buf bytes.Buffer
+		l, err := newAccessLogger(&buf, "", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, _ := responseFor(test.query, domain)
+		if err := l.Log(now, addr, resp, 50, test.truncated); err != nil {
+			t.Fatal(err)
+		}
+		expected := fmt.Sprintf("%s - - [02/Jan/2000:03:04:05 +0000] %s\n", addr, test.expected)
+		if buf.String() != expected {
+			t.Errorf("expected %+q, got %+q", expected, buf.String())
+		}
+	}
+}
+
+func TestAccessLoggerIdent(t *testing.T) {
+	now := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	addr := turbotunnel.DummyAddr{}
+	domain := mustParseName("t.example.com")
+
+	var buf bytes.Buffer
+	l, err := newAccessLogger(&buf, "dnstt-7", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := responseFor(nsQuery(mustParseName("www.t.example.com")), domain)
+	if err := l.Log(now, addr, resp, 50, false); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("%s dnstt-7 - [02/Jan/2000:03:04:05 +0000] \"NS www.t.example.com\" NXDOMAIN 50 -\n", addr)
+	if buf.String() != expected {
+		t.Errorf("expected %+q, got %+q", expected, buf.String())
+	}
+}
+
+func TestSendLoopAccessLog(t *testing.T) {
+	var buf syncBuffer
+	defer func(saved *accessLogger) { accessLog = saved }(accessLog)
+	var err error
+	accessLog, err = newAccessLogger(&buf, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	ch, dnsConn, _, stop := startSendLoop(ttConn)
+	domain := mustParseName("t.example.com")
+	resp, _ := responseFor(nsQuery(mustParseName("example.com")), domain)
+	ch <- &record{resp, turbotunnel.DummyAddr{}, turbotunnel.ClientID{}}
+	m := expectWritten(t, dnsConn)
+	stop()
+
+	expected := fmt.Sprintf("%s - - [01/Jan/2000:00:00:00 +0000] \"NS example.com\" NXDOMAIN %d -\n", turbotunnel.DummyAddr{}, len(m.P))
+	if buf.String() != expected {
+		t.Errorf("expected %+q, got %+q", expected, buf.String())
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// bannedClientIDs is the set of ClientIDs whose queries recvLoop drops. It is
+// loaded from the file named by the -ban-file option, and reloaded on SIGHUP.
+var bannedClientIDs banList
+
+// banList is a set of ClientIDs. The zero value is an empty set. Its methods
+// are safe to call from multiple goroutines.
+type banList struct {
+	ids  map[turbotunnel.ClientID]struct{}
+	lock sync.RWMutex
+}
+
+// Contains returns true if clientID is in the set.
+func (b *banList) Contains(clientID turbotunnel.ClientID) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	_, ok := b.ids[clientID]
+	return ok
+}
+
+// Set replaces the contents of the set with ids, and returns the ClientIDs
+// that are in ids but were not in the set before.
+func (b *banList) Set(ids map[turbotunnel.ClientID]struct{}) []turbotunnel.ClientID {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var added []turbotunnel.ClientID
+	for clientID := range ids {
+		if _, ok := b.ids[clientID]; !ok {
+			added = append(added, clientID)
+		}
+	}
+	b.ids = ids
+	return added
+}
+
+// readBanFile reads a set of ClientIDs from a file, one hex-encoded ClientID
+// per line. Blank lines and lines beginning with '#' are ignored.
+func readBanFile(filename string) (map[turbotunnel.ClientID]struct{}, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ids := make(map[turbotunnel.ClientID]struct{})
+	s := bufio.NewScanner(f)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var clientID turbotunnel.ClientID
+		buf, err := hex.DecodeString(line)
+		if err != nil || len(buf) != len(clientID) {
+			return nil, fmt.Errorf("%s:%d: ClientID must be %d hex-encoded bytes", filename, lineNum, len(clientID))
+		}
+		copy(clientID[:], buf)
+		ids[clientID] = struct{}{}
+	}
+	return ids, s.Err()
+}
+
+// loadBanFile replaces the contents of bannedClientIDs with the ClientIDs
+// listed in filename, and closes any open sessions of newly banned ClientIDs.
+// On error, bannedClientIDs is unchanged.
+func loadBanFile(filename string) error {
+	ids, err := readBanFile(filename)
+	if err != nil {
+		return err
+	}
+	added := bannedClientIDs.Set(ids)
+	log.Printf("loaded %d banned ClientIDs from %s", len(ids), filename)
+	for _, clientID := range added {
+		n := sessions.CloseClientID(clientID)
+		log.Printf("banned ClientID %v; closed %d sessions", clientID, n)
+	}
+	return nil
+}
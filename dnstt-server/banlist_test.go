@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestReadBanFile(t *testing.T) {
+	for _, test := range []struct {
+		contents string
+		ids      []turbotunnel.ClientID
+		ok       bool
+	}{
+		{"", nil, true},
+		{"# comment\n\n0102030405060708\n  a1a2a3a4a5a6a7a8  \n", []turbotunnel.ClientID{
+			{1, 2, 3, 4, 5, 6, 7, 8},
+			{0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7, 0xa8},
+		}, true},
+		{"0102030405060708", []turbotunnel.ClientID{{1, 2, 3, 4, 5, 6, 7, 8}}, true},
+		{"01020304050607\n", nil, false},
+		{"010203040506070809\n", nil, false},
+		{"010203040506070g\n", nil, false},
+	} {
+		f, err := ioutil.TempFile("", "dnstt-ban-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(test.contents)
+		f.Close()
+
+		ids, err := readBanFile(f.Name())
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%+q: expected error", test.contents)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+q: %v", test.contents, err)
+			continue
+		}
+		if len(ids) != len(test.ids) {
+			t.Errorf("%+q: got %d ClientIDs, expected %d", test.contents, len(ids), len(test.ids))
+		}
+		for _, clientID := range test.ids {
+			if _, ok := ids[clientID]; !ok {
+				t.Errorf("%+q: missing %v", test.contents, clientID)
+			}
+		}
+	}
+}
+
+func TestRecvLoopBannedClientID(t *testing.T) {
+	banned := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	other := turbotunnel.ClientID{8, 7, 6, 5, 4, 3, 2, 1}
+	bannedClientIDs.Set(map[turbotunnel.ClientID]struct{}{banned: {}})
+	defer bannedClientIDs.Set(nil)
+
+	domain := mustParseName("t.example.com")
+	dnsConn, ch, ttConn, stop := startRecvLoop(domain, 1000)
+	defer stop()
+
+	// The banned ClientID's query gets no response, and its packet does
+	// not reach ttConn. The first record and the first packet are those of
+	// the query that follows.
+	payload := append(append([]byte(nil), banned[:]...), 6, 'b', 'a', 'n', 'n', 'e', 'd')
+	buf, err := tunnelQuery(payload, domain).WireFormat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsConn.Inject(buf, turbotunnel.DummyAddr{})
+	rec := injectQuery(t, dnsConn, ch, domain, other, []byte("other"))
+	if rec.ClientID != other {
+		t.Errorf("response for %v, expected %v", rec.ClientID, other)
+	}
+	var p [1000]byte
+	n, addr, err := ttConn.ReadFrom(p[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != other || !bytes.Equal(p[:n], []byte("other")) {
+		t.Errorf("got packet %+q from %v, expected %+q from %v", p[:n], addr, "other", other)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	// How long to wait for the -bootstrap URL to respond.
+	bootstrapTimeout = 30 * time.Second
+
+	// The largest bootstrap configuration document we will read.
+	maxBootstrapLen = 64 * 1024
+)
+
+// bootstrapConfig is the configuration read by the -bootstrap option: the
+// values that are otherwise given as the DOMAIN and UPSTREAMADDR command-line
+// arguments. It is encoded as a JSON object, for example
+//
+//	{"domain": "t.example.com", "upstream": "127.0.0.1:8000"}
+type bootstrapConfig struct {
+	Domain   string `json:"domain"`
+	Upstream string `json:"upstream"`
+}
+
+// parseBootstrapConfig decodes a bootstrapConfig from r. Unknown fields and
+// missing fields are errors. The values themselves are checked by the caller,
+// as they would be if they came from the command line.
+func parseBootstrapConfig(r io.Reader) (*bootstrapConfig, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var config bootstrapConfig
+	err := dec.Decode(&config)
+	if err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("extra data after JSON object")
+	}
+	if config.Domain == "" {
+		return nil, fmt.Errorf("missing \"domain\"")
+	}
+	if config.Upstream == "" {
+		return nil, fmt.Errorf("missing \"upstream\"")
+	}
+	return &config, nil
+}
+
+// fetchBootstrapConfig reads a bootstrapConfig from an http, https, or file
+// URL, or from a local filename.
+func fetchBootstrapConfig(rawurl string) (*bootstrapConfig, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	switch u.Scheme {
+	case "http", "https":
+		client := http.Client{Timeout: bootstrapTimeout}
+		resp, err := client.Get(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s", rawurl, resp.Status)
+		}
+		body, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxBootstrapLen+1))
+		if err != nil {
+			return nil, err
+		}
+	case "file", "":
+		filename := u.Path
+		if u.Scheme == "" {
+			filename = rawurl
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		body, err = ioutil.ReadAll(io.LimitReader(f, maxBootstrapLen+1))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported URL scheme %+q", u.Scheme)
+	}
+	if len(body) > maxBootstrapLen {
+		return nil, fmt.Errorf("%s: more than %d bytes", rawurl, maxBootstrapLen)
+	}
+	config, err := parseBootstrapConfig(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", rawurl, err)
+	}
+	return config, nil
+}
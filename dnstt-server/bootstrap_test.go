@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseBootstrapConfig(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected *bootstrapConfig
+	}{
+		{`{"domain": "t.example.com", "upstream": "127.0.0.1:8000"}`, &bootstrapConfig{"t.example.com", "127.0.0.1:8000"}},
+		{"{\"upstream\":\"[::1]:22\",\"domain\":\"t.example.com\"}\n", &bootstrapConfig{"t.example.com", "[::1]:22"}},
+		{``, nil},
+		{`{}`, nil},
+		{`{"domain": "t.example.com"}`, nil},
+		{`{"upstream": "127.0.0.1:8000"}`, nil},
+		{`{"domain": "t.example.com", "upstream": "127.0.0.1:8000", "mtu": 1000}`, nil},
+		{`{"domain": "t.example.com", "upstream": "127.0.0.1:8000"} {}`, nil},
+		{`["t.example.com", "127.0.0.1:8000"]`, nil},
+	} {
+		config, err := parseBootstrapConfig(strings.NewReader(test.input))
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%+q: expected error, got %+v", test.input, config)
+			}
+		} else if err != nil || *config != *test.expected {
+			t.Errorf("%+q: expected %+v, got %+v, %v", test.input, test.expected, config, err)
+		}
+	}
+}
+
+func TestFetchBootstrapConfig(t *testing.T) {
+	const doc = `{"domain": "t.example.com", "upstream": "127.0.0.1:8000"}`
+	expected := bootstrapConfig{"t.example.com", "127.0.0.1:8000"}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/config.json":
+			w.Write([]byte(doc))
+		case "/huge.json":
+			w.Write([]byte(strings.Repeat(" ", maxBootstrapLen) + doc))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "dnstt-bootstrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(filename, []byte(doc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, url := range []string{server.URL + "/config.json", "file://" + filename, filename} {
+		config, err := fetchBootstrapConfig(url)
+		if err != nil || *config != expected {
+			t.Errorf("%s: expected %+v, got %+v, %v", url, expected, config, err)
+		}
+	}
+	for _, url := range []string{
+		server.URL + "/missing.json",
+		server.URL + "/huge.json",
+		filepath.Join(dir, "missing.json"),
+		"ftp://example.com/config.json",
+	} {
+		config, err := fetchBootstrapConfig(url)
+		if err == nil {
+			t.Errorf("%s: expected error, got %+v", url, config)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// clientIDExpiry holds the per-ClientID overrides of how long the turbotunnel
+// layer remembers an idle ClientID. It is loaded from the file named by the
+// -clientid-expiry-file option, and reloaded on SIGHUP.
+var clientIDExpiry expiryOverrides
+
+// expiryOverride is one line of a -clientid-expiry-file: ClientIDs that begin
+// with Prefix expire after Timeout.
+type expiryOverride struct {
+	Prefix  []byte
+	Timeout time.Duration
+}
+
+// expiryOverrides is a list of expiryOverride. The zero value is an empty list.
+// Its methods are safe to call from multiple goroutines.
+type expiryOverrides struct {
+	overrides []expiryOverride
+	lock      sync.RWMutex
+}
+
+// Set replaces the contents of the list.
+func (e *expiryOverrides) Set(overrides []expiryOverride) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.overrides = overrides
+}
+
+// Timeout returns the timeout of the override with the longest prefix that
+// clientID begins with, or def if there is none. A full 8-byte prefix is an
+// exact match, so it is preferred to any shorter one.
+func (e *expiryOverrides) Timeout(clientID turbotunnel.ClientID, def time.Duration) time.Duration {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	timeout := def
+	longest := -1
+	for _, o := range e.overrides {
+		if len(o.Prefix) > longest && bytes.HasPrefix(clientID[:], o.Prefix) {
+			timeout = o.Timeout
+			longest = len(o.Prefix)
+		}
+	}
+	return timeout
+}
+
+// clientIDTimeoutFunc returns a function, to pass to
+// turbotunnel.NewQueuePacketConnFunc, that gives each ClientID the timeout in
+// clientIDExpiry, or def.
+func clientIDTimeoutFunc(def time.Duration) func(net.Addr) time.Duration {
+	return func(addr net.Addr) time.Duration {
+		clientID, ok := addr.(turbotunnel.ClientID)
+		if !ok {
+			return def
+		}
+		return clientIDExpiry.Timeout(clientID, def)
+	}
+}
+
+// readExpiryFile reads a list of expiry overrides from a file. Each line has a
+// hex-encoded ClientID or ClientID prefix and a duration, separated by
+// whitespace; a duration of 0 means never to expire. Blank lines and lines
+// beginning with '#' are ignored.
+func readExpiryFile(filename string) ([]expiryOverride, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var overrides []expiryOverride
+	s := bufio.NewScanner(f)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a ClientID prefix and a duration", filename, lineNum)
+		}
+		prefix, err := hex.DecodeString(fields[0])
+		if err != nil || len(prefix) == 0 || len(prefix) > len(turbotunnel.ClientID{}) {
+			return nil, fmt.Errorf("%s:%d: ClientID prefix must be 1 to %d hex-encoded bytes", filename, lineNum, len(turbotunnel.ClientID{}))
+		}
+		timeout, err := time.ParseDuration(fields[1])
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("%s:%d: bad duration %+q", filename, lineNum, fields[1])
+		}
+		overrides = append(overrides, expiryOverride{Prefix: prefix, Timeout: timeout})
+	}
+	return overrides, s.Err()
+}
+
+// loadExpiryFile replaces the contents of clientIDExpiry with the overrides in
+// filename. On error, clientIDExpiry is unchanged. A new timeout takes effect
+// for a ClientID the next time it is seen.
+func loadExpiryFile(filename string) error {
+	overrides, err := readExpiryFile(filename)
+	if err != nil {
+		return err
+	}
+	clientIDExpiry.Set(overrides)
+	log.Printf("loaded %d ClientID expiry overrides from %s", len(overrides), filename)
+	return nil
+}
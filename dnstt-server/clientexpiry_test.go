@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestReadExpiryFile(t *testing.T) {
+	for _, test := range []struct {
+		contents  string
+		overrides []expiryOverride
+		ok        bool
+	}{
+		{"", nil, true},
+		{"# comment\n\n0102030405060708 1h\n  a1 0  \n", []expiryOverride{
+			{[]byte{1, 2, 3, 4, 5, 6, 7, 8}, time.Hour},
+			{[]byte{0xa1}, 0},
+		}, true},
+		{"0102030405060708\n", nil, false},
+		{"010203040506070809 1h\n", nil, false},
+		{"010 1h\n", nil, false},
+		{"01 1h 2h\n", nil, false},
+		{"01 -1s\n", nil, false},
+		{"01 forever\n", nil, false},
+	} {
+		f, err := ioutil.TempFile("", "dnstt-expiry-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(test.contents)
+		f.Close()
+
+		overrides, err := readExpiryFile(f.Name())
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%+q: expected error", test.contents)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+q: %v", test.contents, err)
+			continue
+		}
+		if !reflect.DeepEqual(overrides, test.overrides) {
+			t.Errorf("%+q: got %+v, expected %+v", test.contents, overrides, test.overrides)
+		}
+	}
+}
+
+func TestExpiryOverridesTimeout(t *testing.T) {
+	var e expiryOverrides
+	e.Set([]expiryOverride{
+		{[]byte{1, 2, 3, 4, 5, 6, 7, 8}, time.Second},
+		{[]byte{1}, time.Minute},
+		{[]byte{1, 2}, 0},
+	})
+	for _, test := range []struct {
+		clientID turbotunnel.ClientID
+		timeout  time.Duration
+	}{
+		{turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}, time.Second},
+		{turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 9}, 0},
+		{turbotunnel.ClientID{1, 3}, time.Minute},
+		{turbotunnel.ClientID{2}, time.Hour},
+	} {
+		if timeout := e.Timeout(test.clientID, time.Hour); timeout != test.timeout {
+			t.Errorf("%v: got %v, expected %v", test.clientID, timeout, test.timeout)
+		}
+	}
+}
+
+// An overridden ClientID expires on its own schedule, not the default one.
+func TestClientIDExpiryOverride(t *testing.T) {
+	defer clientIDExpiry.Set(nil)
+
+	waitForStats := func(ttConn *turbotunnel.QueuePacketConn, live int, expired uint64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			l, e := ttConn.RemoteStats()
+			if l == live && e == expired {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("live %d, expired %d; expected %d, %d", l, e, live, expired)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// A short override under a long default.
+	clientIDExpiry.Set([]expiryOverride{{[]byte{2}, 20 * time.Millisecond}})
+	ttConn := turbotunnel.NewQueuePacketConnFunc(turbotunnel.DummyAddr{}, clientIDTimeoutFunc(time.Hour))
+	defer ttConn.Close()
+	ttConn.WriteTo([]byte("a"), turbotunnel.ClientID{1})
+	ttConn.WriteTo([]byte("b"), turbotunnel.ClientID{2})
+	waitForStats(ttConn, 1, 1)
+	// The other ClientID's queue still has its packet.
+	q := ttConn.OutgoingQueue(turbotunnel.ClientID{1})
+	if p := <-q; string(p) != "a" {
+		t.Errorf("ClientID 1 queue has %+q, expected \"a\"", p)
+	}
+
+	// An override that never expires under a short default.
+	clientIDExpiry.Set([]expiryOverride{{[]byte{2}, 0}})
+	ttConn = turbotunnel.NewQueuePacketConnFunc(turbotunnel.DummyAddr{}, clientIDTimeoutFunc(20*time.Millisecond))
+	defer ttConn.Close()
+	ttConn.WriteTo([]byte("a"), turbotunnel.ClientID{1})
+	ttConn.WriteTo([]byte("b"), turbotunnel.ClientID{2})
+	waitForStats(ttConn, 1, 1)
+	time.Sleep(100 * time.Millisecond)
+	waitForStats(ttConn, 1, 1)
+}
@@ -0,0 +1,36 @@
+package main
+
+import "time"
+
+// clock is a source of the current time and of timers. Functions whose timing
+// behavior needs to be tested, like sendLoop, take a clock rather than calling
+// time.Now and time.NewTimer directly, so that tests can control the passage of
+// time.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) timer
+}
+
+// timer is the subset of the methods of *time.Timer that we use, with C
+// changed from a struct field to a method.
+type timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// realClock is a clock that uses the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+// realTimer is a timer that wraps a *time.Timer.
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock is a clock whose time advances only when Advance is called. Every
+// call to NewTimer or to a timer's Reset method sends the requested duration
+// on the Events channel, so tests can synchronize with the code under test.
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	Events chan time.Duration
+	lock   sync.Mutex
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		Events: make(chan time.Duration, 100),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	c.lock.Lock()
+	t := &fakeTimer{
+		clock:    c,
+		c:        make(chan time.Time, 1),
+		deadline: c.now.Add(d),
+		active:   true,
+	}
+	c.timers = append(c.timers, t)
+	c.lock.Unlock()
+	c.Events <- d
+	return t
+}
+
+// Advance moves the clock forward by d and fires any timers whose deadlines
+// have been reached. Advance(0) fires timers that have been Reset(0).
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		if t.active && !t.deadline.After(c.now) {
+			t.active = false
+			select {
+			case t.c <- c.now:
+			default:
+			}
+		}
+	}
+}
+
+// fakeTimer is a timer belonging to a fakeClock.
+type fakeTimer struct {
+	clock    *fakeClock
+	c        chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.lock.Lock()
+	wasActive := t.active
+	t.deadline = t.clock.now.Add(d)
+	t.active = true
+	t.clock.lock.Unlock()
+	t.clock.Events <- d
+	return wasActive
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// sessionCooldowns is the record of when each ClientID last started a session,
+// for -session-cooldown.
+var sessionCooldowns = newCooldownTracker()
+
+// cooldownEntry is the per-ClientID state of a cooldownTracker.
+type cooldownEntry struct {
+	started time.Time
+	// How many queries have been dropped since the session started.
+	dropped uint64
+}
+
+// cooldownTracker enforces sessionCooldown, a minimum interval between the
+// starts of a ClientID's sessions. acceptSessions calls Started for every new
+// session; recvLoop calls Allow for queries from ClientIDs that have no open
+// session, and drops them if it returns false, so that KCP never sees the
+// packets that would start a new session.
+//
+// cooldownTracker's methods are safe to call from multiple goroutines.
+type cooldownTracker struct {
+	entries   map[turbotunnel.ClientID]*cooldownEntry
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+func newCooldownTracker() *cooldownTracker {
+	return &cooldownTracker{
+		entries: make(map[turbotunnel.ClientID]*cooldownEntry),
+	}
+}
+
+// Started records that clientID started a session at time now. It does
+// nothing if sessionCooldown is not positive.
+func (c *cooldownTracker) Started(clientID turbotunnel.ClientID, now time.Time) {
+	if sessionCooldown <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if now.Sub(c.lastSweep) >= rateLimiterSweepInterval {
+		c.sweep(now)
+		c.lastSweep = now
+	}
+	if entry, ok := c.entries[clientID]; ok && entry.dropped != 0 {
+		log.Printf("ClientID %v cooldown over; dropped %d queries", clientID, entry.dropped)
+	}
+	c.entries[clientID] = &cooldownEntry{started: now}
+}
+
+// Allow returns true if a query from clientID, which has no open session,
+// received at time now may start a new session, and false if it should be
+// dropped because clientID's last session started less than sessionCooldown
+// before now.
+//
+// Allow logs a message when it first drops a query from a ClientID after the
+// start of its last session.
+func (c *cooldownTracker) Allow(clientID turbotunnel.ClientID, now time.Time) bool {
+	if sessionCooldown <= 0 {
+		return true
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[clientID]
+	if !ok || now.Sub(entry.started) >= sessionCooldown {
+		return true
+	}
+	if entry.dropped == 0 {
+		log.Printf("ClientID %v reconnecting %v after its last session started (-session-cooldown %v); dropping queries", clientID, now.Sub(entry.started), sessionCooldown)
+	}
+	entry.dropped++
+	queriesSessionCooldown.Inc()
+	return false
+}
+
+// sweep removes entries whose cooldown has passed, logging the number of
+// queries dropped for any that had some. Requires c.lock to be held.
+func (c *cooldownTracker) sweep(now time.Time) {
+	for clientID, entry := range c.entries {
+		if now.Sub(entry.started) >= sessionCooldown {
+			if entry.dropped != 0 {
+				log.Printf("ClientID %v cooldown over; dropped %d queries", clientID, entry.dropped)
+			}
+			delete(c.entries, clientID)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestCooldownTracker(t *testing.T) {
+	defer func(saved time.Duration) { sessionCooldown = saved }(sessionCooldown)
+	var logBuf syncBuffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// With no cooldown, nothing is recorded or dropped.
+	sessionCooldown = 0
+	c := newCooldownTracker()
+	c.Started(clientID, now)
+	if !c.Allow(clientID, now) {
+		t.Errorf("dropped with no cooldown")
+	}
+
+	sessionCooldown = 10 * time.Second
+	c = newCooldownTracker()
+	// A ClientID that has never started a session is allowed.
+	if !c.Allow(clientID, now) {
+		t.Errorf("dropped before any session")
+	}
+	c.Started(clientID, now)
+	for _, elapsed := range []time.Duration{0, 1 * time.Second, 9 * time.Second} {
+		if c.Allow(clientID, now.Add(elapsed)) {
+			t.Errorf("%v: allowed within cooldown", elapsed)
+		}
+	}
+	// Other ClientIDs are not affected.
+	if !c.Allow(turbotunnel.ClientID{8, 7, 6, 5, 4, 3, 2, 1}, now) {
+		t.Errorf("dropped a different ClientID")
+	}
+	if !c.Allow(clientID, now.Add(10*time.Second)) {
+		t.Errorf("dropped after cooldown")
+	}
+	if n := strings.Count(logBuf.String(), "dropping queries"); n != 1 {
+		t.Errorf("logged %d drops, expected 1", n)
+	}
+
+	// The sweep removes expired entries and logs how many queries they
+	// dropped.
+	c.Started(turbotunnel.ClientID{8, 7, 6, 5, 4, 3, 2, 1}, now.Add(rateLimiterSweepInterval))
+	if _, ok := c.entries[clientID]; ok {
+		t.Errorf("expired entry not swept")
+	}
+	if !strings.Contains(logBuf.String(), "cooldown over; dropped 3 queries") {
+		t.Errorf("unexpected log %q", logBuf.String())
+	}
+}
+
+func TestRecvLoopSessionCooldown(t *testing.T) {
+	defer func(saved time.Duration) { sessionCooldown = saved }(sessionCooldown)
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	domain := mustParseName("t.example.com")
+	established := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	reconnecting := turbotunnel.ClientID{8, 7, 6, 5, 4, 3, 2, 1}
+	pconn := newFakePacketConn()
+	defer pconn.Close()
+	conn := newTestKCPConn(t, 0x01020304, established, pconn)
+	defer conn.Close()
+	sessions.Add(conn)
+	defer sessions.Remove(conn)
+
+	sessionCooldown = time.Hour
+	sessionCooldowns.Started(established, time.Now())
+	sessionCooldowns.Started(reconnecting, time.Now())
+
+	dnsConn, ch, ttConn, stop := startRecvLoop(domain, 1000)
+	defer stop()
+
+	// The reconnecting ClientID has no open session, so its query is
+	// dropped without a response. The first record and packet are those
+	// of the established ClientID's query that follows, which is served
+	// although its session started within the cooldown.
+	before := queriesSessionCooldown.Value()
+	payload := append(append([]byte(nil), reconnecting[:]...), 3, 'n', 'e', 'w')
+	buf, err := tunnelQuery(payload, domain).WireFormat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsConn.Inject(buf, turbotunnel.DummyAddr{})
+	rec := injectQuery(t, dnsConn, ch, domain, established, []byte("old"))
+	if rec.ClientID != established {
+		t.Errorf("response for %v, expected %v", rec.ClientID, established)
+	}
+	var p [1000]byte
+	n, addr, err := ttConn.ReadFrom(p[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != established || !bytes.Equal(p[:n], []byte("old")) {
+		t.Errorf("got packet %+q from %v, expected %+q from %v", p[:n], addr, "old", established)
+	}
+	if n := queriesSessionCooldown.Value() - before; n != 1 {
+		t.Errorf("counted %d dropped queries, expected 1", n)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+)
+
+const (
+	// How long -verify-delegation waits for the resolver to return the
+	// answer to its test query.
+	delegationCheckTimeout = 15 * time.Second
+
+	// How often -verify-delegation resends its test query while waiting.
+	delegationCheckRetry = 2 * time.Second
+)
+
+// delegationProbe is the test name that verifyDelegation resolves, and the TXT
+// answer that responseFor gives for it. seen is set (with sync/atomic) when
+// responseFor receives a query for the name, so that a failed check can tell
+// whether the query reached the server at all.
+type delegationProbe struct {
+	name  dns.Name
+	token []byte
+	seen  uint32
+}
+
+// currentDelegationProbe holds the *delegationProbe of a -verify-delegation
+// check in progress, or a nil *delegationProbe.
+var currentDelegationProbe atomic.Value
+
+// delegationProbeAnswer returns the answer to question, if it is the test
+// query of a -verify-delegation check in progress. The name is compared without
+// regard to case, because a resolver may randomize the case of the names it
+// queries.
+func delegationProbeAnswer(question dns.Question) (dns.RR, bool) {
+	probe, _ := currentDelegationProbe.Load().(*delegationProbe)
+	if probe == nil || !strings.EqualFold(question.Name.String(), probe.name.String()) {
+		return dns.RR{}, false
+	}
+	atomic.StoreUint32(&probe.seen, 1)
+	if question.Type != dns.RRTypeTXT {
+		return dns.RR{}, false
+	}
+	return dns.RR{
+		Name:  question.Name,
+		Type:  dns.RRTypeTXT,
+		Class: question.Class,
+		TTL:   0,
+		Data:  dns.EncodeRDataTXT(probe.token),
+	}, true
+}
+
+// verifyDelegation checks that domain is delegated to this server, by asking
+// the recursive resolver at resolverAddr for a TXT record of a random name
+// under domain, and checking that the answer is the one that responseFor gives
+// for that name. It must be called while the server is answering queries. It
+// returns a diagnostic error if the answer does not arrive within timeout.
+func verifyDelegation(resolverAddr string, domain dns.Name, timeout time.Duration) error {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	// The '-' keeps the label from decoding as base32, so the name cannot
+	// be mistaken for a tunnel query.
+	token := []byte(fmt.Sprintf("dnstt-verify-%x", nonce))
+	name, err := dns.NewName(append([][]byte{token}, domain...))
+	if err != nil {
+		return err
+	}
+	probe := &delegationProbe{name: name, token: token}
+	currentDelegationProbe.Store(probe)
+	defer currentDelegationProbe.Store((*delegationProbe)(nil))
+
+	query := &dns.Message{
+		ID:    binary.BigEndian.Uint16(nonce[:2]),
+		Flags: 0x0100, // QR = 0, RD = 1
+		Question: []dns.Question{
+			{Name: name, Type: dns.RRTypeTXT, Class: dns.ClassIN},
+		},
+		Additional: []dns.RR{
+			{
+				Name:  dns.Name{},
+				Type:  dns.RRTypeOPT,
+				Class: 1232, // requester's UDP payload size
+				TTL:   0,    // extended RCODE and flags
+				Data:  []byte{},
+			},
+		},
+	}
+	buf, err := query.WireFormat()
+	if err != nil {
+		return err
+	}
+	expected := dns.EncodeRDataTXT(token)
+
+	conn, err := net.Dial("udp", resolverAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// lastErr describes the most recent unsatisfactory response.
+	var lastErr error
+	deadline := time.Now().Add(timeout)
+	var p [4096]byte
+loop:
+	for time.Now().Before(deadline) {
+		if _, err := conn.Write(buf); err != nil {
+			return err
+		}
+		retry := time.Now().Add(delegationCheckRetry)
+		if retry.After(deadline) {
+			retry = deadline
+		}
+		conn.SetReadDeadline(retry)
+		for {
+			n, err := conn.Read(p[:])
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				continue loop
+			} else if err != nil {
+				// An ICMP port unreachable, for example.
+				lastErr = err
+				time.Sleep(time.Until(retry))
+				continue loop
+			}
+			resp, err := dns.MessageFromWireFormat(p[:n])
+			if err != nil || resp.ID != query.ID || resp.Flags&0x8000 == 0 {
+				continue
+			}
+			if resp.Rcode() != dns.RcodeNoError {
+				lastErr = fmt.Errorf("resolver answered with RCODE %d", resp.Rcode())
+				continue
+			}
+			for _, rr := range resp.Answer {
+				if rr.Type == dns.RRTypeTXT && bytes.Equal(rr.Data, expected) {
+					return nil
+				}
+			}
+			lastErr = fmt.Errorf("resolver's answer does not have the expected TXT record")
+		}
+	}
+
+	var diagnosis string
+	if atomic.LoadUint32(&probe.seen) != 0 {
+		diagnosis = "the query reached this server, but the answer did not get back through the resolver"
+	} else {
+		diagnosis = fmt.Sprintf("the query never reached this server; check that %s has an NS record naming a host whose A or AAAA record is this server's public address, and that UDP port 53 is reachable from the Internet", domain)
+	}
+	if lastErr != nil {
+		diagnosis += fmt.Sprintf(" (last error: %v)", lastErr)
+	}
+	return fmt.Errorf("resolving %s through %s: no correct answer after %v: %s", name, resolverAddr, timeout, diagnosis)
+}
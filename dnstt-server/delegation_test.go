@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+)
+
+// startFakeResolver runs a UDP server that answers each query with the result
+// of handle, and returns its address.
+func startFakeResolver(t *testing.T, handle func(query *dns.Message) *dns.Message) (string, func()) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var buf [4096]byte
+		for {
+			n, addr, err := conn.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			query, err := dns.MessageFromWireFormat(buf[:n])
+			if err != nil {
+				continue
+			}
+			resp := handle(&query)
+			if resp == nil {
+				continue
+			}
+			p, err := resp.WireFormat()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(p, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func TestVerifyDelegation(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	domain := mustParseName("t.example.com")
+
+	// A resolver that passes queries to this server, randomizing the case
+	// of the name.
+	addr, stop := startFakeResolver(t, func(query *dns.Message) *dns.Message {
+		query.Question[0].Name = dns.Name(bytes.Split(bytes.ToUpper([]byte(query.Question[0].Name.String())), []byte(".")))
+		resp, _ := responseFor(query, domain)
+		return resp
+	})
+	err := verifyDelegation(addr, domain, 2*time.Second)
+	stop()
+	if err != nil {
+		t.Errorf("delegated: %v", err)
+	}
+	// The test name is answered only during the check.
+	query := nsQuery(mustParseName("dnstt-verify-0000000000000000.t.example.com"))
+	query.Question[0].Type = dns.RRTypeTXT
+	if resp, _ := responseFor(query, domain); resp == nil || len(resp.Answer) != 0 {
+		t.Errorf("after the check: got %+v", resp)
+	}
+
+	// A resolver that knows nothing of this server.
+	addr, stop = startFakeResolver(t, func(query *dns.Message) *dns.Message {
+		return &dns.Message{
+			ID:       query.ID,
+			Flags:    0x8180 | dns.RcodeNameError,
+			Question: query.Question,
+		}
+	})
+	err = verifyDelegation(addr, domain, 300*time.Millisecond)
+	stop()
+	if err == nil || !strings.Contains(err.Error(), "never reached this server") || !strings.Contains(err.Error(), "RCODE 3") {
+		t.Errorf("not delegated: got %v", err)
+	}
+
+	// A resolver that passes queries to this server, but loses the
+	// answers.
+	addr, stop = startFakeResolver(t, func(query *dns.Message) *dns.Message {
+		responseFor(query, domain)
+		return &dns.Message{
+			ID:       query.ID,
+			Flags:    0x8180 | dns.RcodeServerFailure,
+			Question: query.Question,
+		}
+	})
+	err = verifyDelegation(addr, domain, 300*time.Millisecond)
+	stop()
+	if err == nil || !strings.Contains(err.Error(), "reached this server, but") {
+		t.Errorf("answers lost: got %v", err)
+	}
+}
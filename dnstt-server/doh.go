@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+const (
+	// The URL path at which -doh accepts queries, the one RFC 8484 uses in
+	// its examples and that DoH clients default to.
+	dohPath = "/dns-query"
+
+	// The media type of DNS messages in DoH requests and responses.
+	dohContentType = "application/dns-message"
+
+	// How long a DoH request waits for its response. recvLoop sends no
+	// response at all to queries it drops (for example because of
+	// -max-client-query-rate), so this must be a good deal longer than
+	// maxResponseDelay, after which sendLoop sends any response it has.
+	dohResponseTimeout = 10 * time.Second
+
+	// How long the DoH HTTP server waits for a client to send the headers
+	// of a request, and how long it keeps open a connection that is idle
+	// between requests. Without these, a client could hold a connection,
+	// and its goroutine, open indefinitely by sending slowly or not at
+	// all. A whole request must also arrive within dohResponseTimeout.
+	dohReadHeaderTimeout = 5 * time.Second
+	dohIdleTimeout       = 2 * time.Minute
+)
+
+// dohAddr is the address of one DoH request. Every request has a different
+// dohAddr, even if it comes over the same HTTP connection as another. ip is
+// the IP address part of remote, or "" if it has none.
+type dohAddr struct {
+	id     uint64
+	remote string
+	ip     string
+}
+
+func (addr dohAddr) Network() string { return "doh" }
+func (addr dohAddr) String() string  { return fmt.Sprintf("%s#%d", addr.remote, addr.id) }
+
+// dohPacketConn is a net.PacketConn that carries DNS messages in DNS over
+// HTTPS requests and responses (RFC 8484). It is also an http.Handler, which
+// may be mounted on any http.ServeMux: ReadFrom returns the DNS query of each
+// request it handles, tagged with a dohAddr for the request, and WriteTo with
+// that dohAddr sends the response. A request whose response does not come
+// within dohResponseTimeout gets an HTTP error instead.
+type dohPacketConn struct {
+	*turbotunnel.QueuePacketConn
+	ln     net.Listener
+	nextID uint64
+}
+
+// newDoHHandler returns a dohPacketConn with no listener of its own, which
+// only receives the requests given to its ServeHTTP method. localAddr is what
+// its LocalAddr method returns.
+func newDoHHandler(localAddr net.Addr) *dohPacketConn {
+	return &dohPacketConn{
+		// Each request has its own outgoing queue, which is needed
+		// only until the request has been answered or given up on.
+		QueuePacketConn: turbotunnel.NewQueuePacketConn(localAddr, 2*dohResponseTimeout),
+	}
+}
+
+// newDoHPacketConn starts an HTTP server on ln that handles DoH requests at
+// dohPath, over TLS with config if config is not nil, or else over plain
+// HTTP, for use behind a reverse proxy that terminates TLS. Closing the
+// dohPacketConn closes ln.
+func newDoHPacketConn(ln net.Listener, config *tls.Config) *dohPacketConn {
+	c := newDoHHandler(ln.Addr())
+	c.ln = ln
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, c)
+	server := &http.Server{
+		Handler:           mux,
+		TLSConfig:         config,
+		ReadHeaderTimeout: dohReadHeaderTimeout,
+		ReadTimeout:       dohResponseTimeout,
+		IdleTimeout:       dohIdleTimeout,
+	}
+	go func() {
+		var err error
+		if config != nil {
+			// The certificate is in config.
+			err = server.ServeTLS(ln, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
+		if err != nil {
+			log.Printf("DoH server: %v", err)
+		}
+		c.Close()
+	}()
+	return c
+}
+
+// parseSNIAllowlist parses a comma-separated list of host names, as given to
+// the -doh-sni option, into a set of names in lower case without a trailing
+// dot. It is an error for the list to be empty.
+func parseSNIAllowlist(s string) (map[string]bool, error) {
+	names := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+		if name == "" {
+			continue
+		}
+		names[name] = true
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no names given")
+	}
+	return names, nil
+}
+
+// withSNIAllowlist returns a copy of config that fails the TLS handshake of
+// any client whose server name indication is not in names (as returned by
+// parseSNIAllowlist), including a client that sends none. Such a client never
+// gets as far as an HTTP request, so it cannot tell that there is a DoH
+// endpoint behind names.
+func withSNIAllowlist(config *tls.Config, names map[string]bool) *tls.Config {
+	config = config.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if names[strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))] {
+			// Use config as it is.
+			return nil, nil
+		}
+		dohSNIRejected.Inc()
+		return nil, fmt.Errorf("server name %+q is not in -doh-sni", hello.ServerName)
+	}
+	return config
+}
+
+// dohQuery returns the DNS query carried by a DoH request: the body of a POST
+// request, or the base64url-encoded dns parameter of a GET request. It returns
+// an HTTP status code other than http.StatusOK if the request is not a valid
+// DoH request.
+func dohQuery(w http.ResponseWriter, r *http.Request) ([]byte, int) {
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, http.StatusBadRequest
+		}
+		// RFC 8484 section 4.1 says the padding is omitted, but
+		// tolerate it anyway.
+		p, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+		if err != nil {
+			return nil, http.StatusBadRequest
+		}
+		return p, http.StatusOK
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			return nil, http.StatusUnsupportedMediaType
+		}
+		p, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 0xffff))
+		if err != nil {
+			return nil, http.StatusRequestEntityTooLarge
+		}
+		return p, http.StatusOK
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		return nil, http.StatusMethodNotAllowed
+	}
+}
+
+// dohCacheControl returns the Cache-Control header for the DoH response resp.
+// As RFC 8484 section 5.1 says, the freshness lifetime is no longer than the
+// smallest TTL of the records in the response, or for a negative response
+// with an SOA record, the smaller of its TTL and MINIMUM (RFC 2308 section
+// 5). SERVFAIL and REFUSED responses, which the server sends to make the
+// client try again (as with -warmup and -saturation-servfail), are not to be
+// cached at all, nor is anything that cannot be parsed.
+func dohCacheControl(resp []byte) string {
+	msg, err := dns.MessageFromWireFormat(resp)
+	if err != nil {
+		return "no-store"
+	}
+	switch msg.Rcode() {
+	case dns.RcodeServerFailure, dns.RcodeRefused:
+		return "no-store"
+	}
+	var maxAge uint32
+	first := true
+	for _, section := range [][]dns.RR{msg.Answer, msg.Authority, msg.Additional} {
+		for _, rr := range section {
+			if rr.Type == dns.RRTypeOPT {
+				// The TTL field of OPT is not a TTL.
+				continue
+			}
+			ttl := rr.TTL
+			if rr.Type == dns.RRTypeSOA && len(rr.Data) >= 4 {
+				if minimum := binary.BigEndian.Uint32(rr.Data[len(rr.Data)-4:]); minimum < ttl {
+					ttl = minimum
+				}
+			}
+			if first || ttl < maxAge {
+				maxAge = ttl
+				first = false
+			}
+		}
+	}
+	// A response with no records has no TTL to go by.
+	return fmt.Sprintf("max-age=%d", maxAge)
+}
+
+// ServeHTTP handles one DoH request, passing its query to ReadFrom and
+// waiting for the response to be given to WriteTo.
+func (c *dohPacketConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query, status := dohQuery(w, r)
+	if status != http.StatusOK {
+		dohRequests.With(strconv.Itoa(status)).Inc()
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	addr := dohAddr{
+		id:     atomic.AddUint64(&c.nextID, 1),
+		remote: r.RemoteAddr,
+		ip:     remoteIP(r.RemoteAddr),
+	}
+	c.QueueIncoming(query, addr)
+
+	timer := time.NewTimer(dohResponseTimeout)
+	defer timer.Stop()
+	var resp []byte
+	select {
+	case resp = <-c.OutgoingQueue(addr):
+	case <-timer.C:
+		// The query was dropped, or the server is overloaded.
+		status = http.StatusServiceUnavailable
+		dohRequests.With(strconv.Itoa(status)).Inc()
+		http.Error(w, http.StatusText(status), status)
+		return
+	case <-r.Context().Done():
+		// The client went away.
+		return
+	}
+
+	dohRequests.With(strconv.Itoa(status)).Inc()
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp)))
+	w.Header().Set("Cache-Control", dohCacheControl(resp))
+	if _, err := w.Write(resp); err != nil {
+		log.Printf("%v: writing DoH response: %v", addr, err)
+	}
+}
+
+// Close closes the dohPacketConn and its listener, if it has one.
+func (c *dohPacketConn) Close() error {
+	if c.ln != nil {
+		c.ln.Close()
+	}
+	return c.QueuePacketConn.Close()
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestDoHQuery(t *testing.T) {
+	query := []byte("\x00\x00\x01\x00query")
+	encoded := base64.RawURLEncoding.EncodeToString(query)
+	for _, test := range []struct {
+		method, target, contentType, body string
+		expected                          []byte
+		expectedStatus                    int
+	}{
+		{"GET", dohPath + "?dns=" + encoded, "", "", query, http.StatusOK},
+		// Padding is tolerated.
+		{"GET", dohPath + "?dns=" + base64.URLEncoding.EncodeToString(query), "", "", query, http.StatusOK},
+		{"GET", dohPath, "", "", nil, http.StatusBadRequest},
+		{"GET", dohPath + "?dns=" + base64.StdEncoding.EncodeToString([]byte("\xff\xff")), "", "", nil, http.StatusBadRequest},
+		{"POST", dohPath, dohContentType, string(query), query, http.StatusOK},
+		{"POST", dohPath, "application/octet-stream", string(query), nil, http.StatusUnsupportedMediaType},
+		{"POST", dohPath, dohContentType, strings.Repeat("x", 0x10000), nil, http.StatusRequestEntityTooLarge},
+		{"PUT", dohPath, dohContentType, string(query), nil, http.StatusMethodNotAllowed},
+	} {
+		r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		w := httptest.NewRecorder()
+		p, status := dohQuery(w, r)
+		if status != test.expectedStatus || !bytes.Equal(p, test.expected) {
+			t.Errorf("%s %s %s: got (%+q, %d), expected (%+q, %d)",
+				test.method, test.target, test.contentType, p, status, test.expected, test.expectedStatus)
+		}
+	}
+}
+
+// echoDoH answers every query read from conn with the query prefixed by
+// "response:", until conn is closed.
+func echoDoH(conn net.PacketConn) {
+	var buf [100]byte
+	for {
+		n, addr, err := conn.ReadFrom(buf[:])
+		if err != nil {
+			return
+		}
+		conn.WriteTo(append([]byte("response:"), buf[:n]...), addr)
+	}
+}
+
+// checkDoHResponse checks that resp is a successful DoH response containing
+// expected.
+func checkDoHResponse(t *testing.T, resp *http.Response, expected []byte) {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d %+q", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohContentType {
+		t.Errorf("Content-Type %+q, expected %+q", ct, dohContentType)
+	}
+	// These are not DNS messages.
+	if cc := resp.Header.Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Cache-Control %+q, expected %+q", cc, "no-store")
+	}
+	if !bytes.Equal(body, expected) {
+		t.Errorf("got %+q, expected %+q", body, expected)
+	}
+}
+
+func TestDoHPacketConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newDoHPacketConn(ln, nil)
+	defer conn.Close()
+	go echoDoH(conn)
+
+	url := "http://" + ln.Addr().String() + dohPath
+	resp, err := http.Get(url + "?dns=" + base64.RawURLEncoding.EncodeToString([]byte("get")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDoHResponse(t, resp, []byte("response:get"))
+
+	resp, err = http.Post(url, dohContentType, strings.NewReader("post"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDoHResponse(t, resp, []byte("response:post"))
+
+	// Only dohPath is served.
+	resp, err = http.Get("http://" + ln.Addr().String() + "/other?dns=AAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("other path: status %d, expected %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	if limit := connResponseSizeLimit(conn); limit != tcpResponseSizeLimit {
+		t.Errorf("response size limit %d, expected %d", limit, tcpResponseSizeLimit)
+	}
+}
+
+func TestDoHPacketConnTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnstt-doh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFilename, keyFilename := writeTestCertificate(t, dir)
+	config, err := newTLSConfig(certFilename, keyFilename, dohNextProtos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newDoHPacketConn(ln, config)
+	defer conn.Close()
+	go echoDoH(conn)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		Timeout: 5 * time.Second,
+	}
+	resp, err := client.Post("https://"+ln.Addr().String()+dohPath, dohContentType, strings.NewReader("post"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDoHResponse(t, resp, []byte("response:post"))
+}
+
+// The handler may be mounted on a mux of someone else's.
+func TestDoHHandler(t *testing.T) {
+	conn := newDoHHandler(turbotunnel.DummyAddr{})
+	defer conn.Close()
+	go echoDoH(conn)
+	mux := http.NewServeMux()
+	mux.Handle("/custom", conn)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/custom", dohContentType, strings.NewReader("post"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDoHResponse(t, resp, []byte("response:post"))
+}
+
+func TestDoHClientGone(t *testing.T) {
+	conn := newDoHHandler(turbotunnel.DummyAddr{})
+	defer conn.Close()
+
+	// Nothing answers the query; the handler returns when the client
+	// gives up, without waiting for dohResponseTimeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("POST", dohPath, strings.NewReader("query")).WithContext(ctx)
+	r.Header.Set("Content-Type", dohContentType)
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		conn.ServeHTTP(w, r)
+		close(done)
+	}()
+	var buf [100]byte
+	if _, _, err := conn.ReadFrom(buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not return after the client went away")
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("unexpected body %+q", w.Body.Bytes())
+	}
+}
+
+// A tunnel query over DoH goes through recvLoop and sendLoop like any other.
+func TestDoHTunnelQuery(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newDoHPacketConn(ln, nil)
+	defer conn.Close()
+	domain := mustParseName("t.example.com")
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	ch := make(chan *record, 100)
+	go recvLoop(domain, conn, ttConn, ch, 1000, nil)
+	go sendLoop(conn, ttConn, ch, computeMaxEncodedPayload(connResponseSizeLimit(conn)), realClock{})
+
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	query := tunnelQuery(append(append([]byte(nil), clientID[:]...), 0xe0), domain)
+	query.ID = 0
+	buf, err := query.WireFormat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttConn.WriteTo([]byte("downstream"), clientID)
+	resp, err := http.Post("http://"+ln.Addr().String()+dohPath, dohContentType, bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d %+q", resp.StatusCode, body)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "max-age=60" {
+		t.Errorf("Cache-Control %+q, expected %+q", cc, "max-age=60")
+	}
+	msg, err := dns.MessageFromWireFormat(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Rcode() != dns.RcodeNoError || len(msg.Answer) != 1 {
+		t.Fatalf("RCODE %d with %d answers", msg.Rcode(), len(msg.Answer))
+	}
+	if !bytes.Contains(msg.Answer[0].Data, []byte("downstream")) {
+		t.Errorf("answer %+q lacks the downstream packet", msg.Answer[0].Data)
+	}
+}
+
+func TestDoHCacheControl(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	txt := dns.RR{Name: domain, Type: dns.RRTypeTXT, Class: dns.ClassIN, TTL: 60, Data: dns.EncodeRDataTXT([]byte("x"))}
+	shortTXT := txt
+	shortTXT.TTL = 10
+	opt := dns.RR{Name: dns.Name{}, Type: dns.RRTypeOPT, Class: 4096, TTL: 0x8000}
+	// An SOA whose MINIMUM is less than its TTL.
+	soa := soaRR(domain)
+	soa.TTL = 60
+	soa.Data = append([]byte(nil), soa.Data...)
+	binary.BigEndian.PutUint32(soa.Data[len(soa.Data)-4:], 7)
+
+	for _, test := range []struct {
+		rcode                         uint16
+		answer, authority, additional []dns.RR
+		expected                      string
+	}{
+		{dns.RcodeNoError, []dns.RR{txt}, nil, []dns.RR{opt}, "max-age=60"},
+		// The smallest TTL wins.
+		{dns.RcodeNoError, []dns.RR{txt, shortTXT}, nil, nil, "max-age=10"},
+		// Negative responses are cached for the SOA MINIMUM.
+		{dns.RcodeNameError, nil, []dns.RR{soa}, []dns.RR{opt}, "max-age=7"},
+		{dns.RcodeNoError, nil, []dns.RR{soa}, nil, "max-age=7"},
+		// Without an SOA, there is nothing to go by.
+		{dns.RcodeNameError, nil, nil, []dns.RR{opt}, "max-age=0"},
+		// SERVFAIL and REFUSED are never cached.
+		{dns.RcodeServerFailure, nil, nil, []dns.RR{opt}, "no-store"},
+		{dns.RcodeRefused, []dns.RR{txt}, nil, nil, "no-store"},
+	} {
+		msg := &dns.Message{
+			Flags:      0x8400 | test.rcode,
+			Question:   []dns.Question{{Name: domain, Type: dns.RRTypeTXT, Class: dns.ClassIN}},
+			Answer:     test.answer,
+			Authority:  test.authority,
+			Additional: test.additional,
+		}
+		buf, err := msg.WireFormat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cc := dohCacheControl(buf); cc != test.expected {
+			t.Errorf("RCODE %d %d/%d/%d: got %+q, expected %+q", test.rcode,
+				len(test.answer), len(test.authority), len(test.additional), cc, test.expected)
+		}
+	}
+	if cc := dohCacheControl([]byte("not a DNS message")); cc != "no-store" {
+		t.Errorf("unparseable: got %+q, expected %+q", cc, "no-store")
+	}
+}
+
+func TestParseSNIAllowlist(t *testing.T) {
+	names, err := parseSNIAllowlist(" DNS.example.com.,doh.example.net,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || !names["dns.example.com"] || !names["doh.example.net"] {
+		t.Errorf("got %v", names)
+	}
+	for _, s := range []string{"", ",", " . "} {
+		if _, err := parseSNIAllowlist(s); err == nil {
+			t.Errorf("%+q: no error", s)
+		}
+	}
+}
+
+func TestDoHSNIAllowlist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnstt-doh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFilename, keyFilename := writeTestCertificate(t, dir)
+	config, err := newTLSConfig(certFilename, keyFilename, dohNextProtos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := parseSNIAllowlist("dns.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newDoHPacketConn(ln, withSNIAllowlist(config, names))
+	defer conn.Close()
+	go echoDoH(conn)
+
+	post := func(serverName string) (*http.Response, error) {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+			},
+			Timeout: 5 * time.Second,
+		}
+		return client.Post("https://"+ln.Addr().String()+dohPath, dohContentType, strings.NewReader("post"))
+	}
+
+	// Names are compared without regard to case.
+	resp, err := post("DNS.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDoHResponse(t, resp, []byte("response:post"))
+
+	// Another name, or none at all (as when connecting to an IP address),
+	// fails the handshake.
+	before := dohSNIRejected.Value()
+	for _, serverName := range []string{"www.example.com", ""} {
+		resp, err := post(serverName)
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("%+q: status %d, expected a handshake failure", serverName, resp.StatusCode)
+		}
+	}
+	if n := dohSNIRejected.Value() - before; n != 2 {
+		t.Errorf("counted %d rejected handshakes, expected 2", n)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// The port -dot listens on when its address has none: the DNS over
+	// TLS port of RFC 7858 section 3.1.
+	dotDefaultPort = "853"
+
+	// How long a DNS over TLS client has to complete the TLS handshake.
+	dotHandshakeTimeout = 10 * time.Second
+)
+
+// dotListenAddr returns addr, with dotDefaultPort added if it has no port.
+func dotListenAddr(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	return net.JoinHostPort(host, dotDefaultPort)
+}
+
+// The ALPN protocol IDs that -dot and -doh offer.
+var (
+	dotNextProtos = []string{"dot"}
+	dohNextProtos = []string{"h2", "http/1.1"}
+)
+
+// newTLSConfig returns the TLS configuration for -dot or -doh, with the
+// certificate and private key read from certFilename and keyFilename, and
+// offering the ALPN protocol IDs nextProtos.
+func newTLSConfig(certFilename, keyFilename string, nextProtos []string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFilename, keyFilename)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   nextProtos,
+	}, nil
+}
+
+// newDoTPacketConn accepts DNS over TLS connections (RFC 7858) on ln, and
+// returns a tcpPacketConn through which to exchange the DNS messages they
+// carry, which are framed as in DNS over TCP. Closing the tcpPacketConn closes
+// ln.
+func newDoTPacketConn(ln net.Listener, config *tls.Config) *tcpPacketConn {
+	return newTCPPacketConn(tls.NewListener(ln, config))
+}
+
+// dotHandshake completes the TLS handshake of a DNS over TLS connection, which
+// would otherwise happen implicitly on the first read. Doing it explicitly
+// gives it a deadline, and lets handshake failures be counted apart from
+// other errors. With debugTLS, it logs the outcome.
+func dotHandshake(conn *tls.Conn, addr net.Addr) error {
+	conn.SetDeadline(time.Now().Add(dotHandshakeTimeout))
+	err := conn.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		dotHandshakesFailed.Inc()
+		if debugTLS {
+			log.Printf("%v: TLS handshake: %v", addr, err)
+		}
+		return err
+	}
+	if debugTLS {
+		state := conn.ConnectionState()
+		log.Printf("%v: TLS version %s cipher suite %s", addr, tlsVersionString(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	}
+	return nil
+}
+
+// tlsVersionString returns the name of a TLS version, or its number in hex if
+// it is unknown. tls.VersionName is not available in the Go versions this
+// program supports.
+func tlsVersionString(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDoTListenAddr(t *testing.T) {
+	for _, test := range []struct {
+		addr, expected string
+	}{
+		{"127.0.0.1:8853", "127.0.0.1:8853"},
+		{"127.0.0.1", "127.0.0.1:853"},
+		{":853", ":853"},
+		{"", ":853"},
+		{"::1", "[::1]:853"},
+		{"[::1]", "[::1]:853"},
+		{"[::1]:8853", "[::1]:8853"},
+		{"localhost", "localhost:853"},
+	} {
+		if addr := dotListenAddr(test.addr); addr != test.expected {
+			t.Errorf("%+q: got %+q, expected %+q", test.addr, addr, test.expected)
+		}
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate and its private key
+// to PEM files in dir, and returns their filenames.
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFilename := filepath.Join(dir, "cert.pem")
+	keyFilename := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFilename, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFilename, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFilename, keyFilename
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnstt-dot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFilename, keyFilename := writeTestCertificate(t, dir)
+
+	config, err := newTLSConfig(certFilename, keyFilename, dotNextProtos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Certificates) != 1 {
+		t.Errorf("%d certificates, expected 1", len(config.Certificates))
+	}
+	// The certificate and key must match, and exist.
+	if _, err := newTLSConfig(keyFilename, certFilename, dotNextProtos); err == nil {
+		t.Errorf("swapped certificate and key: no error")
+	}
+	if _, err := newTLSConfig(filepath.Join(dir, "missing.pem"), keyFilename, dotNextProtos); err == nil {
+		t.Errorf("missing certificate: no error")
+	}
+}
+
+func TestDoTPacketConn(t *testing.T) {
+	defer func(saved bool) { debugTLS = saved }(debugTLS)
+	debugTLS = true
+	var logBuf syncBuffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	dir, err := ioutil.TempDir("", "dnstt-dot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFilename, keyFilename := writeTestCertificate(t, dir)
+	config, err := newTLSConfig(certFilename, keyFilename, dotNextProtos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newDoTPacketConn(ln, config)
+	defer conn.Close()
+
+	// A client that does not speak TLS fails the handshake, without
+	// stopping the listener.
+	before := dotHandshakesFailed.Value()
+	plain, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := plain.Write([]byte("\x00\x05query")); err != nil {
+		t.Fatal(err)
+	}
+	// The server closes the connection.
+	var buf [100]byte
+	for {
+		if _, err := plain.Read(buf[:]); err != nil {
+			break
+		}
+	}
+	plain.Close()
+	if n := dotHandshakesFailed.Value() - before; n != 1 {
+		t.Errorf("counted %d failed handshakes, expected 1", n)
+	}
+
+	c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("\x00\x05query")); err != nil {
+		t.Fatal(err)
+	}
+	n, addr, err := conn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], []byte("query")) {
+		t.Fatalf("got %+q, expected %+q", buf[:n], "query")
+	}
+	if _, err := conn.WriteTo([]byte("response"), addr); err != nil {
+		t.Fatal(err)
+	}
+	if p := readTCPMessage(t, c); !bytes.Equal(p, []byte("response")) {
+		t.Fatalf("got %+q, expected %+q", p, "response")
+	}
+	if state := c.ConnectionState(); state.NegotiatedProtocol != "" && state.NegotiatedProtocol != "dot" {
+		t.Errorf("negotiated protocol %+q", state.NegotiatedProtocol)
+	}
+
+	// DNS over TLS responses may be as large as over TCP.
+	if limit := connResponseSizeLimit(conn); limit != tcpResponseSizeLimit {
+		t.Errorf("response size limit %d, expected %d", limit, tcpResponseSizeLimit)
+	}
+
+	for _, s := range []string{"TLS handshake: ", "cipher suite TLS_"} {
+		if !strings.Contains(logBuf.String(), s) {
+			t.Errorf("log lacks %q: %q", s, logBuf.String())
+		}
+	}
+}
+
+func TestTLSVersionString(t *testing.T) {
+	for _, test := range []struct {
+		version  uint16
+		expected string
+	}{
+		{tls.VersionTLS12, "1.2"},
+		{tls.VersionTLS13, "1.3"},
+		{0x0300, "0x0300"},
+	} {
+		if s := tlsVersionString(test.version); s != test.expected {
+			t.Errorf("%#04x: got %+q, expected %+q", test.version, s, test.expected)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+)
+
+// The most that bufferedCopy reads from its source at once.
+const downloadBufferChunk = 16 * 1024
+
+// bufferedCopy is like io.Copy, except that it reads from src in a separate
+// goroutine, which may get up to about size bytes ahead of the writes to dst.
+// handleStream uses it, with -download-buffer, for the stream←upstream
+// direction, so that a momentary stall in writing to the smux stream does not
+// at once stop reading from the upstream. size must be positive.
+//
+// bufferedCopy returns the number of bytes written to dst and the first error
+// from either side, except that io.EOF from src is not an error. It does not
+// return until the reading goroutine has exited. After a write error, it calls
+// interrupt, if not nil, to make a Read in progress return.
+func bufferedCopy(dst io.Writer, src io.Reader, size int, interrupt func() error) (int64, error) {
+	chunk := downloadBufferChunk
+	if size < chunk {
+		chunk = size
+	}
+	// Each element of ch is at most chunk bytes, so its capacity bounds the
+	// bytes that have been read and not yet written.
+	ch := make(chan []byte, (size+chunk-1)/chunk)
+	// The error that ended reading; valid once ch is closed.
+	var readErr error
+	// Closed after a write error, to stop the reader.
+	done := make(chan struct{})
+	go func() {
+		defer close(ch)
+		for {
+			p := make([]byte, chunk)
+			n, err := src.Read(p)
+			if n > 0 {
+				select {
+				case ch <- p[:n]:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+		}
+	}()
+
+	var written int64
+	for p := range ch {
+		n, err := dst.Write(p)
+		written += int64(n)
+		if err != nil {
+			close(done)
+			if interrupt != nil {
+				interrupt()
+			}
+			// The reader closes ch when it exits.
+			for range ch {
+			}
+			return written, err
+		}
+	}
+	return written, readErr
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestBufferedCopy(t *testing.T) {
+	data := make([]byte, 100*1024)
+	rand.New(rand.NewSource(0)).Read(data)
+	for _, size := range []int{1, 1000, downloadBufferChunk, 256 * 1024} {
+		for _, test := range []struct {
+			src      io.Reader
+			expected []byte
+		}{
+			{bytes.NewReader(data), data},
+			{iotest.OneByteReader(bytes.NewReader(data[:5000])), data[:5000]},
+			{iotest.DataErrReader(bytes.NewReader(data)), data},
+		} {
+			var dst bytes.Buffer
+			n, err := bufferedCopy(&dst, test.src, size, nil)
+			if err != nil || n != int64(len(test.expected)) || !bytes.Equal(dst.Bytes(), test.expected) {
+				t.Errorf("size %d: copied %d of %d bytes, error %v", size, n, len(test.expected), err)
+			}
+		}
+	}
+
+	// A read error is returned after what was read before it is written.
+	readErr := errors.New("read error")
+	var dst bytes.Buffer
+	n, err := bufferedCopy(&dst, io.MultiReader(bytes.NewReader(data[:10]), &errReader{readErr}), 1000, nil)
+	if n != 10 || err != readErr {
+		t.Errorf("read error: copied %d bytes, error %v", n, err)
+	}
+
+	// A write error interrupts a Read in progress, and is returned only
+	// after the reader has exited.
+	writeErr := errors.New("write error")
+	src, srcWriter := io.Pipe()
+	defer srcWriter.Close()
+	go srcWriter.Write(data[:10])
+	tracked := &trackingReader{r: src}
+	n, err = bufferedCopy(failingWriter{writeErr}, tracked, 1000, src.Close)
+	if n != 0 || err != writeErr {
+		t.Errorf("write error: copied %d bytes, error %v", n, err)
+	}
+	if reading := atomic.LoadInt32(&tracked.reading); reading != 0 {
+		t.Errorf("write error: reader still in Read")
+	}
+}
+
+// trackingReader counts the Reads in progress on r.
+type trackingReader struct {
+	r       io.Reader
+	reading int32
+}
+
+func (r *trackingReader) Read(p []byte) (int, error) {
+	atomic.AddInt32(&r.reading, 1)
+	defer atomic.AddInt32(&r.reading, -1)
+	return r.r.Read(p)
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read(p []byte) (int, error) { return 0, r.err }
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write(p []byte) (int, error) { return 0, w.err }
+
+// lossyLinkWriter is a writer that, like an smux stream over KCP on a lossy
+// link, usually accepts data at once but sometimes stalls.
+type lossyLinkWriter struct {
+	rng *rand.Rand
+}
+
+func (w lossyLinkWriter) Write(p []byte) (int, error) {
+	if w.rng.Intn(10) == 0 {
+		// Waiting for a retransmission.
+		time.Sleep(2 * time.Millisecond)
+	}
+	return len(p), nil
+}
+
+// slowReader is an upstream that produces downloadBufferChunk bytes every
+// 200 µs.
+type slowReader struct {
+	remaining int
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(200 * time.Microsecond)
+	n := len(p)
+	if n > downloadBufferChunk {
+		n = downloadBufferChunk
+	}
+	if n > r.remaining {
+		n = r.remaining
+	}
+	r.remaining -= n
+	return n, nil
+}
+
+func benchmarkDownloadBuffer(b *testing.B, size int) {
+	const total = 1024 * 1024
+	b.SetBytes(total)
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < b.N; i++ {
+		var err error
+		src := &slowReader{remaining: total}
+		if size > 0 {
+			_, err = bufferedCopy(lossyLinkWriter{rng}, src, size, nil)
+		} else {
+			_, err = io.Copy(lossyLinkWriter{rng}, src)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDownloadBuffer0(b *testing.B)    { benchmarkDownloadBuffer(b, 0) }
+func BenchmarkDownloadBuffer64K(b *testing.B)  { benchmarkDownloadBuffer(b, 64*1024) }
+func BenchmarkDownloadBuffer256K(b *testing.B) { benchmarkDownloadBuffer(b, 256*1024) }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+// transientErrnos are the system errors that we expect to go away by
+// themselves, and which should not cause a loop to exit.
+var transientErrnos = []syscall.Errno{
+	// An ICMP error from an earlier send, reported on a later read or
+	// write of an unconnected UDP socket. This happens whenever a
+	// requester goes away, and is harmless.
+	syscall.ECONNREFUSED,
+	syscall.ECONNRESET,
+	syscall.EHOSTUNREACH,
+	syscall.ENETUNREACH,
+	// Out of buffer space, or a firewall rule rejected a send.
+	syscall.ENOBUFS,
+	syscall.EPERM,
+	// Out of file descriptors.
+	syscall.EMFILE,
+	syscall.ENFILE,
+	// The rest of the conditions considered by syscall.Errno.Temporary.
+	syscall.EINTR,
+	syscall.EAGAIN,
+	syscall.ECONNABORTED,
+	syscall.ETIMEDOUT,
+}
+
+// isTransient returns true if err is a condition that is expected to go away
+// by itself: a timeout, or one of transientErrnos. We use this rather than the
+// deprecated net.Error.Temporary method.
+func isTransient(err error) bool {
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return true
+	}
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorLogInterval is the minimum interval between log messages about
+// transient errors from any one loop.
+const errorLogInterval = 10 * time.Second
+
+// loopErrors implements the error policy of a loop like recvLoop or
+// acceptSessions. Transient errors are logged, at most once per
+// errorLogInterval, and ignored, unless there have been more than
+// maxConsecutive of them in a row, in which case they become fatal. Other
+// errors are always fatal. loopErrors is not safe for concurrent use; each loop
+// should have its own.
+type loopErrors struct {
+	// Name of the operation, for log messages.
+	name string
+	// 0 means transient errors are never fatal.
+	maxConsecutive int
+
+	consecutive int
+	suppressed  int
+	lastLog     time.Time
+}
+
+// newLoopErrors returns a loopErrors for the operation name that uses the
+// limit set by -max-consecutive-errors.
+func newLoopErrors(name string) *loopErrors {
+	return &loopErrors{name: name, maxConsecutive: maxConsecutiveErrors}
+}
+
+// Check returns nil if the loop should continue after err, or a non-nil error
+// if the loop should exit.
+func (e *loopErrors) Check(err error, now time.Time) error {
+	if !isTransient(err) {
+		return err
+	}
+	e.consecutive++
+	if e.maxConsecutive > 0 && e.consecutive > e.maxConsecutive {
+		return fmt.Errorf("%d consecutive errors: %v", e.consecutive, err)
+	}
+	if now.Sub(e.lastLog) < errorLogInterval {
+		e.suppressed++
+		return nil
+	}
+	if e.suppressed > 0 {
+		log.Printf("%s error: %v (and %d more)", e.name, err, e.suppressed)
+	} else {
+		log.Printf("%s error: %v", e.name, err)
+	}
+	e.suppressed = 0
+	e.lastLog = now
+	return nil
+}
+
+// Success resets the count of consecutive errors.
+func (e *loopErrors) Success() {
+	e.consecutive = 0
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// econnrefused returns an error like the one returned by WriteTo on a UDP
+// socket after an ICMP port unreachable.
+func econnrefused() error {
+	return &net.OpError{
+		Op:  "write",
+		Net: "udp",
+		Err: os.NewSyscallError("sendto", syscall.ECONNREFUSED),
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		transient bool
+	}{
+		{econnrefused(), true},
+		{&net.OpError{Op: "read", Net: "udp", Err: timeoutError{}}, true},
+		{io.EOF, false},
+		{io.ErrClosedPipe, false},
+		{errors.New("other"), false},
+	} {
+		if isTransient(test.err) != test.transient {
+			t.Errorf("isTransient(%v) != %v", test.err, test.transient)
+		}
+	}
+}
+
+// timeoutError is a net.Error whose Timeout method returns true.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestLoopErrors(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Non-transient errors are always fatal.
+	e := &loopErrors{name: "test"}
+	if err := e.Check(io.EOF, now); err != io.EOF {
+		t.Errorf("non-transient error returned %v", err)
+	}
+
+	// With no limit, transient errors are never fatal.
+	e = &loopErrors{name: "test"}
+	for i := 0; i < 1000; i++ {
+		if err := e.Check(econnrefused(), now); err != nil {
+			t.Fatalf("transient error %d returned %v", i, err)
+		}
+	}
+
+	// With a limit, too many consecutive transient errors are fatal, but
+	// a success resets the count.
+	e = &loopErrors{name: "test", maxConsecutive: 3}
+	for i := 0; i < 3; i++ {
+		if err := e.Check(econnrefused(), now); err != nil {
+			t.Fatalf("transient error %d returned %v", i, err)
+		}
+	}
+	e.Success()
+	for i := 0; i < 3; i++ {
+		if err := e.Check(econnrefused(), now); err != nil {
+			t.Fatalf("transient error %d after success returned %v", i, err)
+		}
+	}
+	if err := e.Check(econnrefused(), now); err == nil {
+		t.Fatalf("too many transient errors returned nil")
+	}
+}
+
+// refusingPacketConn is a fakePacketConn whose WriteTo fails with
+// ECONNREFUSED for the first refusals calls.
+type refusingPacketConn struct {
+	*fakePacketConn
+	refusals int
+}
+
+func (c *refusingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.refusals > 0 {
+		c.refusals--
+		return 0, econnrefused()
+	}
+	return c.fakePacketConn.WriteTo(p, addr)
+}
+
+func TestSendLoopECONNREFUSED(t *testing.T) {
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	dnsConn := &refusingPacketConn{newFakePacketConn(), 100}
+	ch := make(chan *record)
+	done := make(chan error)
+	go func() {
+		done <- sendLoop(dnsConn, ttConn, ch, computeMaxEncodedPayload(maxUDPPayload), realClock{})
+	}()
+
+	// Queue a packet with each record so that sendLoop does not have to
+	// wait.
+	for i := 0; i < 101; i++ {
+		ttConn.WriteTo([]byte("x"), clientID)
+		ch <- tunnelRecord(clientID)
+	}
+	// The first 100 responses were refused, but sendLoop kept going.
+	expectWritten(t, dnsConn.fakePacketConn)
+	close(ch)
+	if err := <-done; err != nil {
+		t.Fatalf("sendLoop returned %v", err)
+	}
+}
+
+// ECONNREFUSED on send does not count toward -max-consecutive-errors.
+func TestSendLoopECONNREFUSEDMaxConsecutive(t *testing.T) {
+	defer func(saved int) { maxConsecutiveErrors = saved }(maxConsecutiveErrors)
+	maxConsecutiveErrors = 3
+
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	dnsConn := &refusingPacketConn{newFakePacketConn(), 10}
+	ch := make(chan *record)
+	done := make(chan error)
+	before := responsesSendRefused.Value()
+	go func() {
+		done <- sendLoop(dnsConn, ttConn, ch, computeMaxEncodedPayload(maxUDPPayload), realClock{})
+	}()
+
+	for i := 0; i < 11; i++ {
+		ttConn.WriteTo([]byte("x"), clientID)
+		select {
+		case ch <- tunnelRecord(clientID):
+		case err := <-done:
+			t.Fatalf("sendLoop returned %v after %d records", err, i)
+		}
+	}
+	expectWritten(t, dnsConn.fakePacketConn)
+	close(ch)
+	if err := <-done; err != nil {
+		t.Fatalf("sendLoop returned %v", err)
+	}
+	if n := responsesSendRefused.Value() - before; n != 10 {
+		t.Errorf("counted %d refused sends, expected 10", n)
+	}
+}
+
+// With -debug-send-refused, an ignored ECONNREFUSED is logged.
+func TestSendResponseECONNREFUSEDDebug(t *testing.T) {
+	defer func(saved bool) { debugSendRefused = saved }(debugSendRefused)
+	defer log.SetOutput(os.Stderr)
+
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	for _, debugSendRefused = range []bool{false, true} {
+		var logBuf syncBuffer
+		log.SetOutput(&logBuf)
+		dnsConn := &refusingPacketConn{newFakePacketConn(), 1}
+		if err := sendResponse(dnsConn, tunnelRecord(clientID), newLoopErrors("WriteTo"), realClock{}); err != nil {
+			t.Fatalf("%v: sendResponse returned %v", debugSendRefused, err)
+		}
+		if logged := strings.Contains(logBuf.String(), "refused"); logged != debugSendRefused {
+			t.Errorf("%v: logged %v: %q", debugSendRefused, logged, logBuf.String())
+		}
+		dnsConn.Close()
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// The period over which -log-handshakes limits the number of sessions whose
+// handshakes are logged.
+const handshakeLogPeriod = time.Minute
+
+// handshakeSampler chooses which new sessions have their handshake progress
+// logged, for -log-handshakes: the first limit sessions in every
+// handshakeLogPeriod. It is not safe for concurrent use; acceptSessions has
+// its own.
+type handshakeSampler struct {
+	limit       int
+	periodStart time.Time
+	count       int
+}
+
+// Sample returns true if a session accepted at now should have its handshake
+// logged.
+func (s *handshakeSampler) Sample(now time.Time) bool {
+	if s.limit <= 0 {
+		return false
+	}
+	if now.Sub(s.periodStart) >= handshakeLogPeriod {
+		s.periodStart = now
+		s.count = 0
+	}
+	if s.count >= s.limit {
+		return false
+	}
+	s.count++
+	return true
+}
+
+// handshakeTrace logs the progress of one session through the layers of the
+// tunnel protocol, for -log-handshakes: the KCP session is accepted, the Noise
+// handshake completes (or fails), and the client opens its first smux stream.
+// A client that "connects but nothing happens" stalls between two of these.
+// A nil *handshakeTrace logs nothing.
+type handshakeTrace struct {
+	conv     uint32
+	clientID string
+	start    time.Time
+}
+
+// newHandshakeTrace logs that the session conv from clientID has been accepted
+// by KCP, and returns a trace for its later phases.
+func newHandshakeTrace(conv uint32, clientID string) *handshakeTrace {
+	t := &handshakeTrace{conv: conv, clientID: clientID, start: time.Now()}
+	log.Printf("handshake %08x clientid %s: KCP session accepted", t.conv, t.clientID)
+	return t
+}
+
+// Noise logs the result of the Noise handshake.
+func (t *handshakeTrace) Noise(err error) {
+	if t == nil {
+		return
+	}
+	if err != nil {
+		log.Printf("handshake %08x clientid %s: Noise handshake failed after %v: %v", t.conv, t.clientID, time.Since(t.start), err)
+		return
+	}
+	log.Printf("handshake %08x clientid %s: Noise handshake done after %v", t.conv, t.clientID, time.Since(t.start))
+}
+
+// FirstStream logs the opening of the session's first smux stream.
+func (t *handshakeTrace) FirstStream(id uint32) {
+	if t == nil {
+		return
+	}
+	log.Printf("handshake %08x clientid %s: first smux stream %d after %v", t.conv, t.clientID, id, time.Since(t.start))
+}
+
+// NoStream logs the end, with err, of a session in which the Noise handshake
+// completed but no stream was ever opened.
+func (t *handshakeTrace) NoStream(err error) {
+	if t == nil {
+		return
+	}
+	log.Printf("handshake %08x clientid %s: session ended after %v without a stream: %v", t.conv, t.clientID, time.Since(t.start), err)
+}
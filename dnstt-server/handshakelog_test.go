@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/noise"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestHandshakeSampler(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// A limit of 0 samples nothing.
+	s := handshakeSampler{}
+	if s.Sample(now) {
+		t.Errorf("limit 0 sampled a session")
+	}
+
+	s = handshakeSampler{limit: 2}
+	for i, expected := range []bool{true, true, false, false} {
+		if sampled := s.Sample(now.Add(time.Duration(i) * time.Second)); sampled != expected {
+			t.Errorf("session %d: got %v, expected %v", i, sampled, expected)
+		}
+	}
+	// The count starts over in the next period.
+	if !s.Sample(now.Add(handshakeLogPeriod)) {
+		t.Errorf("not sampled in the next period")
+	}
+}
+
+// tunnelClientConn is the client side of a tunnel, as a net.PacketConn that
+// carries KCP packets in tunnel queries injected into dnsConn, and gets
+// downstream packets from the responses written to dnsConn. It polls with
+// empty queries so that the server always has a response in which to send
+// data. It keeps every response, for inspection.
+type tunnelClientConn struct {
+	domain    dns.Name
+	clientID  turbotunnel.ClientID
+	dnsConn   *fakePacketConn
+	incoming  chan []byte
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	lock      sync.Mutex
+	responses []dns.Message
+}
+
+func newTunnelClientConn(domain dns.Name, clientID turbotunnel.ClientID, dnsConn *fakePacketConn) *tunnelClientConn {
+	c := &tunnelClientConn{
+		domain:   domain,
+		clientID: clientID,
+		dnsConn:  dnsConn,
+		incoming: make(chan []byte, 100),
+		closed:   make(chan struct{}),
+	}
+	go c.pollLoop()
+	go c.readLoop()
+	return c
+}
+
+// send injects a tunnel query whose payload is the ClientID followed by
+// packets, which must be already length-prefixed.
+func (c *tunnelClientConn) send(packets []byte) {
+	query := tunnelQuery(append(c.clientID[:], packets...), c.domain)
+	buf, err := query.WireFormat()
+	if err != nil {
+		panic(err)
+	}
+	select {
+	case <-c.closed:
+	case <-c.dnsConn.closed:
+	default:
+		c.dnsConn.Inject(buf, turbotunnel.DummyAddr{})
+	}
+}
+
+func (c *tunnelClientConn) pollLoop() {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			c.send(nil)
+		}
+	}
+}
+
+func (c *tunnelClientConn) readLoop() {
+	for {
+		var m taggedMessage
+		select {
+		case <-c.closed:
+			return
+		case m = <-c.dnsConn.Written:
+		}
+		resp, err := dns.MessageFromWireFormat(m.P)
+		if err != nil {
+			panic(err)
+		}
+		c.lock.Lock()
+		c.responses = append(c.responses, resp)
+		c.lock.Unlock()
+		if len(resp.Answer) != 1 {
+			continue
+		}
+		payload, err := dns.DecodeRDataTXT(resp.Answer[0].Data)
+		if err != nil {
+			continue
+		}
+		for len(payload) >= 2 {
+			n := int(binary.BigEndian.Uint16(payload[:2]))
+			if len(payload) < 2+n {
+				break
+			}
+			select {
+			case c.incoming <- payload[2 : 2+n]:
+			case <-c.closed:
+				return
+			}
+			payload = payload[2+n:]
+		}
+	}
+}
+
+// Responses returns the responses received so far.
+func (c *tunnelClientConn) Responses() []dns.Message {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]dns.Message(nil), c.responses...)
+}
+
+func (c *tunnelClientConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, io.EOF
+	case packet := <-c.incoming:
+		return copy(p, packet), turbotunnel.DummyAddr{}, nil
+	}
+}
+
+func (c *tunnelClientConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.send(append([]byte{byte(len(p))}, p...))
+	return len(p), nil
+}
+
+func (c *tunnelClientConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *tunnelClientConn) LocalAddr() net.Addr                { return turbotunnel.DummyAddr{} }
+func (c *tunnelClientConn) SetDeadline(t time.Time) error      { return nil }
+func (c *tunnelClientConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *tunnelClientConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// startTestTunnel runs the server over a fakePacketConn, with upstream as its
+// upstream, and connects to it through the KCP, Noise, and smux layers as a
+// client would. It returns the client's smux session and the tunnelClientConn
+// under it, and a function that shuts everything down.
+func startTestTunnel(t *testing.T, upstream string) (*smux.Session, *tunnelClientConn, func()) {
+	t.Helper()
+	keys := &noise.LocalKeyProvider{}
+	if err := keys.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	domain := mustParseName("t.example.com")
+	dnsConn := newFakePacketConn()
+	done := make(chan error)
+	go func() {
+		done <- run(keys, domain, newUpstreamDialer(upstream, 0), []net.PacketConn{dnsConn})
+	}()
+	clientConn := newTunnelClientConn(domain, turbotunnel.NewClientID(), dnsConn)
+	var sess *smux.Session
+	var conn *kcp.UDPSession
+	stop := func() {
+		if sess != nil {
+			sess.Close()
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		clientConn.Close()
+		dnsConn.Close()
+		<-done
+	}
+
+	conn, err := kcp.NewConn2(turbotunnel.DummyAddr{}, nil, 0, 0, clientConn)
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	conn.SetStreamMode(true)
+	conn.SetNoDelay(0, 0, 0, 1)
+	// Small enough that every query name is shorter than 255 octets.
+	conn.SetMtu(120)
+	rw, err := noise.NewClient(conn, keys.Pubkey())
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = 2
+	sess, err = smux.Client(rw, smuxConfig)
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	return sess, clientConn, stop
+}
+
+// A client going through the KCP, Noise, and smux handshakes gets responses
+// that are well-formed and have the same structure as any other, and the
+// phases are logged with -log-handshakes.
+func TestHandshakeResponses(t *testing.T) {
+	defer func(saved int) { logHandshakes = saved }(logHandshakes)
+	logHandshakes = 10
+	var logBuf syncBuffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sess, clientConn, stop := startTestTunnel(t, ln.Addr().String())
+	defer stop()
+	stream, err := sess.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	upstreamConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstreamConn.Close()
+	upstreamConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf [5]byte
+	if _, err := io.ReadFull(upstreamConn, buf[:]); err != nil || string(buf[:]) != "hello" {
+		t.Fatalf("upstream read %+q, error %v", buf[:], err)
+	}
+
+	responses := clientConn.Responses()
+	if len(responses) == 0 {
+		t.Fatalf("no responses")
+	}
+	withData := 0
+	for i, resp := range responses {
+		if resp.Flags != 0x8500 || // QR = 1, AA = 1, RD = 1, NOERROR
+			len(resp.Question) != 1 ||
+			len(resp.Answer) != 1 || len(resp.Authority) != 0 || len(resp.Additional) != 1 {
+			t.Fatalf("response %d: bad structure %+v", i, resp)
+		}
+		rr := resp.Answer[0]
+		if rr.Type != dns.RRTypeTXT || rr.Class != dns.ClassIN || rr.TTL != responseTTL ||
+			!strings.EqualFold(rr.Name.String(), resp.Question[0].Name.String()) {
+			t.Fatalf("response %d: bad answer %+v", i, rr)
+		}
+		if opt := resp.Additional[0]; opt.Type != dns.RRTypeOPT || opt.Class != 4096 || opt.TTL != 0 || len(opt.Data) != 0 {
+			t.Fatalf("response %d: bad OPT %+v", i, opt)
+		}
+		if payload, err := dns.DecodeRDataTXT(rr.Data); err != nil {
+			t.Fatalf("response %d: bad TXT data: %v", i, err)
+		} else if len(payload) > 0 {
+			withData++
+		}
+	}
+	if withData == 0 {
+		t.Errorf("no response carried data")
+	}
+
+	s := logBuf.String()
+	for _, phase := range []string{
+		"KCP session accepted",
+		"Noise handshake done after",
+		"first smux stream",
+	} {
+		if !strings.Contains(s, phase) {
+			t.Errorf("log lacks %q", phase)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// The number of packets that a delayedIngester can hold. Packets that arrive
+// when it is full are dropped, as QueueIncoming drops packets when the KCP
+// receive queue is full.
+const ingestQueueSize = 4096
+
+// delayedPacket is a packet waiting in a delayedIngester.
+type delayedPacket struct {
+	p    []byte
+	addr net.Addr
+	due  time.Time
+}
+
+// delayedIngester passes packets to a QueuePacketConn's QueueIncoming a fixed
+// delay after they are given to it, for -ingest-delay. Because the delay is the
+// same for every packet, and one goroutine delivers them in the order they were
+// queued, packets are never reordered.
+type delayedIngester struct {
+	ttConn *turbotunnel.QueuePacketConn
+	delay  time.Duration
+	queue  chan delayedPacket
+	done   chan struct{}
+}
+
+// newDelayedIngester returns a delayedIngester for ttConn and starts its
+// delivery goroutine. Call Close to stop it.
+func newDelayedIngester(ttConn *turbotunnel.QueuePacketConn, delay time.Duration) *delayedIngester {
+	d := &delayedIngester{
+		ttConn: ttConn,
+		delay:  delay,
+		queue:  make(chan delayedPacket, ingestQueueSize),
+		done:   make(chan struct{}),
+	}
+	go d.deliverLoop()
+	return d
+}
+
+// QueueIncoming arranges for p, from addr, to be passed to the
+// QueuePacketConn's QueueIncoming after the delay. Like
+// QueuePacketConn.QueueIncoming, it copies p, so that the caller may reuse it.
+func (d *delayedIngester) QueueIncoming(p []byte, addr net.Addr) {
+	packet := delayedPacket{
+		p:    append([]byte(nil), p...),
+		addr: addr,
+		due:  time.Now().Add(d.delay),
+	}
+	select {
+	case d.queue <- packet:
+	default:
+		// Drop the packet if the queue is full.
+	}
+}
+
+// Close stops the delivery goroutine. Packets still waiting are discarded.
+// QueueIncoming must not be called after Close.
+func (d *delayedIngester) Close() {
+	close(d.done)
+}
+
+func (d *delayedIngester) deliverLoop() {
+	timer := time.NewTimer(0)
+	<-timer.C
+	defer timer.Stop()
+	for {
+		var packet delayedPacket
+		select {
+		case packet = <-d.queue:
+		case <-d.done:
+			return
+		}
+		if wait := time.Until(packet.due); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-d.done:
+				return
+			}
+		}
+		d.ttConn.QueueIncoming(packet.p, packet.addr)
+	}
+}
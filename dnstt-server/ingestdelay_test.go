@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestDelayedIngester(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	defer ttConn.Close()
+	d := newDelayedIngester(ttConn, delay)
+	defer d.Close()
+
+	// Packets from two clients, interleaved and queued over a period
+	// longer than the delay, come out in the order they went in, each no
+	// sooner than the delay after it went in.
+	clientIDs := []turbotunnel.ClientID{{1}, {2}}
+	const numPackets = 20
+	sent := make([]time.Time, numPackets)
+	go func() {
+		buf := make([]byte, 10)
+		for i := 0; i < numPackets; i++ {
+			n := copy(buf, fmt.Sprintf("%d", i))
+			sent[i] = time.Now()
+			d.QueueIncoming(buf[:n], clientIDs[i%2])
+			// The caller may reuse its buffer.
+			copy(buf, "xxxxxxxxxx")
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	var buf [10]byte
+	for i := 0; i < numPackets; i++ {
+		ttConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, addr, err := ttConn.ReadFrom(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		received := time.Now()
+		if string(buf[:n]) != fmt.Sprintf("%d", i) || addr != clientIDs[i%2] {
+			t.Fatalf("packet %d: got %+q from %v", i, buf[:n], addr)
+		}
+		if elapsed := received.Sub(sent[i]); elapsed < delay {
+			t.Errorf("packet %d: delivered after %v, expected at least %v", i, elapsed, delay)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// The layout of a KCP segment header, which dnstt's KCP packets begin with,
+// having neither encryption nor FEC headers: conv (4 bytes, little-endian),
+// cmd (1), frg (1), wnd (2), ts (4), sn (4), una (4), and len (4), followed by
+// len bytes of data.
+const (
+	kcpOverhead   = 24
+	kcpLenOffset  = 20
+	kcpCmdOffset  = 4
+	kcpCmdPush    = 81
+	kcpCmdWinTell = 84
+)
+
+// plausibleKCPPacket returns true if p could be a KCP packet, for
+// -check-packets. A KCP packet is a sequence of segments, each a header and
+// data, all with the same conversation ID. It checks only what KCP itself
+// requires of every packet, so that it rejects nothing that KCP would accept:
+// that p is at least one header long, that every segment has a known command
+// and a length that fits in p, and that all segments have the same
+// conversation ID. As in KCP, fewer than kcpOverhead bytes left over after the
+// last segment are ignored.
+func plausibleKCPPacket(p []byte) bool {
+	if len(p) < kcpOverhead {
+		return false
+	}
+	conv := binary.LittleEndian.Uint32(p)
+	for len(p) >= kcpOverhead {
+		if binary.LittleEndian.Uint32(p) != conv {
+			return false
+		}
+		if cmd := p[kcpCmdOffset]; cmd < kcpCmdPush || cmd > kcpCmdWinTell {
+			return false
+		}
+		length := binary.LittleEndian.Uint32(p[kcpLenOffset:])
+		p = p[kcpOverhead:]
+		if uint64(length) > uint64(len(p)) {
+			return false
+		}
+		p = p[length:]
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// kcpSegment returns a KCP segment with the given conversation ID, command,
+// and data.
+func kcpSegment(conv uint32, cmd byte, data []byte) []byte {
+	seg := make([]byte, kcpOverhead, kcpOverhead+len(data))
+	binary.LittleEndian.PutUint32(seg[0:], conv)
+	seg[kcpCmdOffset] = cmd
+	binary.LittleEndian.PutUint16(seg[6:], 32)
+	binary.LittleEndian.PutUint32(seg[kcpLenOffset:], uint32(len(data)))
+	return append(seg, data...)
+}
+
+func TestPlausibleKCPPacket(t *testing.T) {
+	push := kcpSegment(0x01020304, kcpCmdPush, []byte("hello"))
+	ack := kcpSegment(0x01020304, 82, nil)
+	overrun := kcpSegment(0x01020304, kcpCmdPush, []byte("hello"))
+	binary.LittleEndian.PutUint32(overrun[kcpLenOffset:], 6)
+
+	for _, test := range []struct {
+		p        []byte
+		expected bool
+	}{
+		{push, true},
+		{ack, true},
+		{kcpSegment(0x01020304, kcpCmdWinTell, nil), true},
+		// Several segments with the same conversation ID.
+		{append(append([]byte(nil), ack...), push...), true},
+		// Fewer than a header's worth of trailing bytes are ignored.
+		{append(append([]byte(nil), push...), 1, 2, 3), true},
+		{nil, false},
+		{push[:kcpOverhead-1], false},
+		{kcpSegment(0x01020304, kcpCmdPush-1, nil), false},
+		{kcpSegment(0x01020304, kcpCmdWinTell+1, nil), false},
+		{overrun, false},
+		// Segments with different conversation IDs.
+		{append(append([]byte(nil), push...), kcpSegment(0x04030201, 82, nil)...), false},
+		{append(append([]byte(nil), push...), bytes.Repeat([]byte{0xff}, kcpOverhead)...), false},
+		{[]byte("this is not a KCP packet at all"), false},
+	} {
+		if plausible := plausibleKCPPacket(test.p); plausible != test.expected {
+			t.Errorf("%x: got %v, expected %v", test.p, plausible, test.expected)
+		}
+	}
+}
+
+func TestRecvLoopCheckPackets(t *testing.T) {
+	defer func(saved bool) { checkPackets = saved }(checkPackets)
+	checkPackets = true
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	domain := mustParseName("t.example.com")
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	dnsConn, ch, ttConn, stop := startRecvLoop(domain, 1000)
+	defer stop()
+
+	// The query is answered, and the KCP packet that follows the garbage
+	// in it is passed on, but not the garbage.
+	before := packetsImplausible.Value()
+	good := kcpSegment(0x01020304, kcpCmdPush, []byte("hello"))
+	rec := injectQuery(t, dnsConn, ch, domain, clientID, []byte("garbage"), good)
+	if rec.ClientID != clientID {
+		t.Errorf("response for %v, expected %v", rec.ClientID, clientID)
+	}
+	var p [1000]byte
+	n, addr, err := ttConn.ReadFrom(p[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != clientID || !bytes.Equal(p[:n], good) {
+		t.Errorf("got packet %x from %v, expected %x from %v", p[:n], addr, good, clientID)
+	}
+	if n := packetsImplausible.Value() - before; n != 1 {
+		t.Errorf("counted %d dropped packets, expected 1", n)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// listenUDP opens a UDP socket on addr for the address family named by
+// family. "4" means IPv4 only. "6" means IPv6 only, with IPV6_V6ONLY set.
+// "dual" means IPv6 and IPv4 (as IPv4-mapped IPv6 addresses) on one socket,
+// with IPV6_V6ONLY cleared; the host in addr must be empty or a wildcard
+// address. "" means whatever the net package does by default, which for a
+// wildcard address is dual-stack where the operating system supports
+// IPv4-mapped addresses, and IPv4 only where it does not (OpenBSD).
+//
+// The point of "6" and "dual" is to make the choice explicit: where the
+// default would silently fall back to IPv4 only, "dual" fails instead.
+func listenUDP(family, addr string) (net.PacketConn, error) {
+	var network string
+	var v6only bool
+	switch family {
+	case "":
+		return net.ListenPacket("udp", addr)
+	case "4":
+		return net.ListenPacket("udp4", addr)
+	case "6":
+		network, v6only = "udp6", true
+	case "dual":
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+			return nil, fmt.Errorf("dual-stack listener needs a wildcard address, not %q", host)
+		}
+		network, v6only, addr = "udp6", false, net.JoinHostPort("::", port)
+	default:
+		return nil, fmt.Errorf("unknown address family %q", family)
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				err = setIPv6Only(fd, v6only)
+			})
+			if cerr != nil {
+				return cerr
+			}
+			if err != nil {
+				return fmt.Errorf("setting IPV6_V6ONLY: %v", err)
+			}
+			return nil
+		},
+	}
+	return lc.ListenPacket(context.Background(), network, addr)
+}
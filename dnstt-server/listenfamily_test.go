@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// canReach returns true if a UDP packet sent to conn's port at ip arrives at
+// conn.
+func canReach(t *testing.T, conn net.PacketConn, ip net.IP) bool {
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	sender, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write([]byte("hello")); err != nil {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+	var buf [16]byte
+	_, _, err = conn.ReadFrom(buf[:])
+	return err == nil
+}
+
+func TestListenUDPFamily4(t *testing.T) {
+	conn, err := listenUDP("4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !canReach(t, conn, net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("IPv4 packet did not arrive")
+	}
+}
+
+func TestListenUDPFamily6(t *testing.T) {
+	conn, err := listenUDP("6", "[::]:0")
+	if err != nil {
+		t.Skipf("cannot open IPv6 socket: %v", err)
+	}
+	defer conn.Close()
+	if !canReach(t, conn, net.IPv6loopback) {
+		t.Errorf("IPv6 packet did not arrive")
+	}
+	if canReach(t, conn, net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("IPv4 packet arrived")
+	}
+	// The same port is free for a separate IPv4 socket.
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	other, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		t.Errorf("cannot listen on IPv4 port %d: %v", port, err)
+	} else {
+		other.Close()
+	}
+}
+
+func TestListenUDPFamilyDual(t *testing.T) {
+	conn, err := listenUDP("dual", ":0")
+	if err != nil {
+		t.Skipf("cannot open dual-stack socket: %v", err)
+	}
+	defer conn.Close()
+	if !canReach(t, conn, net.IPv6loopback) {
+		t.Errorf("IPv6 packet did not arrive")
+	}
+	if !canReach(t, conn, net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("IPv4 packet did not arrive")
+	}
+	// The IPv4 port is taken too.
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	if other, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port}); err == nil {
+		other.Close()
+		t.Errorf("IPv4 port %d is not in use", port)
+	}
+}
+
+func TestListenUDPFamilyErrors(t *testing.T) {
+	for _, test := range []struct {
+		family, addr string
+	}{
+		{"5", ":0"},
+		{"dual", "127.0.0.1:0"},
+		{"dual", "[::1]:0"},
+		{"dual", "localhost:0"},
+		{"4", "[::1]:0"},
+	} {
+		conn, err := listenUDP(test.family, test.addr)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%q %q: expected error", test.family, test.addr)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+import "syscall"
+
+// setIPv6Only sets or clears the IPV6_V6ONLY socket option on fd.
+func setIPv6Only(fd uintptr, v6only bool) error {
+	v := 0
+	if v6only {
+		v = 1
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, v)
+}
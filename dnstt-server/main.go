@@ -20,7 +20,10 @@
 //     -privkey 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
 //
 // The -udp option controls the address that will listen for incoming DNS
-// queries.
+// queries. The -tcp option additionally or alternatively accepts DNS queries
+// over TCP, whose responses may be larger than over UDP; the -dot and -doh
+// options, over DNS over TLS and DNS over HTTPS. The -ws option accepts DNS
+// queries carried in WebSocket messages, for use behind a CDN.
 //
 // The -mtu option controls the maximum size of response UDP payloads.
 // Queries that do not advertise requester support for responses of at least
@@ -32,25 +35,44 @@
 //
 // UPSTREAMADDR is the TCP address to which incoming tunnelled streams will be
 // forwarded.
+//
+// With the -bootstrap option, DOMAIN and UPSTREAMADDR are instead read at
+// startup from a JSON document at a URL, so that identical server images can
+// be configured from a metadata service.
+//     -bootstrap http://169.254.169.254/dnstt.json
+//
+// With the -replay option, the server reads one raw DNS query from a file and
+// prints how it would respond to it for DOMAIN, without opening any sockets.
+//     dnstt-server -replay query.bin t.example.com
 package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/base32"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/xtaci/kcp-go/v5"
 	"github.com/xtaci/smux"
 	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/internal/registry"
 	"www.bamsoftware.com/git/dnstt.git/noise"
 	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
 )
@@ -63,9 +85,9 @@ const (
 	responseTTL = 60
 
 	// How long we may wait for downstream data before sending an empty
-	// response. If another query comes in while we are waiting, we'll send
-	// an empty response anyway and restart the delay timer for the next
-	// response.
+	// response: the default and greatest value of emptyResponseDelay. If
+	// another query comes in while we are waiting, we'll send an empty
+	// response anyway and restart the delay timer for the next response.
 	//
 	// This number should be less than 2 seconds, which in 2019 was reported
 	// to be the query timeout of the Quad9 DoH server.
@@ -74,6 +96,38 @@ const (
 
 	// How long to wait for a TCP connection to upstream to be established.
 	upstreamDialTimeout = 30 * time.Second
+
+	// With -stream-tags, how long to wait for a client to send the tag at
+	// the beginning of a stream.
+	streamTagTimeout = 30 * time.Second
+
+	// With -repeat-downstream, how long sendLoop remembers the most recent
+	// downstream bundle for a ClientID, for the purpose of repeating it in
+	// a later response.
+	repeatWindow = 10 * maxResponseDelay
+
+	// With -experimental-no-edns, the maximum size of responses. This is
+	// the limit for DNS messages over UDP without EDNS(0).
+	// https://tools.ietf.org/html/rfc1035#section-2.3.4
+	noEDNSMaxUDPPayload = 512
+
+	// The size of the buffer into which recvLoop reads each query. A longer
+	// query is truncated by the net.PacketConn (as a UDP socket would do),
+	// and so fails to parse.
+	maxQuerySize = 4096
+
+	// With -stream-workers, the number of streams that may wait for a
+	// worker is this many times the number of workers.
+	streamQueueFactor = 4
+
+	// With -send-workers, the number of responses that may wait for each
+	// worker.
+	sendQueueLen = 64
+
+	// recvLoop logs the number of oversized incoming packets it has
+	// dropped, and of those dropped by checkPackets, at most this often;
+	// responseFor likewise the number of extra OPT RRs it has ignored.
+	oversizedLogInterval = 1 * time.Minute
 )
 
 var (
@@ -91,11 +145,542 @@ var (
 	// On 2020-04-19, the Quad9 resolver was seen to have a UDP payload size
 	// of 1232. Cloudflare's was 1452, and Google's was 4096.
 	maxUDPPayload = 1280 - 40 - 8
+
+	// The maximum sustained rate of queries per second we will accept from
+	// any one ClientID. Queries in excess of this rate are dropped before
+	// their packets are fed to KCP. Each ClientID may additionally send a
+	// burst of up to this many queries at once. The default is high enough
+	// not to affect ordinary bulk uploads; it is meant to stop a single
+	// client (or a spoofer reusing a ClientID) from flooding the server. 0
+	// means no limit.
+	//
+	// Control this value with the -max-client-query-rate command-line
+	// option.
+	maxClientQueryRate = 1000.0
+
+	// If true, sendLoop repeats the most recent downstream bundle sent to a
+	// ClientID in the next response to that ClientID that would otherwise
+	// be empty, so that a single lost response can be recovered from the
+	// following one without waiting for a KCP retransmission. The client
+	// needs no changes, because KCP discards duplicate segments. This costs
+	// bandwidth and is off by default.
+	//
+	// Control this value with the -repeat-downstream command-line option.
+	repeatDownstream = false
+
+	// How long sendLoop waits for downstream data before sending an empty
+	// response, at most maxResponseDelay. Shorter waits make fewer
+	// responses carry data, but keep a resolver with a short query timeout
+	// from giving up on the query. With 0, a response carries only the
+	// data that is already queued when it is sent.
+	//
+	// Control this value with the -empty-response-delay command-line
+	// option.
+	emptyResponseDelay = maxResponseDelay
+
+	// If positive, cache the resolved IP addresses of the upstream host for
+	// this long. If zero, resolve the upstream host anew on every dial.
+	//
+	// Control this value with the -upstream-resolve-interval command-line
+	// option.
+	upstreamResolveInterval time.Duration = 0
+
+	// If true, and the upstream host resolves to more than one address,
+	// always connect the streams of a given ClientID to the same address
+	// (as long as it is reachable), rather than to the first address.
+	//
+	// Control this value with the -upstream-sticky command-line option.
+	upstreamSticky = false
+
+	// If not nil, handleStream carries streams to the upstream as streams
+	// of a single shared connection, rather than dialing a connection for
+	// each.
+	//
+	// Control this value with the -upstream-mux command-line option.
+	sharedUpstream *upstreamMux = nil
+
+	// If positive, the maximum size of responses, when it is smaller than
+	// maxUDPPayload. Unlike maxUDPPayload, it does not affect which queries
+	// are accepted: a requester must still advertise a UDP payload size of
+	// at least maxUDPPayload. It is meant for paths that drop large
+	// responses even when the requester says it can receive them. It
+	// limits the KCP MTU accordingly. 0 means no limit other than
+	// maxUDPPayload.
+	//
+	// Control this value with the -max-response-size command-line option.
+	maxResponseSize = 0
+
+	// If true, HTTPS and SVCB queries for names in the tunnel domain get a
+	// NODATA response (NOERROR with no answer), rather than NXDOMAIN. Web
+	// browsers query these types for every name they look up, and an
+	// NXDOMAIN for a name that has other records is unusual.
+	//
+	// Control this value with the -nodata-https command-line option.
+	noDataHTTPS = false
+
+	// If true, set the RA (recursion available) bit in responses. The
+	// server does not do recursion or forward queries, so RA = 0 is
+	// correct for it alone; this is for when it sits behind something that
+	// does, and responses should say so.
+	// https://tools.ietf.org/html/rfc1035#section-4.1.1
+	//
+	// Control this value with the -recursion-available command-line
+	// option.
+	recursionAvailable = false
+
+	// If not negative, NXDOMAIN responses for names in the tunnel domain
+	// carry an SOA in the Authority section, and the TTL of negative
+	// answers (the SOA MINIMUM) is this many seconds instead of
+	// responseTTL. RFC 2308 resolvers do not cache an NXDOMAIN without an
+	// SOA, but others may cache it for a long time of their own choosing;
+	// a short negative TTL bounds how long a stray NXDOMAIN can keep a
+	// client from reconnecting.
+	//
+	// Control this value with the -negative-ttl command-line option.
+	negativeTTL = -1
+
+	// The set of QTYPEs whose queries are treated as tunnel queries.
+	// Queries for other QTYPEs in the tunnel domain get NXDOMAIN (or NODATA
+	// with -nodata-https). It may contain only types in
+	// supportedTunnelQTypes.
+	//
+	// Control this value with the -tunnel-qtype command-line option.
+	tunnelQTypes = map[uint16]bool{dns.RRTypeTXT: true}
+
+	// If true, a query with more than one OPT RR is processed using the
+	// first one, rather than being answered with FORMERR as RFC 6891
+	// requires. Some middleboxes are known to duplicate OPT RRs.
+	//
+	// Control this value with the -lenient-edns command-line option.
+	lenientEDNS = false
+
+	// If true, a query whose OPT RR contains an EDNS option that the server
+	// does not implement (anything but those in knownEDNSOptions), or whose
+	// option list is malformed, gets a FORMERR response. By default,
+	// unknown options are ignored, as RFC 6891 requires.
+	//
+	// Control this value with the -strict-edns-options command-line option.
+	strictEDNSOptions = false
+
+	// If not nil, the value of the EDNS NSID option (RFC 5001) to include
+	// in responses to queries that request it, in order to identify which
+	// server in a group of servers answered. Anyone who can send a query
+	// can read it.
+	//
+	// Control this value with the -nsid command-line option.
+	nsid []byte = nil
+
+	// If not nil, sendLoop writes a line describing every response it
+	// sends to accessLog.
+	//
+	// Control this value with the -access-log command-line option.
+	accessLog *accessLogger = nil
+
+	// Identifies this server instance in every log line, as a prefix, and
+	// in the access log, so that the logs of several servers can be told
+	// apart when they are collected in one place. The default is the host
+	// name. Empty means no identifier.
+	//
+	// Control this value with the -instance-id command-line option.
+	instanceID = ""
+
+	// How the -metrics option exports metrics: "prometheus" to serve them
+	// over HTTP for scraping, or "statsd" to push them to a StatsD server
+	// over UDP every metricsInterval.
+	//
+	// Control this value with the -metrics-backend command-line option.
+	metricsBackend = "prometheus"
+
+	// How often to push metrics when metricsBackend is "statsd".
+	//
+	// Control this value with the -metrics-interval command-line option.
+	metricsInterval = 10 * time.Second
+
+	// If true, failing to open an auxiliary listener (the -metrics or
+	// -debug-addr HTTP server) is a fatal error. By default it is logged,
+	// and the server goes on serving tunnel traffic without that listener.
+	//
+	// Control this value with the -strict-aux-listeners command-line option.
+	strictAuxListeners = false
+
+	// EDNS flags that must be set, and that must not be set, in the OPT RR
+	// of a query. A query whose OPT RR does not meet these requirements
+	// gets a REFUSED response. A query without an OPT RR is not affected
+	// (see experimentalNoEDNS). The flags are the low 16 bits of the OPT
+	// RR's TTL field; the most significant bit is DO (DNSSEC OK).
+	//
+	// Control these values with the -edns-require-flags and
+	// -edns-forbid-flags command-line options.
+	ednsRequireFlags uint16 = 0
+	ednsForbidFlags  uint16 = 0
+
+	// EDNS flags that are copied from the OPT RR of a query to the OPT RR
+	// of its response, if set in the query. All others are clear in the
+	// response. RFC 3225 requires a DNSSEC-aware server to copy the DO flag
+	// (0x8000); the tunnel is not DNSSEC-aware, so by default none are
+	// copied.
+	//
+	// Control this value with the -edns-reflect-flags command-line option.
+	ednsReflectFlags uint16 = 0
+
+	// If true, size responses so that they fit in 512 bytes, the limit
+	// for requesters that do not support EDNS(0). Queries without an OPT
+	// RR can then carry tunnel data, and are answered without an OPT RR.
+	// This is meant for paths where a middlebox strips OPT RRs from
+	// queries. It makes the KCP MTU very small, about 200 bytes, and
+	// severely limits throughput.
+	//
+	// Control this value with the -experimental-no-edns command-line
+	// option.
+	experimentalNoEDNS = false
+
+	// The number of consecutive transient errors (such as ECONNREFUSED
+	// from an ICMP port unreachable) after which recvLoop, sendLoop,
+	// acceptSessions, or acceptStreams gives up and returns an error.
+	// Transient errors are otherwise logged and ignored. 0 means never
+	// give up.
+	//
+	// Control this value with the -max-consecutive-errors command-line
+	// option.
+	maxConsecutiveErrors = 0
+
+	// How to answer queries for the tunnel domain itself, which are never
+	// tunnel queries, when neither -ns nor -zone answers them. With
+	// "nxdomain" (the default), they get NXDOMAIN, like a tunnel query too
+	// short to contain a ClientID. With "nodata", the domain looks like an
+	// ordinary name that exists: SOA queries get an SOA record, and other
+	// queries get NODATA.
+	//
+	// Control this value with the -apex-response command-line option.
+	apexResponse = "nxdomain"
+
+	// How to answer queries for names below the tunnel domain that cannot
+	// be tunnel queries because of their structure (see isDeepNonTunnelName),
+	// when -zone does not answer them. With "nxdomain" (the default), they
+	// get NXDOMAIN, as do other names that are not valid tunnel queries.
+	// With "nodata", they get NODATA with an SOA, like names that exist, as
+	// a wildcard in an ordinary zone would give.
+	//
+	// Control this value with the -deep-name-response command-line option.
+	deepNameResponse = "nxdomain"
+
+	// How to set the owner name of the Answer RR in tunnel responses. With
+	// "question" (the default), it is the name from the Question section,
+	// which the encoder compresses to a 2-byte pointer. With "root", it is
+	// the root name, which takes 1 byte; but the owner name then does not
+	// match the question, and a recursive resolver is likely to discard
+	// the answer. This is meant for experimentation with encodings that
+	// use the owner name.
+	//
+	// Control this value with the -experimental-answer-name command-line
+	// option.
+	experimentalAnswerName = "question"
+
+	// If true, clients send a tag at the beginning of every stream, which
+	// is used to label logs and metrics for the stream. All clients must
+	// then use the -stream-tag option of dnstt-client (possibly with an
+	// empty tag), because the tag is indistinguishable from stream data.
+	//
+	// Control this value with the -stream-tags command-line option.
+	streamTags = false
+
+	// If positive, streams are handled by a pool of this many worker
+	// goroutines, rather than each by its own goroutine. Each worker
+	// handles one stream at a time, for the whole life of the stream, so
+	// this is a limit on the number of streams being handled at once.
+	// Streams beyond the limit wait in a queue for a free worker; streams
+	// beyond the capacity of the queue are closed. 0 means a goroutine per
+	// stream, with no limit.
+	//
+	// Control this value with the -stream-workers command-line option.
+	streamWorkers = 0
+
+	// If positive, each sendLoop serializes and sends its responses from a
+	// pool of this many worker goroutines, so that a WriteTo that blocks
+	// (for example on a full socket buffer) delays only the responses
+	// behind it for the same worker. Responses for one ClientID are always
+	// sent by the same worker, in order. Responses beyond the capacity of a
+	// worker's queue are dropped. 0 means each sendLoop sends its
+	// responses itself, one at a time.
+	//
+	// Control this value with the -send-workers command-line option.
+	sendWorkers = 0
+
+	// If true, KCP sessions use KCP's dynamic congestion window. By default
+	// the congestion window is off, and the sending rate is limited only by
+	// the static send and receive windows. That gets the most throughput
+	// out of a lossy DNS path, but does not back off when the path is
+	// congested, which is unfair to other traffic on a shared link.
+	//
+	// Control this value with the -kcp-congestion command-line option.
+	kcpCongestion = false
+
+	// Parameters of the smux session in every KCP session (see
+	// newSmuxConfig). The defaults are those of smux.DefaultConfig.
+	// MaxReceiveBuffer bounds the data buffered for all of a session's
+	// streams and MaxStreamBuffer that of any one stream, so together with
+	// the number of sessions they set most of the server's memory use;
+	// smaller values save memory at the cost of throughput. They limit
+	// what the client may send; the client's own settings limit what the
+	// server may send, so the two should be roughly the same.
+	//
+	// Control these values with the -smux-max-frame-size,
+	// -smux-max-receive-buffer, and -smux-max-stream-buffer command-line
+	// options.
+	smuxMaxFrameSize     = 32768
+	smuxMaxReceiveBuffer = 4194304
+	smuxMaxStreamBuffer  = 65536
+
+	// If true, sendLoop logs a line for every response it sends to a
+	// client: the ClientID, a per-ClientID sequence number, how long it
+	// waited for downstream data, the length of every packet bundled into
+	// the response, the length of any packet stashed for a later response
+	// because it did not fit, and whether the bundle was a repeat (see
+	// repeatDownstream). This is a verbose diagnostic for problems with
+	// downstream data, not for regular use: the log is large, and
+	// sendLoop remembers a sequence number for every ClientID it has seen.
+	//
+	// Control this value with the -debug-bundles command-line option.
+	debugBundles = false
+
+	// If true, recvLoop logs, for the first query from each ClientID that
+	// carries a packet, how the bytes of the query name are spent: on the
+	// tunnel domain, on base32 and label overhead, on the ClientID, on
+	// padding and length prefixes, and on packet data, and how much packet
+	// data a query from that client can carry at most. This explains why
+	// upstream throughput is so much lower than downstream. recvLoop
+	// remembers every ClientID it has logged.
+	//
+	// Control this value with the -debug-upstream-budget command-line
+	// option.
+	debugUpstreamBudget = false
+
+	// If true, connections to -dot log the TLS version and cipher suite
+	// they negotiate, or the error that ended the handshake. This lets an
+	// operator confirm that clients connect, and why they fail to.
+	//
+	// Control this value with the -debug-tls command-line option.
+	debugTLS = false
+
+	// If true, sendResponse logs every response whose send fails with
+	// ECONNREFUSED, with the address it was sent to. Such failures are
+	// otherwise only counted, because the address that caused the ICMP
+	// port unreachable behind one may be some other requester's.
+	//
+	// Control this value with the -debug-send-refused command-line option.
+	debugSendRefused = false
+
+	// If positive, the greatest number of goroutines that may run at once
+	// for sessions and streams: one per session, and three per stream (one
+	// for handleStream and one for each direction of copying; two if
+	// -stream-workers is used, because the pool workers are not counted;
+	// one more with -download-buffer, for reading from the upstream).
+	// A new session or stream that would exceed the limit is closed
+	// immediately, so that a flood of them cannot exhaust memory. The
+	// current count is in tunnelGoroutines.
+	//
+	// Control this value with the -max-tunnel-goroutines command-line
+	// option.
+	maxTunnelGoroutines = 0
+
+	// If true, recvLoop answers tunnel queries from ClientIDs that have no
+	// open session with SERVFAIL, and ignores their packets, while the
+	// server is saturated (see saturationMonitor), so that clients fail
+	// over quickly instead of retrying into a server that cannot take
+	// them.
+	//
+	// Control this value with the -saturation-servfail command-line option.
+	saturationServfail = false
+
+	// The greatest number of new sessions per minute whose progress
+	// through the KCP, Noise, and smux layers is logged (see
+	// handshakeTrace). 0 means none.
+	//
+	// Control this value with the -log-handshakes command-line option.
+	logHandshakes = 0
+
+	// The minimum time between the starts of any one ClientID's sessions.
+	// Queries from a ClientID that has no open session, and whose last
+	// session started less than this long ago, are dropped without a
+	// response (see cooldownTracker), which stops a misbehaving client
+	// from making the server set up session after session. 0 means no
+	// minimum.
+	//
+	// Control this value with the -session-cooldown command-line option.
+	sessionCooldown time.Duration = 0
+
+	// If positive, handleStream reads from the upstream connection in a
+	// separate goroutine, which may get up to this many bytes ahead of
+	// writing to the client's stream, so that a momentary stall in the
+	// stream (while KCP waits for acknowledgements, say) does not at once
+	// stop reading from the upstream. If 0, the stream←upstream copy reads
+	// only as fast as it writes.
+	//
+	// Control this value with the -download-buffer command-line option.
+	downloadBuffer = 0
+
+	// If positive, recvLoop passes the packets from each query to KCP this
+	// long after receiving the query, rather than at once. Every packet is
+	// delayed by the same amount, so packets are not reordered. This is
+	// for experimenting with the timing profile of the tunnel; it adds this
+	// much latency to the upstream direction.
+	//
+	// Control this value with the -ingest-delay command-line option.
+	ingestDelay time.Duration = 0
+
+	// If true, run returns an error if the upstream address is the address
+	// of one of the server's own listeners, rather than logging a warning.
+	//
+	// Control this value with the -upstream-loop-fatal command-line option.
+	upstreamLoopFatal = false
+
+	// If not nil, handleStream refuses to connect to an upstream address in
+	// any of these ranges, whatever the upstream host name resolves to.
+	// This protects internal services when the upstream is not under the
+	// operator's control.
+	//
+	// Control this value with the -deny-private-upstream and
+	// -denied-upstream-ranges command-line options.
+	deniedUpstreamRanges []*net.IPNet = nil
+
+	// If positive, queries whose name has more labels than this get a
+	// FORMERR response, before any work is done to decode the name. A
+	// 255-octet name can have as many as 127 labels; dnstt-client never
+	// sends more than 4 labels of data, plus the labels of the tunnel
+	// domain.
+	//
+	// Control this value with the -max-query-labels command-line option.
+	maxQueryLabels = 0
+
+	// If positive, recvLoop measures how long it takes to parse one in
+	// every this many queries and build the response to it, and counts the
+	// time by the query's source address (see queryCostSampler), so that
+	// a source that causes disproportionate work, with maximally long
+	// names, say, can be found. 0 means no measurement.
+	//
+	// Control this value with the -query-cost-sample command-line option.
+	queryCostSample = 0
+
+	// If true, recvLoop drops packets that could not be KCP packets (see
+	// plausibleKCPPacket) instead of feeding them to KCP, where a query
+	// from a scanner that happens to decode as base32 could otherwise
+	// start a useless session.
+	//
+	// Control this value with the -check-packets command-line option.
+	checkPackets = false
+
+	// If positive, handleStream closes a stream, and its upstream
+	// connection, if no data has been copied in either direction this long
+	// after the upstream connection is made. This reaps streams that will
+	// never be used (a stalled client, or a probe) much sooner than
+	// idleTimeout would. Once any data has been copied, it has no effect.
+	//
+	// Control this value with the -first-byte-timeout command-line option.
+	firstByteTimeout time.Duration = 0
+
+	// If positive, handleStream closes a stream, and its upstream
+	// connection, this long after the upstream connection is made, whether
+	// or not the stream is active. This puts a hard limit on the life of
+	// any one stream.
+	//
+	// Control this value with the -stream-max-lifetime command-line option.
+	streamMaxLifetime time.Duration = 0
+
+	// If positive, handleStream logs, and counts in
+	// dnstt_upstream_slow_dials_total, every upstream connection that takes
+	// longer than this to make, whether or not it succeeds. This gives
+	// warning of a slow backend or network before connections start to
+	// fail outright.
+	//
+	// Control this value with the -slow-dial-threshold command-line option.
+	slowDialThreshold time.Duration = 0
+
+	// If positive, for this long after the server starts, tunnel queries
+	// get a SERVFAIL response and their packets are ignored, although the
+	// listeners are already open. This gives time for something the
+	// upstream depends on to start.
+	//
+	// Control this value with the -warmup command-line option.
+	warmup time.Duration = 0
+
+	// If positive, log a summary of activity this often.
+	//
+	// Control this value with the -stats-interval command-line option.
+	statsInterval time.Duration = 0
+
+	// If true, queries in the CHAOS class get a REFUSED response, as many
+	// hardened name servers give, rather than NXDOMAIN.
+	//
+	// Control this value with the -chaos-refuse command-line option.
+	chaosRefuse = false
+
+	// If not nil, CHAOS-class TXT queries for version.bind and
+	// hostname.bind, which diagnostic tools and scanners send to learn
+	// what software a name server runs, are answered with a TXT record
+	// containing this string, rather than with NXDOMAIN. It may be empty.
+	//
+	// Control this value with the -chaos-txt command-line option.
+	chaosTXT []byte = nil
+
+	// If not nil, queries for NS records at the apex of the tunnel domain
+	// are answered with an NS record naming this host, rather than with
+	// NXDOMAIN. Some recursive resolvers check the delegation of a zone
+	// before querying names within it, and treat the zone as broken if the
+	// authoritative server denies the existence of its own NS record.
+	//
+	// Control this value with the -ns command-line option.
+	nsName dns.Name = nil
+
+	// If not nil, static records that are answered for names in the tunnel
+	// domain, other than names that the tunnel uses, so that the domain
+	// can look like an ordinary zone.
+	//
+	// Control this value with the -zone command-line option.
+	serveZone *zone = nil
+
+	// If true, the RRs of a multi-RR answer are put in a random order in
+	// every response, rather than always in the order of the zone file, as
+	// many authoritative servers do. An RRset is unordered
+	// (https://tools.ietf.org/html/rfc2181#section-5), so this is always
+	// safe. Nothing else is reordered: the order of sections is fixed by
+	// the message format, a tunnel response has only one Answer RR, and
+	// the OPT RR has at most one option.
+	//
+	// Control this value with the -shuffle-rrs command-line option.
+	shuffleRRs = false
 )
 
-// base32Encoding is a base32 encoding without padding.
+// base32Encoding is a base32 encoding without padding, with the alphabet that
+// clients use to encode query names.
+//
+// Control this value with the -base32-alphabet command-line option.
 var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
 
+// configureUpstreamConn, if not nil, is called by handleStream on every newly
+// dialed upstream connection, before any data is exchanged over it. It is an
+// extension point for programs that embed the server and need to apply
+// platform-specific tuning, such as TCP_NODELAY, keepalives, or a firewall
+// mark for policy routing. If it returns an error, the upstream connection is
+// closed and the stream is abandoned.
+var configureUpstreamConn func(conn net.Conn) error
+
+// streamHandler, if not nil, is called by acceptStreams for every new stream
+// instead of handleStream, which reads the stream tag and proxies the stream to
+// a TCP upstream. It is set from a handler given to registerStreamHandler,
+// with the -stream-handler option, so that programs that embed the server can
+// serve streams in-process, with an HTTP handler or a protocol of their own.
+// conv identifies the KCP session and streamID the stream within it, as in
+// log messages. The handler owns the stream: acceptStreams does not close it
+// when the handler returns, so the handler must close it itself, before
+// returning or later. An error returned by the handler is logged. The stream
+// still counts against -max-tunnel-goroutines and -stream-workers, but none of
+// the upstream options (-stream-tags, -first-byte-timeout,
+// -stream-max-lifetime, and so on) apply to it.
+var streamHandler streamHandlerFunc
+
+// streamHandlerName is the name of streamHandler, for log messages.
+var streamHandlerName string
+
 // generateKeypair generates a private key and the corresponding public key. If
 // privkeyFilename and pubkeyFilename are respectively empty, it prints the
 // corresponding key to standard output; otherwise it saves the key to the given
@@ -140,17 +725,9 @@ func generateKeypair(privkeyFilename, pubkeyFilename string) (err error) {
 	}
 
 	if pubkeyFilename != "" {
-		// Save the pubkey to a file.
-		f, err := os.Create(pubkeyFilename)
-		if err != nil {
-			return err
-		}
-		toDelete = append(toDelete, pubkeyFilename)
-		err = noise.WriteKey(f, pubkey)
-		if err2 := f.Close(); err == nil {
-			err = err2
-		}
-		if err != nil {
+		// Save the pubkey to a file. Nothing after this can fail, so
+		// only writePubkeyFile itself need delete it.
+		if err := writePubkeyFile(pubkeyFilename, pubkey); err != nil {
 			return err
 		}
 	}
@@ -172,6 +749,53 @@ func generateKeypair(privkeyFilename, pubkeyFilename string) (err error) {
 	return nil
 }
 
+// openKeyProvider opens the key provider named by spec, which has the form
+// NAME or NAME:CONFIG, as for the -key-provider option.
+func openKeyProvider(spec string) (noise.KeyProvider, error) {
+	return noise.OpenKeyProvider(registry.SplitSpec(spec))
+}
+
+// generateProviderKey generates a new private key in keys. If pubkeyFilename
+// is empty, it prints the public key to standard output; otherwise it saves
+// the public key to the given file name. The private key stays wherever keys
+// stores it.
+func generateProviderKey(keys noise.KeyProvider, pubkeyFilename string) error {
+	if err := keys.Generate(); err != nil {
+		return err
+	}
+	pubkey := keys.Pubkey()
+	if pubkeyFilename != "" {
+		if err := writePubkeyFile(pubkeyFilename, pubkey); err != nil {
+			return err
+		}
+		fmt.Printf("pubkey  written to %s\n", pubkeyFilename)
+	} else {
+		fmt.Printf("pubkey  %x\n", pubkey)
+	}
+	return nil
+}
+
+// writePubkeyFile writes a public key to a named file, created with mode 0666
+// (before umask). If writing fails, it attempts to delete the partially
+// written file.
+func writePubkeyFile(filename string, pubkey []byte) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = noise.WriteKey(f, pubkey)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "deleting partially written file %s\n", filename)
+		if removeErr := os.Remove(filename); removeErr != nil {
+			fmt.Fprintf(os.Stderr, "cannot remove %s: %v\n", filename, removeErr)
+		}
+	}
+	return err
+}
+
 // readKeyFromFile reads a key from a named file.
 func readKeyFromFile(filename string) ([]byte, error) {
 	f, err := os.Open(filename)
@@ -183,36 +807,130 @@ func readKeyFromFile(filename string) ([]byte, error) {
 }
 
 // handleStream bidirectionally connects a client stream with a TCP socket
-// addressed by upstream.
-func handleStream(stream *smux.Stream, upstream string, conv uint32) error {
+// dialed by upstream. If streamTags is set, it first reads the stream's tag.
+// clientID identifies the client to upstream.Dial, for upstreamSticky.
+//
+// When the client closes the stream, handleStream half-closes the TCP
+// connection (CloseWrite) after copying all the data the client sent, and
+// keeps copying data from upstream until upstream closes. When upstream
+// closes, handleStream closes the stream after copying all the data upstream
+// sent; smux.Stream.Write does not return until the data is queued in the
+// session, ahead of the FIN. But smux (as of v1.5) has no half-close, so
+// closing the stream also ends the client→upstream direction: an upstream that
+// half-closes its side and then expects to read more from the client will not
+// get it.
+//
+// If sharedUpstream is not nil, the upstream connection is a stream in its
+// shared session instead of a TCP connection of its own. Such a stream has no
+// half-close either, so when the client closes, the upstream stream is closed
+// entirely.
+func handleStream(stream *smux.Stream, upstream *upstreamDialer, conv uint32, clientID turbotunnel.ClientID, entry *streamEntry) error {
+	var tag string
+	if streamTags {
+		stream.SetReadDeadline(time.Now().Add(streamTagTimeout))
+		var err error
+		tag, err = readStreamTag(stream)
+		if err != nil {
+			return fmt.Errorf("stream %08x:%d reading tag: %v", conv, stream.ID(), err)
+		}
+		stream.SetReadDeadline(time.Time{})
+		if tag != "" {
+			log.Printf("stream %08x:%d tag %q", conv, stream.ID(), tag)
+		}
+	}
+
 	dialer := net.Dialer{
 		Timeout: upstreamDialTimeout,
 	}
-	upstreamConn, err := dialer.Dial("tcp", upstream)
+	if deniedUpstreamRanges != nil {
+		dialer.Control = denyUpstreamControl(deniedUpstreamRanges)
+	}
+	var upstreamConn net.Conn
+	var err error
+	dialStart := time.Now()
+	if sharedUpstream != nil {
+		upstreamConn, err = sharedUpstream.OpenStream(&dialer, clientID, conv, stream.ID(), tag)
+	} else {
+		upstreamConn, err = upstream.Dial(&dialer, clientID)
+	}
+	if dialDuration := time.Since(dialStart); slowDialThreshold > 0 && dialDuration > slowDialThreshold {
+		addr := upstream.String()
+		if err == nil {
+			addr = upstreamConn.RemoteAddr().String()
+		}
+		log.Printf("stream %08x:%d slow upstream dial to %s took %v", conv, stream.ID(), addr, dialDuration)
+		upstreamSlowDials.Inc()
+	}
 	if err != nil {
 		return fmt.Errorf("stream %08x:%d connect upstream: %v", conv, stream.ID(), err)
 	}
 	defer upstreamConn.Close()
-	upstreamTCPConn := upstreamConn.(*net.TCPConn)
+	if configureUpstreamConn != nil && sharedUpstream == nil {
+		err := configureUpstreamConn(upstreamConn)
+		if err != nil {
+			return fmt.Errorf("stream %08x:%d configure upstream: %v", conv, stream.ID(), err)
+		}
+	}
+	closeRead, closeWrite := func() error { return nil }, upstreamConn.Close
+	if upstreamTCPConn, ok := upstreamConn.(*net.TCPConn); ok {
+		closeRead, closeWrite = upstreamTCPConn.CloseRead, upstreamTCPConn.CloseWrite
+	}
+	sessions.SetStreamInfo(entry, upstreamConn.RemoteAddr().String(), tag)
+
+	var toStream io.Writer = countingWriter{countingWriter{stream, downstreamBytes}, &entry.Downstream}
+	var toUpstream io.Writer = countingWriter{countingWriter{upstreamConn, upstreamBytes}, &entry.Upstream}
+	if tag != "" {
+		toStream = countingWriter{toStream, downstreamBytesByTag.With(tag)}
+		toUpstream = countingWriter{toUpstream, upstreamBytesByTag.With(tag)}
+	}
+
+	if firstByteTimeout > 0 {
+		timer := time.AfterFunc(firstByteTimeout, func() {
+			if entry.Upstream.Value() == 0 && entry.Downstream.Value() == 0 {
+				log.Printf("stream %08x:%d no data after %v, closing", conv, stream.ID(), firstByteTimeout)
+				streamsFirstByteTimeout.Inc()
+				upstreamConn.Close()
+				stream.Close()
+			}
+		})
+		defer timer.Stop()
+	}
+
+	if streamMaxLifetime > 0 {
+		timer := time.AfterFunc(streamMaxLifetime, func() {
+			log.Printf("stream %08x:%d reached maximum lifetime %v, closing", conv, stream.ID(), streamMaxLifetime)
+			streamsMaxLifetime.Inc()
+			upstreamConn.Close()
+			stream.Close()
+		})
+		defer timer.Stop()
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		_, err := io.Copy(stream, upstreamTCPConn)
+		var err error
+		if downloadBuffer > 0 {
+			_, err = bufferedCopy(toStream, upstreamConn, downloadBuffer, closeRead)
+		} else {
+			_, err = io.Copy(toStream, upstreamConn)
+		}
 		if err == io.EOF {
 			// smux Stream.Write may return io.EOF.
 			err = nil
 		}
-		if err != nil {
+		if err != nil && err != io.ErrClosedPipe {
 			log.Printf("stream %08x:%d copy stream←upstream: %v", conv, stream.ID(), err)
 		}
-		upstreamTCPConn.CloseRead()
+		closeRead()
+		// This also stops the upstream←stream copy; see the
+		// comment above handleStream.
 		stream.Close()
 	}()
 	go func() {
 		defer wg.Done()
-		_, err := io.Copy(upstreamTCPConn, stream)
+		_, err := io.Copy(toUpstream, stream)
 		if err == io.EOF {
 			// smux Stream.WriteTo may return io.EOF.
 			err = nil
@@ -220,85 +938,200 @@ func handleStream(stream *smux.Stream, upstream string, conv uint32) error {
 		if err != nil && err != io.ErrClosedPipe {
 			log.Printf("stream %08x:%d copy upstream←stream: %v", conv, stream.ID(), err)
 		}
-		upstreamTCPConn.CloseWrite()
+		closeWrite()
 	}()
 	wg.Wait()
 
 	return nil
 }
 
+// acquireTunnelGoroutines adds n to tunnelGoroutines and returns true, unless
+// that would exceed maxTunnelGoroutines, in which case it returns false. Every
+// successful call must be matched by a call to releaseTunnelGoroutines with
+// the same n.
+func acquireTunnelGoroutines(n int64) bool {
+	if maxTunnelGoroutines <= 0 {
+		tunnelGoroutines.Add(n)
+		return true
+	}
+	return tunnelGoroutines.AddIfAtMost(n, int64(maxTunnelGoroutines))
+}
+
+// releaseTunnelGoroutines subtracts n from tunnelGoroutines.
+func releaseTunnelGoroutines(n int64) {
+	tunnelGoroutines.Add(-n)
+}
+
+// newSmuxConfig returns the configuration of the smux session in every KCP
+// session, with the -smux-* options applied. Check it with smux.VerifyConfig.
+func newSmuxConfig() *smux.Config {
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = 2
+	smuxConfig.KeepAliveTimeout = idleTimeout
+	smuxConfig.MaxFrameSize = smuxMaxFrameSize
+	smuxConfig.MaxReceiveBuffer = smuxMaxReceiveBuffer
+	smuxConfig.MaxStreamBuffer = smuxMaxStreamBuffer
+	return smuxConfig
+}
+
 // acceptStreams wraps a KCP session in a Noise channel and an smux.Session,
-// then awaits smux streams. It passes each stream to handleStream.
-func acceptStreams(conn *kcp.UDPSession, privkey, pubkey []byte, upstream string) error {
+// then awaits smux streams. It passes each stream to handleStream, in a new
+// goroutine or, if pool is not nil, in pool. It records the streams in
+// session.
+func acceptStreams(session *sessionEntry, keys noise.KeyProvider, upstream *upstreamDialer, pool *streamPool) error {
+	conn := session.conn
+	clientID, _ := sessionClientID(conn)
 	// Put a Noise channel on top of the KCP conn.
-	rw, err := noise.NewServer(conn, privkey, pubkey)
+	rw, err := noise.NewServerKeyProvider(conn, keys)
+	session.handshake.Noise(err)
 	if err != nil {
 		return err
 	}
 
 	// Put an smux session on top of the encrypted Noise channel.
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.Version = 2
-	smuxConfig.KeepAliveTimeout = idleTimeout
-	sess, err := smux.Server(rw, smuxConfig)
+	sess, err := smux.Server(rw, newSmuxConfig())
 	if err != nil {
 		return err
 	}
 	defer sess.Close()
 
+	// Goroutines per stream, for maxTunnelGoroutines: handleStream and
+	// its two copying goroutines, unless handleStream runs in a pool
+	// worker, and the reading goroutine of bufferedCopy.
+	var goroutinesPerStream int64 = 3
+	if pool != nil {
+		goroutinesPerStream = 2
+	}
+	if downloadBuffer > 0 {
+		goroutinesPerStream++
+	}
+	loopErrs := newLoopErrors("AcceptStream")
+	firstStream := true
 	for {
 		stream, err := sess.AcceptStream()
 		if err != nil {
-			if err, ok := err.(net.Error); ok && err.Temporary() {
-				continue
+			if err := loopErrs.Check(err, time.Now()); err != nil {
+				if firstStream {
+					session.handshake.NoStream(err)
+				}
+				return err
 			}
-			return err
+			continue
+		}
+		loopErrs.Success()
+		if firstStream {
+			session.handshake.FirstStream(stream.ID())
+			firstStream = false
+		}
+		if !acquireTunnelGoroutines(goroutinesPerStream) {
+			log.Printf("reject stream %08x:%d: too many goroutines (-max-tunnel-goroutines %d)", conn.GetConv(), stream.ID(), maxTunnelGoroutines)
+			tunnelGoroutinesRejected.With("stream").Inc()
+			stream.Close()
+			continue
 		}
 		log.Printf("begin stream %08x:%d", conn.GetConv(), stream.ID())
-		go func() {
+		streamsActive.Add(1)
+		entry := sessions.AddStream(session, stream.ID())
+		handler, handlerName := streamHandler, "handleStream"
+		if handler != nil {
+			handlerName = fmt.Sprintf("stream handler %q", streamHandlerName)
+		}
+		f := func() {
 			defer func() {
 				log.Printf("end stream %08x:%d", conn.GetConv(), stream.ID())
-				stream.Close()
+				if handler == nil {
+					stream.Close()
+				}
+				sessions.RemoveStream(session, entry)
+				streamsActive.Add(-1)
+				releaseTunnelGoroutines(goroutinesPerStream)
 			}()
-			err := handleStream(stream, upstream, conn.GetConv())
+			var err error
+			if handler != nil {
+				err = handler(stream, conn.GetConv(), stream.ID())
+			} else {
+				err = handleStream(stream, upstream, conn.GetConv(), clientID, entry)
+			}
 			if err != nil {
-				log.Printf("stream %08x:%d handleStream: %v", conn.GetConv(), stream.ID(), err)
+				log.Printf("stream %08x:%d %s: %v", conn.GetConv(), stream.ID(), handlerName, err)
 			}
-		}()
+		}
+		if pool == nil {
+			go f()
+		} else if !pool.Submit(f) {
+			log.Printf("end stream %08x:%d: all stream workers busy and queue full", conn.GetConv(), stream.ID())
+			stream.Close()
+			sessions.RemoveStream(session, entry)
+			streamsActive.Add(-1)
+			releaseTunnelGoroutines(goroutinesPerStream)
+		}
 	}
 }
 
 // acceptSessions listens for incoming KCP connections and passes them to
 // acceptStreams.
-func acceptSessions(ln *kcp.Listener, privkey, pubkey []byte, mtu int, upstream string) error {
+//
+// kcp-go queues at most 128 new sessions for AcceptKCP, a limit that cannot be
+// configured. When the queue is full, it ignores the packets of further new
+// sessions, and the clients must retransmit them. acceptSessions therefore
+// never blocks between calls to AcceptKCP: a session that cannot be taken on
+// is closed at once, and the work of each session happens in its own
+// goroutine. Another layer of buffering here would only lengthen the same
+// queue.
+func acceptSessions(ln *kcp.Listener, keys noise.KeyProvider, mtu int, upstream *upstreamDialer, pool *streamPool) error {
+	sampler := handshakeSampler{limit: logHandshakes}
+	loopErrs := newLoopErrors("AcceptKCP")
 	for {
 		conn, err := ln.AcceptKCP()
 		if err != nil {
-			if err, ok := err.(net.Error); ok && err.Temporary() {
-				continue
+			if err := loopErrs.Check(err, time.Now()); err != nil {
+				return err
 			}
-			return err
+			continue
+		}
+		loopErrs.Success()
+		if clientID, ok := conn.RemoteAddr().(turbotunnel.ClientID); ok {
+			sessionCooldowns.Started(clientID, time.Now())
+		}
+		if !acquireTunnelGoroutines(1) {
+			log.Printf("reject session %08x: too many goroutines (-max-tunnel-goroutines %d)", conn.GetConv(), maxTunnelGoroutines)
+			tunnelGoroutinesRejected.With("session").Inc()
+			conn.Close()
+			continue
 		}
 		log.Printf("begin session %08x", conn.GetConv())
 		// Permit coalescing the payloads of consecutive sends.
 		conn.SetStreamMode(true)
 		// Disable the dynamic congestion window (limit only by the
-		// maximum of local and remote static windows).
+		// maximum of local and remote static windows), unless
+		// kcpCongestion is set.
+		nc := 1 // nc=1 => congestion window off
+		if kcpCongestion {
+			nc = 0 // nc=0 => congestion window on
+		}
 		conn.SetNoDelay(
 			0, // default nodelay
 			0, // default interval
 			0, // default resend
-			1, // nc=1 => congestion window off
+			nc,
 		)
 		if rc := conn.SetMtu(mtu); !rc {
 			panic(rc)
 		}
+		sessionsActive.Add(1)
+		session := sessions.Add(conn)
+		if sampler.Sample(time.Now()) {
+			session.handshake = newHandshakeTrace(conn.GetConv(), conn.RemoteAddr().String())
+		}
 		go func() {
 			defer func() {
 				log.Printf("end session %08x", conn.GetConv())
 				conn.Close()
+				sessions.Remove(conn)
+				sessionsActive.Add(-1)
+				releaseTunnelGoroutines(1)
 			}()
-			err := acceptStreams(conn, privkey, pubkey, upstream)
+			err := acceptStreams(session, keys, upstream, pool)
 			if err != nil {
 				log.Printf("session %08x acceptStreams: %v", conn.GetConv(), err)
 			}
@@ -343,23 +1176,87 @@ func nextPacket(r *bytes.Reader) ([]byte, error) {
 	}
 }
 
+// optTTL returns the TTL field for the OPT RR of a response whose RCODE is
+// rcode (which may be an extended RCODE), to a query whose OPT RR had the EDNS
+// flags queryFlags. The response has the EDNS version 0 and only those of
+// queryFlags that are in ednsReflectFlags. The caller must still put the low 4
+// bits of rcode in the message header.
+func optTTL(rcode uint16, queryFlags uint16) uint32 {
+	return dns.EncodeOPTTTL(rcode, 0, queryFlags&ednsReflectFlags)
+}
+
+// extraOPTLog rate-limits the log message of responseFor about the extra OPT
+// RRs it ignores with -lenient-edns, which a duplicating middlebox could
+// otherwise cause for every query. responseFor may be called from more than one
+// recvLoop at once.
+var extraOPTLog struct {
+	lock    sync.Mutex
+	last    time.Time
+	ignored int
+}
+
+// logExtraOPT counts an extra OPT RR ignored with -lenient-edns, and logs the
+// number ignored at most once every oversizedLogInterval.
+func logExtraOPT() {
+	queriesExtraOPT.Inc()
+	extraOPTLog.lock.Lock()
+	defer extraOPTLog.lock.Unlock()
+	extraOPTLog.ignored++
+	if now := time.Now(); now.Sub(extraOPTLog.last) >= oversizedLogInterval {
+		log.Printf("ignored %d extra OPT RRs", extraOPTLog.ignored)
+		extraOPTLog.ignored = 0
+		extraOPTLog.last = now
+	}
+}
+
 // responseFor constructs a response dns.Message that is appropriate for query.
 // Along with the dns.Message, it returns the query's decoded data payload. If
 // the returned dns.Message is nil, it means that there should be no response to
 // this query. If the returned dns.Message has an Rcode() of dns.RcodeNoError,
 // the message is a candidate for for carrying downstream data in a TXT record.
+// responseFor is for queries received over UDP; see responseForTransport.
 func responseFor(query *dns.Message, domain dns.Name) (*dns.Message, []byte) {
+	return responseForTransport(query, domain, false)
+}
+
+// responseForTransport is like responseFor, but if stream is true, treats
+// query as having been received over a stream transport (TCP, DNS over TLS, or
+// DNS over HTTPS), whose responses are not limited by the requester's UDP
+// payload size.
+func responseForTransport(query *dns.Message, domain dns.Name, stream bool) (*dns.Message, []byte) {
 	resp := &dns.Message{
-		ID:       query.ID,
-		Flags:    0x8000, // QR = 1, RCODE = no error
+		ID: query.ID,
+		// QR = 1, RCODE = no error. OPCODE and RD are copied from the
+		// query (https://tools.ietf.org/html/rfc1035#section-4.1.1), as
+		// is CD (https://tools.ietf.org/html/rfc4035#section-3.1.6 "The
+		// name server side MUST copy the setting of the CD bit from a
+		// query to the corresponding response."). AA is set below if
+		// isAuthoritative, and TC by sendLoop if it truncates the
+		// response.
+		// RA = 0 because we do not offer recursion, unless
+		// recursionAvailable says otherwise. AD = 0 because we do not
+		// serve DNSSEC-signed data. Z = 0.
+		Flags:    0x8000 | query.Flags&0x7910,
 		Question: query.Question,
 	}
+	if recursionAvailable {
+		resp.Flags |= 0x0080 // RA = 1
+	}
 
 	if query.Flags&0x8000 != 0 {
 		// QR != 0, this is not a query. Don't even send a response.
 		return nil, nil
 	}
 
+	// Set AA in one place, before any of the returns below, so that every
+	// response to a query for a name in our domain, or for one of the
+	// CHAOS names we answer, has AA = 1, whatever its RCODE and whether or
+	// not it has answers, and no other response does.
+	// https://tools.ietf.org/html/rfc1035#section-4.1.1
+	if isAuthoritative(query, domain) {
+		resp.Flags |= 0x0400 // AA = 1
+	}
+
 	// Check for EDNS(0) support. Include our own OPT RR only if we receive
 	// one from the requester.
 	// https://tools.ietf.org/html/rfc6891#section-6.1.1
@@ -373,6 +1270,11 @@ func responseFor(query *dns.Message, domain dns.Name) (*dns.Message, []byte) {
 			continue
 		}
 		if len(resp.Additional) != 0 {
+			if lenientEDNS {
+				// Use the first OPT RR and ignore the rest.
+				logExtraOPT()
+				continue
+			}
 			// https://tools.ietf.org/html/rfc6891#section-6.1.1
 			// "If a query message with more than one OPT RR is
 			// received, a FORMERR (RCODE=1) MUST be returned."
@@ -380,27 +1282,58 @@ func responseFor(query *dns.Message, domain dns.Name) (*dns.Message, []byte) {
 			log.Printf("FORMERR: more than one OPT RR")
 			return resp, nil
 		}
+		// The EDNS version and flags (DO and Z) are in the TTL.
+		// https://tools.ietf.org/html/rfc6891#section-6.1.3
+		_, version, ednsFlags := dns.DecodeOPTTTL(rr.TTL)
 		resp.Additional = append(resp.Additional, dns.RR{
 			Name:  dns.Name{},
 			Type:  dns.RRTypeOPT,
 			Class: 4096, // responder's UDP payload size
-			TTL:   0,
+			TTL:   optTTL(dns.RcodeNoError, ednsFlags),
 			Data:  []byte{},
 		})
 		additional := &resp.Additional[0]
 
-		version := (rr.TTL >> 16) & 0xff
 		if version != 0 {
 			// https://tools.ietf.org/html/rfc6891#section-6.1.1
 			// "If a responder does not implement the VERSION level
 			// of the request, then it MUST respond with
 			// RCODE=BADVERS."
 			resp.Flags |= dns.ExtendedRcodeBadVers & 0xf
-			additional.TTL = (dns.ExtendedRcodeBadVers >> 4) << 24
+			additional.TTL = optTTL(dns.ExtendedRcodeBadVers, ednsFlags)
 			log.Printf("BADVERS: EDNS version %d != 0", version)
 			return resp, nil
 		}
 
+		if strictEDNSOptions {
+			if code, err := unknownEDNSOption(rr.Data); err != nil {
+				resp.Flags |= dns.RcodeFormatError
+				queriesUnknownEDNSOption.Inc()
+				log.Printf("FORMERR: malformed EDNS options: %v", err)
+				return resp, nil
+			} else if code != nil {
+				resp.Flags |= dns.RcodeFormatError
+				queriesUnknownEDNSOption.Inc()
+				log.Printf("FORMERR: unknown EDNS option %d", *code)
+				return resp, nil
+			}
+		}
+
+		if ednsFlags&ednsRequireFlags != ednsRequireFlags || ednsFlags&ednsForbidFlags != 0 {
+			// There is no RCODE specifically for this; it is a
+			// matter of policy.
+			resp.Flags |= dns.RcodeRefused
+			log.Printf("REFUSED: EDNS flags %#04x do not match policy", ednsFlags)
+			return resp, nil
+		}
+
+		// https://tools.ietf.org/html/rfc5001#section-2.2 "A name
+		// server MUST NOT send an NSID option back to a resolver which
+		// did not request it."
+		if nsid != nil && hasEDNSOption(rr.Data, ednsOptionNSID) {
+			additional.Data = appendEDNSOption(additional.Data, ednsOptionNSID, nsid)
+		}
+
 		payloadSize = int(rr.Class)
 	}
 	if payloadSize < 512 {
@@ -409,15 +1342,43 @@ func responseFor(query *dns.Message, domain dns.Name) (*dns.Message, []byte) {
 		payloadSize = 512
 	}
 	// We will return RcodeFormatError if payloadSize is too small, but
-	// first, check the name in order to set the AA bit properly.
+	// first, check the name and QTYPE, whose errors take precedence.
 
 	// There must be exactly one question.
 	if len(query.Question) != 1 {
 		resp.Flags |= dns.RcodeFormatError
+		queriesBadQuestionCount.Inc()
 		log.Printf("FORMERR: too few or too many questions (%d)", len(query.Question))
 		return resp, nil
 	}
 	question := query.Question[0]
+	// Bound the number of labels joined together below, if so configured.
+	if maxQueryLabels > 0 && len(question.Name) > maxQueryLabels {
+		resp.Flags |= dns.RcodeFormatError
+		queriesTooManyLabels.Inc()
+		log.Printf("FORMERR: name has %d labels", len(question.Name))
+		return resp, nil
+	}
+	if question.Class == dns.ClassCHAOS && query.Opcode() == 0 {
+		if chaosRefuse {
+			resp.Flags |= dns.RcodeRefused
+			return resp, nil
+		}
+		if isChaosTXTQuery(query) {
+			resp.Answer = []dns.RR{
+				{
+					Name:  question.Name,
+					Type:  dns.RRTypeTXT,
+					Class: dns.ClassCHAOS,
+					TTL:   0,
+					Data:  dns.EncodeRDataTXT(chaosTXT),
+				},
+			}
+			return resp, nil
+		}
+		// Otherwise, NXDOMAIN like any other name outside our
+		// domain.
+	}
 	// Check the name to see if it ends in our chosen domain, and extract
 	// all that comes before the domain if it does. If it does not, we will
 	// return RcodeNameError below, but prefer to return RcodeFormatError
@@ -429,7 +1390,6 @@ func responseFor(query *dns.Message, domain dns.Name) (*dns.Message, []byte) {
 		log.Printf("NXDOMAIN: not authoritative for %s", question.Name)
 		return resp, nil
 	}
-	resp.Flags |= 0x0400 // AA = 1
 
 	if query.Opcode() != 0 {
 		// We don't support OPCODE != QUERY.
@@ -438,8 +1398,84 @@ func responseFor(query *dns.Message, domain dns.Name) (*dns.Message, []byte) {
 		return resp, nil
 	}
 
-	if question.Type != dns.RRTypeTXT {
-		// We only support QTYPE == TXT.
+	if rr, ok := delegationProbeAnswer(question); ok {
+		// The test query of -verify-delegation.
+		resp.Answer = []dns.RR{rr}
+		return resp, nil
+	}
+
+	if nsName != nil && len(prefix) == 0 && question.Type == dns.RRTypeNS {
+		// An NS query for the tunnel domain itself.
+		resp.Answer = []dns.RR{
+			{
+				Name:  question.Name,
+				Type:  dns.RRTypeNS,
+				Class: question.Class,
+				TTL:   responseTTL,
+				Data:  dns.EncodeRDataNS(nsName),
+			},
+		}
+		return resp, nil
+	}
+
+	if serveZone != nil && question.Class == dns.ClassIN &&
+		!(tunnelQTypes[question.Type] && looksLikeTunnelName(prefix)) {
+		// Answer from the zone if it has the name, but never for a
+		// name that could be a tunnel query of a tunnel QTYPE.
+		if rrs, ok := serveZone.Lookup(question.Name, question.Type); ok {
+			for _, rr := range rrs {
+				// Echo the case of the question name.
+				rr.Name = question.Name
+				resp.Answer = append(resp.Answer, rr)
+			}
+			if shuffleRRs {
+				rand.Shuffle(len(resp.Answer), func(i, j int) {
+					resp.Answer[i], resp.Answer[j] = resp.Answer[j], resp.Answer[i]
+				})
+			}
+			if len(resp.Answer) == 0 {
+				// NODATA: the name exists, but has no records
+				// of this TYPE. The SOA lets resolvers cache
+				// that, and keeps this from looking like a
+				// tunnel response to isTunnelResponse.
+				// https://tools.ietf.org/html/rfc2308#section-2.2
+				resp.Authority = []dns.RR{soaRR(domain)}
+			}
+			return resp, nil
+		}
+	}
+
+	if len(prefix) == 0 && apexResponse == "nodata" {
+		// A query for the tunnel domain itself. Tunnel queries always
+		// have at least a ClientID before the domain, so this is not
+		// one; answer as for a name that exists.
+		soa := soaRR(domain)
+		if question.Type == dns.RRTypeSOA {
+			soa.Name = question.Name
+			resp.Answer = []dns.RR{soa}
+		} else {
+			// NODATA. https://tools.ietf.org/html/rfc2308#section-2.2
+			resp.Authority = []dns.RR{soa}
+		}
+		return resp, nil
+	}
+
+	if deepNameResponse == "nodata" && isDeepNonTunnelName(prefix) {
+		// Clearly not a tunnel query. NODATA, for every QTYPE, so that
+		// the name consistently seems to exist.
+		// https://tools.ietf.org/html/rfc2308#section-2.2
+		resp.Authority = []dns.RR{soaRR(domain)}
+		return resp, nil
+	}
+
+	if noDataHTTPS && (question.Type == dns.RRTypeHTTPS || question.Type == dns.RRTypeSVCB) {
+		// NODATA: the name exists, but has no records of this
+		// type. https://tools.ietf.org/html/rfc2308#section-2.2
+		return resp, nil
+	}
+
+	if !tunnelQTypes[question.Type] {
+		// Not a QTYPE we use for tunnel queries.
 		resp.Flags |= dns.RcodeNameError
 		// No log message here; it's common for recursive resolvers to
 		// send NS or A queries when the client only asked for a TXT. I
@@ -449,12 +1485,27 @@ func responseFor(query *dns.Message, domain dns.Name) (*dns.Message, []byte) {
 		return resp, nil
 	}
 
+	// Bound the amount of base32 to decode by what a name under domain
+	// can carry. dns.MessageFromWireFormat refuses names longer than 255
+	// octets, which cannot exceed the bound, but this does not depend on
+	// where the message came from.
+	encodedLen := 0
+	for _, label := range prefix {
+		encodedLen += len(label)
+	}
+	if n := base32Encoding.DecodedLen(encodedLen); n > maxUpstreamPayload(domain) {
+		resp.Flags |= dns.RcodeFormatError
+		queriesPayloadTooLong.Inc()
+		log.Printf("FORMERR: name encodes %d bytes", n)
+		return resp, nil
+	}
 	encoded := bytes.ToUpper(bytes.Join(prefix, nil))
 	payload := make([]byte, base32Encoding.DecodedLen(len(encoded)))
 	n, err := base32Encoding.Decode(payload, encoded)
 	if err != nil {
 		// Base32 error, make like the name doesn't exist.
 		resp.Flags |= dns.RcodeNameError
+		queriesUndecodable.With("base32").Inc()
 		log.Printf("NXDOMAIN: base32 decoding: %v", err)
 		return resp, nil
 	}
@@ -465,19 +1516,276 @@ func responseFor(query *dns.Message, domain dns.Name) (*dns.Message, []byte) {
 	// bytes). https://tools.ietf.org/html/rfc6891#section-7 "If there is a
 	// problem with processing the OPT record itself, such as an option
 	// value that is badly formatted or that includes out-of-range values, a
-	// FORMERR MUST be returned."
-	if payloadSize < maxUDPPayload {
+	// FORMERR MUST be returned." Over a stream transport, the response may
+	// be as large as connResponseSizeLimit allows regardless.
+	if !stream && payloadSize < maxUDPPayload {
 		resp.Flags |= dns.RcodeFormatError
-		log.Printf("FORMERR: requester payload size %d is too small (minimum %d)", payloadSize, maxUDPPayload)
+		if len(resp.Additional) == 0 {
+			log.Printf("FORMERR: query lacks EDNS(0) (see -experimental-no-edns)")
+		} else {
+			log.Printf("FORMERR: requester payload size %d is too small (minimum %d)", payloadSize, maxUDPPayload)
+		}
 		return resp, nil
 	}
 
 	return resp, payload
 }
 
-// record represents a DNS message appropriate for a response to a previously
-// received query, along with metadata necessary for sending the response.
-// recvLoop sends instances of record to sendLoop via a channel. sendLoop
+// chaosTXTNames are the CHAOS-class names answered when chaosTXT is set.
+var chaosTXTNames = []dns.Name{
+	{[]byte("version"), []byte("bind")},
+	{[]byte("hostname"), []byte("bind")},
+}
+
+// isChaosTXTQuery returns true if query is a standard query with one question,
+// for a CHAOS-class TXT record of one of chaosTXTNames, and chaosTXT is set
+// (and chaosRefuse is not) so that responseFor answers it.
+func isChaosTXTQuery(query *dns.Message) bool {
+	if chaosTXT == nil || chaosRefuse || query.Opcode() != 0 || len(query.Question) != 1 {
+		return false
+	}
+	question := query.Question[0]
+	return question.Class == dns.ClassCHAOS && question.Type == dns.RRTypeTXT && isChaosTXTName(question.Name)
+}
+
+// isChaosTXTName returns true if name is one of chaosTXTNames, ignoring case.
+func isChaosTXTName(name dns.Name) bool {
+	for _, chaosName := range chaosTXTNames {
+		if prefix, ok := name.TrimSuffix(chaosName); ok && len(prefix) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// soaRR returns an SOA resource record for domain, for the Authority section
+// of negative responses. Its MNAME is nsName, if set, or else domain itself.
+// Its MINIMUM, and its own TTL if smaller, are negativeTTL, if set.
+// https://tools.ietf.org/html/rfc2308#section-3
+func soaRR(domain dns.Name) dns.RR {
+	mname := nsName
+	if mname == nil {
+		mname = domain
+	}
+	rname := append(dns.Name{[]byte("hostmaster")}, domain...)
+	var ttl, minimum uint32 = responseTTL, responseTTL
+	if negativeTTL >= 0 {
+		minimum = uint32(negativeTTL)
+		// https://tools.ietf.org/html/rfc2308#section-3 "The TTL of
+		// this record is set from the minimum of the MINIMUM field of
+		// the SOA record and the TTL of the SOA itself".
+		if minimum < ttl {
+			ttl = minimum
+		}
+	}
+	return dns.RR{
+		Name:  domain,
+		Type:  dns.RRTypeSOA,
+		Class: dns.ClassIN,
+		TTL:   ttl,
+		// SERIAL, REFRESH, RETRY, EXPIRE, and MINIMUM. MINIMUM is
+		// the TTL of negative answers.
+		Data: dns.EncodeRDataSOA(mname, rname, 1, 3600, 600, 86400, minimum),
+	}
+}
+
+// addNegativeSOA adds soaRR(domain) to the Authority section of resp if
+// negativeTTL is set and resp is an authoritative NXDOMAIN that does not
+// already have an Authority section. It is the last step in building a
+// response in recvLoop, because tunnelResponseFor sets NXDOMAIN for payloads
+// too short to contain a ClientID.
+func addNegativeSOA(resp *dns.Message, domain dns.Name) {
+	if negativeTTL >= 0 && resp.Rcode() == dns.RcodeNameError &&
+		resp.Flags&0x0400 != 0 && len(resp.Authority) == 0 {
+		resp.Authority = []dns.RR{soaRR(domain)}
+	}
+}
+
+// isDeepNonTunnelName returns true if prefix, the labels of a query name that
+// come before the tunnel domain, cannot be those of a tunnel query because of
+// how they are laid out. dnstt-client breaks the encoded payload into labels
+// greedily, so in a tunnel query every label but the last is 63 octets long. A
+// name with a shorter label before its last one, like www.mail.DOMAIN, is not
+// a tunnel query, whatever its contents.
+func isDeepNonTunnelName(prefix dns.Name) bool {
+	for i := 0; i+1 < len(prefix); i++ {
+		if len(prefix[i]) != 63 {
+			return true
+		}
+	}
+	return false
+}
+
+// isAuthoritative returns true if query has exactly one question, and its name
+// is domain or a subdomain of domain, or it is a query that chaosTXT answers.
+func isAuthoritative(query *dns.Message, domain dns.Name) bool {
+	if len(query.Question) != 1 {
+		return false
+	}
+	if isChaosTXTQuery(query) {
+		return true
+	}
+	_, ok := query.Question[0].Name.TrimSuffix(domain)
+	return ok
+}
+
+// ednsOptionNSID is the EDNS option code for NSID.
+// https://tools.ietf.org/html/rfc5001#section-2.3
+const ednsOptionNSID = 3
+
+// hasEDNSOption returns true if the OPT RR data contains an option with the
+// given code. Malformed data after the last well-formed option is ignored.
+// https://tools.ietf.org/html/rfc6891#section-6.1.2
+func hasEDNSOption(data []byte, code uint16) bool {
+	for len(data) >= 4 {
+		optionLen := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+optionLen {
+			break
+		}
+		if binary.BigEndian.Uint16(data[0:2]) == code {
+			return true
+		}
+		data = data[4+optionLen:]
+	}
+	return false
+}
+
+// knownEDNSOptions are the EDNS option codes that -strict-edns-options permits
+// in queries: those that responseFor implements.
+var knownEDNSOptions = map[uint16]bool{
+	ednsOptionNSID: true,
+}
+
+// unknownEDNSOption returns the code of the first option in the OPT RR data
+// that is not in knownEDNSOptions, or nil if there is none. Unlike
+// hasEDNSOption, it returns an error if the data is not a well-formed list of
+// options.
+// https://tools.ietf.org/html/rfc6891#section-6.1.2
+func unknownEDNSOption(data []byte) (*uint16, error) {
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("%d trailing bytes", len(data))
+		}
+		code := binary.BigEndian.Uint16(data[0:2])
+		optionLen := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+optionLen {
+			return nil, fmt.Errorf("option %d length %d exceeds remaining %d bytes", code, optionLen, len(data)-4)
+		}
+		if !knownEDNSOptions[code] {
+			return &code, nil
+		}
+		data = data[4+optionLen:]
+	}
+	return nil, nil
+}
+
+// appendEDNSOption appends an option with the given code and value to the OPT
+// RR data, and returns the extended data.
+func appendEDNSOption(data []byte, code uint16, value []byte) []byte {
+	var header [4]byte
+	binary.BigEndian.PutUint16(header[0:2], code)
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(value)))
+	data = append(data, header[:]...)
+	return append(data, value...)
+}
+
+// nameWireLen returns the length of name in uncompressed wire format: a length
+// octet and the contents of each label, and a terminating zero octet.
+func nameWireLen(name dns.Name) int {
+	n := 1
+	for _, label := range name {
+		n += 1 + len(label)
+	}
+	return n
+}
+
+// maxUpstreamPayload returns the number of bytes that can be base32-encoded
+// into the labels of a query name under domain, without exceeding the maximum
+// name length. This is the same as dnsNameCapacity in dnstt-client.
+func maxUpstreamPayload(domain dns.Name) int {
+	capacity := 255 - nameWireLen(domain)
+	// Each label may be up to 63 bytes long and requires 64 bytes to
+	// encode.
+	capacity = capacity * 63 / 64
+	// Base32 expands every 5 bytes to 8.
+	return capacity * 5 / 8
+}
+
+// maxUpstreamPacket returns the size of the largest packet that a query name
+// under domain can carry: what fits in maxUpstreamPayload after the ClientID
+// and one length prefix, and no more than a length prefix can express.
+func maxUpstreamPacket(domain dns.Name) int {
+	n := maxUpstreamPayload(domain) - len(turbotunnel.ClientID{}) - 1
+	if n > 0xdf {
+		n = 0xdf
+	}
+	return n
+}
+
+// kcpMTU returns the MTU to give KCP when responses can carry at most
+// maxEncodedPayload bytes of encoded packets, or an error if that leaves too
+// little room.
+func kcpMTU(maxEncodedPayload int) (int, error) {
+	// 2 bytes accounts for a packet length prefix.
+	mtu := maxEncodedPayload - 2
+	if mtu < 80 {
+		if mtu < 0 {
+			mtu = 0
+		}
+		return 0, fmt.Errorf("maximum response size of %d leaves only %d bytes for payload", responseSizeLimit(), mtu)
+	}
+	return mtu, nil
+}
+
+// isTunnelResponse returns true if resp is a non-error response to a tunnel
+// query, as opposed to an error response or a response that responseFor has
+// already completed (like an answer to an NS query, or a NODATA response with
+// an SOA in the Authority section). sendLoop fills the Answer section of a
+// tunnel response with downstream data.
+func isTunnelResponse(resp *dns.Message) bool {
+	return resp.Rcode() == dns.RcodeNoError &&
+		len(resp.Question) == 1 &&
+		tunnelQTypes[resp.Question[0].Type] &&
+		len(resp.Answer) == 0 &&
+		len(resp.Authority) == 0
+}
+
+// supportedTunnelQTypes maps the name of each QTYPE that sendLoop can encode
+// downstream data in to its value. Only these may be used with -tunnel-qtype.
+var supportedTunnelQTypes = map[string]uint16{
+	"TXT": dns.RRTypeTXT,
+}
+
+// parseTunnelQTypes parses a comma-separated list of QTYPE names, as given to
+// the -tunnel-qtype option, into a set. Names are case-insensitive. It is an
+// error for the list to be empty or to contain a QTYPE that is not in
+// supportedTunnelQTypes.
+func parseTunnelQTypes(s string) (map[uint16]bool, error) {
+	qtypes := make(map[uint16]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		qtype, ok := supportedTunnelQTypes[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported QTYPE %+q", name)
+		}
+		qtypes[qtype] = true
+	}
+	if len(qtypes) == 0 {
+		return nil, fmt.Errorf("no QTYPEs given")
+	}
+	return qtypes, nil
+}
+
+// warmingUp is nonzero while recvLoop should answer tunnel queries with
+// SERVFAIL, during the -warmup period. Access it only with sync/atomic.
+var warmingUp int32
+
+// record represents a DNS message appropriate for a response to a previously
+// received query, along with metadata necessary for sending the response.
+// recvLoop sends instances of record to sendLoop via a channel. sendLoop
 // receives instances of record and may fill in the message's Answer section
 // before sending it.
 type record struct {
@@ -486,55 +1794,216 @@ type record struct {
 	ClientID turbotunnel.ClientID
 }
 
+// tunnelResponseFor is the part of handling a query that recvLoop and -replay
+// share. It runs query through responseForTransport, and splits the decoded
+// payload into a ClientID and the packet data that follows it. n is the number
+// of bytes of ClientID the payload contained, which is less than the length of
+// a ClientID if the payload is too short to contain one. In that case, if resp
+// would otherwise be a tunnel response, it is made an NXDOMAIN instead, and
+// tooShort is true. The caller applies its own per-client checks and then
+// calls addNegativeSOA.
+func tunnelResponseFor(query *dns.Message, domain dns.Name, stream bool) (resp *dns.Message, clientID turbotunnel.ClientID, n int, payload []byte, tooShort bool) {
+	resp, payload = responseForTransport(query, domain, stream)
+	n = copy(clientID[:], payload)
+	payload = payload[n:]
+	if n < len(clientID) && resp != nil && isTunnelResponse(resp) {
+		// An empty payload is usually a query for the tunnel domain
+		// itself; a short but nonempty one is more likely a client
+		// speaking a different protocol version. Both get the same
+		// NXDOMAIN as a base32 error, so that a prober learns nothing
+		// from the difference. (Unless the response is already
+		// complete, like an answer to an NS query.)
+		resp.Flags |= dns.RcodeNameError
+		tooShort = true
+	}
+	return resp, clientID, n, payload, tooShort
+}
+
 // recvLoop repeatedly calls dnsConn.ReadFrom, extracts the packets contained in
 // the incoming DNS queries, and puts them on ttConn's incoming queue. Whenever
 // a query calls for a response, constructs a partial response and passes it to
-// sendLoop over ch.
-func recvLoop(domain dns.Name, dnsConn net.PacketConn, ttConn *turbotunnel.QueuePacketConn, ch chan<- *record) error {
+// sendLoop over ch. Packets larger than maxPacketSize, the MTU of KCP, are
+// dropped; no query carries one unless maxPacketSize is less than
+// maxUpstreamPacket(domain). If limiter is not nil, queries from ClientIDs that
+// exceed its rate are dropped without a response.
+//
+// Packets from any one query are queued in the order they appear in the query,
+// and queries are processed in the order dnsConn returns them. But nothing
+// stops queries from a client from arriving in a different order than the
+// client sent them, and nothing here puts them back in order: KCP is
+// responsible for reordering (and deduplicating) the packets it gets from
+// ttConn. It is therefore safe to run several recvLoops on the same ttConn.
+//
+// recvLoop must be the only sender on ch, and it closes ch when it returns, so
+// that a sendLoop reading from ch stops. Closing ch anywhere else could race
+// with a send still in progress here.
+func recvLoop(domain dns.Name, dnsConn net.PacketConn, ttConn *turbotunnel.QueuePacketConn, ch chan<- *record, maxPacketSize int, limiter *clientRateLimiter) error {
+	defer close(ch)
+
+	// Count of packets dropped for being larger than maxPacketSize since
+	// the last log message about them.
+	var oversized int
+	var lastOversizedLog time.Time
+	// Likewise for packets dropped by checkPackets.
+	var implausible int
+	var lastImplausibleLog time.Time
+	// ClientIDs whose budget has been logged, used when
+	// debugUpstreamBudget is set.
+	budgetLogged := make(map[turbotunnel.ClientID]struct{})
+	// Where to send incoming packets: to KCP directly, or through a
+	// delayedIngester.
+	queueIncoming := ttConn.QueueIncoming
+	if ingestDelay > 0 {
+		ingester := newDelayedIngester(ttConn, ingestDelay)
+		defer ingester.Close()
+		queueIncoming = ingester.QueueIncoming
+	}
+	costSampler := queryCostSampler{every: queryCostSample}
+	var saturation *saturationMonitor
+	if saturationServfail {
+		saturation = newSaturationMonitor(dnsConn.LocalAddr().String())
+	}
+	stream := isStreamConn(dnsConn)
+	loopErrs := newLoopErrors("ReadFrom")
 	for {
-		var buf [4096]byte
+		var buf [maxQuerySize]byte
 		n, addr, err := dnsConn.ReadFrom(buf[:])
 		if err != nil {
-			if err, ok := err.(net.Error); ok && err.Temporary() {
-				log.Printf("ReadFrom temporary error: %v", err)
-				continue
+			if err := loopErrs.Check(err, time.Now()); err != nil {
+				return err
 			}
-			return err
+			continue
+		}
+		loopErrs.Success()
+
+		var costStart time.Time
+		sampled := costSampler.Sample()
+		if sampled {
+			costStart = time.Now()
 		}
 
-		// Got a UDP packet. Try to parse it as a DNS message.
+		// Got a packet. Try to parse it as a DNS message.
 		query, err := dns.MessageFromWireFormat(buf[:n])
 		if err != nil {
+			if sampled {
+				recordQueryCost(addr, time.Since(costStart))
+			}
 			log.Printf("cannot parse DNS query: %v", err)
 			continue
 		}
+		queriesReceived.Inc()
+		if atomic.LoadInt32(&logQueries) != 0 {
+			logQuery(addr, &query)
+		}
 
-		resp, payload := responseFor(&query, domain)
-		// Extract the ClientID from the payload.
-		var clientID turbotunnel.ClientID
-		n = copy(clientID[:], payload)
-		payload = payload[n:]
+		resp, clientID, n, payload, tooShort := tunnelResponseFor(&query, domain, stream)
+		if sampled {
+			recordQueryCost(addr, time.Since(costStart))
+		}
+		decodedLen := n + len(payload)
 		if n == len(clientID) {
+			if bannedClientIDs.Contains(clientID) {
+				// Banned with -ban-file. Drop the query
+				// without a response.
+				continue
+			}
+			if limiter != nil && !limiter.Allow(clientID, time.Now()) {
+				// Over the rate limit. Drop the query before
+				// doing any more work on it.
+				continue
+			}
+			if sessionCooldown > 0 && !sessions.HasClientID(clientID) && !sessionCooldowns.Allow(clientID, time.Now()) {
+				// Would start a new session too soon after
+				// the last one. Drop the query without a
+				// response.
+				continue
+			}
+			if atomic.LoadInt32(&warmingUp) != 0 {
+				// Still in the -warmup period. Answer with
+				// SERVFAIL and ignore the packets; the client
+				// will send them again.
+				resp.Flags |= dns.RcodeServerFailure
+				payload = nil
+			} else if atomic.LoadInt32(&maintenance) != 0 && !sessions.HasClientID(clientID) {
+				// In maintenance mode, and this client has no
+				// session to finish. Answer with SERVFAIL and
+				// ignore the packets, so that KCP never sees a
+				// new session.
+				resp.Flags |= dns.RcodeServerFailure
+				payload = nil
+			} else if saturation != nil && saturation.Check(time.Now(), len(ch) >= cap(ch)) && !sessions.HasClientID(clientID) {
+				// Saturated, and this client would need a new
+				// session. As in maintenance mode, answer with
+				// SERVFAIL and ignore the packets.
+				resp.Flags |= dns.RcodeServerFailure
+				payload = nil
+				queriesSaturated.Inc()
+			}
 			// Discard padding and pull out the packets contained in
-			// the payload.
+			// the payload. A payload that contains nothing after the
+			// ClientID (or only padding) is valid: it is a polling
+			// query, sent only to give us a chance to send downstream
+			// data in the response.
 			r := bytes.NewReader(payload)
+			packetLen := 0
 			for {
 				p, err := nextPacket(r)
 				if err != nil {
 					break
 				}
+				packetLen += len(p)
+				if len(p) == 0 {
+					// There's no use in giving KCP an
+					// empty packet.
+					continue
+				}
+				if len(p) > maxPacketSize {
+					// KCP would reject or misparse a
+					// packet larger than its MTU; don't
+					// even give it the chance.
+					packetsOversized.Inc()
+					oversized++
+					if now := time.Now(); now.Sub(lastOversizedLog) >= oversizedLogInterval {
+						log.Printf("dropped %d packets larger than %d bytes", oversized, maxPacketSize)
+						oversized = 0
+						lastOversizedLog = now
+					}
+					continue
+				}
+				if checkPackets && !plausibleKCPPacket(p) {
+					// Not a KCP packet. Answer the query
+					// as usual, but don't give the packet
+					// to KCP.
+					packetsImplausible.Inc()
+					implausible++
+					if now := time.Now(); now.Sub(lastImplausibleLog) >= oversizedLogInterval {
+						log.Printf("dropped %d packets that are not KCP packets", implausible)
+						implausible = 0
+						lastImplausibleLog = now
+					}
+					continue
+				}
 				// Feed the incoming packet to KCP.
-				ttConn.QueueIncoming(p, clientID)
+				queueIncoming(p, clientID)
 			}
-		} else {
+			if _, ok := budgetLogged[clientID]; debugUpstreamBudget && packetLen > 0 && !ok {
+				budgetLogged[clientID] = struct{}{}
+				logUpstreamBudget(clientID, query.Question[0].Name, domain, decodedLen, packetLen)
+			}
+		} else if tooShort {
 			// Payload is not long enough to contain a ClientID.
-			if resp != nil && resp.Rcode() == dns.RcodeNoError {
-				resp.Flags |= dns.RcodeNameError
-				log.Printf("NXDOMAIN: %d bytes are too short to contain a ClientID", n)
+			// Empty and short payloads get the same NXDOMAIN, but
+			// they are counted separately.
+			if n == 0 {
+				queriesUndecodable.With("empty").Inc()
+			} else {
+				queriesUndecodable.With("short").Inc()
 			}
+			log.Printf("NXDOMAIN: %d bytes are too short to contain a ClientID", n)
 		}
 		// If a response is called for, pass it to sendLoop via the channel.
 		if resp != nil {
+			addNegativeSOA(resp, domain)
 			select {
 			case ch <- &record{resp, addr, clientID}:
 			default:
@@ -543,11 +2012,50 @@ func recvLoop(domain dns.Name, dnsConn net.PacketConn, ttConn *turbotunnel.Queue
 	}
 }
 
+// repeatedBundle is a downstream payload remembered by sendLoop for the
+// purpose of -repeat-downstream.
+type repeatedBundle struct {
+	Payload []byte
+	Sent    time.Time
+}
+
+// logUpstreamBudget logs how the query name name, from clientID, is divided
+// between the tunnel domain, base32 and label overhead, the ClientID, padding
+// and length prefixes, and packetLen bytes of packet data, along with the
+// greatest amount of packet data that a query with the same overhead could
+// carry. decodedLen is the length of the payload decoded from name.
+func logUpstreamBudget(clientID turbotunnel.ClientID, name, domain dns.Name, decodedLen, packetLen int) {
+	nameLen := nameWireLen(name)
+	domainLen := nameWireLen(domain)
+	framing := decodedLen - len(clientID) - packetLen
+	room := maxUpstreamPayload(domain) - len(clientID) - framing
+	log.Printf("upstream budget %v: name %d of 255 bytes: domain %d, encoding %d, ClientID %d, padding and prefixes %d, packets %d; room for %d bytes of packets per query",
+		clientID, nameLen, domainLen, nameLen-domainLen-decodedLen,
+		len(clientID), framing, packetLen, room)
+}
+
 // sendLoop repeatedly receives records from ch. Those that represent an error
 // response, it sends on the network immediately. Those that represent a
 // response capable of carrying data, it packs full of as many packets as will
-// fit while keeping the total size under maxEncodedPayload, then sends it.
-func sendLoop(dnsConn net.PacketConn, ttConn *turbotunnel.QueuePacketConn, ch <-chan *record, maxEncodedPayload int) error {
+// fit while keeping the total size under maxEncodedPayload, then sends it. clk
+// controls the timing of responses.
+func sendLoop(dnsConn net.PacketConn, ttConn *turbotunnel.QueuePacketConn, ch <-chan *record, maxEncodedPayload int, clk clock) error {
+	// Most recent non-empty bundle per ClientID, used when
+	// repeatDownstream is set.
+	lastBundles := make(map[turbotunnel.ClientID]repeatedBundle)
+	lastSweep := clk.Now()
+	// Count of responses per ClientID, used when debugBundles is set.
+	bundleSeqs := make(map[turbotunnel.ClientID]uint64)
+	loopErrs := newLoopErrors("WriteTo")
+	// With sendWorkers, responses are serialized and sent by a pool of
+	// workers, while bundling stays in this goroutine.
+	var pool *sendPool
+	if sendWorkers > 0 {
+		pool = newSendPool(sendWorkers, sendQueueLen, func(rec *record, loopErrs *loopErrors) error {
+			return sendResponse(dnsConn, rec, loopErrs, clk)
+		})
+	}
+
 	var nextRec *record
 	for {
 		rec := nextRec
@@ -561,15 +2069,25 @@ func sendLoop(dnsConn net.PacketConn, ttConn *turbotunnel.QueuePacketConn, ch <-
 			}
 		}
 
-		if rec.Resp.Rcode() == dns.RcodeNoError && len(rec.Resp.Question) == 1 {
-			// If it's a non-error response, we can fill the Answer
-			// section with downstream packets.
+		if isTunnelResponse(rec.Resp) {
+			// If it's a non-error response to a tunnel query, we
+			// can fill the Answer section with downstream packets.
 
 			// Any changes to how responses are built need to happen
 			// also in computeMaxEncodedPayload.
+			//
+			// All downstream data goes in a single Answer RR. It
+			// would not help to carry packets that overflow the
+			// Answer RR in a second TXT RR in the Additional
+			// section: maxEncodedPayload is a budget for the whole
+			// message, not for the Answer section, so the second
+			// RR would draw from the same budget and additionally
+			// cost at least 12 bytes of RR header (a compressed or
+			// root owner name, TYPE, CLASS, TTL, RDLENGTH) and a
+			// character-string length octet.
 			rec.Resp.Answer = []dns.RR{
 				{
-					Name:  rec.Resp.Question[0].Name,
+					Name:  answerOwnerName(rec.Resp.Question[0].Name),
 					Type:  rec.Resp.Question[0].Type,
 					Class: rec.Resp.Question[0].Class,
 					TTL:   responseTTL,
@@ -579,36 +2097,64 @@ func sendLoop(dnsConn net.PacketConn, ttConn *turbotunnel.QueuePacketConn, ch <-
 
 			var payload bytes.Buffer
 			limit := maxEncodedPayload
+			// For debugBundles: when we started waiting, the
+			// lengths of the packets bundled, the length of a
+			// packet stashed for later (-1 if none), and whether
+			// the bundle is a repeat.
+			bundleStart := clk.Now()
+			var bundleLengths []int
+			bundleStashed := -1
+			bundleRepeated := false
 			// We loop and bundle as many packets from OutgoingQueue
 			// into the response as will fit. Any packet that would
 			// overflow the capacity of the DNS response, we stash
 			// to be bundled into a future response.
-			timer := time.NewTimer(maxResponseDelay)
+			timer := clk.NewTimer(emptyResponseDelay)
 		loop:
 			for {
 				var p []byte
-				select {
-				// Check the nextRec, timer, and stash cases
-				// before considering the OutgoingQueue case.
-				// Only if all these cases fail do we enter the
-				// default arm, where they are checked again in
-				// addition to OutgoingQueue.
-				case nextRec = <-ch:
-					// If there's another response waiting
-					// to be sent, wait no longer for a
-					// payload for this one.
-					break loop
-				case <-timer.C:
-					break loop
-				case p = <-ttConn.Unstash(rec.ClientID):
-				default:
+				if emptyResponseDelay == 0 {
+					// Don't wait at all, but take the
+					// packets that are already queued. A
+					// timer of 0 is ready at once, and
+					// would always win the select below
+					// against them.
+					select {
+					case p = <-ttConn.Unstash(rec.ClientID):
+					default:
+						select {
+						case p = <-ttConn.Unstash(rec.ClientID):
+						case p = <-ttConn.OutgoingQueue(rec.ClientID):
+						default:
+							break loop
+						}
+					}
+				} else {
 					select {
+					// Check the nextRec, timer, and stash
+					// cases before considering the
+					// OutgoingQueue case. Only if all these
+					// cases fail do we enter the default
+					// arm, where they are checked again in
+					// addition to OutgoingQueue.
 					case nextRec = <-ch:
+						// If there's another response
+						// waiting to be sent, wait no
+						// longer for a payload for this
+						// one.
 						break loop
-					case <-timer.C:
+					case <-timer.C():
 						break loop
 					case p = <-ttConn.Unstash(rec.ClientID):
-					case p = <-ttConn.OutgoingQueue(rec.ClientID):
+					default:
+						select {
+						case nextRec = <-ch:
+							break loop
+						case <-timer.C():
+							break loop
+						case p = <-ttConn.Unstash(rec.ClientID):
+						case p = <-ttConn.OutgoingQueue(rec.ClientID):
+						}
 					}
 				}
 				// We wait for the first packet in a bundle
@@ -627,6 +2173,7 @@ func sendLoop(dnsConn net.PacketConn, ttConn *turbotunnel.QueuePacketConn, ch <-
 					// Stash this packet to send in the next
 					// response.
 					ttConn.Stash(p, rec.ClientID)
+					bundleStashed = len(p)
 					break loop
 				}
 				if int(uint16(len(p))) != len(p) {
@@ -634,38 +2181,170 @@ func sendLoop(dnsConn net.PacketConn, ttConn *turbotunnel.QueuePacketConn, ch <-
 				}
 				binary.Write(&payload, binary.BigEndian, uint16(len(p)))
 				payload.Write(p)
+				if debugBundles {
+					bundleLengths = append(bundleLengths, len(p))
+				}
 			}
 			timer.Stop()
 
+			if repeatDownstream {
+				now := clk.Now()
+				if payload.Len() > 0 {
+					lastBundles[rec.ClientID] = repeatedBundle{
+						Payload: append([]byte(nil), payload.Bytes()...),
+						Sent:    now,
+					}
+				} else if last, ok := lastBundles[rec.ClientID]; ok && now.Sub(last.Sent) < repeatWindow {
+					// Nothing new to send; repeat the
+					// previous bundle, but only once.
+					payload.Write(last.Payload)
+					delete(lastBundles, rec.ClientID)
+					bundleRepeated = true
+				}
+				if now.Sub(lastSweep) >= repeatWindow {
+					for clientID, last := range lastBundles {
+						if now.Sub(last.Sent) >= repeatWindow {
+							delete(lastBundles, clientID)
+						}
+					}
+					lastSweep = now
+				}
+			}
+
+			if debugBundles {
+				seq := bundleSeqs[rec.ClientID]
+				bundleSeqs[rec.ClientID] = seq + 1
+				log.Printf("bundle %v %d: delay %v, packet lengths %v, stashed %d, repeated %v",
+					rec.ClientID, seq, clk.Now().Sub(bundleStart),
+					bundleLengths, bundleStashed, bundleRepeated)
+			}
+
 			rec.Resp.Answer[0].Data = dns.EncodeRDataTXT(payload.Bytes())
 		}
 
-		buf, err := rec.Resp.WireFormat()
-		if err != nil {
-			log.Printf("resp WireFormat: %v", err)
+		if pool != nil {
+			if err := pool.Err(); err != nil {
+				pool.Close()
+				return err
+			}
+			if !pool.Submit(rec) {
+				responsesDropped.Inc()
+			}
 			continue
 		}
-		// Truncate if necessary.
-		// https://tools.ietf.org/html/rfc1035#section-4.1.1
-		if len(buf) > maxUDPPayload {
-			log.Printf("truncating response of %d bytes to max of %d", len(buf), maxUDPPayload)
-			buf = buf[:maxUDPPayload]
-			buf[2] |= 0x02 // TC = 1
+		if err := sendResponse(dnsConn, rec, loopErrs, clk); err != nil {
+			return err
 		}
+	}
+	if pool != nil {
+		// Wait for the queued responses to be sent.
+		pool.Close()
+		return pool.Err()
+	}
+	return nil
+}
+
+// sendResponse serializes rec.Resp, truncating it if necessary, and sends it
+// to rec.Addr on dnsConn. It returns an error only if loopErrs says the error
+// from WriteTo is fatal.
+func sendResponse(dnsConn net.PacketConn, rec *record, loopErrs *loopErrors, clk clock) error {
+	buf, err := rec.Resp.WireFormat()
+	if err != nil {
+		log.Printf("resp WireFormat: %v", err)
+		return nil
+	}
+	// Truncate if necessary.
+	// https://tools.ietf.org/html/rfc1035#section-4.1.1
+	truncated := false
+	if limit := connResponseSizeLimit(dnsConn); len(buf) > limit {
+		log.Printf("truncating response of %d bytes to max of %d", len(buf), limit)
+		if dropped := truncatedAnswerBytes(rec.Resp, limit); dropped > 0 {
+			// Cutting into the Answer section loses downstream
+			// data, which KCP will have to retransmit. That is a
+			// sign of a misconfigured MTU or payload size, not of
+			// a merely large response.
+			responsesAnswerTruncated.Inc()
+			log.Printf("%v: dropped %d bytes of downstream data: response of %d bytes exceeds limit of %d", rec.ClientID, dropped, len(buf), limit)
+		}
+		buf = buf[:limit]
+		buf[2] |= 0x02 // TC = 1
+		truncated = true
+	}
 
-		// Now we actually send the message as a UDP packet.
-		_, err = dnsConn.WriteTo(buf, rec.Addr)
+	// Now we actually send the message as a UDP packet.
+	_, err = dnsConn.WriteTo(buf, rec.Addr)
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		// An ICMP port unreachable from an earlier send, to this or
+		// another requester, reported on this one. The socket is fine,
+		// so do not let it count toward -max-consecutive-errors, as a
+		// run of departed requesters could otherwise stop sendLoop.
+		responsesSendRefused.Inc()
+		if debugSendRefused {
+			log.Printf("send to %v refused: %v", rec.Addr, err)
+		}
+		return nil
+	} else if err != nil {
+		return loopErrs.Check(err, clk.Now())
+	}
+	loopErrs.Success()
+
+	responseSizes.With(rcodeString(extendedRcode(rec.Resp)), strconv.FormatBool(truncated)).Observe(uint64(len(buf)))
+	if accessLog != nil {
+		err := accessLog.Log(clk.Now(), rec.Addr, rec.Resp, len(buf), truncated)
 		if err != nil {
-			if err, ok := err.(net.Error); ok && err.Temporary() {
-				log.Printf("WriteTo temporary error: %v", err)
-				continue
-			}
-			return err
+			log.Printf("access log: %v", err)
 		}
 	}
 	return nil
 }
 
+// truncatedAnswerBytes returns how many bytes of the Answer section of resp
+// would be lost if its wire format were truncated to limit bytes: 0 if
+// truncation would remove only the Authority and Additional sections.
+func truncatedAnswerBytes(resp *dns.Message, limit int) int {
+	if len(resp.Answer) == 0 {
+		return 0
+	}
+	// The wire format of resp up to the start and the end of the Answer
+	// section. Later sections do not affect the encoding of earlier ones.
+	m := *resp
+	m.Answer, m.Authority, m.Additional = nil, nil, nil
+	start, err := m.WireFormat()
+	if err != nil {
+		return 0
+	}
+	m.Answer = resp.Answer
+	end, err := m.WireFormat()
+	if err != nil {
+		return 0
+	}
+	if limit >= len(end) {
+		return 0
+	}
+	if limit < len(start) {
+		limit = len(start)
+	}
+	return len(end) - limit
+}
+
+// responseSizeLimit returns the maximum size of a response: maxUDPPayload, or
+// maxResponseSize if it is set and smaller.
+func responseSizeLimit() int {
+	if maxResponseSize > 0 && maxResponseSize < maxUDPPayload {
+		return maxResponseSize
+	}
+	return maxUDPPayload
+}
+
+// answerOwnerName returns the owner name for the Answer RR in a response to a
+// question for name, according to experimentalAnswerName.
+func answerOwnerName(name dns.Name) dns.Name {
+	if experimentalAnswerName == "root" {
+		return dns.Name{}
+	}
+	return name
+}
+
 // computeMaxEncodedPayload computes the maximum amount of downstream TXT RR
 // data that keep the overall response size less than maxUDPPayload, in the
 // worst case when the response answers a query that has a maximum-length name
@@ -690,10 +2369,6 @@ func computeMaxEncodedPayload(limit int) int {
 			len(maxLengthName.String())+2, 255, maxLengthName))
 	}
 
-	queryLimit := uint16(limit)
-	if int(queryLimit) != limit {
-		queryLimit = 0xffff
-	}
 	query := &dns.Message{
 		Question: []dns.Question{
 			{
@@ -702,14 +2377,18 @@ func computeMaxEncodedPayload(limit int) int {
 				Class: dns.RRTypeTXT,
 			},
 		},
-		// EDNS(0)
+		// EDNS(0). Advertise the maximum UDP payload size, so that
+		// responseFor does not reject the query when limit is less than
+		// maxUDPPayload (with -max-response-size).
 		Additional: []dns.RR{
 			{
 				Name:  dns.Name{},
 				Type:  dns.RRTypeOPT,
-				Class: queryLimit, // requester's UDP payload size
-				TTL:   0,          // extended RCODE and flags
-				Data:  []byte{},
+				Class: 0xffff, // requester's UDP payload size
+				TTL:   0,      // extended RCODE and flags
+				// Request NSID, so that the response has room
+				// for it if nsid is set.
+				Data: appendEDNSOption(nil, ednsOptionNSID, nil),
 			},
 		},
 	}
@@ -717,7 +2396,7 @@ func computeMaxEncodedPayload(limit int) int {
 	// As in sendLoop.
 	resp.Answer = []dns.RR{
 		{
-			Name:  query.Question[0].Name,
+			Name:  answerOwnerName(query.Question[0].Name),
 			Type:  query.Question[0].Type,
 			Class: query.Question[0].Class,
 			TTL:   responseTTL,
@@ -726,17 +2405,15 @@ func computeMaxEncodedPayload(limit int) int {
 	}
 
 	// Binary search to find the maximum payload length that does not result
-	// in a wire-format message whose length exceeds the limit.
+	// in a wire-format message whose length exceeds the limit. A payload
+	// too large for the 16-bit RDLENGTH is also too large.
 	low := 0
-	high := 32768
+	high := 0x10000
 	for low+1 < high {
 		mid := (low + high) / 2
 		resp.Answer[0].Data = dns.EncodeRDataTXT(make([]byte, mid))
 		buf, err := resp.WireFormat()
-		if err != nil {
-			panic(err)
-		}
-		if len(buf) <= limit {
+		if err == nil && len(buf) <= limit {
 			low = mid
 		} else {
 			high = mid
@@ -746,70 +2423,174 @@ func computeMaxEncodedPayload(limit int) int {
 	return low
 }
 
-func run(privkey, pubkey []byte, domain dns.Name, upstream string, dnsConn net.PacketConn) error {
-	defer dnsConn.Close()
+// run serves the tunnel for domain on dnsConns, which the caller has already
+// opened: they may be UDP sockets, tcpPacketConns, dohPacketConns,
+// wsPacketConns, or any other net.PacketConn that carries DNS messages and
+// meets the requirements described at registerTransport. run takes ownership
+// of dnsConns and closes them before returning. It returns when reading from
+// any of them fails.
+func run(keys noise.KeyProvider, domain dns.Name, upstream *upstreamDialer, dnsConns []net.PacketConn) error {
+	// Wait for every sendLoop to finish before returning (deferred first,
+	// so it runs after dnsConns are closed).
+	var sendLoops sync.WaitGroup
+	defer sendLoops.Wait()
+	for _, dnsConn := range dnsConns {
+		defer dnsConn.Close()
+	}
 
-	log.Printf("pubkey %x", pubkey)
+	log.Printf("pubkey %x", keys.Pubkey())
+
+	if err := checkUpstreamLoops(upstream, dnsConns); err != nil {
+		return err
+	}
 
 	// We have a variable amount of room in which to encode downstream
 	// packets in each response, because each response must contain the
 	// query's Question section, which is of variable length. But we cannot
 	// give dynamic packet size limits to KCP; the best we can do is set a
 	// global maximum which no packet will exceed. We choose that maximum to
-	// keep the UDP payload size under maxUDPPayload, even in the worst case
-	// of a maximum-length name in the query's Question section.
-	maxEncodedPayload := computeMaxEncodedPayload(maxUDPPayload)
-	// 2 bytes accounts for a packet length prefix.
-	mtu := maxEncodedPayload - 2
-	if mtu < 80 {
-		if mtu < 0 {
-			mtu = 0
-		}
-		return fmt.Errorf("maximum UDP payload size of %d leaves only %d bytes for payload", maxUDPPayload, mtu)
+	// keep the UDP payload size under responseSizeLimit(), even in the
+	// worst case of a maximum-length name in the query's Question section.
+	maxEncodedPayload := computeMaxEncodedPayload(responseSizeLimit())
+	mtu, err := kcpMTU(maxEncodedPayload)
+	if err != nil {
+		return err
+	}
+	log.Printf("response size limit %d, maximum encoded payload %d, effective MTU %d", responseSizeLimit(), maxEncodedPayload, mtu)
+	// recvLoop drops incoming packets larger than KCP's MTU, which can
+	// only happen when the MTU is less than the largest packet a query can
+	// carry, with a small -mtu or -max-response-size.
+	if n := maxUpstreamPacket(domain); mtu < n {
+		log.Printf("incoming packets larger than %d bytes, of up to %d, will be dropped", mtu, n)
 	}
-	log.Printf("effective MTU %d", mtu)
 
 	// Start up the virtual PacketConn for turbotunnel.
-	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, idleTimeout*2)
+	ttConn := turbotunnel.NewQueuePacketConnFunc(turbotunnel.DummyAddr{}, clientIDTimeoutFunc(idleTimeout*2))
+	registerClientIDMetrics(ttConn)
 	ln, err := kcp.ServeConn(nil, 0, 0, ttConn)
 	if err != nil {
 		return fmt.Errorf("opening KCP listener: %v", err)
 	}
 	defer ln.Close()
+	var pool *streamPool
+	if streamWorkers > 0 {
+		pool = newStreamPool(streamWorkers, streamWorkers*streamQueueFactor)
+	}
 	go func() {
-		err := acceptSessions(ln, privkey, pubkey, mtu, upstream)
+		err := acceptSessions(ln, keys, mtu, upstream, pool)
 		if err != nil {
 			log.Printf("acceptSessions: %v", err)
 		}
 	}()
 
-	ch := make(chan *record, 100)
-	defer close(ch)
+	if warmup > 0 {
+		atomic.StoreInt32(&warmingUp, 1)
+		log.Printf("warming up for %v", warmup)
+		time.AfterFunc(warmup, func() {
+			atomic.StoreInt32(&warmingUp, 0)
+			log.Printf("warm-up finished; accepting tunnel queries")
+		})
+	}
 
-	// We could run multiple copies of sendLoop; that would allow more time
-	// for each response to collect downstream data before being evicted by
-	// another response that needs to be sent.
-	go func() {
-		err := sendLoop(dnsConn, ttConn, ch, maxEncodedPayload)
-		if err != nil {
-			log.Printf("sendLoop: %v", err)
+	if statsInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go logStats(statsInterval, done)
+	}
+
+	var limiter *clientRateLimiter
+	if maxClientQueryRate > 0 {
+		limiter = newClientRateLimiter(maxClientQueryRate, maxClientQueryRate)
+	}
+
+	// Each dnsConn gets its own recvLoop and sendLoop, all feeding the
+	// same ttConn. Return when any recvLoop returns.
+	errCh := make(chan error, len(dnsConns))
+	for _, dnsConn := range dnsConns {
+		ch := make(chan *record, 100)
+
+		// Responses over TCP may be larger than over UDP, and so carry
+		// more packets; but the packets themselves are no larger, as
+		// KCP has the one mtu for all of dnsConns.
+		connMaxEncodedPayload := maxEncodedPayload
+		if limit := connResponseSizeLimit(dnsConn); limit != responseSizeLimit() {
+			connMaxEncodedPayload = computeMaxEncodedPayload(limit)
+			log.Printf("%v: response size limit %d, maximum encoded payload %d", dnsConn.LocalAddr(), limit, connMaxEncodedPayload)
 		}
-	}()
 
-	return recvLoop(domain, dnsConn, ttConn, ch)
+		// We could run multiple copies of sendLoop; that would allow
+		// more time for each response to collect downstream data before
+		// being evicted by another response that needs to be sent.
+		sendLoops.Add(1)
+		go func(dnsConn net.PacketConn) {
+			defer sendLoops.Done()
+			err := sendLoop(dnsConn, ttConn, ch, connMaxEncodedPayload, realClock{})
+			if err != nil {
+				log.Printf("sendLoop: %v", err)
+			}
+		}(dnsConn)
+
+		go func(dnsConn net.PacketConn) {
+			errCh <- recvLoop(domain, dnsConn, ttConn, ch, mtu, limiter)
+		}(dnsConn)
+	}
+	return <-errCh
 }
 
 func main() {
+	var accessLogFilename string
+	var accessLogNames bool
+	var banFilename string
+	var base32Alphabet string
+	var bootstrapURL string
+	var certFilename string
+	var chaosTXTString string
+	var debugAddr string
+	var deniedUpstreamRangesString string
+	var denyPrivateUpstream bool
+	var dohAddr string
+	var dohSNIString string
+	var dotAddr string
+	var ednsForbidFlagsUint uint
+	var ednsReflectFlagsUint uint
+	var ednsRequireFlagsUint uint
+	var ephemeralPubkeyFilename string
+	var expiryFilename string
 	var genKey bool
+	var keyFilename string
+	var keyProviderSpec string
+	var listenFamily string
+	var logQueriesFlag bool
+	var metricsAddr string
+	var nsNameString string
+	var nsidString string
 	var privkeyFilename string
 	var privkeyString string
 	var pubkeyFilename string
+	var replayFilename string
+	var streamHandlerSpec string
+	var tcpAddr string
+	var transportSpec string
+	var tunnelQTypeString string
 	var udpAddr string
+	var udpSource string
+	var upstreamMuxFlag bool
+	var verifyDelegationAddr string
+	var wsAddr string
+	var wsPath string
+	var zoneFilename string
+
+	if hostname, err := os.Hostname(); err == nil {
+		instanceID = hostname
+	}
 
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), `Usage:
   %[1]s -gen-key -privkey-file PRIVKEYFILE -pubkey-file PUBKEYFILE
   %[1]s -udp ADDR -privkey-file PRIVKEYFILE DOMAIN UPSTREAMADDR
+  %[1]s -ws ADDR -privkey-file PRIVKEYFILE DOMAIN UPSTREAMADDR
+  %[1]s -udp ADDR -privkey-file PRIVKEYFILE -bootstrap URL
+  %[1]s -replay QUERYFILE DOMAIN
 
 Example:
   %[1]s -gen-key -privkey-file server.key -pubkey-file server.pub
@@ -818,40 +2599,334 @@ Example:
 `, os.Args[0])
 		flag.PrintDefaults()
 	}
+	flag.StringVar(&accessLogFilename, "access-log", "", "append a line for every response to file")
+	flag.BoolVar(&accessLogNames, "access-log-names", false, "with -access-log, log query names instead of hashes of them")
+	flag.StringVar(&apexResponse, "apex-response", apexResponse, "answer queries for DOMAIN itself with \"nxdomain\" or \"nodata\"")
+	flag.StringVar(&banFilename, "ban-file", "", "drop queries from the hex ClientIDs listed in file (reloaded on SIGHUP)")
+	flag.StringVar(&base32Alphabet, "base32-alphabet", dns.Base32StdAlphabet, "32 letters and digits to decode query names with, instead of the standard base32 alphabet (clients must use the same)")
+	flag.StringVar(&bootstrapURL, "bootstrap", "", "read DOMAIN and UPSTREAMADDR from a JSON document at this http, https, or file URL")
+	flag.StringVar(&certFilename, "cert", "", "with -dot or -doh, TLS certificate file (PEM)")
+	flag.BoolVar(&chaosRefuse, "chaos-refuse", chaosRefuse, "answer CHAOS-class queries with REFUSED")
+	flag.StringVar(&chaosTXTString, "chaos-txt", "", "answer CHAOS TXT queries for version.bind and hostname.bind with this string (may be empty)")
+	flag.BoolVar(&checkPackets, "check-packets", checkPackets, "drop incoming packets that cannot be KCP packets instead of passing them to KCP")
+	flag.StringVar(&expiryFilename, "clientid-expiry-file", "", "forget idle ClientIDs after durations listed by ClientID prefix in file (reloaded on SIGHUP)")
+	flag.StringVar(&debugAddr, "debug-addr", "", "TCP address on which to serve /debug/sessions over HTTP, apart from -metrics (for -metrics-backend statsd)")
+	flag.BoolVar(&debugBundles, "debug-bundles", debugBundles, "log the lengths of the packets in every response (verbose)")
+	flag.BoolVar(&debugSendRefused, "debug-send-refused", debugSendRefused, "log every response whose send fails with ECONNREFUSED (otherwise only counted)")
+	flag.BoolVar(&debugTLS, "debug-tls", debugTLS, "log the TLS version and cipher suite, or handshake error, of every -dot connection")
+	flag.BoolVar(&debugUpstreamBudget, "debug-upstream-budget", debugUpstreamBudget, "log how the query name is spent, once per client")
+	flag.StringVar(&deepNameResponse, "deep-name-response", deepNameResponse, "answer queries for names below DOMAIN that cannot be tunnel queries with \"nxdomain\" or \"nodata\"")
+	flag.StringVar(&deniedUpstreamRangesString, "denied-upstream-ranges", defaultDeniedUpstreamRanges, "with -deny-private-upstream, comma-separated CIDR ranges to refuse")
+	flag.BoolVar(&denyPrivateUpstream, "deny-private-upstream", false, "refuse to connect to upstream addresses in private, loopback, and link-local ranges")
+	flag.StringVar(&dohAddr, "doh", "", "TCP address to listen on for DNS over HTTPS (over plain HTTP without -cert and -key)")
+	flag.StringVar(&dohSNIString, "doh-sni", "", "with -doh, -cert, and -key, comma-separated server names to complete the TLS handshake for")
+	flag.StringVar(&dotAddr, "dot", "", "TCP address to listen on for DNS over TLS (port 853 if none is given)")
+	flag.IntVar(&downloadBuffer, "download-buffer", downloadBuffer, "read up to this many bytes ahead from the upstream of each stream (0 to read only as fast as the stream is written)")
+	flag.UintVar(&ednsForbidFlagsUint, "edns-forbid-flags", uint(ednsForbidFlags), "refuse queries with any of these EDNS flags set (e.g. 0x8000 for DO)")
+	flag.UintVar(&ednsReflectFlagsUint, "edns-reflect-flags", uint(ednsReflectFlags), "copy these EDNS flags from queries to responses (e.g. 0x8000 for DO)")
+	flag.UintVar(&ednsRequireFlagsUint, "edns-require-flags", uint(ednsRequireFlags), "refuse queries without all of these EDNS flags set (e.g. 0x8000 for DO)")
+	flag.DurationVar(&emptyResponseDelay, "empty-response-delay", emptyResponseDelay, "wait at most this long for downstream data before sending an empty response (at most 1s)")
+	flag.StringVar(&ephemeralPubkeyFilename, "ephemeral-pubkey-file", "", "without -privkey or -privkey-file, write the temporary public key to file")
+	flag.StringVar(&experimentalAnswerName, "experimental-answer-name", experimentalAnswerName, "owner name of Answer RRs: \"question\" or \"root\"")
+	flag.BoolVar(&experimentalNoEDNS, "experimental-no-edns", experimentalNoEDNS, "tunnel in queries without EDNS(0), with responses of at most 512 bytes (very slow)")
+	flag.DurationVar(&firstByteTimeout, "first-byte-timeout", firstByteTimeout, "close streams that copy no data in either direction for this long after connecting upstream (0 for never)")
 	flag.BoolVar(&genKey, "gen-key", false, "generate a server keypair; print to stdout or save to files")
+	flag.DurationVar(&ingestDelay, "ingest-delay", ingestDelay, "pass the packets of each query to KCP this long after receiving it (adds latency)")
+	flag.StringVar(&instanceID, "instance-id", instanceID, "identify this server in log lines and the access log (\"\" for none)")
+	flag.BoolVar(&kcpCongestion, "kcp-congestion", kcpCongestion, "enable KCP congestion control (fairer on shared links, but slower)")
+	flag.StringVar(&keyFilename, "key", "", "with -dot or -doh, TLS private key file (PEM)")
+	flag.StringVar(&keyProviderSpec, "key-provider", "", "keep the server private key in the named key provider (NAME[:CONFIG]) instead of -privkey or -privkey-file")
+	flag.BoolVar(&lenientEDNS, "lenient-edns", lenientEDNS, "ignore extra OPT RRs instead of returning FORMERR")
+	flag.StringVar(&listenFamily, "listen-family", "", "with -udp, listen on IPv4 only (\"4\"), IPv6 only (\"6\"), or both on one socket (\"dual\")")
+	flag.IntVar(&logHandshakes, "log-handshakes", logHandshakes, "log the handshake progress of at most this many new sessions per minute (0 for none)")
+	flag.BoolVar(&logQueriesFlag, "log-queries", false, "log every query received (toggle at run time with SIGUSR1)")
+	flag.Float64Var(&maxClientQueryRate, "max-client-query-rate", maxClientQueryRate, "maximum queries per second per client (0 for no limit)")
+	flag.IntVar(&maxConsecutiveErrors, "max-consecutive-errors", maxConsecutiveErrors, "exit after this many consecutive transient network errors (0 for never)")
+	flag.IntVar(&maxQueryLabels, "max-query-labels", maxQueryLabels, "answer queries whose name has more than this many labels with FORMERR (0 for no limit)")
+	flag.IntVar(&maxResponseSize, "max-response-size", maxResponseSize, "maximum size of DNS responses, if smaller than -mtu (0 for no extra limit)")
+	flag.IntVar(&maxTunnelGoroutines, "max-tunnel-goroutines", maxTunnelGoroutines, "close new sessions and streams beyond this many goroutines for them (0 for no limit)")
+	flag.StringVar(&metricsAddr, "metrics", "", "TCP address on which to serve metrics over HTTP at /metrics (or StatsD UDP address, with -metrics-backend statsd)")
+	flag.StringVar(&metricsBackend, "metrics-backend", metricsBackend, "how to export metrics: \"prometheus\" or \"statsd\"")
+	flag.DurationVar(&metricsInterval, "metrics-interval", metricsInterval, "with -metrics-backend statsd, push metrics this often")
 	flag.IntVar(&maxUDPPayload, "mtu", maxUDPPayload, "maximum size of DNS responses")
+	flag.IntVar(&negativeTTL, "negative-ttl", negativeTTL, "put an SOA with this negative-caching TTL, in seconds, in NXDOMAIN responses (-1 for none)")
+	flag.BoolVar(&noDataHTTPS, "nodata-https", noDataHTTPS, "answer HTTPS and SVCB queries with NODATA instead of NXDOMAIN")
+	flag.StringVar(&nsNameString, "ns", "", "answer NS queries for DOMAIN with this name server name")
+	flag.StringVar(&nsidString, "nsid", "", "identify this server with the given string in the EDNS NSID option, when requested")
 	flag.StringVar(&privkeyString, "privkey", "", fmt.Sprintf("server private key (%d hex digits)", noise.KeyLen*2))
 	flag.StringVar(&privkeyFilename, "privkey-file", "", "read server private key from file (with -gen-key, write to file)")
 	flag.StringVar(&pubkeyFilename, "pubkey-file", "", "with -gen-key, write server public key to file")
-	flag.StringVar(&udpAddr, "udp", "", "UDP address to listen on (required)")
+	flag.IntVar(&queryCostSample, "query-cost-sample", queryCostSample, "measure the time to process one in this many queries, by source address (0 for none)")
+	flag.BoolVar(&recursionAvailable, "recursion-available", recursionAvailable, "set the RA (recursion available) bit in responses")
+	flag.BoolVar(&repeatDownstream, "repeat-downstream", repeatDownstream, "repeat the previous downstream data in otherwise empty responses (for lossy links)")
+	flag.StringVar(&replayFilename, "replay", "", "describe the response to the raw DNS query in file, without opening any sockets")
+	flag.BoolVar(&saturationServfail, "saturation-servfail", saturationServfail, "answer queries that would start new sessions with SERVFAIL while the server is overloaded")
+	flag.IntVar(&sendWorkers, "send-workers", sendWorkers, "send responses from a pool of this many worker goroutines per listener (0 to send from one goroutine)")
+	flag.DurationVar(&sessionCooldown, "session-cooldown", sessionCooldown, "minimum time between the starts of one client's sessions (0 for no minimum)")
+	flag.BoolVar(&shuffleRRs, "shuffle-rrs", shuffleRRs, "put the RRs of multi-RR answers from -zone in a random order")
+	flag.DurationVar(&slowDialThreshold, "slow-dial-threshold", slowDialThreshold, "log upstream connections that take longer than this to make (0 for never)")
+	flag.IntVar(&smuxMaxFrameSize, "smux-max-frame-size", smuxMaxFrameSize, "maximum size of smux frames, at most 65535")
+	flag.IntVar(&smuxMaxReceiveBuffer, "smux-max-receive-buffer", smuxMaxReceiveBuffer, "maximum bytes buffered for all the streams of a session")
+	flag.IntVar(&smuxMaxStreamBuffer, "smux-max-stream-buffer", smuxMaxStreamBuffer, "maximum bytes buffered for one stream, at most -smux-max-receive-buffer")
+	flag.DurationVar(&statsInterval, "stats-interval", statsInterval, "log a summary of activity this often (0 for never)")
+	flag.StringVar(&streamHandlerSpec, "stream-handler", "", "serve streams in-process with the named custom stream handler (NAME[:CONFIG]), which must be compiled in, instead of proxying them to UPSTREAMADDR")
+	flag.DurationVar(&streamMaxLifetime, "stream-max-lifetime", streamMaxLifetime, "close streams this long after connecting upstream, even if active (0 for never)")
+	flag.BoolVar(&streamTags, "stream-tags", streamTags, "read a tag from the beginning of every stream, for accounting (clients must use -stream-tag)")
+	flag.IntVar(&streamWorkers, "stream-workers", streamWorkers, "handle streams with a pool of this many worker goroutines (0 for a goroutine per stream)")
+	flag.BoolVar(&strictAuxListeners, "strict-aux-listeners", strictAuxListeners, "exit if the -metrics or -debug-addr listener cannot be opened, instead of logging a warning")
+	flag.BoolVar(&strictEDNSOptions, "strict-edns-options", strictEDNSOptions, "return FORMERR for queries with EDNS options the server does not implement")
+	flag.StringVar(&tcpAddr, "tcp", "", "TCP address to listen on for DNS over TCP")
+	flag.StringVar(&transportSpec, "transport", "", "also listen using the named custom transport (NAME[:CONFIG]), which must be compiled in")
+	flag.StringVar(&tunnelQTypeString, "tunnel-qtype", "TXT", "comma-separated list of QTYPEs to accept as tunnel queries")
+	flag.StringVar(&udpAddr, "udp", "", "UDP address to listen on")
+	flag.StringVar(&udpSource, "udp-source", "", "with -udp, send responses from this IP address, or from the query's destination address if \"query\"")
+	flag.BoolVar(&upstreamLoopFatal, "upstream-loop-fatal", upstreamLoopFatal, "exit if UPSTREAMADDR is the address of one of this server's listeners, instead of logging a warning")
+	flag.BoolVar(&upstreamMuxFlag, "upstream-mux", false, "carry all streams over one smux connection to UPSTREAMADDR (upstream must speak smux)")
+	flag.DurationVar(&upstreamResolveInterval, "upstream-resolve-interval", upstreamResolveInterval, "cache upstream host resolution for this long (0 to resolve on every connection)")
+	flag.BoolVar(&upstreamSticky, "upstream-sticky", upstreamSticky, "connect all streams of a client to the same upstream address, if the host has several")
+	flag.StringVar(&verifyDelegationAddr, "verify-delegation", "", "at startup, resolve a test name in DOMAIN through the recursive resolver at this address, and exit if the answer does not come from this server")
+	flag.DurationVar(&warmup, "warmup", warmup, "answer tunnel queries with SERVFAIL for this long after starting")
+	flag.StringVar(&wsAddr, "ws", "", "TCP address to listen on for DNS over WebSocket")
+	flag.StringVar(&wsPath, "ws-path", "/", "with -ws, URL path at which to accept WebSocket connections")
+	flag.StringVar(&zoneFilename, "zone", "", "answer for names in DOMAIN from records in this zone file")
 	flag.Parse()
 
 	log.SetFlags(log.LstdFlags | log.LUTC)
+	if strings.IndexFunc(instanceID, func(r rune) bool { return !unicode.IsGraphic(r) || unicode.IsSpace(r) }) != -1 {
+		fmt.Fprintf(os.Stderr, "-instance-id may not contain spaces or control characters\n")
+		os.Exit(1)
+	}
+	if instanceID != "" {
+		log.SetPrefix(instanceID + " ")
+	}
 
 	if genKey {
 		// -gen-key mode.
-		if flag.NArg() != 0 || privkeyString != "" || udpAddr != "" {
+		if flag.NArg() != 0 || privkeyString != "" || udpAddr != "" || ephemeralPubkeyFilename != "" || nsNameString != "" || metricsAddr != "" || debugAddr != "" || tcpAddr != "" || dotAddr != "" || dohAddr != "" || wsAddr != "" || banFilename != "" || accessLogFilename != "" || bootstrapURL != "" || replayFilename != "" {
 			flag.Usage()
 			os.Exit(1)
 		}
-		if err := generateKeypair(privkeyFilename, pubkeyFilename); err != nil {
+		if keyProviderSpec != "" {
+			if privkeyFilename != "" {
+				fmt.Fprintf(os.Stderr, "-privkey-file may not be used with -key-provider\n")
+				os.Exit(1)
+			}
+			keys, err := openKeyProvider(keyProviderSpec)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot open key provider: %v\n", err)
+				os.Exit(1)
+			}
+			if err := generateProviderKey(keys, pubkeyFilename); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot generate keypair: %v\n", err)
+				os.Exit(1)
+			}
+		} else if err := generateKeypair(privkeyFilename, pubkeyFilename); err != nil {
 			fmt.Fprintf(os.Stderr, "cannot generate keypair: %v\n", err)
 			os.Exit(1)
 		}
 	} else {
 		// Ordinary server mode.
-		if flag.NArg() != 2 {
+		args := flag.Args()
+		if bootstrapURL != "" {
+			if len(args) != 0 {
+				fmt.Fprintf(os.Stderr, "DOMAIN and UPSTREAMADDR may not be given with -bootstrap\n")
+				os.Exit(1)
+			}
+			config, err := fetchBootstrapConfig(bootstrapURL)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot read bootstrap configuration: %v\n", err)
+				os.Exit(1)
+			}
+			log.Printf("bootstrap configuration from %s: domain %s, upstream %s", bootstrapURL, config.Domain, config.Upstream)
+			args = []string{config.Domain, config.Upstream}
+		}
+		nargs := 2
+		if replayFilename != "" {
+			// Only DOMAIN.
+			nargs = 1
+			if bootstrapURL != "" || udpAddr != "" || tcpAddr != "" || dotAddr != "" || dohAddr != "" || wsAddr != "" || transportSpec != "" || verifyDelegationAddr != "" {
+				fmt.Fprintf(os.Stderr, "-replay may not be used with -bootstrap, -udp, -tcp, -dot, -doh, -ws, -transport, or -verify-delegation\n")
+				os.Exit(1)
+			}
+		}
+		if len(args) != nargs {
 			flag.Usage()
 			os.Exit(1)
 		}
-		domain, err := dns.ParseName(flag.Arg(0))
+		domain, err := dns.ParseName(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid domain %+q: %v\n", args[0], err)
+			os.Exit(1)
+		}
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "nsid" {
+				nsid = []byte(nsidString)
+			}
+		})
+		if len(nsid) > 0xffff {
+			fmt.Fprintf(os.Stderr, "-nsid is too long\n")
+			os.Exit(1)
+		}
+
+		base32Encoding, err = dns.NewBase32Encoding(base32Alphabet)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "invalid domain %+q: %v\n", flag.Arg(0), err)
+			fmt.Fprintf(os.Stderr, "invalid -base32-alphabet: %v\n", err)
 			os.Exit(1)
 		}
-		upstream := flag.Arg(1)
-		// We keep upstream as a string in order to eventually pass it
-		// to net.Dial in handleStream. But for the sake of displaying
+
+		tunnelQTypes, err = parseTunnelQTypes(tunnelQTypeString)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -tunnel-qtype: %v\n", err)
+			os.Exit(1)
+		}
+
+		if err := smux.VerifyConfig(newSmuxConfig()); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -smux-* options: %v\n", err)
+			os.Exit(1)
+		}
+
+		if nsNameString != "" {
+			nsName, err = dns.ParseName(nsNameString)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid -ns name %+q: %v\n", nsNameString, err)
+				os.Exit(1)
+			}
+		}
+		if shuffleRRs {
+			rand.Seed(time.Now().UnixNano())
+		}
+		if zoneFilename != "" {
+			serveZone, err = readZoneFile(zoneFilename, domain)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot read zone file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "chaos-txt" {
+				// Non-nil even if empty.
+				chaosTXT = append([]byte{}, chaosTXTString...)
+			}
+		})
+		if chaosRefuse && chaosTXT != nil {
+			fmt.Fprintf(os.Stderr, "-chaos-refuse and -chaos-txt may not be used together\n")
+			os.Exit(1)
+		}
+		if ednsRequireFlagsUint > 0xffff || ednsForbidFlagsUint > 0xffff {
+			fmt.Fprintf(os.Stderr, "-edns-require-flags and -edns-forbid-flags must be at most 0xffff\n")
+			os.Exit(1)
+		}
+		ednsRequireFlags = uint16(ednsRequireFlagsUint)
+		ednsForbidFlags = uint16(ednsForbidFlagsUint)
+		if ednsRequireFlags&ednsForbidFlags != 0 {
+			fmt.Fprintf(os.Stderr, "-edns-require-flags and -edns-forbid-flags overlap\n")
+			os.Exit(1)
+		}
+		if ednsReflectFlagsUint > 0xffff {
+			fmt.Fprintf(os.Stderr, "-edns-reflect-flags must be at most 0xffff\n")
+			os.Exit(1)
+		}
+		ednsReflectFlags = uint16(ednsReflectFlagsUint)
+
+		switch metricsBackend {
+		case "prometheus", "statsd":
+		default:
+			fmt.Fprintf(os.Stderr, "-metrics-backend must be \"prometheus\" or \"statsd\"\n")
+			os.Exit(1)
+		}
+		if metricsInterval <= 0 {
+			fmt.Fprintf(os.Stderr, "-metrics-interval must be positive\n")
+			os.Exit(1)
+		}
+
+		if denyPrivateUpstream {
+			deniedUpstreamRanges, err = parseIPRanges(deniedUpstreamRangesString)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid -denied-upstream-ranges: %v\n", err)
+				os.Exit(1)
+			}
+		} else {
+			rangesSet := false
+			flag.Visit(func(f *flag.Flag) {
+				if f.Name == "denied-upstream-ranges" {
+					rangesSet = true
+				}
+			})
+			if rangesSet {
+				fmt.Fprintf(os.Stderr, "-denied-upstream-ranges may only be used with -deny-private-upstream\n")
+				os.Exit(1)
+			}
+		}
+
+		switch apexResponse {
+		case "nodata", "nxdomain":
+		default:
+			fmt.Fprintf(os.Stderr, "-apex-response must be \"nodata\" or \"nxdomain\"\n")
+			os.Exit(1)
+		}
+
+		if emptyResponseDelay < 0 || emptyResponseDelay > maxResponseDelay {
+			fmt.Fprintf(os.Stderr, "-empty-response-delay must be between 0 and %v\n", maxResponseDelay)
+			os.Exit(1)
+		}
+
+		// https://tools.ietf.org/html/rfc2181#section-8
+		if negativeTTL > 0x7fffffff {
+			fmt.Fprintf(os.Stderr, "-negative-ttl may be at most %d\n", 0x7fffffff)
+			os.Exit(1)
+		}
+
+		switch deepNameResponse {
+		case "nodata", "nxdomain":
+		default:
+			fmt.Fprintf(os.Stderr, "-deep-name-response must be \"nodata\" or \"nxdomain\"\n")
+			os.Exit(1)
+		}
+
+		switch experimentalAnswerName {
+		case "question", "root":
+		default:
+			fmt.Fprintf(os.Stderr, "-experimental-answer-name must be \"question\" or \"root\"\n")
+			os.Exit(1)
+		}
+
+		if experimentalNoEDNS {
+			mtuSet := false
+			flag.Visit(func(f *flag.Flag) {
+				if f.Name == "mtu" {
+					mtuSet = true
+				}
+			})
+			if mtuSet {
+				fmt.Fprintf(os.Stderr, "-experimental-no-edns may not be used with -mtu\n")
+				os.Exit(1)
+			}
+			maxUDPPayload = noEDNSMaxUDPPayload
+			log.Printf("warning: -experimental-no-edns limits responses to %d bytes; throughput will be very low", maxUDPPayload)
+		}
+
+		if maxResponseSize != 0 && (maxResponseSize < 0 || maxResponseSize > maxUDPPayload) {
+			fmt.Fprintf(os.Stderr, "-max-response-size must be between 1 and the maximum UDP payload size %d\n", maxUDPPayload)
+			os.Exit(1)
+		}
+
+		if replayFilename != "" {
+			buf, err := ioutil.ReadFile(replayFilename)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot read query: %v\n", err)
+				os.Exit(1)
+			}
+			err = replayQuery(os.Stdout, buf, domain)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		upstream := args[1]
+		// We keep upstream as a string in order to eventually resolve
+		// it when dialing in handleStream. But for the sake of displaying
 		// an error or warning at startup, rather than only when the
 		// first stream occurs, we apply some parsing and name
 		// resolution checks here.
@@ -866,8 +2941,8 @@ Example:
 			upstreamIPAddr, err := net.ResolveIPAddr("ip", upstreamHost)
 			if err != nil {
 				// Failure to resolve the host portion is only a
-				// warning. The name will be re-resolved on each
-				// net.Dial in handleStream.
+				// warning. The name will be re-resolved when
+				// dialing in handleStream.
 				log.Printf("warning: cannot resolve upstream host %+q: %v", upstreamHost, err)
 			} else if upstreamIPAddr.IP == nil {
 				// Handle the special case of an empty string
@@ -876,18 +2951,218 @@ Example:
 				// able to dial this address.
 				fmt.Fprintf(os.Stderr, "cannot parse upstream address %+q: missing host in address\n", upstream)
 				os.Exit(1)
+			} else if ipNet := deniedRange(upstreamIPAddr.IP, deniedUpstreamRanges); ipNet != nil {
+				// Only a warning, because the name may
+				// resolve differently when dialing.
+				log.Printf("warning: upstream host %+q resolves to %s, in denied range %s; streams will be refused", upstreamHost, upstreamIPAddr.IP, ipNet)
 			}
 		}
 
-		if udpAddr == "" {
-			fmt.Fprintf(os.Stderr, "the -udp option is required\n")
+		if udpAddr == "" && tcpAddr == "" && dotAddr == "" && dohAddr == "" && wsAddr == "" && transportSpec == "" {
+			fmt.Fprintf(os.Stderr, "at least one of -udp, -tcp, -dot, -doh, -ws, and -transport is required\n")
 			os.Exit(1)
 		}
-		dnsConn, err := net.ListenPacket("udp", udpAddr)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "opening UDP listener: %v\n", err)
+		if (certFilename == "") != (keyFilename == "") {
+			fmt.Fprintf(os.Stderr, "-cert and -key must be used together\n")
+			os.Exit(1)
+		} else if certFilename != "" && dotAddr == "" && dohAddr == "" {
+			fmt.Fprintf(os.Stderr, "-cert and -key require -dot or -doh\n")
+			os.Exit(1)
+		} else if dotAddr != "" && certFilename == "" {
+			fmt.Fprintf(os.Stderr, "-dot requires -cert and -key\n")
+			os.Exit(1)
+		} else if dohSNIString != "" && (dohAddr == "" || certFilename == "") {
+			fmt.Fprintf(os.Stderr, "-doh-sni requires -doh, -cert, and -key\n")
+			os.Exit(1)
+		}
+		var dnsConns []net.PacketConn
+		if udpAddr != "" {
+			dnsConn, err := listenUDP(listenFamily, udpAddr)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "opening UDP listener: %v\n", err)
+				os.Exit(1)
+			}
+			if udpSource != "" {
+				var source net.IP
+				if udpSource != "query" {
+					source = net.ParseIP(udpSource)
+					if source == nil {
+						fmt.Fprintf(os.Stderr, "-udp-source must be an IP address or \"query\"\n")
+						os.Exit(1)
+					}
+				}
+				dnsConn, err = newPktinfoConn(dnsConn.(*net.UDPConn), source)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "cannot use -udp-source: %v\n", err)
+					os.Exit(1)
+				}
+			}
+			dnsConns = append(dnsConns, dnsConn)
+		} else if udpSource != "" {
+			fmt.Fprintf(os.Stderr, "-udp-source requires -udp\n")
+			os.Exit(1)
+		} else if listenFamily != "" {
+			fmt.Fprintf(os.Stderr, "-listen-family requires -udp\n")
 			os.Exit(1)
 		}
+		if tcpAddr != "" {
+			ln, err := net.Listen("tcp", tcpAddr)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "opening TCP listener: %v\n", err)
+				os.Exit(1)
+			}
+			dnsConns = append(dnsConns, newTCPPacketConn(ln))
+		}
+		if dotAddr != "" {
+			config, err := newTLSConfig(certFilename, keyFilename, dotNextProtos)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot load -dot certificate: %v\n", err)
+				os.Exit(1)
+			}
+			ln, err := net.Listen("tcp", dotListenAddr(dotAddr))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "opening DNS over TLS listener: %v\n", err)
+				os.Exit(1)
+			}
+			dnsConns = append(dnsConns, newDoTPacketConn(ln, config))
+		}
+		if dohAddr != "" {
+			var config *tls.Config
+			if certFilename != "" {
+				var err error
+				config, err = newTLSConfig(certFilename, keyFilename, dohNextProtos)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "cannot load -doh certificate: %v\n", err)
+					os.Exit(1)
+				}
+				if dohSNIString != "" {
+					names, err := parseSNIAllowlist(dohSNIString)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "-doh-sni: %v\n", err)
+						os.Exit(1)
+					}
+					config = withSNIAllowlist(config, names)
+				}
+			}
+			ln, err := net.Listen("tcp", dohAddr)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "opening DNS over HTTPS listener: %v\n", err)
+				os.Exit(1)
+			}
+			dnsConns = append(dnsConns, newDoHPacketConn(ln, config))
+		}
+		if wsAddr != "" {
+			ln, err := net.Listen("tcp", wsAddr)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "opening WebSocket listener: %v\n", err)
+				os.Exit(1)
+			}
+			dnsConns = append(dnsConns, newWSPacketConn(ln, wsPath))
+		}
+		if transportSpec != "" {
+			dnsConn, err := openTransport(transportSpec)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "opening -transport listener: %v\n", err)
+				os.Exit(1)
+			}
+			dnsConns = append(dnsConns, dnsConn)
+		}
+		if streamHandlerSpec != "" {
+			handler, err := openStreamHandler(streamHandlerSpec)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "-stream-handler: %v\n", err)
+				os.Exit(1)
+			}
+			streamHandler = handler
+			streamHandlerName, _ = registry.SplitSpec(streamHandlerSpec)
+		}
+
+		if accessLogFilename != "" {
+			f, err := os.OpenFile(accessLogFilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot open access log: %v\n", err)
+				os.Exit(1)
+			}
+			accessLog, err = newAccessLogger(f, instanceID, accessLogNames)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot open access log: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		if logQueriesFlag {
+			setLogQueries(true)
+		}
+		// Toggle query logging on SIGUSR1.
+		toggleCh := make(chan os.Signal, 1)
+		notifyToggleLogQueries(toggleCh)
+		go func() {
+			for range toggleCh {
+				toggleLogQueries()
+			}
+		}()
+
+		// Toggle maintenance mode on SIGUSR2.
+		maintenanceCh := make(chan os.Signal, 1)
+		notifyToggleMaintenance(maintenanceCh)
+		go func() {
+			for range maintenanceCh {
+				toggleMaintenance()
+			}
+		}()
+
+		if banFilename != "" {
+			if err := loadBanFile(banFilename); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot read ban file: %v\n", err)
+				os.Exit(1)
+			}
+			// Reload the file on SIGHUP. If the new file is bad,
+			// keep the old list.
+			sigCh := make(chan os.Signal, 1)
+			signal.Notify(sigCh, syscall.SIGHUP)
+			go func() {
+				for range sigCh {
+					if err := loadBanFile(banFilename); err != nil {
+						log.Printf("cannot reload ban file: %v", err)
+					}
+				}
+			}()
+		}
+
+		if expiryFilename != "" {
+			if err := loadExpiryFile(expiryFilename); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot read ClientID expiry file: %v\n", err)
+				os.Exit(1)
+			}
+			sigCh := make(chan os.Signal, 1)
+			signal.Notify(sigCh, syscall.SIGHUP)
+			go func() {
+				for range sigCh {
+					if err := loadExpiryFile(expiryFilename); err != nil {
+						log.Printf("cannot reload ClientID expiry file: %v", err)
+					}
+				}
+			}()
+		}
+
+		if metricsAddr != "" {
+			var err error
+			if metricsBackend == "statsd" {
+				err = startStatsd(metricsAddr, metricsInterval)
+			} else {
+				err = startMetrics(metricsAddr)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "opening metrics listener: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if debugAddr != "" {
+			if err := startDebug(debugAddr); err != nil {
+				fmt.Fprintf(os.Stderr, "opening debug listener: %v\n", err)
+				os.Exit(1)
+			}
+		}
 
 		if pubkeyFilename != "" {
 			fmt.Fprintf(os.Stderr, "-pubkey-file may only be used with -gen-key\n")
@@ -895,7 +3170,10 @@ Example:
 		}
 
 		var privkey []byte
-		if privkeyFilename != "" && privkeyString != "" {
+		if keyProviderSpec != "" && (privkeyFilename != "" || privkeyString != "" || ephemeralPubkeyFilename != "") {
+			fmt.Fprintf(os.Stderr, "-privkey, -privkey-file, and -ephemeral-pubkey-file may not be used with -key-provider\n")
+			os.Exit(1)
+		} else if privkeyFilename != "" && privkeyString != "" {
 			fmt.Fprintf(os.Stderr, "only one of -privkey and -privkey-file may be used\n")
 			os.Exit(1)
 		} else if privkeyFilename != "" {
@@ -913,19 +3191,66 @@ Example:
 				os.Exit(1)
 			}
 		}
-		if len(privkey) == 0 {
-			log.Println("generating a temporary one-time keypair")
-			log.Println("use the -privkey or -privkey-file option for a persistent server keypair")
+		if len(privkey) != 0 && ephemeralPubkeyFilename != "" {
+			fmt.Fprintf(os.Stderr, "-ephemeral-pubkey-file may not be used with -privkey or -privkey-file\n")
+			os.Exit(1)
+		}
+		var keys noise.KeyProvider
+		if keyProviderSpec != "" {
 			var err error
-			privkey, _, err = noise.GenerateKeypair()
+			keys, err = openKeyProvider(keyProviderSpec)
+			if err == nil {
+				err = keys.LoadPrivate()
+			}
 			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot open key provider: %v\n", err)
+				os.Exit(1)
+			}
+		} else if len(privkey) == 0 {
+			log.Println("generating a temporary one-time keypair")
+			log.Println("use the -privkey or -privkey-file option for a persistent server keypair")
+			local := &noise.LocalKeyProvider{}
+			if err := local.Generate(); err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
 			}
+			keys = local
+		} else {
+			local := &noise.LocalKeyProvider{Privkey: privkey}
+			if err := local.LoadPrivate(); err != nil {
+				fmt.Fprintf(os.Stderr, "privkey format error: %v\n", err)
+				os.Exit(1)
+			}
+			keys = local
+		}
+		if ephemeralPubkeyFilename != "" {
+			err := writePubkeyFile(ephemeralPubkeyFilename, keys.Pubkey())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot write pubkey to file: %v\n", err)
+				os.Exit(1)
+			}
+			log.Printf("pubkey written to %s", ephemeralPubkeyFilename)
 		}
-		pubkey := noise.PubkeyFromPrivkey(privkey)
 
-		err = run(privkey, pubkey, domain, upstream, dnsConn)
+		dialer := newUpstreamDialer(upstream, upstreamResolveInterval)
+		if upstreamMuxFlag {
+			sharedUpstream = newUpstreamMux(dialer)
+		}
+		if verifyDelegationAddr != "" {
+			if _, _, err := net.SplitHostPort(verifyDelegationAddr); err != nil {
+				verifyDelegationAddr = net.JoinHostPort(verifyDelegationAddr, "53")
+			}
+			// The listeners are already open, so the test query
+			// will be answered once run starts.
+			go func() {
+				err := verifyDelegation(verifyDelegationAddr, domain, delegationCheckTimeout)
+				if err != nil {
+					log.Fatalf("-verify-delegation: %v", err)
+				}
+				log.Printf("verified that %s is delegated to this server", domain)
+			}()
+		}
+		err = run(keys, domain, dialer, dnsConns)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -0,0 +1,3125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/noise"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// mustParseName parses a dns.Name, or panics.
+func mustParseName(s string) dns.Name {
+	name, err := dns.ParseName(s)
+	if err != nil {
+		panic(err)
+	}
+	return name
+}
+
+// tunnelName returns a name under domain that encodes payload as a client
+// would: base32-encoded and split into labels of at most 63 octets.
+func tunnelName(payload []byte, domain dns.Name) dns.Name {
+	encoded := bytes.ToLower([]byte(base32Encoding.EncodeToString(payload)))
+	var labels [][]byte
+	for len(encoded) > 63 {
+		labels = append(labels, encoded[:63])
+		encoded = encoded[63:]
+	}
+	if len(encoded) > 0 {
+		labels = append(labels, encoded)
+	}
+	name, err := dns.NewName(append(labels, domain...))
+	if err != nil {
+		panic(err)
+	}
+	return name
+}
+
+// optRR returns an OPT RR advertising a UDP payload size of 4096.
+func optRR() dns.RR {
+	return dns.RR{
+		Name:  dns.Name{},
+		Type:  dns.RRTypeOPT,
+		Class: 4096,
+		TTL:   0,
+		Data:  []byte{},
+	}
+}
+
+// tunnelQuery returns a TXT query for a name under domain encoding payload,
+// with an OPT RR.
+func tunnelQuery(payload []byte, domain dns.Name) *dns.Message {
+	return &dns.Message{
+		ID:    0x1234,
+		Flags: 0x0100, // QR = 0, RD = 1
+		Question: []dns.Question{
+			{
+				Name:  tunnelName(payload, domain),
+				Type:  dns.RRTypeTXT,
+				Class: dns.ClassIN,
+			},
+		},
+		Additional: []dns.RR{optRR()},
+	}
+}
+
+func TestResponseForDuplicateOPT(t *testing.T) {
+	defer func(saved bool) { lenientEDNS = saved }(lenientEDNS)
+
+	domain := mustParseName("t.example.com")
+	payload := []byte("CLIENTIDpayload")
+	query := tunnelQuery(payload, domain)
+	query.Additional = append(query.Additional, optRR())
+
+	lenientEDNS = false
+	resp, _ := responseFor(query, domain)
+	if resp == nil || resp.Rcode() != dns.RcodeFormatError {
+		t.Errorf("strict: expected FORMERR, got %+v", resp)
+	}
+
+	lenientEDNS = true
+	resp, p := responseFor(query, domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNoError {
+		t.Fatalf("lenient: expected NOERROR, got %+v", resp)
+	}
+	if len(resp.Additional) != 1 || resp.Additional[0].Type != dns.RRTypeOPT {
+		t.Errorf("lenient: expected exactly one OPT RR in response, got %+v", resp.Additional)
+	}
+	if !bytes.Equal(p, payload) {
+		t.Errorf("lenient: payload %+q, expected %+q", p, payload)
+	}
+}
+
+// Extra OPT RRs ignored with -lenient-edns are counted, but not logged for
+// every query.
+func TestResponseForDuplicateOPTLog(t *testing.T) {
+	defer func(saved bool) { lenientEDNS = saved }(lenientEDNS)
+	lenientEDNS = true
+	var logBuf syncBuffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	domain := mustParseName("t.example.com")
+	query := tunnelQuery([]byte("CLIENTIDpayload"), domain)
+	query.Additional = append(query.Additional, optRR())
+	before := queriesExtraOPT.Value()
+	for i := 0; i < 10; i++ {
+		responseFor(query, domain)
+	}
+	if n := queriesExtraOPT.Value() - before; n != 10 {
+		t.Errorf("counted %d extra OPT RRs, expected 10", n)
+	}
+	if n := strings.Count(logBuf.String(), "extra OPT"); n > 1 {
+		t.Errorf("logged %d times, expected at most once: %q", n, logBuf.String())
+	}
+}
+
+// Over a stream transport, queries without EDNS, or with a small UDP payload
+// size, are answered as usual.
+func TestResponseForTransportStream(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	payload := []byte("CLIENTIDpayload")
+	for _, additional := range [][]dns.RR{
+		nil,
+		{{Name: dns.Name{}, Type: dns.RRTypeOPT, Class: 512}},
+	} {
+		query := tunnelQuery(payload, domain)
+		query.Additional = additional
+		if resp, _ := responseForTransport(query, domain, false); resp == nil || resp.Rcode() != dns.RcodeFormatError {
+			t.Errorf("%d additional RRs, UDP: expected FORMERR, got %+v", len(additional), resp)
+		}
+		resp, p := responseForTransport(query, domain, true)
+		if resp == nil || resp.Rcode() != dns.RcodeNoError || !bytes.Equal(p, payload) {
+			t.Errorf("%d additional RRs, stream: expected NOERROR with payload %+q, got %+v %+q", len(additional), payload, resp, p)
+		}
+	}
+}
+
+func TestTunnelResponseFor(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	for _, test := range []struct {
+		payload  string
+		n        int
+		rest     string
+		rcode    uint16
+		tooShort bool
+	}{
+		{"CLIENTIDpayload", 8, "payload", dns.RcodeNoError, false},
+		{"CLIENTID", 8, "", dns.RcodeNoError, false},
+		{"CLIENT", 6, "", dns.RcodeNameError, true},
+	} {
+		resp, clientID, n, payload, tooShort := tunnelResponseFor(tunnelQuery([]byte(test.payload), domain), domain, false)
+		if resp == nil || resp.Rcode() != test.rcode || n != test.n || string(payload) != test.rest || tooShort != test.tooShort {
+			t.Errorf("%+q: got %+v, %d, %+q, %v", test.payload, resp, n, payload, tooShort)
+			continue
+		}
+		if !bytes.Equal(clientID[:n], []byte(test.payload[:n])) {
+			t.Errorf("%+q: ClientID %v", test.payload, clientID)
+		}
+	}
+
+	// A response that is already complete is not made an NXDOMAIN.
+	defer func(saved string) { apexResponse = saved }(apexResponse)
+	apexResponse = "nodata"
+	query := &dns.Message{
+		Flags:      0x0100,
+		Question:   []dns.Question{{Name: domain, Type: dns.RRTypeNS, Class: dns.ClassIN}},
+		Additional: []dns.RR{optRR()},
+	}
+	resp, _, n, _, tooShort := tunnelResponseFor(query, domain, false)
+	if resp == nil || resp.Rcode() != dns.RcodeNoError || n != 0 || tooShort {
+		t.Errorf("NS: got %+v, %d, %v", resp, n, tooShort)
+	}
+}
+
+func TestResponseForNoEDNS(t *testing.T) {
+	defer func(saved int) { maxUDPPayload = saved }(maxUDPPayload)
+
+	domain := mustParseName("t.example.com")
+	payload := bytes.Repeat([]byte("X"), 130)
+	query := tunnelQuery(payload, domain)
+	query.Additional = nil
+
+	resp, _ := responseFor(query, domain)
+	if resp == nil || resp.Rcode() != dns.RcodeFormatError {
+		t.Errorf("default: expected FORMERR, got %+v", resp)
+	}
+
+	// As with -experimental-no-edns.
+	maxUDPPayload = noEDNSMaxUDPPayload
+	resp, p := responseFor(query, domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNoError {
+		t.Fatalf("no EDNS: expected NOERROR, got %+v", resp)
+	}
+	if len(resp.Additional) != 0 {
+		t.Errorf("no EDNS: expected no OPT RR, got %+v", resp.Additional)
+	}
+	if !bytes.Equal(p, payload) {
+		t.Errorf("no EDNS: payload %+q, expected %+q", p, payload)
+	}
+	// A full response, filled as sendLoop would, fits in the limit.
+	resp.Answer = []dns.RR{
+		{
+			Name:  resp.Question[0].Name,
+			Type:  resp.Question[0].Type,
+			Class: resp.Question[0].Class,
+			TTL:   responseTTL,
+			Data:  dns.EncodeRDataTXT(make([]byte, computeMaxEncodedPayload(maxUDPPayload))),
+		},
+	}
+	buf, err := resp.WireFormat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) > noEDNSMaxUDPPayload {
+		t.Errorf("no EDNS: response is %d bytes, more than %d", len(buf), noEDNSMaxUDPPayload)
+	}
+}
+
+func TestComputeMaxEncodedPayload(t *testing.T) {
+	defer func(saved string) { experimentalAnswerName = saved }(experimentalAnswerName)
+	defer func(saved []byte) { nsid = saved }(nsid)
+	nsid = nil
+
+	// The worst-case response has a 12-byte header, a Question of a
+	// 255-byte name plus 4 bytes of type and class, an Answer RR of a
+	// 2-byte compression pointer plus 10 bytes of type, class, TTL, and
+	// RDLENGTH, and an 11-byte OPT RR: 294 bytes of overhead. The TXT
+	// RDATA that remains costs 1 length byte per 255 bytes of payload.
+	for _, test := range []struct {
+		answerName string
+		limit      int
+		expected   int
+	}{
+		// 1232 - 294 = 938 = 934 + 4 length bytes.
+		{"question", 1232, 934},
+		// 512 - 294 = 218 = 217 + 1 length byte.
+		{"question", 512, 217},
+		// An owner name of the root saves 1 byte over a pointer.
+		{"root", 1232, 935},
+		// Too small for any payload.
+		{"question", 294, 0},
+		// The largest response over TCP. 65535 - 294 = 65241 =
+		// 64986 + 255 length bytes.
+		{"question", tcpResponseSizeLimit, 64986},
+	} {
+		experimentalAnswerName = test.answerName
+		if n := computeMaxEncodedPayload(test.limit); n != test.expected {
+			t.Errorf("%s %d: got %d, expected %d", test.answerName, test.limit, n, test.expected)
+		}
+	}
+}
+
+// nsQuery returns an NS query for name, with an OPT RR.
+func nsQuery(name dns.Name) *dns.Message {
+	return &dns.Message{
+		ID:    0x1234,
+		Flags: 0x0100, // QR = 0, RD = 1
+		Question: []dns.Question{
+			{
+				Name:  name,
+				Type:  dns.RRTypeNS,
+				Class: dns.ClassIN,
+			},
+		},
+		Additional: []dns.RR{optRR()},
+	}
+}
+
+func TestResponseForHTTPS(t *testing.T) {
+	defer func(saved bool) { noDataHTTPS = saved }(noDataHTTPS)
+
+	domain := mustParseName("t.example.com")
+	query := func(name dns.Name, qtype uint16) *dns.Message {
+		q := nsQuery(name)
+		q.Question[0].Type = qtype
+		return q
+	}
+
+	for _, qtype := range []uint16{dns.RRTypeHTTPS, dns.RRTypeSVCB} {
+		for _, name := range []dns.Name{domain, mustParseName("www.t.example.com")} {
+			// Disabled by default.
+			noDataHTTPS = false
+			resp, _ := responseFor(query(name, qtype), domain)
+			if resp == nil || resp.Rcode() != dns.RcodeNameError {
+				t.Errorf("%d %s disabled: expected NXDOMAIN, got %+v", qtype, name, resp)
+			}
+
+			noDataHTTPS = true
+			resp, p := responseFor(query(name, qtype), domain)
+			if resp == nil || resp.Rcode() != dns.RcodeNoError || resp.Flags&0x0400 == 0 || len(resp.Answer) != 0 {
+				t.Errorf("%d %s: expected authoritative NODATA, got %+v", qtype, name, resp)
+			}
+			if p != nil {
+				t.Errorf("%d %s: expected no payload, got %+q", qtype, name, p)
+			}
+			if isTunnelResponse(resp) {
+				t.Errorf("%d %s: NODATA response is a tunnel response", qtype, name)
+			}
+		}
+	}
+
+	// Names outside the domain are still NXDOMAIN.
+	resp, _ := responseFor(query(mustParseName("example.com"), dns.RRTypeHTTPS), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNameError {
+		t.Errorf("outside domain: expected NXDOMAIN, got %+v", resp)
+	}
+
+	// Tunnel queries are unaffected.
+	payload := []byte("CLIENTIDpayload")
+	resp, p := responseFor(tunnelQuery(payload, domain), domain)
+	if resp == nil || !isTunnelResponse(resp) || !bytes.Equal(p, payload) {
+		t.Errorf("tunnel: expected tunnel response with payload %+q, got %+v %+q", payload, resp, p)
+	}
+}
+
+func TestRecvLoopNoDataHTTPS(t *testing.T) {
+	defer func(saved bool) { noDataHTTPS = saved }(noDataHTTPS)
+	noDataHTTPS = true
+
+	domain := mustParseName("t.example.com")
+	dnsConn, ch, _, stop := startRecvLoop(domain, 1000)
+	defer stop()
+
+	// recvLoop must not turn the NODATA into NXDOMAIN for lack of a
+	// ClientID.
+	query := nsQuery(domain)
+	query.Question[0].Type = dns.RRTypeHTTPS
+	buf, err := query.WireFormat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsConn.Inject(buf, turbotunnel.DummyAddr{})
+	select {
+	case rec := <-ch:
+		if rec.Resp.Rcode() != dns.RcodeNoError || len(rec.Resp.Answer) != 0 {
+			t.Errorf("expected NODATA, got %+v", rec.Resp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a record")
+	}
+}
+
+func TestResponseForLongName(t *testing.T) {
+	domain := mustParseName("t.example.com")
+
+	// A maximum-length name made of many short labels is processed
+	// normally. 80 2-octet labels and the 15 octets of domain make 255
+	// octets; 160 base32 characters decode to 100 bytes.
+	payload := bytes.Repeat([]byte("0123456789"), 10)
+	encoded := []byte(base32Encoding.EncodeToString(payload))
+	var labels [][]byte
+	for i := 0; i < len(encoded); i += 2 {
+		labels = append(labels, encoded[i:i+2])
+	}
+	labels = append(labels, domain...)
+	name, err := dns.NewName(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := nameWireLen(name); n != 255 {
+		t.Fatalf("name is %d octets, expected 255", n)
+	}
+	query := tunnelQuery(nil, domain)
+	query.Question[0].Name = name
+	resp, p := responseFor(query, domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNoError || !bytes.Equal(p, payload) {
+		t.Errorf("255 octets: expected NOERROR with payload %+q, got %+v %+q", payload, resp, p)
+	}
+
+	// A longer name, which could only come from somewhere other than
+	// dns.MessageFromWireFormat, gets FORMERR without being decoded, once
+	// it encodes more than maxUpstreamPayload(domain) bytes.
+	before := queriesPayloadTooLong.Value()
+	longName := name
+	for i := 0; i < 38; i++ {
+		longName = append(dns.Name{[]byte("AA")}, longName...)
+	}
+	query.Question[0].Name = longName
+	resp, p = responseFor(query, domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNoError || len(p) != maxUpstreamPayload(domain) {
+		t.Errorf("%d octets: expected NOERROR with %d bytes, got %+v %+q", nameWireLen(longName), maxUpstreamPayload(domain), resp, p)
+	}
+	query.Question[0].Name = append(dns.Name{[]byte("AA")}, longName...)
+	resp, p = responseFor(query, domain)
+	if resp == nil || resp.Rcode() != dns.RcodeFormatError || p != nil {
+		t.Errorf("%d octets: expected FORMERR, got %+v %+q", nameWireLen(query.Question[0].Name), resp, p)
+	}
+	if queriesPayloadTooLong.Value() != before+1 {
+		t.Errorf("rejected query was not counted")
+	}
+}
+
+func TestResponseForMaxQueryLabels(t *testing.T) {
+	defer func(saved int) { maxQueryLabels = saved }(maxQueryLabels)
+	domain := mustParseName("t.example.com")
+
+	// The most labels a name under domain can have: 120 1-octet labels
+	// and the 3 labels of domain make 123 labels and 255 octets. 120
+	// base32 characters decode to 75 bytes.
+	payload := bytes.Repeat([]byte("abcde"), 15)
+	encoded := []byte(base32Encoding.EncodeToString(payload))
+	var labels [][]byte
+	for i := range encoded {
+		labels = append(labels, encoded[i:i+1])
+	}
+	labels = append(labels, domain...)
+	name, err := dns.NewName(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := nameWireLen(name); len(name) != 123 || n != 255 {
+		t.Fatalf("name has %d labels and %d octets, expected 123 and 255", len(name), n)
+	}
+	query := tunnelQuery(nil, domain)
+	query.Question[0].Name = name
+
+	for _, test := range []struct {
+		max   int
+		rcode uint16
+	}{
+		{0, dns.RcodeNoError},
+		{123, dns.RcodeNoError},
+		{122, dns.RcodeFormatError},
+	} {
+		maxQueryLabels = test.max
+		before := queriesTooManyLabels.Value()
+		resp, p := responseFor(query, domain)
+		if resp == nil || resp.Rcode() != test.rcode {
+			t.Errorf("max %d: expected RCODE %d, got %+v", test.max, test.rcode, resp)
+			continue
+		}
+		if test.rcode == dns.RcodeNoError && !bytes.Equal(p, payload) {
+			t.Errorf("max %d: payload %+q, expected %+q", test.max, p, payload)
+		}
+		if test.rcode == dns.RcodeFormatError && (p != nil || queriesTooManyLabels.Value() != before+1) {
+			t.Errorf("max %d: rejected query was decoded or not counted", test.max)
+		}
+	}
+
+	// An ordinary tunnel query is well under a modest limit.
+	maxQueryLabels = 8
+	resp, _ := responseFor(tunnelQuery([]byte("CLIENTIDpayload"), domain), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNoError {
+		t.Errorf("ordinary query: expected NOERROR, got %+v", resp)
+	}
+}
+
+func TestResponseForEDNSFlags(t *testing.T) {
+	defer func(require, forbid uint16) {
+		ednsRequireFlags, ednsForbidFlags = require, forbid
+	}(ednsRequireFlags, ednsForbidFlags)
+
+	domain := mustParseName("t.example.com")
+	for _, test := range []struct {
+		require, forbid uint16
+		version         uint8
+		flags           uint16
+		rcode           uint16
+	}{
+		// By default, any flags are accepted, but only version 0.
+		{0, 0, 0, 0x0000, dns.RcodeNoError},
+		{0, 0, 0, 0x8000, dns.RcodeNoError},
+		{0, 0, 0, 0x7fff, dns.RcodeNoError},
+		{0, 0, 1, 0x0000, dns.ExtendedRcodeBadVers},
+		// Required flags.
+		{0x8000, 0, 0, 0x0000, dns.RcodeRefused},
+		{0x8000, 0, 0, 0x4000, dns.RcodeRefused},
+		{0x8000, 0, 0, 0x8000, dns.RcodeNoError},
+		{0x8000, 0, 0, 0xc000, dns.RcodeNoError},
+		// Forbidden flags.
+		{0, 0x8000, 0, 0x8000, dns.RcodeRefused},
+		{0, 0x8000, 0, 0x4000, dns.RcodeNoError},
+		// Both.
+		{0x4000, 0x8000, 0, 0x4000, dns.RcodeNoError},
+		{0x4000, 0x8000, 0, 0xc000, dns.RcodeRefused},
+		// The version check comes first.
+		{0x8000, 0, 1, 0x0000, dns.ExtendedRcodeBadVers},
+	} {
+		ednsRequireFlags, ednsForbidFlags = test.require, test.forbid
+		query := tunnelQuery([]byte("CLIENTID"), domain)
+		query.Additional[0].TTL = uint32(test.version)<<16 | uint32(test.flags)
+		resp, _ := responseFor(query, domain)
+		if resp == nil {
+			t.Errorf("%+v: no response", test)
+			continue
+		}
+		rcode := resp.Rcode()
+		if len(resp.Additional) == 1 {
+			rcode |= uint16(resp.Additional[0].TTL>>24) << 4
+		}
+		if rcode != test.rcode {
+			t.Errorf("%+v: got RCODE %d", test, rcode)
+		}
+	}
+
+	// A query without an OPT RR is not subject to the policy; it gets
+	// FORMERR as before.
+	ednsRequireFlags, ednsForbidFlags = 0x8000, 0
+	query := tunnelQuery([]byte("CLIENTID"), domain)
+	query.Additional = nil
+	resp, _ := responseFor(query, domain)
+	if resp == nil || resp.Rcode() != dns.RcodeFormatError {
+		t.Errorf("no OPT: expected FORMERR, got %+v", resp)
+	}
+}
+
+// The OPT RR of every response packs the extended RCODE, version 0, and the
+// reflected flags into its TTL.
+func TestResponseForOPTTTL(t *testing.T) {
+	defer func(require, reflect uint16) {
+		ednsRequireFlags, ednsReflectFlags = require, reflect
+	}(ednsRequireFlags, ednsReflectFlags)
+
+	domain := mustParseName("t.example.com")
+	for _, test := range []struct {
+		require, reflect uint16
+		version          uint8
+		flags            uint16
+		rcode            uint16
+		ttl              uint32
+	}{
+		// By default, no flags are reflected.
+		{0, 0, 0, 0x8000, dns.RcodeNoError, 0x00000000},
+		{0, 0, 1, 0x8000, dns.ExtendedRcodeBadVers, 0x01000000},
+		// DO is reflected when set, and only DO.
+		{0, 0x8000, 0, 0x8000, dns.RcodeNoError, 0x00008000},
+		{0, 0x8000, 0, 0x0000, dns.RcodeNoError, 0x00000000},
+		{0, 0x8000, 0, 0xc001, dns.RcodeNoError, 0x00008000},
+		// BADVERS with DO: the response version is 0, not the
+		// query's.
+		{0, 0x8000, 7, 0x8000, dns.ExtendedRcodeBadVers, 0x01008000},
+		// A non-extended error has nothing in the upper bits.
+		{0x4000, 0x8000, 0, 0x8000, dns.RcodeRefused, 0x00008000},
+	} {
+		ednsRequireFlags, ednsReflectFlags = test.require, test.reflect
+		query := tunnelQuery([]byte("CLIENTID"), domain)
+		query.Additional[0].TTL = dns.EncodeOPTTTL(0, test.version, test.flags)
+		resp, _ := responseFor(query, domain)
+		if resp == nil || len(resp.Additional) != 1 {
+			t.Errorf("%+v: bad response %+v", test, resp)
+			continue
+		}
+		if resp.Rcode() != test.rcode&0xf || resp.Additional[0].TTL != test.ttl {
+			t.Errorf("%+v: got RCODE %d, TTL %#08x", test, resp.Rcode(), resp.Additional[0].TTL)
+		}
+	}
+}
+
+func TestResponseForNSID(t *testing.T) {
+	defer func(saved []byte) { nsid = saved }(nsid)
+
+	domain := mustParseName("t.example.com")
+	nsidRequest := appendEDNSOption(nil, ednsOptionNSID, nil)
+	for _, test := range []struct {
+		nsid     []byte
+		optData  []byte
+		expected []byte
+	}{
+		// Disabled by default.
+		{nil, nil, []byte{}},
+		{nil, nsidRequest, []byte{}},
+		// Not requested.
+		{[]byte("server1"), nil, []byte{}},
+		{[]byte("server1"), []byte{0, 8, 0, 0}, []byte{}},
+		// Malformed options are ignored.
+		{[]byte("server1"), []byte{0, 3, 0}, []byte{}},
+		{[]byte("server1"), []byte{0, 8, 0, 2, 0}, []byte{}},
+		// Requested.
+		{[]byte("server1"), nsidRequest, []byte("\x00\x03\x00\x07server1")},
+		{[]byte("server1"), append([]byte{0, 8, 0, 1, 0}, nsidRequest...), []byte("\x00\x03\x00\x07server1")},
+		{[]byte{}, nsidRequest, []byte("\x00\x03\x00\x00")},
+	} {
+		nsid = test.nsid
+		query := tunnelQuery([]byte("CLIENTID"), domain)
+		query.Additional[0].Data = test.optData
+		resp, _ := responseFor(query, domain)
+		if resp == nil || resp.Rcode() != dns.RcodeNoError || len(resp.Additional) != 1 {
+			t.Errorf("%+q %+q: bad response %+v", test.nsid, test.optData, resp)
+			continue
+		}
+		if !bytes.Equal(resp.Additional[0].Data, test.expected) {
+			t.Errorf("%+q %+q: got OPT data %+q, expected %+q", test.nsid, test.optData, resp.Additional[0].Data, test.expected)
+		}
+	}
+
+	// Room is left in responses for the NSID option.
+	nsid = nil
+	without := computeMaxEncodedPayload(maxUDPPayload)
+	nsid = []byte("server1")
+	with := computeMaxEncodedPayload(maxUDPPayload)
+	if with != without-4-len(nsid) {
+		t.Errorf("with NSID, payload is %d, expected %d", with, without-4-len(nsid))
+	}
+}
+
+func TestResponseForStrictEDNSOptions(t *testing.T) {
+	defer func(saved bool) { strictEDNSOptions = saved }(strictEDNSOptions)
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	domain := mustParseName("t.example.com")
+	nsidRequest := appendEDNSOption(nil, ednsOptionNSID, nil)
+	for _, test := range []struct {
+		optData []byte
+		// Expected RCODE with strictEDNSOptions.
+		rcode uint16
+	}{
+		{nil, dns.RcodeNoError},
+		{nsidRequest, dns.RcodeNoError},
+		{append(append([]byte{}, nsidRequest...), nsidRequest...), dns.RcodeNoError},
+		// Unknown options.
+		{[]byte{0, 8, 0, 0}, dns.RcodeFormatError},
+		{append([]byte{0, 10, 0, 1, 0}, nsidRequest...), dns.RcodeFormatError},
+		{append(append([]byte{}, nsidRequest...), 0xff, 0xff, 0, 0), dns.RcodeFormatError},
+		// Malformed option lists.
+		{[]byte{0, 3, 0}, dns.RcodeFormatError},
+		{append(append([]byte{}, nsidRequest...), 0, 3, 0, 2, 0), dns.RcodeFormatError},
+	} {
+		for _, strict := range []bool{false, true} {
+			strictEDNSOptions = strict
+			query := tunnelQuery([]byte("CLIENTID"), domain)
+			query.Additional[0].Data = test.optData
+			resp, _ := responseFor(query, domain)
+			expected := uint16(dns.RcodeNoError)
+			if strict {
+				expected = test.rcode
+			}
+			if resp == nil || resp.Rcode() != expected {
+				t.Errorf("%+q strict=%v: got %+v, expected RCODE %d", test.optData, strict, resp, expected)
+			}
+		}
+	}
+}
+
+func TestNewSmuxConfig(t *testing.T) {
+	defer func(a, b, c int) {
+		smuxMaxFrameSize, smuxMaxReceiveBuffer, smuxMaxStreamBuffer = a, b, c
+	}(smuxMaxFrameSize, smuxMaxReceiveBuffer, smuxMaxStreamBuffer)
+
+	// The defaults are those of smux.
+	config := newSmuxConfig()
+	def := smux.DefaultConfig()
+	if config.MaxFrameSize != def.MaxFrameSize ||
+		config.MaxReceiveBuffer != def.MaxReceiveBuffer ||
+		config.MaxStreamBuffer != def.MaxStreamBuffer {
+		t.Errorf("defaults %+v differ from smux's %+v", config, def)
+	}
+	if err := smux.VerifyConfig(config); err != nil {
+		t.Errorf("defaults: %v", err)
+	}
+
+	for _, test := range []struct {
+		frame, receive, stream int
+		ok                     bool
+	}{
+		{1024, 65536, 16384, true},
+		{65535, 65536, 65536, true},
+		{0, 65536, 16384, false},
+		{65536, 65536, 16384, false},
+		{1024, 0, 0, false},
+		{1024, 16384, 65536, false},
+	} {
+		smuxMaxFrameSize, smuxMaxReceiveBuffer, smuxMaxStreamBuffer = test.frame, test.receive, test.stream
+		config := newSmuxConfig()
+		if config.MaxFrameSize != test.frame || config.MaxReceiveBuffer != test.receive || config.MaxStreamBuffer != test.stream {
+			t.Errorf("%+v: options not applied: %+v", test, config)
+		}
+		if err := smux.VerifyConfig(config); (err == nil) != test.ok {
+			t.Errorf("%+v: got error %v", test, err)
+		}
+	}
+}
+
+// A query encoded with a different alphabet than the server's gets NXDOMAIN.
+func TestResponseForBase32Alphabet(t *testing.T) {
+	defer func(saved *base32.Encoding) { base32Encoding = saved }(base32Encoding)
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	domain := mustParseName("t.example.com")
+	custom, err := dns.NewBase32Encoding("0123456789abcdefghijklmnopqrstuv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	std := base32Encoding
+	// The leading zero byte encodes as '0', which is not in the standard
+	// alphabet.
+	payload := []byte("\x00CLIENTID")
+
+	base32Encoding = custom
+	query := tunnelQuery(payload, domain)
+
+	// Matching alphabet.
+	resp, decoded := responseFor(query, domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNoError || !bytes.Equal(decoded, payload) {
+		t.Errorf("same alphabet: got %+v %+q", resp, decoded)
+	}
+
+	// Mismatched alphabet.
+	base32Encoding = std
+	resp, _ = responseFor(query, domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNameError {
+		t.Errorf("different alphabet: got %+v, expected NXDOMAIN", resp)
+	}
+}
+
+func TestResponseForHeaderFlags(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	for _, test := range []struct {
+		query, resp uint16
+	}{
+		// QR and AA are always set in a response for our domain.
+		{0x0000, 0x8400},
+		// RD and CD are copied.
+		{0x0100, 0x8500},
+		{0x0010, 0x8410},
+		// AA, TC, RA, Z, and AD in a query are ignored.
+		{0x0400, 0x8400},
+		{0x0200, 0x8400},
+		{0x0080, 0x8400},
+		{0x0040, 0x8400},
+		{0x0020, 0x8400},
+		{0x07f0, 0x8510},
+		// OPCODE is copied, even in a NOTIMP response.
+		{0x1100, 0x9504},
+	} {
+		query := tunnelQuery([]byte("CLIENTID"), domain)
+		query.Flags = test.query
+		resp, _ := responseFor(query, domain)
+		if resp == nil || resp.Flags != test.resp {
+			t.Errorf("query flags %#04x: expected response flags %#04x, got %+v", test.query, test.resp, resp)
+		}
+	}
+
+	// Outside our domain, AA is not set, but RD and CD are still copied.
+	query := tunnelQuery([]byte("CLIENTID"), mustParseName("example.com"))
+	query.Flags = 0x0110
+	resp, _ := responseFor(query, domain)
+	if resp == nil || resp.Flags != 0x8113 {
+		t.Errorf("outside domain: expected response flags %#04x, got %+v", 0x8113, resp)
+	}
+}
+
+func TestResponseForRA(t *testing.T) {
+	defer func(saved bool) { recursionAvailable = saved }(recursionAvailable)
+
+	domain := mustParseName("t.example.com")
+	withRA := tunnelQuery([]byte("CLIENTID"), domain)
+	withRA.Flags |= 0x0080
+	twoOPT := tunnelQuery([]byte("CLIENTID"), domain)
+	twoOPT.Additional = append(twoOPT.Additional, optRR())
+	for _, test := range []struct {
+		recursionAvailable bool
+		query              *dns.Message
+		expected           uint16
+	}{
+		{false, tunnelQuery([]byte("CLIENTID"), domain), 0x0000},
+		{true, tunnelQuery([]byte("CLIENTID"), domain), 0x0080},
+		// RA in the query is ignored.
+		{false, withRA, 0x0000},
+		// Error responses and responses outside our domain too.
+		{true, nsQuery(mustParseName("example.com")), 0x0080},
+		{true, twoOPT, 0x0080},
+	} {
+		recursionAvailable = test.recursionAvailable
+		resp, _ := responseFor(test.query, domain)
+		if resp == nil || resp.Flags&0x0080 != test.expected {
+			t.Errorf("recursionAvailable=%v: expected RA %#04x, got %+v", test.recursionAvailable, test.expected, resp)
+		}
+	}
+}
+
+func TestResponseForAA(t *testing.T) {
+	defer func(saved dns.Name, savedNoData bool) { nsName, noDataHTTPS = saved, savedNoData }(nsName, noDataHTTPS)
+	nsName = mustParseName("tns.example.com")
+	noDataHTTPS = true
+
+	domain := mustParseName("t.example.com")
+	withType := func(query *dns.Message, qtype uint16) *dns.Message {
+		query.Question[0].Type = qtype
+		return query
+	}
+	tunnel := func() *dns.Message { return tunnelQuery([]byte("CLIENTID"), domain) }
+	for _, test := range []struct {
+		desc  string
+		query *dns.Message
+		rcode uint16
+		aa    bool
+	}{
+		{"TXT tunnel", tunnel(), dns.RcodeNoError, true},
+		{"NS", nsQuery(domain), dns.RcodeNoError, true},
+		{"NODATA HTTPS", withType(nsQuery(domain), dns.RRTypeHTTPS), dns.RcodeNoError, true},
+		{"NXDOMAIN QTYPE", withType(tunnel(), 1 /* A */), dns.RcodeNameError, true},
+		{"NXDOMAIN base32", withType(nsQuery(mustParseName("1.t.example.com")), dns.RRTypeTXT), dns.RcodeNameError, true},
+		{"NXDOMAIN other domain", nsQuery(mustParseName("example.com")), dns.RcodeNameError, false},
+		{"NOTIMP", func() *dns.Message { q := tunnel(); q.Flags |= 0x2000; return q }(), dns.RcodeNotImplemented, true},
+		{"FORMERR no EDNS", func() *dns.Message { q := tunnel(); q.Additional = nil; return q }(), dns.RcodeFormatError, true},
+		{"FORMERR two OPT", func() *dns.Message { q := tunnel(); q.Additional = append(q.Additional, optRR()); return q }(), dns.RcodeFormatError, true},
+		{"FORMERR two questions", func() *dns.Message { q := tunnel(); q.Question = append(q.Question, q.Question[0]); return q }(), dns.RcodeFormatError, false},
+		{"BADVERS", func() *dns.Message { q := tunnel(); q.Additional[0].TTL = 1 << 16; return q }(), dns.ExtendedRcodeBadVers & 0xf, true},
+	} {
+		resp, _ := responseFor(test.query, domain)
+		if resp == nil || resp.Rcode() != test.rcode || (resp.Flags&0x0400 != 0) != test.aa {
+			t.Errorf("%s: expected RCODE %d with AA %v, got %+v", test.desc, test.rcode, test.aa, resp)
+		}
+	}
+}
+
+func TestResponseForQuestionCount(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	before := queriesBadQuestionCount.Value()
+	for _, count := range []int{0, 2} {
+		query := tunnelQuery([]byte("CLIENTID"), domain)
+		for len(query.Question) < count {
+			query.Question = append(query.Question, query.Question[0])
+		}
+		query.Question = query.Question[:count]
+		// Round-trip through the wire format, as recvLoop would see it.
+		buf, err := query.WireFormat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := dns.MessageFromWireFormat(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, p := responseFor(&parsed, domain)
+		// QR = 1, RD copied, AA = 0 because the query is not for a
+		// single name in our domain, RCODE = FORMERR.
+		if resp == nil || resp.Flags != 0x8101 {
+			t.Errorf("%d questions: expected flags 0x8101, got %+v", count, resp)
+		}
+		if p != nil {
+			t.Errorf("%d questions: expected no payload, got %+q", count, p)
+		}
+	}
+	if n := queriesBadQuestionCount.Value() - before; n != 2 {
+		t.Errorf("counted %d queries, expected 2", n)
+	}
+}
+
+func TestResponseForApex(t *testing.T) {
+	defer func(saved string) { apexResponse = saved }(apexResponse)
+	defer func(saved dns.Name) { nsName = saved }(nsName)
+
+	domain := mustParseName("t.example.com")
+	query := func(name string, qtype uint16) *dns.Message {
+		q := nsQuery(mustParseName(name))
+		q.Question[0].Type = qtype
+		return q
+	}
+
+	// With "nodata", the domain itself exists, but has no records other
+	// than its SOA.
+	apexResponse = "nodata"
+	nsName = nil
+	for _, qtype := range []uint16{dns.RRTypeTXT, dns.RRTypeA, dns.RRTypeNS} {
+		resp, p := responseFor(query("t.example.com", qtype), domain)
+		if resp == nil || resp.Rcode() != dns.RcodeNoError || resp.Flags&0x0400 == 0 || p != nil {
+			t.Errorf("%d: expected authoritative NOERROR, got %+v", qtype, resp)
+			continue
+		}
+		if len(resp.Answer) != 0 || len(resp.Authority) != 1 || resp.Authority[0].Type != dns.RRTypeSOA {
+			t.Errorf("%d: expected NODATA with SOA, got %+v", qtype, resp)
+		}
+		if isTunnelResponse(resp) {
+			t.Errorf("%d: NODATA looks like a tunnel response", qtype)
+		}
+	}
+	resp, _ := responseFor(query("T.Example.com", dns.RRTypeSOA), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNoError || len(resp.Answer) != 1 ||
+		resp.Answer[0].Type != dns.RRTypeSOA || resp.Answer[0].Name.String() != "T.Example.com" ||
+		!bytes.HasPrefix(resp.Answer[0].Data, dns.EncodeRDataNS(domain)) {
+		t.Errorf("SOA: got %+v", resp)
+	}
+
+	// With -ns, the NS query is answered, and the SOA names the server.
+	nsName = mustParseName("tns.example.com")
+	resp, _ = responseFor(query("t.example.com", dns.RRTypeNS), domain)
+	if resp == nil || len(resp.Answer) != 1 || resp.Answer[0].Type != dns.RRTypeNS {
+		t.Errorf("NS with -ns: got %+v", resp)
+	}
+	resp, _ = responseFor(query("t.example.com", dns.RRTypeTXT), domain)
+	if resp == nil || len(resp.Authority) != 1 || !bytes.HasPrefix(resp.Authority[0].Data, dns.EncodeRDataNS(nsName)) {
+		t.Errorf("SOA with -ns: got %+v", resp)
+	}
+
+	// With "nxdomain", a TXT query for the domain is left for recvLoop,
+	// which answers NXDOMAIN for lack of a ClientID (see
+	// TestRecvLoopShortPayload), and other types get NXDOMAIN here.
+	apexResponse = "nxdomain"
+	resp, p := responseFor(query("t.example.com", dns.RRTypeTXT), domain)
+	if resp == nil || !isTunnelResponse(resp) || len(p) != 0 {
+		t.Errorf("nxdomain TXT: got %+v, payload %+q", resp, p)
+	}
+	resp, _ = responseFor(query("t.example.com", dns.RRTypeA), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNameError || len(resp.Authority) != 0 {
+		t.Errorf("nxdomain A: got %+v", resp)
+	}
+
+	// Subdomains and tunnel queries are unaffected.
+	for _, mode := range []string{"nodata", "nxdomain"} {
+		apexResponse = mode
+		resp, _ = responseFor(query("www.t.example.com", dns.RRTypeA), domain)
+		if resp == nil || resp.Rcode() != dns.RcodeNameError {
+			t.Errorf("%s: subdomain got %+v", mode, resp)
+		}
+		payload := []byte("CLIENTIDpayload")
+		resp, p := responseFor(tunnelQuery(payload, domain), domain)
+		if resp == nil || !isTunnelResponse(resp) || !bytes.Equal(p, payload) {
+			t.Errorf("%s: tunnel query got %+v, payload %+q", mode, resp, p)
+		}
+	}
+}
+
+func TestIsDeepNonTunnelName(t *testing.T) {
+	long := strings.Repeat("a", 63)
+	for _, test := range []struct {
+		name string
+		deep bool
+	}{
+		{"", false},
+		{"www", false},
+		{long, false},
+		{long + ".aaaa", false},
+		{long + "." + long + ".a", false},
+		{"www.mail", true},
+		{"a.b.c.d.e", true},
+		{"aaaa." + long, true},
+		{long + ".aaaa.a", true},
+	} {
+		var prefix dns.Name
+		if test.name != "" {
+			prefix = mustParseName(test.name)
+		}
+		if deep := isDeepNonTunnelName(prefix); deep != test.deep {
+			t.Errorf("%+q: got %v, expected %v", test.name, deep, test.deep)
+		}
+	}
+}
+
+func TestResponseForDeepName(t *testing.T) {
+	defer func(saved string) { deepNameResponse = saved }(deepNameResponse)
+
+	domain := mustParseName("t.example.com")
+	query := func(name string, qtype uint16) *dns.Message {
+		q := nsQuery(mustParseName(name))
+		q.Question[0].Type = qtype
+		return q
+	}
+
+	// By default, deep names get NXDOMAIN like any other non-tunnel name.
+	deepNameResponse = "nxdomain"
+	for _, qtype := range []uint16{dns.RRTypeTXT, dns.RRTypeA} {
+		resp, _ := responseFor(query("www.mail.t.example.com", qtype), domain)
+		if qtype == dns.RRTypeTXT {
+			// A TXT query is left for recvLoop, which answers
+			// NXDOMAIN for lack of a ClientID.
+			if resp == nil || !isTunnelResponse(resp) {
+				t.Errorf("nxdomain %d: got %+v", qtype, resp)
+			}
+		} else if resp == nil || resp.Rcode() != dns.RcodeNameError {
+			t.Errorf("nxdomain %d: got %+v", qtype, resp)
+		}
+	}
+
+	// With "nodata", deep names get NODATA with an SOA, for every QTYPE,
+	// whether or not they happen to decode as base32.
+	deepNameResponse = "nodata"
+	for _, name := range []string{"www.mail.t.example.com", "a.b.c.d.e.t.example.com"} {
+		for _, qtype := range []uint16{dns.RRTypeTXT, dns.RRTypeA, dns.RRTypeAAAA} {
+			resp, p := responseFor(query(name, qtype), domain)
+			if resp == nil || resp.Rcode() != dns.RcodeNoError || resp.Flags&0x0400 == 0 || p != nil {
+				t.Errorf("%s %d: expected authoritative NOERROR, got %+v", name, qtype, resp)
+				continue
+			}
+			if len(resp.Answer) != 0 || len(resp.Authority) != 1 || resp.Authority[0].Type != dns.RRTypeSOA {
+				t.Errorf("%s %d: expected NODATA with SOA, got %+v", name, qtype, resp)
+			}
+			if isTunnelResponse(resp) {
+				t.Errorf("%s %d: NODATA looks like a tunnel response", name, qtype)
+			}
+		}
+	}
+
+	// Tunnel queries, long enough to take several labels, are unaffected.
+	payload := bytes.Repeat([]byte("CLIENTIDpayload"), 5)
+	resp, p := responseFor(tunnelQuery(payload, domain), domain)
+	if resp == nil || !isTunnelResponse(resp) || !bytes.Equal(p, payload) {
+		t.Errorf("tunnel query got %+v, payload %+q", resp, p)
+	}
+	// So are names of one label, which could be a short tunnel query.
+	resp, _ = responseFor(query("www.t.example.com", dns.RRTypeA), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNameError {
+		t.Errorf("one label got %+v", resp)
+	}
+}
+
+// soaMinimum returns the MINIMUM field of an encoded SOA RDATA.
+func soaMinimum(data []byte) uint32 {
+	return binary.BigEndian.Uint32(data[len(data)-4:])
+}
+
+func TestAddNegativeSOA(t *testing.T) {
+	defer func(saved int) { negativeTTL = saved }(negativeTTL)
+	domain := mustParseName("t.example.com")
+	query := func(name string) *dns.Message {
+		q := nsQuery(mustParseName(name))
+		q.Question[0].Type = dns.RRTypeA
+		return q
+	}
+
+	// Off by default.
+	negativeTTL = -1
+	resp, _ := responseFor(query("www.t.example.com"), domain)
+	addNegativeSOA(resp, domain)
+	if resp.Rcode() != dns.RcodeNameError || len(resp.Authority) != 0 {
+		t.Errorf("default: got %+v", resp)
+	}
+
+	for _, test := range []struct {
+		negativeTTL int
+		ttl         uint32
+	}{
+		{0, 0},
+		{5, 5},
+		// The SOA's own TTL is never more than responseTTL.
+		{3600, responseTTL},
+	} {
+		negativeTTL = test.negativeTTL
+		resp, _ := responseFor(query("www.t.example.com"), domain)
+		addNegativeSOA(resp, domain)
+		if resp.Rcode() != dns.RcodeNameError || len(resp.Authority) != 1 {
+			t.Errorf("%d: expected NXDOMAIN with SOA, got %+v", test.negativeTTL, resp)
+			continue
+		}
+		soa := resp.Authority[0]
+		if soa.Type != dns.RRTypeSOA || soa.Name.String() != domain.String() ||
+			soa.TTL != test.ttl || soaMinimum(soa.Data) != uint32(test.negativeTTL) {
+			t.Errorf("%d: bad SOA %+v", test.negativeTTL, soa)
+		}
+		if isTunnelResponse(resp) {
+			t.Errorf("%d: NXDOMAIN looks like a tunnel response", test.negativeTTL)
+		}
+	}
+
+	negativeTTL = 5
+	// Not for names outside the domain, for which we are not
+	// authoritative.
+	resp, _ = responseFor(query("www.example.com"), domain)
+	addNegativeSOA(resp, domain)
+	if resp.Rcode() != dns.RcodeNameError || len(resp.Authority) != 0 {
+		t.Errorf("outside domain: got %+v", resp)
+	}
+	// Not for other RCODEs.
+	resp, _ = responseFor(tunnelQuery([]byte("CLIENTIDpayload"), domain), domain)
+	addNegativeSOA(resp, domain)
+	if len(resp.Authority) != 0 {
+		t.Errorf("tunnel response: got %+v", resp)
+	}
+	// NODATA responses, with -apex-response nodata, have the same
+	// negative TTL.
+	defer func(saved string) { apexResponse = saved }(apexResponse)
+	apexResponse = "nodata"
+	resp, _ = responseFor(query("t.example.com"), domain)
+	addNegativeSOA(resp, domain)
+	if resp.Rcode() != dns.RcodeNoError || len(resp.Authority) != 1 ||
+		resp.Authority[0].TTL != 5 || soaMinimum(resp.Authority[0].Data) != 5 {
+		t.Errorf("NODATA: got %+v", resp)
+	}
+}
+
+func TestRecvLoopNegativeSOA(t *testing.T) {
+	defer func(saved int) { negativeTTL = saved }(negativeTTL)
+	negativeTTL = 5
+
+	domain := mustParseName("t.example.com")
+	dnsConn, ch, _, stop := startRecvLoop(domain, 1000)
+	defer stop()
+
+	// recvLoop's own NXDOMAIN, for a payload too short to contain a
+	// ClientID, gets the SOA too.
+	rec := injectPayload(t, dnsConn, ch, domain, []byte{1, 2, 3})
+	if rec.Resp.Rcode() != dns.RcodeNameError || len(rec.Resp.Authority) != 1 ||
+		rec.Resp.Authority[0].Type != dns.RRTypeSOA || rec.Resp.Authority[0].TTL != 5 {
+		t.Errorf("expected NXDOMAIN with SOA, got %+v", rec.Resp)
+	}
+}
+
+func TestResponseForNS(t *testing.T) {
+	defer func(saved dns.Name) { nsName = saved }(nsName)
+
+	domain := mustParseName("t.example.com")
+
+	// Disabled by default.
+	nsName = nil
+	resp, _ := responseFor(nsQuery(domain), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNameError {
+		t.Errorf("disabled: expected NXDOMAIN, got %+v", resp)
+	}
+
+	nsName = mustParseName("tns.example.com")
+	resp, p := responseFor(nsQuery(domain), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNoError || resp.Flags&0x0400 == 0 {
+		t.Fatalf("expected authoritative NOERROR, got %+v", resp)
+	}
+	if p != nil {
+		t.Errorf("expected no payload, got %+q", p)
+	}
+	if len(resp.Answer) != 1 ||
+		resp.Answer[0].Type != dns.RRTypeNS ||
+		resp.Answer[0].Name.String() != domain.String() ||
+		!bytes.Equal(resp.Answer[0].Data, dns.EncodeRDataNS(nsName)) {
+		t.Errorf("bad NS answer %+v", resp.Answer)
+	}
+
+	// Only the apex of the domain has an NS record.
+	resp, _ = responseFor(nsQuery(mustParseName("sub.t.example.com")), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNameError {
+		t.Errorf("subdomain: expected NXDOMAIN, got %+v", resp)
+	}
+
+	// Tunnel queries are unaffected.
+	payload := []byte("CLIENTIDpayload")
+	resp, p = responseFor(tunnelQuery(payload, domain), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNoError || len(resp.Answer) != 0 {
+		t.Errorf("tunnel: expected NOERROR with no answer, got %+v", resp)
+	}
+	if !bytes.Equal(p, payload) {
+		t.Errorf("tunnel: payload %+q, expected %+q", p, payload)
+	}
+}
+
+func TestResponseForCHAOS(t *testing.T) {
+	defer func(saved bool) { chaosRefuse = saved }(chaosRefuse)
+	defer func(saved []byte) { chaosTXT = saved }(chaosTXT)
+
+	domain := mustParseName("t.example.com")
+	chaosQuery := func(name string, qtype uint16) *dns.Message {
+		return &dns.Message{
+			ID:    1234,
+			Flags: 0x0100,
+			Question: []dns.Question{
+				{Name: mustParseName(name), Type: qtype, Class: dns.ClassCHAOS},
+			},
+		}
+	}
+	// Tunnel queries are in class IN, and are unaffected by every setting.
+	checkTunnel := func(label string) {
+		t.Helper()
+		payload := []byte("CLIENTIDpayload")
+		resp, p := responseFor(tunnelQuery(payload, domain), domain)
+		if resp == nil || resp.Rcode() != dns.RcodeNoError || len(resp.Answer) != 0 || !bytes.Equal(p, payload) {
+			t.Errorf("%s: tunnel query got %+v, payload %+q", label, resp, p)
+		}
+	}
+
+	// Disabled by default: NXDOMAIN, as for any name outside the domain.
+	chaosRefuse = false
+	chaosTXT = nil
+	resp, _ := responseFor(chaosQuery("version.bind", dns.RRTypeTXT), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNameError || resp.Flags&0x0400 != 0 || len(resp.Answer) != 0 {
+		t.Errorf("disabled: expected non-authoritative NXDOMAIN, got %+v", resp)
+	}
+	checkTunnel("disabled")
+
+	chaosRefuse = true
+	chaosTXT = []byte("9.18.0")
+	resp, _ = responseFor(chaosQuery("version.bind", dns.RRTypeTXT), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeRefused || resp.Flags&0x0400 != 0 {
+		t.Errorf("refuse: expected non-authoritative REFUSED, got %+v", resp)
+	}
+	checkTunnel("refuse")
+
+	chaosRefuse = false
+	for _, text := range []string{"9.18.0", ""} {
+		chaosTXT = []byte(text)
+		for _, name := range []string{"version.bind", "HOSTNAME.Bind"} {
+			resp, p := responseFor(chaosQuery(name, dns.RRTypeTXT), domain)
+			if resp == nil || resp.Rcode() != dns.RcodeNoError || resp.Flags&0x0400 == 0 || p != nil {
+				t.Fatalf("txt %q %s: expected authoritative NOERROR, got %+v", text, name, resp)
+			}
+			if len(resp.Answer) != 1 ||
+				resp.Answer[0].Class != dns.ClassCHAOS ||
+				resp.Answer[0].Name.String() != name ||
+				!bytes.Equal(resp.Answer[0].Data, dns.EncodeRDataTXT([]byte(text))) {
+				t.Errorf("txt %q %s: bad answer %+v", text, name, resp.Answer)
+			}
+		}
+		checkTunnel("txt")
+	}
+	// Other names and types are not answered.
+	for _, q := range []*dns.Message{
+		chaosQuery("id.server", dns.RRTypeTXT),
+		chaosQuery("version.bind", dns.RRTypeNS),
+	} {
+		resp, _ := responseFor(q, domain)
+		if resp == nil || resp.Rcode() != dns.RcodeNameError || resp.Flags&0x0400 != 0 {
+			t.Errorf("%+v: expected non-authoritative NXDOMAIN, got %+v", q.Question, resp)
+		}
+	}
+	// The answer is authoritative because isAuthoritative says so.
+	if !isAuthoritative(chaosQuery("version.bind", dns.RRTypeTXT), domain) {
+		t.Errorf("isAuthoritative is false for version.bind")
+	}
+}
+
+// fakePacketConn is a net.PacketConn that returns packets given to Inject from
+// ReadFrom, and sends packets given to WriteTo on the Written channel.
+type fakePacketConn struct {
+	incoming  chan taggedMessage
+	Written   chan taggedMessage
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// taggedMessage is a message and an address.
+type taggedMessage struct {
+	P    []byte
+	Addr net.Addr
+}
+
+func newFakePacketConn() *fakePacketConn {
+	return &fakePacketConn{
+		incoming: make(chan taggedMessage, 100),
+		Written:  make(chan taggedMessage, 100),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Inject queues p to be returned from ReadFrom as if it came from addr.
+func (c *fakePacketConn) Inject(p []byte, addr net.Addr) {
+	c.incoming <- taggedMessage{append([]byte(nil), p...), addr}
+}
+
+func (c *fakePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, io.EOF
+	case m := <-c.incoming:
+		return copy(p, m.P), m.Addr, nil
+	}
+}
+
+func (c *fakePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	case c.Written <- taggedMessage{append([]byte(nil), p...), addr}:
+		return len(p), nil
+	}
+}
+
+func (c *fakePacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakePacketConn) LocalAddr() net.Addr                { return turbotunnel.DummyAddr{} }
+func (c *fakePacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fakePacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakePacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// responsePackets parses a response as written by sendLoop and returns the
+// packets in its Answer section.
+func responsePackets(t *testing.T, buf []byte) [][]byte {
+	resp, err := dns.MessageFromWireFormat(buf)
+	if err != nil {
+		t.Fatalf("cannot parse response: %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("response has %d answers, expected 1", len(resp.Answer))
+	}
+	payload, err := dns.DecodeRDataTXT(resp.Answer[0].Data)
+	if err != nil {
+		t.Fatalf("cannot decode TXT: %v", err)
+	}
+	var packets [][]byte
+	for len(payload) > 0 {
+		var n uint16
+		r := bytes.NewReader(payload)
+		binary.Read(r, binary.BigEndian, &n)
+		packets = append(packets, payload[2:2+n])
+		payload = payload[2+n:]
+	}
+	return packets
+}
+
+// expectEvent waits for the next timer event from clk and checks that it is
+// for duration d.
+func expectEvent(t *testing.T, clk *fakeClock, d time.Duration) {
+	t.Helper()
+	select {
+	case event := <-clk.Events:
+		if event != d {
+			t.Fatalf("timer event %v, expected %v", event, d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for timer event %v", d)
+	}
+}
+
+// expectWritten waits for the next message written to conn.
+func expectWritten(t *testing.T, conn *fakePacketConn) taggedMessage {
+	t.Helper()
+	select {
+	case m := <-conn.Written:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a response")
+	}
+	panic("unreachable")
+}
+
+// startSendLoop runs sendLoop with a fake clock and connection, returning the
+// channel on which to send records. The returned function stops sendLoop.
+func startSendLoop(ttConn *turbotunnel.QueuePacketConn) (chan<- *record, *fakePacketConn, *fakeClock, func()) {
+	dnsConn := newFakePacketConn()
+	clk := newFakeClock()
+	ch := make(chan *record)
+	done := make(chan struct{})
+	go func() {
+		sendLoop(dnsConn, ttConn, ch, computeMaxEncodedPayload(responseSizeLimit()), clk)
+		close(done)
+	}()
+	return ch, dnsConn, clk, func() {
+		close(ch)
+		<-done
+	}
+}
+
+// tunnelRecord returns a record for a NOERROR response to a tunnel query from
+// clientID.
+func tunnelRecord(clientID turbotunnel.ClientID) *record {
+	domain := mustParseName("t.example.com")
+	resp, _ := responseFor(tunnelQuery(clientID[:], domain), domain)
+	return &record{resp, turbotunnel.DummyAddr{}, clientID}
+}
+
+func TestSendLoopFirstPacketWait(t *testing.T) {
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	ch, dnsConn, clk, stop := startSendLoop(ttConn)
+	defer stop()
+
+	// With no data available, sendLoop waits for maxResponseDelay and
+	// then sends an empty response.
+	ch <- tunnelRecord(clientID)
+	expectEvent(t, clk, maxResponseDelay)
+	clk.Advance(maxResponseDelay)
+	if packets := responsePackets(t, expectWritten(t, dnsConn).P); len(packets) != 0 {
+		t.Fatalf("expected empty response, got %x", packets)
+	}
+
+	// A packet that arrives during the wait is sent after the wait is
+	// cut short, without waiting for the remainder of maxResponseDelay.
+	ch <- tunnelRecord(clientID)
+	expectEvent(t, clk, maxResponseDelay)
+	ttConn.WriteTo([]byte("hello"), clientID)
+	expectEvent(t, clk, 0)
+	clk.Advance(0)
+	packets := responsePackets(t, expectWritten(t, dnsConn).P)
+	if len(packets) != 1 || !bytes.Equal(packets[0], []byte("hello")) {
+		t.Fatalf("expected [hello], got %+q", packets)
+	}
+}
+
+func TestSendLoopImmediateDrain(t *testing.T) {
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	otherID := turbotunnel.ClientID{8, 7, 6, 5, 4, 3, 2, 1}
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	ch, dnsConn, clk, stop := startSendLoop(ttConn)
+	defer stop()
+
+	// All packets that are already queued are bundled together, but
+	// not packets for a different ClientID.
+	for _, p := range []string{"one", "two", "three"} {
+		ttConn.WriteTo([]byte(p), clientID)
+	}
+	ttConn.WriteTo([]byte("other"), otherID)
+	ch <- tunnelRecord(clientID)
+	expectEvent(t, clk, maxResponseDelay)
+	for i := 0; i < 3; i++ {
+		expectEvent(t, clk, 0)
+	}
+	clk.Advance(0)
+	packets := responsePackets(t, expectWritten(t, dnsConn).P)
+	if len(packets) != 3 ||
+		!bytes.Equal(packets[0], []byte("one")) ||
+		!bytes.Equal(packets[1], []byte("two")) ||
+		!bytes.Equal(packets[2], []byte("three")) {
+		t.Fatalf("expected [one two three], got %+q", packets)
+	}
+}
+
+func TestSendLoopEmptyResponseDelay(t *testing.T) {
+	defer func(saved time.Duration) { emptyResponseDelay = saved }(emptyResponseDelay)
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+
+	// With no data available, the empty response is sent after
+	// emptyResponseDelay, not maxResponseDelay.
+	emptyResponseDelay = 200 * time.Millisecond
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	ch, dnsConn, clk, stop := startSendLoop(ttConn)
+	ch <- tunnelRecord(clientID)
+	expectEvent(t, clk, emptyResponseDelay)
+	clk.Advance(emptyResponseDelay - time.Millisecond)
+	select {
+	case m := <-dnsConn.Written:
+		t.Fatalf("response sent before emptyResponseDelay: %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clk.Advance(time.Millisecond)
+	if packets := responsePackets(t, expectWritten(t, dnsConn).P); len(packets) != 0 {
+		t.Fatalf("expected empty response, got %x", packets)
+	}
+	stop()
+
+	// With 0, the response is sent at once, but still carries data that
+	// is already queued. This uses the real clock, whose timer of 0 is
+	// ready at once, unlike the fake clock's.
+	emptyResponseDelay = 0
+	ttConn = turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	dnsConn = newFakePacketConn()
+	realCh := make(chan *record)
+	done := make(chan struct{})
+	go func() {
+		sendLoop(dnsConn, ttConn, realCh, computeMaxEncodedPayload(responseSizeLimit()), realClock{})
+		close(done)
+	}()
+	defer func() {
+		close(realCh)
+		<-done
+	}()
+	realCh <- tunnelRecord(clientID)
+	if packets := responsePackets(t, expectWritten(t, dnsConn).P); len(packets) != 0 {
+		t.Fatalf("expected empty response, got %x", packets)
+	}
+	for i := 0; i < 100; i++ {
+		ttConn.WriteTo([]byte("hello"), clientID)
+		ttConn.WriteTo([]byte("world"), clientID)
+		realCh <- tunnelRecord(clientID)
+		packets := responsePackets(t, expectWritten(t, dnsConn).P)
+		if len(packets) != 2 || !bytes.Equal(packets[0], []byte("hello")) || !bytes.Equal(packets[1], []byte("world")) {
+			t.Fatalf("%d: expected [hello world], got %+q", i, packets)
+		}
+	}
+}
+
+func TestSendLoopSendWorkers(t *testing.T) {
+	defer func(saved int) { sendWorkers = saved }(sendWorkers)
+	sendWorkers = 2
+
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	ch, dnsConn, clk, stop := startSendLoop(ttConn)
+
+	// Bundling is unchanged; the workers only send.
+	for _, p := range []string{"one", "two"} {
+		ttConn.WriteTo([]byte(p), clientID)
+	}
+	ch <- tunnelRecord(clientID)
+	expectEvent(t, clk, maxResponseDelay)
+	for i := 0; i < 2; i++ {
+		expectEvent(t, clk, 0)
+	}
+	clk.Advance(0)
+	packets := responsePackets(t, expectWritten(t, dnsConn).P)
+	if len(packets) != 2 ||
+		!bytes.Equal(packets[0], []byte("one")) ||
+		!bytes.Equal(packets[1], []byte("two")) {
+		t.Fatalf("expected [one two], got %+q", packets)
+	}
+
+	// Responses queued when the loop stops are still sent.
+	ttConn.WriteTo([]byte("three"), clientID)
+	ch <- tunnelRecord(clientID)
+	expectEvent(t, clk, maxResponseDelay)
+	expectEvent(t, clk, 0)
+	clk.Advance(0)
+	stop()
+	packets = responsePackets(t, expectWritten(t, dnsConn).P)
+	if len(packets) != 1 || !bytes.Equal(packets[0], []byte("three")) {
+		t.Fatalf("expected [three], got %+q", packets)
+	}
+}
+
+func TestSendLoopResponseSizes(t *testing.T) {
+	// count returns the number of observations and their sum for the given
+	// labels.
+	count := func(rcode, truncated string) (uint64, uint64) {
+		for _, h := range responseSizes.values() {
+			if h.LabelValues[0] == rcode && h.LabelValues[1] == truncated {
+				return h.Counts[len(h.Counts)-1], h.Sum
+			}
+		}
+		return 0, 0
+	}
+	beforeCount, beforeSum := count("NXDOMAIN", "false")
+
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	ch, dnsConn, _, stop := startSendLoop(ttConn)
+	defer stop()
+
+	domain := mustParseName("t.example.com")
+	resp, _ := responseFor(tunnelQuery([]byte("CLIENTID"), mustParseName("example.com")), domain)
+	ch <- &record{resp, turbotunnel.DummyAddr{}, turbotunnel.ClientID{}}
+	written := expectWritten(t, dnsConn)
+
+	// The response is counted just after it is written.
+	deadline := time.Now().Add(5 * time.Second)
+	afterCount, afterSum := count("NXDOMAIN", "false")
+	for afterCount == beforeCount && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		afterCount, afterSum = count("NXDOMAIN", "false")
+	}
+	if afterCount-beforeCount != 1 || afterSum-beforeSum != uint64(len(written.P)) {
+		t.Errorf("expected 1 response of %d bytes, got %d of %d bytes",
+			len(written.P), afterCount-beforeCount, afterSum-beforeSum)
+	}
+}
+
+func TestSendLoopDebugBundles(t *testing.T) {
+	defer func(saved bool) { debugBundles = saved }(debugBundles)
+	debugBundles = true
+	var buf syncBuffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	ch, dnsConn, clk, stop := startSendLoop(ttConn)
+	defer stop()
+
+	for _, p := range []string{"one", "three"} {
+		ttConn.WriteTo([]byte(p), clientID)
+	}
+	ch <- tunnelRecord(clientID)
+	expectEvent(t, clk, maxResponseDelay)
+	for i := 0; i < 2; i++ {
+		expectEvent(t, clk, 0)
+	}
+	clk.Advance(0)
+	expectWritten(t, dnsConn)
+
+	expected := "bundle 0102030405060708 0: delay 0s, packet lengths [3 5], stashed -1, repeated false"
+	if !strings.Contains(buf.String(), expected) {
+		t.Errorf("log %q does not contain %q", buf.String(), expected)
+	}
+}
+
+func TestSendLoopNextRecordPreempts(t *testing.T) {
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	ch, dnsConn, clk, stop := startSendLoop(ttConn)
+	defer stop()
+
+	// When another record arrives while waiting, the current response is
+	// sent immediately, without any advance of the clock.
+	ch <- tunnelRecord(clientID)
+	expectEvent(t, clk, maxResponseDelay)
+	ch <- tunnelRecord(clientID)
+	if packets := responsePackets(t, expectWritten(t, dnsConn).P); len(packets) != 0 {
+		t.Fatalf("expected empty response, got %x", packets)
+	}
+	// The second record then waits in turn.
+	expectEvent(t, clk, maxResponseDelay)
+	clk.Advance(maxResponseDelay)
+	if packets := responsePackets(t, expectWritten(t, dnsConn).P); len(packets) != 0 {
+		t.Fatalf("expected empty response, got %x", packets)
+	}
+}
+
+func TestSendLoopNSAnswer(t *testing.T) {
+	defer func(saved dns.Name) { nsName = saved }(nsName)
+	nsName = mustParseName("tns.example.com")
+
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	ch, dnsConn, _, stop := startSendLoop(ttConn)
+	defer stop()
+
+	// An NS answer is sent as is and immediately, without waiting for or
+	// consuming downstream data.
+	ttConn.WriteTo([]byte("hello"), clientID)
+	domain := mustParseName("t.example.com")
+	resp, _ := responseFor(nsQuery(domain), domain)
+	ch <- &record{resp, turbotunnel.DummyAddr{}, clientID}
+	msg, err := dns.MessageFromWireFormat(expectWritten(t, dnsConn).P)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answer) != 1 || msg.Answer[0].Type != dns.RRTypeNS {
+		t.Fatalf("bad NS answer %+v", msg.Answer)
+	}
+	select {
+	case p := <-ttConn.OutgoingQueue(clientID):
+		if !bytes.Equal(p, []byte("hello")) {
+			t.Fatalf("unexpected queued packet %+q", p)
+		}
+	default:
+		t.Fatalf("downstream packet was consumed")
+	}
+}
+
+// startRecvLoop runs recvLoop with a fake connection for the given domain,
+// returning the connection, the channel of records, and ttConn. The returned
+// function stops recvLoop.
+func startRecvLoop(domain dns.Name, maxPacketSize int) (*fakePacketConn, <-chan *record, *turbotunnel.QueuePacketConn, func()) {
+	dnsConn := newFakePacketConn()
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	ch := make(chan *record, 100)
+	done := make(chan struct{})
+	go func() {
+		recvLoop(domain, dnsConn, ttConn, ch, maxPacketSize, nil)
+		close(done)
+	}()
+	return dnsConn, ch, ttConn, func() {
+		dnsConn.Close()
+		<-done
+	}
+}
+
+// injectQuery sends a tunnel query containing packets from clientID to
+// dnsConn, and waits for recvLoop to pass on its response on ch.
+func injectQuery(t *testing.T, dnsConn *fakePacketConn, ch <-chan *record, domain dns.Name, clientID turbotunnel.ClientID, packets ...[]byte) *record {
+	t.Helper()
+	payload := append([]byte(nil), clientID[:]...)
+	for _, p := range packets {
+		payload = append(payload, byte(len(p)))
+		payload = append(payload, p...)
+	}
+	return injectPayload(t, dnsConn, ch, domain, payload)
+}
+
+// injectPayload sends a tunnel query containing the raw payload to dnsConn,
+// and waits for recvLoop to pass on its response on ch.
+func injectPayload(t *testing.T, dnsConn *fakePacketConn, ch <-chan *record, domain dns.Name, payload []byte) *record {
+	t.Helper()
+	buf, err := tunnelQuery(payload, domain).WireFormat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsConn.Inject(buf, turbotunnel.DummyAddr{})
+	select {
+	case rec := <-ch:
+		return rec
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a record")
+	}
+	panic("unreachable")
+}
+
+func TestRecvLoopOversizedPacket(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	dnsConn, ch, ttConn, stop := startRecvLoop(domain, 50)
+	defer stop()
+
+	// The oversized packet is dropped, but not the one that follows it in
+	// the same query.
+	injectQuery(t, dnsConn, ch, domain, clientID, bytes.Repeat([]byte("X"), 51), []byte("small"))
+	injectQuery(t, dnsConn, ch, domain, clientID, bytes.Repeat([]byte("Y"), 50))
+	var buf [1000]byte
+	for _, expected := range [][]byte{[]byte("small"), bytes.Repeat([]byte("Y"), 50)} {
+		n, addr, err := ttConn.ReadFrom(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != clientID {
+			t.Errorf("packet from %v, expected %v", addr, clientID)
+		}
+		if !bytes.Equal(buf[:n], expected) {
+			t.Errorf("got packet %+q, expected %+q", buf[:n], expected)
+		}
+	}
+}
+
+// With a small enough -max-response-size, KCP's MTU is less than the largest
+// packet a query can carry, and recvLoop drops the packets that exceed it, as
+// run sets it up.
+func TestRecvLoopOversizedPacketMTU(t *testing.T) {
+	defer func(saved int) { maxResponseSize = saved }(maxResponseSize)
+	maxResponseSize = 400
+
+	domain := mustParseName("t.example.com")
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	mtu, err := kcpMTU(computeMaxEncodedPayload(responseSizeLimit()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	max := maxUpstreamPacket(domain)
+	if mtu >= max {
+		t.Fatalf("MTU %d is not less than the largest packet %d", mtu, max)
+	}
+	dnsConn, ch, ttConn, stop := startRecvLoop(domain, mtu)
+	defer stop()
+
+	before := packetsOversized.Value()
+	injectQuery(t, dnsConn, ch, domain, clientID, bytes.Repeat([]byte("X"), max))
+	injectQuery(t, dnsConn, ch, domain, clientID, bytes.Repeat([]byte("Y"), mtu))
+	if n := packetsOversized.Value() - before; n != 1 {
+		t.Errorf("counted %d oversized packets, expected 1", n)
+	}
+	var buf [1000]byte
+	n, _, err := ttConn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := bytes.Repeat([]byte("Y"), mtu); !bytes.Equal(buf[:n], expected) {
+		t.Errorf("got packet %+q, expected %+q", buf[:n], expected)
+	}
+}
+
+func TestMaxUpstreamPacket(t *testing.T) {
+	for _, test := range []struct {
+		domain   string
+		expected int
+	}{
+		{".", 147},
+		{"t.example.com", 138},
+	} {
+		if n := maxUpstreamPacket(mustParseName(test.domain)); n != test.expected {
+			t.Errorf("%q: got %d, expected %d", test.domain, n, test.expected)
+		}
+	}
+}
+
+func TestKCPMTU(t *testing.T) {
+	if mtu, err := kcpMTU(1000); err != nil || mtu != 998 {
+		t.Errorf("1000: got (%d, %v), expected (998, nil)", mtu, err)
+	}
+	if _, err := kcpMTU(81); err == nil {
+		t.Errorf("81: no error")
+	}
+}
+
+func TestRecvLoopEmptyPayload(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	dnsConn, ch, ttConn, stop := startRecvLoop(domain, 1000)
+	defer stop()
+
+	// Queries with nothing after the ClientID, with only padding, and with
+	// an explicitly zero-length packet, are polling queries: they get a
+	// NOERROR response, but put no packets into ttConn.
+	for _, payload := range [][]byte{
+		clientID[:],
+		append(clientID[:], 0xe0+3, 'p', 'a', 'd'),
+		append(clientID[:], 0),
+	} {
+		rec := injectPayload(t, dnsConn, ch, domain, payload)
+		if rec.Resp.Rcode() != dns.RcodeNoError || rec.ClientID != clientID {
+			t.Errorf("%+q: expected NOERROR for %v, got %+v", payload, clientID, rec)
+		}
+	}
+	// The first packet in ttConn is the one from the following query.
+	injectQuery(t, dnsConn, ch, domain, clientID, []byte("after"))
+	var buf [1000]byte
+	n, _, err := ttConn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], []byte("after")) {
+		t.Errorf("got packet %+q, expected %+q", buf[:n], "after")
+	}
+}
+
+func TestRecvLoopShortPayload(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	dnsConn, ch, _, stop := startRecvLoop(domain, 1000)
+	defer stop()
+
+	// Payloads shorter than a ClientID, whether empty or not, get
+	// NXDOMAIN, as a base32 error does. They are counted separately.
+	before := map[string]uint64{}
+	for _, reason := range []string{"base32", "empty", "short"} {
+		before[reason] = queriesUndecodable.With(reason).Value()
+	}
+	for _, payload := range [][]byte{
+		{},
+		{1},
+		{1, 2, 3, 4, 5, 6, 7},
+	} {
+		rec := injectPayload(t, dnsConn, ch, domain, payload)
+		if rec.Resp.Rcode() != dns.RcodeNameError {
+			t.Errorf("%+q: expected NXDOMAIN, got %+v", payload, rec.Resp)
+		}
+	}
+	// Invalid base32 is counted as such.
+	query := tunnelQuery(nil, domain)
+	query.Question[0].Name = mustParseName("a1.t.example.com")
+	buf, err := query.WireFormat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsConn.Inject(buf, turbotunnel.DummyAddr{})
+	select {
+	case rec := <-ch:
+		if rec.Resp.Rcode() != dns.RcodeNameError {
+			t.Errorf("base32: expected NXDOMAIN, got %+v", rec.Resp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a record")
+	}
+	for reason, expected := range map[string]uint64{"base32": 1, "empty": 1, "short": 2} {
+		if n := queriesUndecodable.With(reason).Value() - before[reason]; n != expected {
+			t.Errorf("%s: counted %d, expected %d", reason, n, expected)
+		}
+	}
+}
+
+func TestRecvLoopDebugUpstreamBudget(t *testing.T) {
+	defer func(saved bool) { debugUpstreamBudget = saved }(debugUpstreamBudget)
+	debugUpstreamBudget = true
+	var buf syncBuffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	domain := mustParseName("t.example.com")
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	dnsConn, ch, _, stop := startRecvLoop(domain, 1000)
+	defer stop()
+
+	// A polling query is not logged; only the first query with a packet
+	// is.
+	injectQuery(t, dnsConn, ch, domain, clientID)
+	injectQuery(t, dnsConn, ch, domain, clientID, []byte("hello"))
+	injectQuery(t, dnsConn, ch, domain, clientID, []byte("again"))
+
+	// 14 decoded bytes take 23 base32 characters, in a 24-byte label.
+	expected := "upstream budget 0102030405060708: name 39 of 255 bytes: domain 15, encoding 10, ClientID 8, padding and prefixes 1, packets 5; room for 138 bytes of packets per query\n"
+	if n := strings.Count(buf.String(), "upstream budget"); n != 1 || !strings.HasSuffix(buf.String(), expected) {
+		t.Errorf("log %q, expected one line %q", buf.String(), expected)
+	}
+}
+
+func TestMaxUpstreamPayload(t *testing.T) {
+	for _, test := range []struct {
+		domain   string
+		expected int
+	}{
+		{".", 156},
+		{"t.example.com", 147},
+	} {
+		if n := maxUpstreamPayload(mustParseName(test.domain)); n != test.expected {
+			t.Errorf("%q: got %d, expected %d", test.domain, n, test.expected)
+		}
+	}
+}
+
+func TestRecvLoopWarmup(t *testing.T) {
+	defer atomic.StoreInt32(&warmingUp, 0)
+	atomic.StoreInt32(&warmingUp, 1)
+
+	domain := mustParseName("t.example.com")
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	dnsConn, ch, ttConn, stop := startRecvLoop(domain, 1000)
+	defer stop()
+
+	// While warming up, tunnel queries get SERVFAIL, and their packets
+	// are ignored.
+	rec := injectQuery(t, dnsConn, ch, domain, clientID, []byte("early"))
+	if rec.Resp.Rcode() != dns.RcodeServerFailure {
+		t.Errorf("warming up: expected SERVFAIL, got %+v", rec.Resp)
+	}
+
+	atomic.StoreInt32(&warmingUp, 0)
+	rec = injectQuery(t, dnsConn, ch, domain, clientID, []byte("ready"))
+	if rec.Resp.Rcode() != dns.RcodeNoError {
+		t.Errorf("ready: expected NOERROR, got %+v", rec.Resp)
+	}
+	var buf [1000]byte
+	n, _, err := ttConn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], []byte("ready")) {
+		t.Errorf("got packet %+q, expected %+q", buf[:n], "ready")
+	}
+}
+
+func TestRecvLoopReorderedQueries(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	dnsConn, ch, ttConn, stop := startRecvLoop(domain, 1000)
+	defer stop()
+
+	ln, err := kcp.ServeConn(nil, 0, 0, ttConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Have a client KCP session send some data, and capture the packets it
+	// sends. The MTU must be small enough for every packet to fit in a
+	// query name.
+	const mtu = 120
+	data := make([]byte, 2000)
+	rand.New(rand.NewSource(0)).Read(data)
+	clientConn := newFakePacketConn()
+	const conv = 0x01020304
+	client := newTestKCPConn(t, conv, clientID, clientConn)
+	client.SetMtu(mtu)
+	client.SetWindowSize(128, 128)
+	client.SetNoDelay(0, 0, 0, 1)
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	// Each KCP segment has a 24-byte header.
+	const segmentLen = mtu - 24
+	expectedLen := len(data) + 24*((len(data)+segmentLen-1)/segmentLen)
+	var packets [][]byte
+	for n := 0; n < expectedLen; {
+		p := expectWritten(t, clientConn).P
+		packets = append(packets, p)
+		n += len(p)
+	}
+	client.Close()
+	clientConn.Close()
+
+	// Deliver the packets in a shuffled order, one per query.
+	for _, i := range rand.New(rand.NewSource(0)).Perm(len(packets)) {
+		injectQuery(t, dnsConn, ch, domain, clientID, packets[i])
+	}
+	if len(packets) > 1 {
+		// Deliver the first one again, late, to be sure that
+		// duplicates are harmless too.
+		injectQuery(t, dnsConn, ch, domain, clientID, packets[0])
+	}
+
+	conn, err := ln.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.GetConv() != conv {
+		t.Errorf("server session has conv %08x, expected %08x", conn.GetConv(), conv)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("data was not reconstructed correctly")
+	}
+}
+
+// roamingClientConn is the client side of a tunnel, as a net.PacketConn for a
+// client KCP session. It sends each packet in its own tunnel query, and polls
+// with empty queries, injecting the queries into a server's fakePacketConn
+// from an address that can be changed with SetAddr, as when a client moves
+// from one network to another. It takes the packets out of the responses the
+// server writes, and counts the responses sent to each address. DropNext
+// makes it lose a response, as on a lossy link.
+type roamingClientConn struct {
+	server   *fakePacketConn
+	domain   dns.Name
+	clientID turbotunnel.ClientID
+	incoming chan []byte
+	closed   chan struct{}
+	lock     sync.Mutex
+	addr     net.Addr
+	sentTo   map[string]int
+	dropNext int32
+}
+
+func newRoamingClientConn(server *fakePacketConn, domain dns.Name, clientID turbotunnel.ClientID, addr net.Addr) *roamingClientConn {
+	c := &roamingClientConn{
+		server:   server,
+		domain:   domain,
+		clientID: clientID,
+		incoming: make(chan []byte, 100),
+		closed:   make(chan struct{}),
+		addr:     addr,
+		sentTo:   make(map[string]int),
+	}
+	go c.pollLoop()
+	go c.responseLoop()
+	return c
+}
+
+// SetAddr changes the address that future queries come from.
+func (c *roamingClientConn) SetAddr(addr net.Addr) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.addr = addr
+}
+
+// DropNext makes the client ignore the next response that carries data.
+func (c *roamingClientConn) DropNext() {
+	atomic.StoreInt32(&c.dropNext, 1)
+}
+
+// SentTo returns the number of responses the server has sent to addr.
+func (c *roamingClientConn) SentTo(addr net.Addr) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sentTo[addr.String()]
+}
+
+func (c *roamingClientConn) query(p []byte) {
+	payload := append([]byte(nil), c.clientID[:]...)
+	if p != nil {
+		payload = append(payload, byte(len(p)))
+		payload = append(payload, p...)
+	}
+	buf, err := tunnelQuery(payload, c.domain).WireFormat()
+	if err != nil {
+		panic(err)
+	}
+	c.lock.Lock()
+	addr := c.addr
+	c.lock.Unlock()
+	c.server.Inject(buf, addr)
+}
+
+func (c *roamingClientConn) pollLoop() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-time.After(10 * time.Millisecond):
+			c.query(nil)
+		}
+	}
+}
+
+func (c *roamingClientConn) responseLoop() {
+	for {
+		var m taggedMessage
+		select {
+		case <-c.closed:
+			return
+		case m = <-c.server.Written:
+		}
+		c.lock.Lock()
+		c.sentTo[m.Addr.String()]++
+		c.lock.Unlock()
+		resp, err := dns.MessageFromWireFormat(m.P)
+		if err != nil || len(resp.Answer) != 1 {
+			continue
+		}
+		payload, err := dns.DecodeRDataTXT(resp.Answer[0].Data)
+		if err != nil {
+			continue
+		}
+		if len(payload) > 0 && atomic.CompareAndSwapInt32(&c.dropNext, 1, 0) {
+			continue
+		}
+		for len(payload) >= 2 {
+			n := int(binary.BigEndian.Uint16(payload))
+			if len(payload) < 2+n {
+				break
+			}
+			select {
+			case c.incoming <- payload[2 : 2+n]:
+			case <-c.closed:
+				return
+			}
+			payload = payload[2+n:]
+		}
+	}
+}
+
+func (c *roamingClientConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, io.EOF
+	case buf := <-c.incoming:
+		return copy(p, buf), turbotunnel.DummyAddr{}, nil
+	}
+}
+
+func (c *roamingClientConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	c.query(p)
+	return len(p), nil
+}
+
+func (c *roamingClientConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+func (c *roamingClientConn) LocalAddr() net.Addr                { return turbotunnel.DummyAddr{} }
+func (c *roamingClientConn) SetDeadline(t time.Time) error      { return nil }
+func (c *roamingClientConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *roamingClientConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// startTunnelLoops runs recvLoop and sendLoop, with a real clock, on a fake
+// connection for domain, as run does, and returns the connection and ttConn.
+// The returned function stops both loops.
+func startTunnelLoops(domain dns.Name) (*fakePacketConn, *turbotunnel.QueuePacketConn, func()) {
+	dnsConn := newFakePacketConn()
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	ch := make(chan *record, 100)
+	recvDone := make(chan struct{})
+	go func() {
+		recvLoop(domain, dnsConn, ttConn, ch, 1000, nil)
+		close(recvDone)
+	}()
+	sendDone := make(chan struct{})
+	go func() {
+		sendLoop(dnsConn, ttConn, ch, computeMaxEncodedPayload(responseSizeLimit()), realClock{})
+		close(sendDone)
+	}()
+	return dnsConn, ttConn, func() {
+		dnsConn.Close()
+		<-recvDone
+		<-sendDone
+	}
+}
+
+// Stopping recvLoop, while queries are still arriving and sendLoop is still
+// reading from the channel between them, must neither panic nor leave sendLoop
+// running. Run with -race.
+func TestRecvLoopSendLoopStartStop(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53000}
+	for i := 0; i < 50; i++ {
+		dnsConn, _, stop := startTunnelLoops(domain)
+		go func() {
+			for j := 0; j < 20; j++ {
+				payload := []byte{1, 2, 3, 4, 5, 6, 7, byte(j), 0}
+				buf, err := tunnelQuery(payload, domain).WireFormat()
+				if err != nil {
+					panic(err)
+				}
+				dnsConn.Inject(buf, addr)
+			}
+		}()
+		time.Sleep(time.Duration(i%5) * time.Millisecond)
+		stopped := make(chan struct{})
+		go func() {
+			stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("cycle %d: loops did not stop", i)
+		}
+	}
+}
+
+// Sessions are identified by ClientID, not by source address: a client whose
+// queries start coming from a new address, in the middle of a session, keeps
+// its session, and gets its responses at the new address.
+func TestClientAddrChange(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	oldAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53000}
+	newAddr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 41000}
+
+	dnsConn, ttConn, stop := startTunnelLoops(domain)
+
+	ln, err := kcp.ServeConn(nil, 0, 0, ttConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	clientConn := newRoamingClientConn(dnsConn, domain, clientID, oldAddr)
+	client := newTestKCPConn(t, 0x01020304, clientID, clientConn)
+	client.SetMtu(120)
+	client.SetNoDelay(0, 0, 0, 1)
+	echo := func(data []byte) {
+		t.Helper()
+		if _, err := client.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(10 * time.Second))
+		received := make([]byte, len(data))
+		if _, err := io.ReadFull(client, received); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, data) {
+			t.Fatalf("echoed data differs")
+		}
+	}
+
+	echo(bytes.Repeat([]byte("before"), 100))
+	clientConn.SetAddr(newAddr)
+	echo(bytes.Repeat([]byte("after"), 100))
+	if n := clientConn.SentTo(newAddr); n == 0 {
+		t.Errorf("no responses were sent to the new address")
+	}
+
+	// The server still has only the one session.
+	ln.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	if conn, err := ln.AcceptKCP(); err == nil {
+		conn.Close()
+		t.Errorf("server accepted a second session after the address change")
+	}
+
+	client.Close()
+	clientConn.Close()
+	stop()
+}
+
+// lossyDownstreamTime sends rounds messages from a server KCP session to a
+// client over a link that loses the first response carrying each message, and
+// returns how long it took, with repeatDownstream set to repeat.
+func lossyDownstreamTime(t *testing.T, repeat bool, rounds int) time.Duration {
+	t.Helper()
+	defer func(saved bool) { repeatDownstream = saved }(repeatDownstream)
+	repeatDownstream = repeat
+
+	domain := mustParseName("t.example.com")
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	dnsConn, ttConn, stop := startTunnelLoops(domain)
+	defer stop()
+	ln, err := kcp.ServeConn(nil, 0, 0, ttConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	clientConn := newRoamingClientConn(dnsConn, domain, clientID, turbotunnel.DummyAddr{})
+	defer clientConn.Close()
+	client := newTestKCPConn(t, 0x01020304, clientID, clientConn)
+	defer client.Close()
+	client.SetMtu(120)
+	client.SetNoDelay(0, 0, 0, 1)
+
+	// The client speaks first, so that the server has a session.
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	ln.SetDeadline(time.Now().Add(10 * time.Second))
+	conn, err := ln.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var buf [100]byte
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(conn, buf[:5]); err != nil {
+		t.Fatal(err)
+	}
+	// Let the server's acknowledgement of "hello" get through.
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	for i := 0; i < rounds; i++ {
+		clientConn.DropNext()
+		msg := []byte(fmt.Sprintf("message %d", i))
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.ReadFull(client, buf[:len(msg)]); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:len(msg)], msg) {
+			t.Fatalf("got %+q, expected %+q", buf[:len(msg)], msg)
+		}
+		if atomic.LoadInt32(&clientConn.dropNext) != 0 {
+			t.Fatalf("round %d: no response was lost", i)
+		}
+	}
+	return time.Since(start)
+}
+
+// With -repeat-downstream, a lost response is recovered from the next one,
+// without waiting for KCP to retransmit, which it does only after at least
+// its minimum RTO of 100 ms.
+func TestRepeatDownstreamLossy(t *testing.T) {
+	const rounds = 5
+	without := lossyDownstreamTime(t, false, rounds)
+	with := lossyDownstreamTime(t, true, rounds)
+	t.Logf("%d lost responses recovered in %v without -repeat-downstream, %v with", rounds, without, with)
+	if without < rounds*100*time.Millisecond {
+		t.Errorf("without -repeat-downstream: recovered in %v, faster than KCP retransmission", without)
+	}
+	if with >= without/2 {
+		t.Errorf("with -repeat-downstream: recovered in %v, not much faster than %v without", with, without)
+	}
+}
+
+func TestMaxTunnelGoroutines(t *testing.T) {
+	defer func(saved int) { maxTunnelGoroutines = saved }(maxTunnelGoroutines)
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	keys := &noise.LocalKeyProvider{}
+	if err := keys.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	pubkey := keys.Pubkey()
+	upstreamLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstreamLn.Close()
+
+	domain := mustParseName("t.example.com")
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	dnsConn, ttConn, stop := startTunnelLoops(domain)
+	defer stop()
+	ln, err := kcp.ServeConn(nil, 0, 0, ttConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Room for one session and one stream.
+	before := tunnelGoroutines.Value()
+	maxTunnelGoroutines = int(before) + 1 + 3
+	rejectedBefore := tunnelGoroutinesRejected.With("stream").Value()
+	go acceptSessions(ln, keys, computeMaxEncodedPayload(responseSizeLimit())-2,
+		newUpstreamDialer(upstreamLn.Addr().String(), 0), nil)
+
+	clientConn := newRoamingClientConn(dnsConn, domain, clientID, turbotunnel.DummyAddr{})
+	defer clientConn.Close()
+	client := newTestKCPConn(t, 0x01020304, clientID, clientConn)
+	defer client.Close()
+	client.SetStreamMode(true)
+	client.SetMtu(120)
+	client.SetNoDelay(0, 0, 0, 1)
+	rw, err := noise.NewClient(client, pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = 2
+	sess, err := smux.Client(rw, smuxConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	// The first stream fits in the budget and reaches the upstream.
+	stream1, err := sess.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream1.Close()
+	stream1.Write([]byte("1"))
+	upstreamLn.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+	upstreamConn, err := upstreamLn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstreamConn.Close()
+
+	// The second stream would exceed it, and is closed.
+	stream2, err := sess.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream2.Close()
+	stream2.Write([]byte("2"))
+	stream2.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := stream2.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("second stream: read error %v, expected EOF", err)
+	}
+	if n := tunnelGoroutinesRejected.With("stream").Value() - rejectedBefore; n != 1 {
+		t.Errorf("%d streams rejected, expected 1", n)
+	}
+	if n := tunnelGoroutines.Value() - before; n != 4 {
+		t.Errorf("%d goroutines counted, expected 4", n)
+	}
+}
+
+// newTestKCPConn returns a client KCP session with the conversation ID conv,
+// which sends its packets through pconn, addressed to clientID. kcp.NewConn2,
+// which dnstt-client uses, chooses conv at random; a fixed conv makes session
+// identifiers, and the server log messages that contain them, reproducible.
+func newTestKCPConn(t *testing.T, conv uint32, clientID turbotunnel.ClientID, pconn net.PacketConn) *kcp.UDPSession {
+	t.Helper()
+	conn, err := kcp.NewConn3(conv, clientID, nil, 0, 0, pconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readResponse waits for a response to be written to dnsConn and parses it.
+func readResponse(t *testing.T, dnsConn *fakePacketConn) dns.Message {
+	t.Helper()
+	resp, err := dns.MessageFromWireFormat(expectWritten(t, dnsConn).P)
+	if err != nil {
+		t.Fatalf("cannot parse response: %v", err)
+	}
+	return resp
+}
+
+func TestRunWithConn(t *testing.T) {
+	keys := &noise.LocalKeyProvider{}
+	if err := keys.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	domain := mustParseName("t.example.com")
+	dnsConn := newFakePacketConn()
+	done := make(chan error)
+	go func() {
+		done <- run(keys, domain, newUpstreamDialer("127.0.0.1:1", 0), []net.PacketConn{dnsConn})
+	}()
+
+	// A query outside the domain gets an immediate NXDOMAIN.
+	query := tunnelQuery([]byte("CLIENTID"), mustParseName("example.com"))
+	query.ID = 1
+	buf, _ := query.WireFormat()
+	dnsConn.Inject(buf, turbotunnel.DummyAddr{})
+	if resp := readResponse(t, dnsConn); resp.ID != 1 || resp.Rcode() != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN for ID 1, got %+v", resp)
+	}
+
+	// A tunnel query gets a NOERROR response, sent immediately when
+	// another query arrives.
+	for _, id := range []uint16{2, 3} {
+		query := tunnelQuery([]byte("CLIENTID"), domain)
+		query.ID = id
+		buf, _ := query.WireFormat()
+		dnsConn.Inject(buf, turbotunnel.DummyAddr{})
+	}
+	if resp := readResponse(t, dnsConn); resp.ID != 2 || resp.Rcode() != dns.RcodeNoError || len(resp.Answer) != 1 {
+		t.Errorf("expected NOERROR with answer for ID 2, got %+v", resp)
+	}
+
+	// Closing the conn makes run return.
+	dnsConn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("run did not return after its conn was closed")
+	}
+}
+
+// queueClientConn is the client side of a KCP session whose server side is
+// the listener on a QueuePacketConn: it writes packets as incoming packets from
+// clientID, and reads those queued to be sent to clientID.
+type queueClientConn struct {
+	clientID  turbotunnel.ClientID
+	server    *turbotunnel.QueuePacketConn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newQueueClientConn(clientID turbotunnel.ClientID, server *turbotunnel.QueuePacketConn) *queueClientConn {
+	return &queueClientConn{clientID: clientID, server: server, closed: make(chan struct{})}
+}
+
+func (c *queueClientConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, io.EOF
+	case packet := <-c.server.OutgoingQueue(c.clientID):
+		return copy(p, packet), turbotunnel.DummyAddr{}, nil
+	}
+}
+
+func (c *queueClientConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.server.QueueIncoming(p, c.clientID)
+	return len(p), nil
+}
+
+func (c *queueClientConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *queueClientConn) LocalAddr() net.Addr                { return turbotunnel.DummyAddr{} }
+func (c *queueClientConn) SetDeadline(t time.Time) error      { return nil }
+func (c *queueClientConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *queueClientConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// A burst of new sessions, several times the size of the KCP library's fixed
+// accept backlog of 128, are all accepted: acceptSessions drains the backlog
+// without blocking, and the first packets of any sessions that find it full
+// are retransmitted.
+func TestAcceptSessionsBurst(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	keys := &noise.LocalKeyProvider{}
+	if err := keys.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	ln, err := kcp.ServeConn(nil, 0, 0, ttConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- acceptSessions(ln, keys, 1000, newUpstreamDialer("127.0.0.1:1", 0), nil)
+	}()
+
+	const numSessions = 3 * 128
+	clientIDs := make([]turbotunnel.ClientID, numSessions)
+	for i := range clientIDs {
+		clientIDs[i] = turbotunnel.ClientID{0xbb, 0xbb, byte(i >> 8), byte(i)}
+		pconn := newQueueClientConn(clientIDs[i], ttConn)
+		defer pconn.Close()
+		conn := newTestKCPConn(t, 0xbbbb0000+uint32(i), clientIDs[i], pconn)
+		defer conn.Close()
+		// Something for KCP to send, to start the session.
+		if _, err := conn.Write([]byte{0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, clientID := range clientIDs {
+			sessions.CloseClientID(clientID)
+		}
+		ln.Close()
+		<-done
+	}()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for _, clientID := range clientIDs {
+		for !sessions.HasClientID(clientID) {
+			if time.Now().After(deadline) {
+				t.Fatalf("session for %v not accepted", clientID)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestSendLoopAnswerName(t *testing.T) {
+	defer func(saved string) { experimentalAnswerName = saved }(experimentalAnswerName)
+
+	// The root name saves 1 byte over a compression pointer.
+	experimentalAnswerName = "question"
+	questionPayload := computeMaxEncodedPayload(maxUDPPayload)
+	experimentalAnswerName = "root"
+	rootPayload := computeMaxEncodedPayload(maxUDPPayload)
+	if rootPayload != questionPayload+1 {
+		t.Errorf("root name allows %d bytes, question name %d", rootPayload, questionPayload)
+	}
+
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	ch, dnsConn, clk, stop := startSendLoop(ttConn)
+	defer stop()
+	ch <- tunnelRecord(clientID)
+	expectEvent(t, clk, maxResponseDelay)
+	clk.Advance(maxResponseDelay)
+	resp := readResponse(t, dnsConn)
+	if len(resp.Answer) != 1 || len(resp.Answer[0].Name) != 0 {
+		t.Errorf("expected an answer with the root name, got %+v", resp.Answer)
+	}
+}
+
+func TestSendLoopMaxResponseSize(t *testing.T) {
+	defer func(saved int) { maxResponseSize = saved }(maxResponseSize)
+	maxResponseSize = 600
+
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	dnsConn := newFakePacketConn()
+	ch := make(chan *record)
+	done := make(chan struct{})
+	go func() {
+		sendLoop(dnsConn, ttConn, ch, computeMaxEncodedPayload(responseSizeLimit()), realClock{})
+		close(done)
+	}()
+	defer func() {
+		close(ch)
+		<-done
+	}()
+
+	// Queue more data than fits in one response. Every response must fit
+	// within the limit without being truncated.
+	const numPackets = 20
+	for i := 0; i < numPackets; i++ {
+		ttConn.WriteTo(bytes.Repeat([]byte{byte(i)}, 100), clientID)
+	}
+	received := 0
+	for received < numPackets {
+		ch <- tunnelRecord(clientID)
+		m := expectWritten(t, dnsConn)
+		if len(m.P) > maxResponseSize {
+			t.Fatalf("response of %d bytes exceeds limit of %d", len(m.P), maxResponseSize)
+		}
+		if m.P[2]&0x02 != 0 {
+			t.Fatalf("response was truncated")
+		}
+		received += len(responsePackets(t, m.P))
+	}
+	if received != numPackets {
+		t.Errorf("received %d packets, expected %d", received, numPackets)
+	}
+}
+
+// A first packet too large for a response is sent anyway and truncated, losing
+// downstream data; that is logged as a distinct event.
+func TestSendLoopAnswerTruncated(t *testing.T) {
+	var buf syncBuffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	dnsConn := newFakePacketConn()
+	ch := make(chan *record)
+	done := make(chan struct{})
+	go func() {
+		sendLoop(dnsConn, ttConn, ch, computeMaxEncodedPayload(responseSizeLimit()), realClock{})
+		close(done)
+	}()
+	defer func() {
+		close(ch)
+		<-done
+	}()
+
+	before := responsesAnswerTruncated.Value()
+	ttConn.WriteTo(make([]byte, maxUDPPayload+100), clientID)
+	ch <- tunnelRecord(clientID)
+	m := expectWritten(t, dnsConn)
+	if len(m.P) != responseSizeLimit() || m.P[2]&0x02 == 0 {
+		t.Fatalf("expected a truncated response of %d bytes, got %d bytes", responseSizeLimit(), len(m.P))
+	}
+	if n := responsesAnswerTruncated.Value() - before; n != 1 {
+		t.Errorf("counted %d, expected 1", n)
+	}
+	if expected := "0102030405060708: dropped "; !strings.Contains(buf.String(), expected) {
+		t.Errorf("log %q does not contain %q", buf.String(), expected)
+	}
+}
+
+func TestTruncatedAnswerBytes(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	resp, _ := responseFor(tunnelQuery([]byte("CLIENTID"), domain), domain)
+	resp.Answer = []dns.RR{{Name: dns.Name{}, Type: dns.RRTypeTXT, Class: dns.ClassIN, Data: make([]byte, 100)}}
+	start, _ := (&dns.Message{ID: resp.ID, Flags: resp.Flags, Question: resp.Question}).WireFormat()
+	whole, _ := resp.WireFormat()
+	// The OPT RR is 11 bytes.
+	end := len(whole) - 11
+	for _, test := range []struct {
+		limit, dropped int
+	}{
+		{len(whole), 0},
+		{end, 0},
+		{end - 1, 1},
+		{len(start) + 1, end - len(start) - 1},
+		// When the Question section is cut too, only the Answer
+		// section counts as lost.
+		{len(start) - 1, end - len(start)},
+	} {
+		if dropped := truncatedAnswerBytes(resp, test.limit); dropped != test.dropped {
+			t.Errorf("limit %d: got %d, expected %d", test.limit, dropped, test.dropped)
+		}
+	}
+	resp.Answer = nil
+	if dropped := truncatedAnswerBytes(resp, 12); dropped != 0 {
+		t.Errorf("no Answer: got %d", dropped)
+	}
+}
+
+// startHandleStream runs handleStream on the server side of an smux stream
+// whose upstream is a TCP listener, and returns the client side of the stream
+// and the listener.
+func startHandleStream(t *testing.T) (*smux.Stream, net.Listener, func()) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientStream, stop := startHandleStreamWith(t, newUpstreamDialer(ln.Addr().String(), 0))
+	return clientStream, ln, func() {
+		ln.Close()
+		stop()
+	}
+}
+
+// startHandleStreamWith runs handleStream with upstream on the server side of
+// an smux stream, and returns the client side of the stream.
+func startHandleStreamWith(t *testing.T, upstream *upstreamDialer) (*smux.Stream, func()) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = 2
+	serverSess, err := smux.Server(serverConn, smuxConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSess, err := smux.Client(clientConn, smuxConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientStream, err := clientSess.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// smux does not tell the server about a stream until the client
+	// writes something, so AcceptStream happens in the background.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stream, err := serverSess.AcceptStream()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		handleStream(stream, upstream, 0x01020304, turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}, &streamEntry{})
+	}()
+	return clientStream, func() {
+		clientSess.Close()
+		serverSess.Close()
+		<-done
+	}
+}
+
+func TestHandleStreamUpstreamCloses(t *testing.T) {
+	defer func(saved int) { downloadBuffer = saved }(downloadBuffer)
+	for _, downloadBuffer = range []int{0, 4096} {
+		testHandleStreamUpstreamCloses(t)
+	}
+}
+
+func testHandleStreamUpstreamCloses(t *testing.T) {
+	clientStream, ln, stop := startHandleStream(t)
+	defer stop()
+
+	// The upstream reads a request, sends a large final chunk, and closes.
+	// The client receives all of the chunk before EOF.
+	response := make([]byte, 256*1024)
+	rand.New(rand.NewSource(0)).Read(response)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var request [5]byte
+		if _, err := io.ReadFull(conn, request[:]); err != nil {
+			return
+		}
+		conn.Write(response)
+	}()
+
+	if _, err := clientStream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	clientStream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received, err := ioutil.ReadAll(clientStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, response) {
+		t.Fatalf("received %d bytes, expected %d", len(received), len(response))
+	}
+}
+
+func TestHandleStreamClientCloses(t *testing.T) {
+	clientStream, ln, stop := startHandleStream(t)
+	defer stop()
+
+	// The client sends a large request and closes the stream. The
+	// upstream receives all of the request before EOF.
+	request := make([]byte, 256*1024)
+	rand.New(rand.NewSource(0)).Read(request)
+	receivedCh := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			receivedCh <- nil
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		received, _ := ioutil.ReadAll(conn)
+		receivedCh <- received
+	}()
+
+	if _, err := clientStream.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	clientStream.Close()
+	received := <-receivedCh
+	if !bytes.Equal(received, request) {
+		t.Fatalf("received %d bytes, expected %d", len(received), len(request))
+	}
+}
+
+func TestHandleStreamFirstByteTimeout(t *testing.T) {
+	defer func(saved time.Duration) { firstByteTimeout = saved }(firstByteTimeout)
+	firstByteTimeout = 100 * time.Millisecond
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// A stream that sends and receives nothing is closed, along with its
+	// upstream connection, soon after the timeout.
+	clientStream, ln, stop := startHandleStream(t)
+	defer stop()
+	before := streamsFirstByteTimeout.Value()
+	start := time.Now()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("upstream read %d bytes, error %v, expected EOF", n, err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stream closed after %v, expected about %v", elapsed, firstByteTimeout)
+	}
+	clientStream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clientStream.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("client read error %v, expected EOF", err)
+	}
+	if n := streamsFirstByteTimeout.Value() - before; n != 1 {
+		t.Errorf("counted %d timeouts, expected 1", n)
+	}
+
+	// A stream that has copied data stays open past the timeout.
+	clientStream2, ln2, stop2 := startHandleStream(t)
+	defer stop2()
+	if _, err := clientStream2.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	conn2, err := ln2.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	conn2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn2, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * firstByteTimeout)
+	if _, err := conn2.Write([]byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	clientStream2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf [1]byte
+	if _, err := io.ReadFull(clientStream2, buf[:]); err != nil || buf[0] != 'y' {
+		t.Errorf("after the timeout: read %q, error %v", buf[:], err)
+	}
+}
+
+func TestHandleStreamMaxLifetime(t *testing.T) {
+	defer func(saved time.Duration) { streamMaxLifetime = saved }(streamMaxLifetime)
+	streamMaxLifetime = 200 * time.Millisecond
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// A stream that is busy copying data in both directions is still closed
+	// at its lifetime.
+	clientStream, ln, stop := startHandleStream(t)
+	defer stop()
+	before := streamsMaxLifetime.Value()
+	start := time.Now()
+	if _, err := clientStream.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, clientStream)
+	go func() {
+		for {
+			if _, err := clientStream.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	go func() {
+		for {
+			if _, err := conn.Write([]byte("y")); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+		t.Fatalf("upstream read error %v, expected EOF", err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < streamMaxLifetime || elapsed > 2*time.Second {
+		t.Errorf("stream closed after %v, expected about %v", elapsed, streamMaxLifetime)
+	}
+	if n := streamsMaxLifetime.Value() - before; n != 1 {
+		t.Errorf("counted %d lifetime closures, expected 1", n)
+	}
+}
+
+func TestHandleStreamSlowDial(t *testing.T) {
+	defer func(saved time.Duration) { slowDialThreshold = saved }(slowDialThreshold)
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	// Resolving the upstream host name takes 50 ms.
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	upstream := newUpstreamDialer(net.JoinHostPort("upstream.example", port), time.Nanosecond)
+	upstream.lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		time.Sleep(50 * time.Millisecond)
+		return []net.IPAddr{{IP: net.IP{127, 0, 0, 1}}}, nil
+	}
+
+	for _, test := range []struct {
+		threshold time.Duration
+		slow      bool
+	}{
+		{0, false},
+		{5 * time.Second, false},
+		{10 * time.Millisecond, true},
+	} {
+		slowDialThreshold = test.threshold
+		logBuf.Reset()
+		before := upstreamSlowDials.Value()
+		clientStream, stop := startHandleStreamWith(t, upstream)
+		clientStream.Write([]byte("x"))
+		// The upstream closes the connection, so the stream ends.
+		clientStream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		ioutil.ReadAll(clientStream)
+		stop()
+
+		logged := strings.Contains(logBuf.String(), "slow upstream dial to "+ln.Addr().String())
+		counted := upstreamSlowDials.Value() - before
+		if test.slow && (!logged || counted != 1) {
+			t.Errorf("threshold %v: logged %v, counted %d; expected a slow dial", test.threshold, logged, counted)
+		} else if !test.slow && (logged || counted != 0) {
+			t.Errorf("threshold %v: logged %v, counted %d; expected no slow dial", test.threshold, logged, counted)
+		}
+	}
+}
+
+func TestHandleStreamConfigureUpstreamConn(t *testing.T) {
+	defer func(saved func(net.Conn) error) { configureUpstreamConn = saved }(configureUpstreamConn)
+
+	for _, hookErr := range []error{nil, errors.New("cannot set mark")} {
+		configured := make(chan net.Addr, 1)
+		configureUpstreamConn = func(conn net.Conn) error {
+			configured <- conn.RemoteAddr()
+			return hookErr
+		}
+		clientStream, ln, stop := startHandleStream(t)
+
+		// The upstream echoes what it reads, then closes.
+		receivedCh := make(chan []byte, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				receivedCh <- nil
+				return
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var buf [5]byte
+			n, _ := io.ReadFull(conn, buf[:])
+			conn.Write(buf[:n])
+			receivedCh <- buf[:n]
+		}()
+		if _, err := clientStream.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		clientStream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply, _ := ioutil.ReadAll(clientStream)
+		received := <-receivedCh
+		stop()
+
+		select {
+		case addr := <-configured:
+			if addr.String() != ln.Addr().String() {
+				t.Errorf("%v: hook got a connection to %v, expected %v", hookErr, addr, ln.Addr())
+			}
+		default:
+			t.Errorf("%v: hook was not called", hookErr)
+		}
+		if hookErr == nil && (string(received) != "hello" || string(reply) != "hello") {
+			t.Errorf("upstream received %+q, client received %+q; expected %+q", received, reply, "hello")
+		}
+		// An error from the hook abandons the stream before any data
+		// is exchanged.
+		if hookErr != nil && (len(received) != 0 || len(reply) != 0) {
+			t.Errorf("%v: upstream received %+q, client received %+q; expected nothing", hookErr, received, reply)
+		}
+	}
+}
+
+func TestGenerateKeypair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnstt-keypair-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	privkeyFilename := filepath.Join(dir, "server.key")
+	pubkeyFilename := filepath.Join(dir, "server.pub")
+
+	if err := generateKeypair(privkeyFilename, pubkeyFilename); err != nil {
+		t.Fatal(err)
+	}
+	privkey, err := readKeyFromFile(privkeyFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey, err := readKeyFromFile(pubkeyFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pubkey, noise.PubkeyFromPrivkey(privkey)) {
+		t.Errorf("public key %x does not match private key", pubkey)
+	}
+
+	// If the public key cannot be written, the private key is deleted.
+	privkeyFilename = filepath.Join(dir, "other.key")
+	if err := generateKeypair(privkeyFilename, filepath.Join(dir, "nonexistent", "other.pub")); err == nil {
+		t.Fatalf("no error writing to a nonexistent directory")
+	}
+	if _, err := os.Stat(privkeyFilename); !os.IsNotExist(err) {
+		t.Errorf("private key was not deleted: %v", err)
+	}
+}
+
+func TestParseTunnelQTypes(t *testing.T) {
+	for _, test := range []struct {
+		s        string
+		expected map[uint16]bool
+	}{
+		{"TXT", map[uint16]bool{dns.RRTypeTXT: true}},
+		{"txt", map[uint16]bool{dns.RRTypeTXT: true}},
+		{" TXT, TXT ,", map[uint16]bool{dns.RRTypeTXT: true}},
+		{"", nil},
+		{",", nil},
+		{"A", nil},
+		{"NULL", nil},
+		{"TXT,CNAME", nil},
+		{"16", nil},
+	} {
+		qtypes, err := parseTunnelQTypes(test.s)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%+q: expected error, got %v", test.s, qtypes)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(qtypes, test.expected) {
+			t.Errorf("%+q: expected %v, got %v, %v", test.s, test.expected, qtypes, err)
+		}
+	}
+}
+
+func TestResponseForTunnelQTypes(t *testing.T) {
+	defer func(saved map[uint16]bool) { tunnelQTypes = saved }(tunnelQTypes)
+
+	domain := mustParseName("t.example.com")
+	query := func(qtype uint16) *dns.Message {
+		q := tunnelQuery([]byte("CLIENTID"), domain)
+		q.Question[0].Type = qtype
+		return q
+	}
+
+	// Accepted QTYPEs get a tunnel response; others get NXDOMAIN.
+	tunnelQTypes = map[uint16]bool{dns.RRTypeTXT: true}
+	resp, p := responseFor(query(dns.RRTypeTXT), domain)
+	if resp == nil || !isTunnelResponse(resp) || p == nil {
+		t.Errorf("TXT accepted: expected tunnel response, got %+v %+q", resp, p)
+	}
+	resp, p = responseFor(query(dns.RRTypeNS), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNameError || isTunnelResponse(resp) || p != nil {
+		t.Errorf("NS not accepted: expected NXDOMAIN, got %+v %+q", resp, p)
+	}
+
+	tunnelQTypes = map[uint16]bool{}
+	resp, p = responseFor(query(dns.RRTypeTXT), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNameError || isTunnelResponse(resp) || p != nil {
+		t.Errorf("TXT not accepted: expected NXDOMAIN, got %+v %+q", resp, p)
+	}
+}
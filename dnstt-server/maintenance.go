@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// maintenance is nonzero while the server is in maintenance mode, in which
+// recvLoop answers tunnel queries from ClientIDs that have no open session
+// with SERVFAIL and ignores their packets, so that no new sessions start,
+// while queries from ClientIDs with an open session are served as usual. It
+// is toggled at run time by a signal (see notifyToggleMaintenance). Access it
+// only with sync/atomic.
+var maintenance int32
+
+// setMaintenance turns maintenance mode on or off, and logs the change.
+func setMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&maintenance, v)
+	if on {
+		log.Printf("entering maintenance mode: refusing new sessions, %d open", sessions.Len())
+	} else {
+		log.Printf("leaving maintenance mode: accepting new sessions")
+	}
+}
+
+// toggleMaintenance turns maintenance mode on if it is off, and off if it is
+// on.
+func toggleMaintenance() {
+	setMaintenance(atomic.LoadInt32(&maintenance) == 0)
+}
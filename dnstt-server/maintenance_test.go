@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestRecvLoopMaintenance(t *testing.T) {
+	defer atomic.StoreInt32(&maintenance, atomic.LoadInt32(&maintenance))
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	domain := mustParseName("t.example.com")
+	established := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	newcomer := turbotunnel.ClientID{8, 7, 6, 5, 4, 3, 2, 1}
+	pconn := newFakePacketConn()
+	defer pconn.Close()
+	conn := newTestKCPConn(t, 0x01020304, established, pconn)
+	defer conn.Close()
+	sessions.Add(conn)
+	defer sessions.Remove(conn)
+
+	dnsConn, ch, ttConn, stop := startRecvLoop(domain, 1000)
+	defer stop()
+
+	setMaintenance(true)
+	// A ClientID without a session gets SERVFAIL, and its packets are
+	// ignored.
+	rec := injectQuery(t, dnsConn, ch, domain, newcomer, []byte("new"))
+	if rec.Resp.Rcode() != dns.RcodeServerFailure {
+		t.Errorf("new client: expected SERVFAIL, got %+v", rec.Resp)
+	}
+	// A ClientID with a session is served as usual.
+	rec = injectQuery(t, dnsConn, ch, domain, established, []byte("old"))
+	if rec.Resp.Rcode() != dns.RcodeNoError {
+		t.Errorf("established client: expected NOERROR, got %+v", rec.Resp)
+	}
+	var buf [1000]byte
+	n, addr, err := ttConn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != established || !bytes.Equal(buf[:n], []byte("old")) {
+		t.Errorf("got packet %+q from %v, expected %+q from %v", buf[:n], addr, "old", established)
+	}
+
+	toggleMaintenance()
+	rec = injectQuery(t, dnsConn, ch, domain, newcomer, []byte("new"))
+	if rec.Resp.Rcode() != dns.RcodeNoError {
+		t.Errorf("after maintenance: expected NOERROR, got %+v", rec.Resp)
+	}
+}
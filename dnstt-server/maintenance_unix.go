@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyToggleMaintenance arranges for the signal that toggles maintenance
+// mode, SIGUSR2, to be sent on c.
+func notifyToggleMaintenance(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// notifyToggleMaintenance does nothing on Windows, which has no SIGUSR2.
+// Maintenance mode is not available there.
+func notifyToggleMaintenance(c chan<- os.Signal) {
+}
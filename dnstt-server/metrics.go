@@ -0,0 +1,600 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// metrics is the registry of all the server's metrics. It is exported over
+// HTTP, in the Prometheus text format, when the -metrics option is used.
+var metrics = newMetricsRegistry()
+
+// Metrics updated throughout the server.
+var (
+	queriesReceived = metrics.NewCounter("dnstt_queries_total",
+		"DNS queries received.")
+	queriesBadQuestionCount = metrics.NewCounter("dnstt_queries_bad_question_count_total",
+		"DNS queries rejected because they did not have exactly one question.")
+	queriesPayloadTooLong = metrics.NewCounter("dnstt_queries_payload_too_long_total",
+		"Tunnel queries rejected because their name encoded more data than a name under the tunnel domain can hold.")
+	queriesTooManyLabels = metrics.NewCounter("dnstt_queries_too_many_labels_total",
+		"DNS queries rejected because their name had more labels than -max-query-labels.")
+	queriesExtraOPT = metrics.NewCounter("dnstt_queries_extra_opt_ignored_total",
+		"Extra OPT RRs in DNS queries ignored because of -lenient-edns.")
+	queriesUnknownEDNSOption = metrics.NewCounter("dnstt_queries_unknown_edns_option_total",
+		"DNS queries rejected by -strict-edns-options because of an unknown or malformed EDNS option.")
+	queriesSaturated = metrics.NewCounter("dnstt_queries_saturated_total",
+		"Tunnel queries answered with SERVFAIL by -saturation-servfail because the server was saturated.")
+	queriesSessionCooldown = metrics.NewCounter("dnstt_queries_session_cooldown_total",
+		"Tunnel queries dropped by -session-cooldown because they would have started a session too soon after the last one from the same ClientID.")
+	queriesUndecodable = metrics.NewCounterVec("dnstt_queries_undecodable_total",
+		"Tunnel queries answered with NXDOMAIN because no ClientID could be decoded from their name, by reason: \"base32\" for invalid base32, \"empty\" for no data, \"short\" for less data than a ClientID.",
+		"reason", 3)
+	dohRequests = metrics.NewCounterVec("dnstt_doh_requests_total",
+		"DNS over HTTPS requests, by the HTTP status code of the response.",
+		"status", 10)
+	dohSNIRejected = metrics.NewCounter("dnstt_doh_sni_rejected_total",
+		"DNS over HTTPS connections whose TLS handshake was refused because their server name was not in -doh-sni.")
+	dotHandshakesFailed = metrics.NewCounter("dnstt_dot_handshakes_failed_total",
+		"DNS over TLS connections closed because the TLS handshake failed.")
+	tcpWritesFailed = metrics.NewCounter("dnstt_tcp_writes_failed_total",
+		"Responses not completely written because a DNS over TCP connection failed or was closed.")
+	packetsOversized = metrics.NewCounter("dnstt_packets_oversized_total",
+		"Incoming packets dropped because they were larger than the KCP MTU.")
+	packetsImplausible = metrics.NewCounter("dnstt_packets_implausible_total",
+		"Incoming packets dropped by -check-packets because they could not be KCP packets.")
+	queryCost = metrics.NewHistogramVec("dnstt_query_cost_microseconds",
+		"Time taken to parse the queries sampled by -query-cost-sample and build responses to them.",
+		[]uint64{10, 25, 50, 100, 250, 500, 1000, 5000})
+	queriesCostSampled = metrics.NewCounterVec("dnstt_queries_cost_sampled_total",
+		"Queries sampled by -query-cost-sample, by source IP address.",
+		"source", queryCostMaxSources)
+	queryCostBySource = metrics.NewCounterVec("dnstt_query_cost_microseconds_total",
+		"Total time taken to parse the queries sampled by -query-cost-sample and build responses to them, by source IP address.",
+		"source", queryCostMaxSources)
+	responseSizes = metrics.NewHistogramVec("dnstt_response_size_bytes",
+		"Sizes of DNS responses sent, by RCODE and whether they were truncated.",
+		[]uint64{64, 128, 256, 512, 768, 1024, 1232, 1452}, "rcode", "truncated")
+	responsesAnswerTruncated = metrics.NewCounter("dnstt_responses_answer_truncated_total",
+		"Responses truncated so much that downstream data in the Answer section was lost.")
+	responsesSendRefused = metrics.NewCounter("dnstt_responses_send_refused_total",
+		"Responses whose send failed with ECONNREFUSED, the delayed report of an ICMP port unreachable; these are ignored.")
+	responsesDropped = metrics.NewCounter("dnstt_responses_dropped_total",
+		"Responses dropped because the queue of a -send-workers worker was full.")
+	sessionsActive = metrics.NewGauge("dnstt_sessions_active",
+		"KCP sessions currently open.")
+	streamsFirstByteTimeout = metrics.NewCounter("dnstt_streams_first_byte_timeout_total",
+		"Streams closed by -first-byte-timeout because no data was copied.")
+	streamsMaxLifetime = metrics.NewCounter("dnstt_streams_max_lifetime_total",
+		"Streams closed by -stream-max-lifetime.")
+	streamsActive = metrics.NewGauge("dnstt_streams_active",
+		"Streams currently open.")
+	tunnelGoroutines = metrics.NewGauge("dnstt_tunnel_goroutines",
+		"Goroutines currently running for sessions and streams, as counted against -max-tunnel-goroutines.")
+	tunnelGoroutinesRejected = metrics.NewCounterVec("dnstt_tunnel_goroutines_rejected_total",
+		"Sessions and streams closed because they would have exceeded -max-tunnel-goroutines, by kind: \"session\" or \"stream\".",
+		"kind", 2)
+	upstreamDenied = metrics.NewCounter("dnstt_upstream_denied_total",
+		"Upstream connections refused by -deny-private-upstream.")
+	upstreamSlowDials = metrics.NewCounter("dnstt_upstream_slow_dials_total",
+		"Upstream connections that took longer than -slow-dial-threshold to make.")
+	upstreamStaleResolutions = metrics.NewCounter("dnstt_upstream_stale_resolutions_total",
+		"Failed resolutions of the upstream host, after which the last addresses that resolved were used instead.")
+	upstreamBytes = metrics.NewCounter("dnstt_upstream_bytes_total",
+		"Stream bytes sent from clients to the upstream.")
+	downstreamBytes = metrics.NewCounter("dnstt_downstream_bytes_total",
+		"Stream bytes sent from the upstream to clients.")
+)
+
+// counter is a monotonically increasing count. Its methods are safe to call
+// from multiple goroutines.
+type counter struct {
+	value uint64
+}
+
+// Inc adds 1 to the counter.
+func (c *counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add adds n to the counter.
+func (c *counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value returns the current value of the counter.
+func (c *counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// gauge is a value that can go up and down. Its methods are safe to call from
+// multiple goroutines.
+type gauge struct {
+	value int64
+}
+
+// Add adds n, which may be negative, to the gauge.
+func (g *gauge) Add(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+
+// AddIfAtMost adds n to the gauge and returns true if the result would be at
+// most max. Otherwise it leaves the gauge unchanged and returns false.
+func (g *gauge) AddIfAtMost(n, max int64) bool {
+	for {
+		old := atomic.LoadInt64(&g.value)
+		if old+n > max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&g.value, old, old+n) {
+			return true
+		}
+	}
+}
+
+// Value returns the current value of the gauge.
+func (g *gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// countingWriter is an io.Writer that adds the number of bytes written to a
+// counter.
+type countingWriter struct {
+	w io.Writer
+	c *counter
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.c.Add(uint64(n))
+	return n, err
+}
+
+// counterVec is a family of counters distinguished by the value of a label.
+// To bound memory use, it holds at most maxValues distinct label values;
+// counts for any further values are combined in a separate overflow counter,
+// rather than under some reserved label value that a real one could equal. Its
+// methods are safe to call from multiple goroutines.
+type counterVec struct {
+	maxValues int
+	counters  map[string]*counter
+	overflow  counter
+	// Registers overflow the first time it is used, so that families
+	// whose values are fixed do not export an overflow counter that is
+	// always 0.
+	registerOverflow sync.Once
+	registry         *metricsRegistry
+	name, help       string
+	lock             sync.Mutex
+}
+
+// With returns the counter for the given label value, creating it if
+// necessary.
+func (v *counterVec) With(value string) *counter {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	c, ok := v.counters[value]
+	if !ok {
+		if len(v.counters) >= v.maxValues {
+			v.registerOverflow.Do(func() {
+				v.registry.CounterFunc(v.name, v.help, func() float64 { return float64(v.overflow.Value()) })
+			})
+			return &v.overflow
+		}
+		c = &counter{}
+		v.counters[value] = c
+	}
+	return c
+}
+
+// labeledValue is the value of one member of a family of metrics, such as a
+// counterVec.
+type labeledValue struct {
+	LabelValue string
+	Value      float64
+}
+
+// values returns the current values of all the counters in v, sorted by label
+// value.
+func (v *counterVec) values() []labeledValue {
+	v.lock.Lock()
+	values := make([]labeledValue, 0, len(v.counters))
+	for labelValue, c := range v.counters {
+		values = append(values, labeledValue{labelValue, float64(c.Value())})
+	}
+	v.lock.Unlock()
+	sort.Slice(values, func(i, j int) bool { return values[i].LabelValue < values[j].LabelValue })
+	return values
+}
+
+// histogram counts non-negative integer observations, such as sizes, in
+// buckets. Its methods are safe to call from multiple goroutines.
+type histogram struct {
+	// Upper bounds of the buckets, in increasing order. There is an
+	// implicit last bucket with no upper bound.
+	bounds []uint64
+	// counts[i] is the number of observations in bucket i (not
+	// cumulative); len(counts) == len(bounds)+1.
+	counts []uint64
+	sum    uint64
+}
+
+// Observe adds v to the histogram.
+func (h *histogram) Observe(v uint64) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return v <= h.bounds[i] })
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, v)
+}
+
+// histogramVec is a family of histograms with the same buckets, distinguished
+// by the values of one or more labels. The caller is responsible for keeping
+// the number of distinct label values small. Its methods are safe to call from
+// multiple goroutines.
+type histogramVec struct {
+	bounds     []uint64
+	histograms map[string]*labeledHistogram
+	lock       sync.Mutex
+}
+
+type labeledHistogram struct {
+	labelValues []string
+	*histogram
+}
+
+// With returns the histogram for the given label values, which must be as many
+// as the family's labels, creating it if necessary.
+func (v *histogramVec) With(labelValues ...string) *histogram {
+	key := strings.Join(labelValues, "\x00")
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	h, ok := v.histograms[key]
+	if !ok {
+		h = &labeledHistogram{
+			labelValues: labelValues,
+			histogram: &histogram{
+				bounds: v.bounds,
+				counts: make([]uint64, len(v.bounds)+1),
+			},
+		}
+		v.histograms[key] = h
+	}
+	return h.histogram
+}
+
+// histogramValue is a snapshot of one member of a histogramVec.
+type histogramValue struct {
+	LabelValues []string
+	Bounds      []uint64
+	// Cumulative counts: Counts[i] is the number of observations less than
+	// or equal to Bounds[i]. The last element, with no corresponding bound,
+	// is the total number of observations.
+	Counts []uint64
+	Sum    uint64
+}
+
+// values returns snapshots of all the histograms in v, sorted by label values.
+func (v *histogramVec) values() []histogramValue {
+	v.lock.Lock()
+	values := make([]histogramValue, 0, len(v.histograms))
+	for _, h := range v.histograms {
+		value := histogramValue{
+			LabelValues: h.labelValues,
+			Bounds:      h.bounds,
+			Counts:      make([]uint64, len(h.counts)),
+			Sum:         atomic.LoadUint64(&h.sum),
+		}
+		var total uint64
+		for i := range h.counts {
+			total += atomic.LoadUint64(&h.counts[i])
+			value.Counts[i] = total
+		}
+		values = append(values, value)
+	}
+	v.lock.Unlock()
+	sort.Slice(values, func(i, j int) bool {
+		return strings.Join(values[i].LabelValues, "\x00") < strings.Join(values[j].LabelValues, "\x00")
+	})
+	return values
+}
+
+// metricsEntry is a single named metric in a metricsRegistry. Exactly one of
+// Value, Values, and Histograms is set. If Values is set, the metric is a
+// family whose members are distinguished by the value of the label named
+// Label. If Histograms is set, the metric is a family of histograms whose
+// members are distinguished by the values of the labels named Labels.
+type metricsEntry struct {
+	Name string
+	Help string
+	// "counter", "gauge", or "histogram".
+	Type       string
+	Value      func() float64
+	Label      string
+	Values     func() []labeledValue
+	Labels     []string
+	Histograms func() []histogramValue
+}
+
+// metricsRegistry is a set of named metrics. Its methods are safe to call from
+// multiple goroutines.
+type metricsRegistry struct {
+	entries map[string]*metricsEntry
+	lock    sync.Mutex
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		entries: make(map[string]*metricsEntry),
+	}
+}
+
+// register adds an entry to the registry, replacing any existing entry with
+// the same name.
+func (r *metricsRegistry) register(entry *metricsEntry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.entries[entry.Name] = entry
+}
+
+// NewCounter creates and registers a new counter.
+func (r *metricsRegistry) NewCounter(name, help string) *counter {
+	c := &counter{}
+	r.CounterFunc(name, help, func() float64 { return float64(c.Value()) })
+	return c
+}
+
+// NewGauge creates and registers a new gauge.
+func (r *metricsRegistry) NewGauge(name, help string) *gauge {
+	g := &gauge{}
+	r.GaugeFunc(name, help, func() float64 { return float64(g.Value()) })
+	return g
+}
+
+// NewCounterVec creates and registers a new counterVec whose members are
+// distinguished by the label named label, with at most maxValues distinct
+// label values. Once there are more, the counter for the rest is registered
+// under name with "_overflow" inserted before the "_total" suffix.
+func (r *metricsRegistry) NewCounterVec(name, help, label string, maxValues int) *counterVec {
+	v := &counterVec{
+		maxValues: maxValues,
+		counters:  make(map[string]*counter),
+		registry:  r,
+		name:      strings.TrimSuffix(name, "_total") + "_overflow_total",
+		help:      fmt.Sprintf("Like %s, combined for the values of %s beyond the first %d.", name, label, maxValues),
+	}
+	r.register(&metricsEntry{Name: name, Help: help, Type: "counter", Label: label, Values: v.values})
+	return v
+}
+
+// NewHistogramVec creates and registers a new histogramVec with buckets whose
+// upper bounds are bounds, and whose members are distinguished by the labels
+// named labels.
+func (r *metricsRegistry) NewHistogramVec(name, help string, bounds []uint64, labels ...string) *histogramVec {
+	v := &histogramVec{
+		bounds:     bounds,
+		histograms: make(map[string]*labeledHistogram),
+	}
+	r.register(&metricsEntry{Name: name, Help: help, Type: "histogram", Labels: labels, Histograms: v.values})
+	return v
+}
+
+// CounterFunc registers a counter whose value is computed by calling f. Use
+// this for counts that are maintained elsewhere.
+func (r *metricsRegistry) CounterFunc(name, help string, f func() float64) {
+	r.register(&metricsEntry{Name: name, Help: help, Type: "counter", Value: f})
+}
+
+// GaugeFunc registers a gauge whose value is computed by calling f.
+func (r *metricsRegistry) GaugeFunc(name, help string, f func() float64) {
+	r.register(&metricsEntry{Name: name, Help: help, Type: "gauge", Value: f})
+}
+
+// Snapshot returns a copy of the registry's entries, sorted by name.
+func (r *metricsRegistry) Snapshot() []metricsEntry {
+	r.lock.Lock()
+	entries := make([]metricsEntry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		entries = append(entries, *entry)
+	}
+	r.lock.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// WritePrometheus writes the current values of all metrics to w in the
+// Prometheus text exposition format.
+//
+// https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+func (r *metricsRegistry) WritePrometheus(w io.Writer) error {
+	for _, entry := range r.Snapshot() {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n",
+			entry.Name, entry.Help,
+			entry.Name, entry.Type)
+		if err != nil {
+			return err
+		}
+		if entry.Histograms != nil {
+			err = writePrometheusHistograms(w, &entry)
+			if err != nil {
+				return err
+			}
+		} else if entry.Values != nil {
+			for _, v := range entry.Values() {
+				_, err = fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n",
+					entry.Name, entry.Label, prometheusLabelEscaper.Replace(v.LabelValue),
+					strconv.FormatFloat(v.Value, 'g', -1, 64))
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			_, err = fmt.Fprintf(w, "%s %s\n",
+				entry.Name, strconv.FormatFloat(entry.Value(), 'g', -1, 64))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writePrometheusHistograms writes the _bucket, _sum, and _count lines of every
+// member of the histogram family entry.
+func writePrometheusHistograms(w io.Writer, entry *metricsEntry) error {
+	for _, h := range entry.Histograms() {
+		var labels []string
+		for i, name := range entry.Labels {
+			labels = append(labels, fmt.Sprintf("%s=\"%s\"", name, prometheusLabelEscaper.Replace(h.LabelValues[i])))
+		}
+		for i, count := range h.Counts {
+			le := "+Inf"
+			if i < len(h.Bounds) {
+				le = strconv.FormatUint(h.Bounds[i], 10)
+			}
+			_, err := fmt.Fprintf(w, "%s_bucket{%s} %d\n",
+				entry.Name, strings.Join(append(labels, fmt.Sprintf("le=\"%s\"", le)), ","), count)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(w, "%s_sum{%s} %d\n%s_count{%s} %d\n",
+			entry.Name, strings.Join(labels, ","), h.Sum,
+			entry.Name, strings.Join(labels, ","), h.Counts[len(h.Counts)-1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prometheusLabelEscaper escapes a label value for the Prometheus text format.
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// registerClientIDMetrics registers metrics that track the number of
+// ClientIDs known to ttConn, and the packets waiting in their outgoing queues.
+// It also makes /debug/sessions report the queue of each session's ClientID.
+func registerClientIDMetrics(ttConn *turbotunnel.QueuePacketConn) {
+	sessions.SetQueues(ttConn)
+	metrics.GaugeFunc("dnstt_clientids_tracked",
+		"Number of ClientIDs currently tracked.",
+		func() float64 {
+			live, _ := ttConn.RemoteStats()
+			return float64(live)
+		})
+	metrics.CounterFunc("dnstt_clientids_expired_total",
+		"Number of ClientIDs forgotten after being idle.",
+		func() float64 {
+			_, expired := ttConn.RemoteStats()
+			return float64(expired)
+		})
+	metrics.GaugeFunc("dnstt_clientid_queued_packets",
+		"Downstream packets waiting to be sent, summed over all ClientIDs.",
+		func() float64 {
+			total := 0
+			for _, n := range ttConn.OutgoingQueueLengths() {
+				total += n
+			}
+			return float64(total)
+		})
+	metrics.GaugeFunc("dnstt_clientid_queue_max_packets",
+		"Downstream packets waiting to be sent to the ClientID with the most.",
+		func() float64 {
+			max := 0
+			for _, n := range ttConn.OutgoingQueueLengths() {
+				if n > max {
+					max = n
+				}
+			}
+			return float64(max)
+		})
+}
+
+// serveMetrics runs an HTTP server on ln that exports metrics at the path
+// /metrics, and the current sessions and streams (to loopback clients only) at
+// /debug/sessions.
+func serveMetrics(ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.WritePrometheus(w)
+	})
+	mux.HandleFunc("/debug/sessions", handleDebugSessions)
+	return http.Serve(ln, mux)
+}
+
+// serveDebug runs an HTTP server on ln that serves only /debug/sessions, for
+// -debug-addr.
+func serveDebug(ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/sessions", handleDebugSessions)
+	return http.Serve(ln, mux)
+}
+
+// startMetrics opens a TCP listener on addr and runs serveMetrics on it in a
+// separate goroutine. If the listener cannot be opened, startMetrics returns
+// an error if strictAuxListeners is set; otherwise it logs a warning and
+// returns nil, and the server runs without metrics.
+func startMetrics(addr string) error {
+	return startAuxListener("metrics", addr, serveMetrics)
+}
+
+// startDebug is like startMetrics, but runs serveDebug.
+func startDebug(addr string) error {
+	return startAuxListener("debug", addr, serveDebug)
+}
+
+// startAuxListener opens a TCP listener on addr and runs serve on it in a
+// separate goroutine, as described at startMetrics. name describes the
+// listener in log messages.
+func startAuxListener(name, addr string, serve func(net.Listener) error) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		if strictAuxListeners {
+			return err
+		}
+		log.Printf("warning: cannot open %s listener, continuing without it: %v", name, err)
+		return nil
+	}
+	go func() {
+		err := serve(ln)
+		if err != nil {
+			log.Printf("%s listener: %v", name, err)
+		}
+	}()
+	return nil
+}
+
+// logStats logs a summary of activity every interval, until done is closed.
+func logStats(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastTime := time.Now()
+	lastQueries := queriesReceived.Value()
+	lastUp := upstreamBytes.Value()
+	lastDown := downstreamBytes.Value()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			queries := queriesReceived.Value()
+			up := upstreamBytes.Value()
+			down := downstreamBytes.Value()
+			log.Printf("stats: %d sessions, %d streams, %.1f queries/s, %d B up, %d B down",
+				sessionsActive.Value(), streamsActive.Value(),
+				float64(queries-lastQueries)/now.Sub(lastTime).Seconds(),
+				up-lastUp, down-lastDown)
+			lastTime, lastQueries, lastUp, lastDown = now, queries, up, down
+		}
+	}
+}
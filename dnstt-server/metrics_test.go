@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/noise"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestMetricsRegistryWritePrometheus(t *testing.T) {
+	r := newMetricsRegistry()
+	c := r.NewCounter("b_total", "A counter.")
+	c.Inc()
+	c.Add(2)
+	r.GaugeFunc("a", "A gauge.", func() float64 { return 1.5 })
+	// Registering the same name again replaces the old entry.
+	r.GaugeFunc("a", "A gauge.", func() float64 { return 2.5 })
+
+	var buf bytes.Buffer
+	if err := r.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP a A gauge.
+# TYPE a gauge
+a 2.5
+# HELP b_total A counter.
+# TYPE b_total counter
+b_total 3
+`
+	if buf.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
+
+func TestMetricsRegistryHistogram(t *testing.T) {
+	r := newMetricsRegistry()
+	v := r.NewHistogramVec("size_bytes", "A histogram.", []uint64{10, 100}, "code", "flag")
+	for _, size := range []uint64{0, 10, 11, 100, 1000} {
+		v.With("A", "false").Observe(size)
+	}
+	v.With("A", "true").Observe(50)
+
+	var buf bytes.Buffer
+	if err := r.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP size_bytes A histogram.
+# TYPE size_bytes histogram
+size_bytes_bucket{code="A",flag="false",le="10"} 2
+size_bytes_bucket{code="A",flag="false",le="100"} 4
+size_bytes_bucket{code="A",flag="false",le="+Inf"} 5
+size_bytes_sum{code="A",flag="false"} 1121
+size_bytes_count{code="A",flag="false"} 5
+size_bytes_bucket{code="A",flag="true",le="10"} 0
+size_bytes_bucket{code="A",flag="true",le="100"} 1
+size_bytes_bucket{code="A",flag="true",le="+Inf"} 1
+size_bytes_sum{code="A",flag="true"} 50
+size_bytes_count{code="A",flag="true"} 1
+`
+	if buf.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
+
+func TestGaugeAddIfAtMost(t *testing.T) {
+	var g gauge
+	if !g.AddIfAtMost(3, 4) || g.Value() != 3 {
+		t.Fatalf("first add failed, value %d", g.Value())
+	}
+	if g.AddIfAtMost(2, 4) || g.Value() != 3 {
+		t.Fatalf("add beyond max succeeded, value %d", g.Value())
+	}
+	if !g.AddIfAtMost(1, 4) || g.Value() != 4 {
+		t.Fatalf("add up to max failed, value %d", g.Value())
+	}
+}
+
+func TestClientIDMetrics(t *testing.T) {
+	const timeout = 20 * time.Millisecond
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, timeout)
+	defer ttConn.Close()
+	registerClientIDMetrics(ttConn)
+
+	value := func(name string) float64 {
+		for _, entry := range metrics.Snapshot() {
+			if entry.Name == name {
+				return entry.Value()
+			}
+		}
+		t.Fatalf("no metric %q", name)
+		return 0
+	}
+
+	ttConn.WriteTo([]byte("a"), turbotunnel.ClientID{1})
+	ttConn.WriteTo([]byte("b"), turbotunnel.ClientID{2})
+	if v := value("dnstt_clientids_tracked"); v != 2 {
+		t.Errorf("tracked = %v, expected 2", v)
+	}
+	if v := value("dnstt_clientids_expired_total"); v != 0 {
+		t.Errorf("expired = %v, expected 0", v)
+	}
+	ttConn.WriteTo([]byte("c"), turbotunnel.ClientID{1})
+	if v := value("dnstt_clientid_queued_packets"); v != 3 {
+		t.Errorf("queued = %v, expected 3", v)
+	}
+	if v := value("dnstt_clientid_queue_max_packets"); v != 2 {
+		t.Errorf("queue max = %v, expected 2", v)
+	}
+
+	// Wait for both ClientIDs to expire.
+	deadline := time.Now().Add(5 * time.Second)
+	for value("dnstt_clientids_expired_total") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for ClientIDs to expire")
+		}
+		time.Sleep(timeout)
+	}
+	if v := value("dnstt_clientids_tracked"); v != 0 {
+		t.Errorf("tracked = %v, expected 0", v)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestLogStats(t *testing.T) {
+	var buf syncBuffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		logStats(10*time.Millisecond, done)
+		close(finished)
+	}()
+	waitFor := func(substr string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(buf.String(), substr) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %q in log: %q", substr, buf.String())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Bytes written after one stats line appear in a later one.
+	waitFor("B up")
+	var w bytes.Buffer
+	countingWriter{&w, upstreamBytes}.Write([]byte("12345"))
+	waitFor(" 5 B up")
+	close(done)
+	<-finished
+}
+
+func TestStartMetricsBindFailure(t *testing.T) {
+	defer func(saved bool) { strictAuxListeners = saved }(strictAuxListeners)
+	var buf syncBuffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	// Occupy a port so that the metrics listener cannot bind to it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	strictAuxListeners = true
+	if err := startMetrics(addr); err == nil {
+		t.Errorf("strict startMetrics on a used port returned nil")
+	}
+
+	strictAuxListeners = false
+	if err := startMetrics(addr); err != nil {
+		t.Fatalf("non-strict startMetrics on a used port returned %v", err)
+	}
+	if !strings.Contains(buf.String(), "cannot open metrics listener") {
+		t.Errorf("no warning logged: %q", buf.String())
+	}
+
+	// The failed listener does not prevent run from serving tunnel
+	// traffic.
+	keys := &noise.LocalKeyProvider{}
+	if err := keys.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	domain := mustParseName("t.example.com")
+	dnsConn := newFakePacketConn()
+	done := make(chan error)
+	go func() {
+		done <- run(keys, domain, newUpstreamDialer("127.0.0.1:1", 0), []net.PacketConn{dnsConn})
+	}()
+	for _, id := range []uint16{1, 2} {
+		query := tunnelQuery([]byte("CLIENTID"), domain)
+		query.ID = id
+		buf, _ := query.WireFormat()
+		dnsConn.Inject(buf, turbotunnel.DummyAddr{})
+	}
+	if resp := readResponse(t, dnsConn); resp.ID != 1 || resp.Rcode() != dns.RcodeNoError || len(resp.Answer) != 1 {
+		t.Errorf("expected NOERROR with answer for ID 1, got %+v", resp)
+	}
+	dnsConn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("run did not return after its conn was closed")
+	}
+}
+
+// -debug-addr serves /debug/sessions, as -metrics does, but not /metrics,
+// which with -metrics-backend statsd is pushed instead.
+func TestServeDebug(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveDebug(ln)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/debug/sessions", http.StatusOK},
+		{"/metrics", http.StatusNotFound},
+	} {
+		resp, err := client.Get("http://" + ln.Addr().String() + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got status %d, expected %d", test.path, resp.StatusCode, test.status)
+		}
+	}
+}
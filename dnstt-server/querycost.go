@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// The greatest number of distinct sources for which -query-cost-sample keeps
+// separate counts. Sources beyond this are counted together under
+// overflowLabelValue.
+const queryCostMaxSources = 100
+
+// queryCostSampler chooses which queries have the cost of processing them
+// measured, for -query-cost-sample: one in every every. Counting is all it
+// does for the queries that are not sampled, so that it adds next to nothing
+// to recvLoop. It is not safe for concurrent use; each recvLoop has its own.
+type queryCostSampler struct {
+	every int
+	count int
+}
+
+// Sample returns true if the next query should be measured.
+func (s *queryCostSampler) Sample() bool {
+	if s.every <= 0 {
+		return false
+	}
+	s.count++
+	if s.count < s.every {
+		return false
+	}
+	s.count = 0
+	return true
+}
+
+// queryCostSource returns the label under which the cost of queries from addr
+// is counted: the remote IP address, for addresses that have one, so that the
+// queries of one resolver are counted together whatever their source port,
+// connection, or request, or else the whole address.
+func queryCostSource(addr net.Addr) string {
+	ip := ""
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP.String()
+	case pktinfoAddr:
+		return queryCostSource(addr.Addr)
+	case tcpAddr:
+		ip = addr.ip
+	case wsAddr:
+		ip = addr.ip
+	case dohAddr:
+		ip = addr.ip
+	}
+	if ip != "" {
+		return ip
+	}
+	return addr.String()
+}
+
+// recordQueryCost records that parsing a sampled query from addr, and building
+// the response to it, took d.
+func recordQueryCost(addr net.Addr, d time.Duration) {
+	us := uint64(d / time.Microsecond)
+	queryCost.With().Observe(us)
+	source := queryCostSource(addr)
+	queriesCostSampled.With(source).Inc()
+	queryCostBySource.With(source).Add(us)
+}
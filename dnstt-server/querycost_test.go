@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestQueryCostSampler(t *testing.T) {
+	// 0 samples nothing.
+	s := queryCostSampler{}
+	for i := 0; i < 10; i++ {
+		if s.Sample() {
+			t.Fatalf("every 0 sampled query %d", i)
+		}
+	}
+
+	s = queryCostSampler{every: 3}
+	for i, expected := range []bool{false, false, true, false, false, true, false} {
+		if sampled := s.Sample(); sampled != expected {
+			t.Errorf("query %d: got %v, expected %v", i, sampled, expected)
+		}
+	}
+}
+
+func TestQueryCostSource(t *testing.T) {
+	for _, test := range []struct {
+		addr     net.Addr
+		expected string
+	}{
+		// The port is not part of the source.
+		{&net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 5353}, "192.0.2.1"},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, "2001:db8::1"},
+		// With -udp-source.
+		{pktinfoAddr{&net.UDPAddr{IP: net.IP{192, 0, 2, 2}, Port: 1234}, net.IP{192, 0, 2, 53}}, "192.0.2.2"},
+		// Every connection and request has its own address, but
+		// those from the same IP address share a source.
+		{tcpAddr{id: 1, remote: "192.0.2.3:1234", ip: remoteIP("192.0.2.3:1234")}, "192.0.2.3"},
+		{tcpAddr{id: 2, remote: "[2001:db8::3]:1234", ip: remoteIP("[2001:db8::3]:1234")}, "2001:db8::3"},
+		{wsAddr{id: 3, remote: "192.0.2.4:1234", ip: remoteIP("192.0.2.4:1234")}, "192.0.2.4"},
+		{dohAddr{id: 4, remote: "192.0.2.5:1234", ip: remoteIP("192.0.2.5:1234")}, "192.0.2.5"},
+		// An address without an IP address is used whole.
+		{tcpAddr{id: 5, remote: "pipe", ip: remoteIP("pipe")}, "pipe#5"},
+		{turbotunnel.DummyAddr{}, turbotunnel.DummyAddr{}.String()},
+	} {
+		if source := queryCostSource(test.addr); source != test.expected {
+			t.Errorf("%v: got %q, expected %q", test.addr, source, test.expected)
+		}
+	}
+}
+
+// queryCostCount returns the number of observations in the queryCost
+// histogram.
+func queryCostCount() uint64 {
+	for _, h := range queryCost.values() {
+		return h.Counts[len(h.Counts)-1]
+	}
+	return 0
+}
+
+func TestRecvLoopQueryCost(t *testing.T) {
+	defer func(saved int) { queryCostSample = saved }(queryCostSample)
+	queryCostSample = 2
+
+	domain := mustParseName("t.example.com")
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	dnsConn, ch, _, stop := startRecvLoop(domain, 1000)
+	defer stop()
+
+	source := queryCostSource(turbotunnel.DummyAddr{})
+	beforeSampled := queriesCostSampled.With(source).Value()
+	beforeCount := queryCostCount()
+	// One in two queries is measured.
+	for i := 0; i < 4; i++ {
+		injectQuery(t, dnsConn, ch, domain, clientID, []byte("packet"))
+	}
+	if n := queriesCostSampled.With(source).Value() - beforeSampled; n != 2 {
+		t.Errorf("sampled %d queries from %s, expected 2", n, source)
+	}
+	if n := queryCostCount() - beforeCount; n != 2 {
+		t.Errorf("histogram counted %d queries, expected 2", n)
+	}
+
+	var buf strings.Builder
+	if err := metrics.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"dnstt_query_cost_microseconds_count{} ",
+		"dnstt_queries_cost_sampled_total{source=\"" + source + "\"} ",
+		"dnstt_query_cost_microseconds_total{source=\"" + source + "\"} ",
+	} {
+		if !strings.Contains(buf.String(), "\n"+line) {
+			t.Errorf("metrics lack %q", line)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+)
+
+// logQueries is nonzero while recvLoop should log every query it receives. It
+// is initially set by the -log-queries option, and may be toggled at run time
+// by a signal (see notifyToggleLogQueries). Access it only with sync/atomic.
+var logQueries int32
+
+// setLogQueries turns query logging on or off, and logs the change, so that
+// the log records when query logging was in effect.
+func setLogQueries(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&logQueries, v)
+	if on {
+		log.Printf("query logging enabled")
+	} else {
+		log.Printf("query logging disabled")
+	}
+}
+
+// toggleLogQueries turns query logging on if it is off, and off if it is on.
+func toggleLogQueries() {
+	setLogQueries(atomic.LoadInt32(&logQueries) == 0)
+}
+
+// logQuery logs the ID and questions of a query received from addr.
+func logQuery(addr net.Addr, query *dns.Message) {
+	questions := make([]string, 0, len(query.Question))
+	for _, question := range query.Question {
+		questions = append(questions, fmt.Sprintf("%s %s", rrTypeString(question.Type), escapeName(question.Name)))
+	}
+	log.Printf("query %04x from %v: %s", query.ID, addr, strings.Join(questions, ", "))
+}
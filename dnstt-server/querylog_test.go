@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestRecvLoopLogQueries(t *testing.T) {
+	defer atomic.StoreInt32(&logQueries, atomic.LoadInt32(&logQueries))
+	var buf syncBuffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	domain := mustParseName("t.example.com")
+	clientID := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	dnsConn, ch, _, stop := startRecvLoop(domain, 1000)
+	defer stop()
+	queryLines := func() []string {
+		var lines []string
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.Contains(line, "query 1234 from dummy: TXT ") {
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	}
+
+	// Off by default.
+	atomic.StoreInt32(&logQueries, 0)
+	injectQuery(t, dnsConn, ch, domain, clientID)
+	if lines := queryLines(); len(lines) != 0 {
+		t.Fatalf("query logged while disabled: %+q", lines)
+	}
+
+	toggleLogQueries()
+	if !strings.Contains(buf.String(), "query logging enabled") {
+		t.Errorf("enabling was not logged: %+q", buf.String())
+	}
+	injectQuery(t, dnsConn, ch, domain, clientID)
+	lines := queryLines()
+	if len(lines) != 1 || !strings.HasSuffix(lines[0], ".t.example.com") {
+		t.Fatalf("expected one query logged, got %+q", lines)
+	}
+
+	toggleLogQueries()
+	if !strings.Contains(buf.String(), "query logging disabled") {
+		t.Errorf("disabling was not logged: %+q", buf.String())
+	}
+	injectQuery(t, dnsConn, ch, domain, clientID)
+	if lines := queryLines(); len(lines) != 1 {
+		t.Fatalf("query logged after disabling: %+q", lines)
+	}
+}
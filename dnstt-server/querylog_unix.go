@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyToggleLogQueries arranges for the signal that toggles query logging,
+// SIGUSR1, to be sent on c.
+func notifyToggleLogQueries(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
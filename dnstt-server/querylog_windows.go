@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// notifyToggleLogQueries does nothing on Windows, which has no SIGUSR1. Query
+// logging can only be set with -log-queries there.
+func notifyToggleLogQueries(c chan<- os.Signal) {
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// How often clientRateLimiter sweeps out buckets that have been idle long
+// enough to be completely refilled.
+const rateLimiterSweepInterval = 1 * time.Minute
+
+// tokenBucket is the per-ClientID state of a clientRateLimiter.
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+	// How many queries have been dropped since the last one that was
+	// allowed.
+	dropped uint64
+}
+
+// clientRateLimiter limits the rate of incoming queries per ClientID, using a
+// token bucket for each ClientID. Each ClientID may send burst queries at once,
+// and thereafter rate queries per second.
+//
+// clientRateLimiter's methods are safe to call from multiple goroutines.
+type clientRateLimiter struct {
+	rate      float64
+	burst     float64
+	buckets   map[turbotunnel.ClientID]*tokenBucket
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+// newClientRateLimiter creates a clientRateLimiter that allows rate queries per
+// second per ClientID, with bursts of up to burst queries.
+func newClientRateLimiter(rate, burst float64) *clientRateLimiter {
+	return &clientRateLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[turbotunnel.ClientID]*tokenBucket),
+	}
+}
+
+// Allow returns true if a query from clientID received at time now is within
+// the rate limit, and false if it should be dropped.
+//
+// Allow logs a message when a ClientID first goes over the limit, and another
+// with the total number of dropped queries when it comes back under.
+func (l *clientRateLimiter) Allow(clientID turbotunnel.ClientID, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimiterSweepInterval {
+		l.sweep(now)
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[clientID]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, lastSeen: now}
+		l.buckets[clientID] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.lastSeen).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.lastSeen = now
+
+	if bucket.tokens < 1.0 {
+		if bucket.dropped == 0 {
+			log.Printf("ClientID %v exceeded query rate of %g/s; dropping queries", clientID, l.rate)
+		}
+		bucket.dropped++
+		return false
+	}
+	bucket.tokens -= 1.0
+	if bucket.dropped != 0 {
+		log.Printf("ClientID %v back under query rate; dropped %d queries", clientID, bucket.dropped)
+		bucket.dropped = 0
+	}
+	return true
+}
+
+// sweep removes buckets that would be full if refilled at time now. Removing
+// them does not change the outcome of future calls to Allow, because a missing
+// bucket is the same as a full one. Requires l.lock to be held.
+func (l *clientRateLimiter) sweep(now time.Time) {
+	for clientID, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*l.rate >= l.burst {
+			if bucket.dropped != 0 {
+				log.Printf("ClientID %v back under query rate; dropped %d queries", clientID, bucket.dropped)
+			}
+			delete(l.buckets, clientID)
+		}
+	}
+}
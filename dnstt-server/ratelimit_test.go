@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestClientRateLimiter(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := newClientRateLimiter(10.0, 5.0)
+	a := turbotunnel.ClientID{'A', 'A', 'A', 'A', 'A', 'A', 'A', 'A'}
+	b := turbotunnel.ClientID{'B', 'B', 'B', 'B', 'B', 'B', 'B', 'B'}
+
+	// A burst of 5 is allowed, the 6th is not.
+	for i := 0; i < 5; i++ {
+		if !limiter.Allow(a, now) {
+			t.Fatalf("query %d of burst was not allowed", i)
+		}
+	}
+	if limiter.Allow(a, now) {
+		t.Fatalf("query after burst was allowed")
+	}
+	// Other ClientIDs are unaffected.
+	if !limiter.Allow(b, now) {
+		t.Fatalf("query from other ClientID was not allowed")
+	}
+	// After 100 ms, one more token is available.
+	now = now.Add(100 * time.Millisecond)
+	if !limiter.Allow(a, now) {
+		t.Fatalf("query after refill was not allowed")
+	}
+	if limiter.Allow(a, now) {
+		t.Fatalf("second query after refill was allowed")
+	}
+	// Tokens do not accumulate past the burst size.
+	now = now.Add(1 * time.Hour)
+	for i := 0; i < 5; i++ {
+		if !limiter.Allow(a, now) {
+			t.Fatalf("query %d of burst after idle was not allowed", i)
+		}
+	}
+	if limiter.Allow(a, now) {
+		t.Fatalf("query after burst after idle was allowed")
+	}
+}
+
+func TestClientRateLimiterSweep(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := newClientRateLimiter(10.0, 5.0)
+	for i := 0; i < 100; i++ {
+		var clientID turbotunnel.ClientID
+		clientID[0] = byte(i)
+		limiter.Allow(clientID, now)
+	}
+	// After long enough, all those buckets will have refilled and will be
+	// swept on the next call.
+	now = now.Add(rateLimiterSweepInterval)
+	limiter.Allow(turbotunnel.ClientID{}, now)
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("%d buckets remain after sweep, expected 1", len(limiter.buckets))
+	}
+}
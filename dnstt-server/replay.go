@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+)
+
+// flagsString returns the mnemonics of the header flags that are set in
+// flags, for example "qr aa rd".
+func flagsString(flags uint16) string {
+	var names []string
+	for _, f := range []struct {
+		bit  uint16
+		name string
+	}{
+		{0x8000, "qr"},
+		{0x0400, "aa"},
+		{0x0200, "tc"},
+		{0x0100, "rd"},
+		{0x0080, "ra"},
+		{0x0020, "ad"},
+		{0x0010, "cd"},
+	} {
+		if flags&f.bit != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// replayQuery parses buf as a DNS query, runs it through tunnelResponseFor for
+// domain, and extracts the ClientID and packets from it, as recvLoop would.
+// It writes a description of each step to w. It opens no sockets and does
+// not change any server state; the packets are not given to KCP. The
+// per-client checks of -ban-file, -max-client-query-rate, and -warmup are not
+// applied. It returns an error only if writing to w fails.
+func replayQuery(w io.Writer, buf []byte, domain dns.Name) error {
+	var out bytes.Buffer
+
+	query, err := dns.MessageFromWireFormat(buf)
+	if err != nil {
+		fmt.Fprintf(&out, "cannot parse DNS query: %v\n", err)
+		_, err = w.Write(out.Bytes())
+		return err
+	}
+	fmt.Fprintf(&out, "query: id %04x, opcode %d, flags %#04x [%s]\n",
+		query.ID, query.Opcode(), query.Flags, flagsString(query.Flags))
+	for _, question := range query.Question {
+		fmt.Fprintf(&out, "question: %s %s\n", rrTypeString(question.Type), escapeName(question.Name))
+	}
+
+	resp, clientID, n, payload, tooShort := tunnelResponseFor(&query, domain, false)
+	if tooShort {
+		fmt.Fprintf(&out, "note: %d bytes are too short to contain a ClientID\n", n)
+	}
+
+	if resp == nil {
+		fmt.Fprintf(&out, "response: none\n")
+	} else {
+		addNegativeSOA(resp, domain)
+		class := "not a tunnel response"
+		if isTunnelResponse(resp) {
+			class = "tunnel response"
+		}
+		fmt.Fprintf(&out, "response: %s, flags %#04x [%s], %s\n",
+			rcodeString(extendedRcode(resp)), resp.Flags, flagsString(resp.Flags), class)
+	}
+
+	if n == len(clientID) {
+		fmt.Fprintf(&out, "clientid: %v\n", clientID)
+		r := bytes.NewReader(payload)
+		for i := 0; ; i++ {
+			p, err := nextPacket(r)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				fmt.Fprintf(&out, "payload error: %v\n", err)
+				break
+			}
+			fmt.Fprintf(&out, "packet %d: %d bytes %s\n", i, len(p), hex.EncodeToString(p))
+		}
+	}
+
+	_, err = w.Write(out.Bytes())
+	return err
+}
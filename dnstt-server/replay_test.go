@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+)
+
+func TestReplayQuery(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	tunnel := tunnelQuery([]byte("CLIENTID\x03one\xe2pp\x03two"), domain)
+	other := tunnelQuery([]byte("CLIENTID"), mustParseName("example.com"))
+	short := tunnelQuery([]byte("CLIENT"), domain)
+	for _, test := range []struct {
+		name     string
+		query    *dns.Message
+		expected []string
+	}{
+		{"tunnel", tunnel, []string{
+			"query: id 1234, opcode 0, flags 0x0100 [rd]\n",
+			"question: TXT ",
+			"response: NOERROR, flags 0x8500 [qr aa rd], tunnel response\n",
+			"clientid: 434c49454e544944\n",
+			"packet 0: 3 bytes 6f6e65\n",
+			"packet 1: 3 bytes 74776f\n",
+		}},
+		{"other domain", other, []string{
+			"response: NXDOMAIN, flags 0x8103 [qr rd], not a tunnel response\n",
+		}},
+		{"short", short, []string{
+			"note: 6 bytes are too short to contain a ClientID\n",
+			"response: NXDOMAIN, flags 0x8503 [qr aa rd], not a tunnel response\n",
+		}},
+	} {
+		buf, err := test.query.WireFormat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := replayQuery(&out, buf, domain); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range test.expected {
+			if !strings.Contains(out.String(), s) {
+				t.Errorf("%s: missing %q in output:\n%s", test.name, s, out.String())
+			}
+		}
+	}
+
+	// An unparseable query is reported.
+	var out bytes.Buffer
+	if err := replayQuery(&out, []byte{0x12, 0x34}, domain); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "cannot parse DNS query: ") {
+		t.Errorf("unparseable: got %q", out.String())
+	}
+}
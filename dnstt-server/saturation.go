@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// How long the response channel of recvLoop must stay full before
+// saturationMonitor considers the server saturated, and how long all signs of
+// saturation must be gone before it considers the server no longer saturated.
+// The delays keep a momentary burst from flapping the state.
+const saturationHold = 1 * time.Second
+
+// saturationMonitor decides, for -saturation-servfail, whether the server is
+// too overloaded to start new sessions. The server is saturated when a new
+// session would be rejected because of -max-tunnel-goroutines, or when the
+// channel from recvLoop to sendLoop has been full, so that responses are being
+// dropped, for at least saturationHold. Entering and leaving the saturated
+// state are logged. A saturationMonitor is not safe for concurrent use; each
+// recvLoop has its own.
+type saturationMonitor struct {
+	name      string
+	saturated bool
+	// When the channel was first seen full in the current run of
+	// observations in which it was full; zero if it was not full at the
+	// last observation.
+	fullSince time.Time
+	// When the last sign of saturation was seen.
+	lastSign time.Time
+}
+
+// newSaturationMonitor returns a saturationMonitor that uses name to identify
+// its listener in log messages.
+func newSaturationMonitor(name string) *saturationMonitor {
+	return &saturationMonitor{name: name}
+}
+
+// Check updates the state of m, given whether the response channel is full
+// at time now, and returns true if the server is saturated.
+func (m *saturationMonitor) Check(now time.Time, chFull bool) bool {
+	var reason string
+	if maxTunnelGoroutines > 0 && tunnelGoroutines.Value() >= int64(maxTunnelGoroutines) {
+		reason = "no goroutines left for a new session (-max-tunnel-goroutines)"
+	}
+	if !chFull {
+		m.fullSince = time.Time{}
+	} else if m.fullSince.IsZero() {
+		m.fullSince = now
+	} else if reason == "" && now.Sub(m.fullSince) >= saturationHold {
+		reason = "response queue full, responses being dropped"
+	}
+
+	if reason != "" {
+		m.lastSign = now
+		if !m.saturated {
+			m.saturated = true
+			log.Printf("%s: entering saturated state: %s; answering new sessions with SERVFAIL", m.name, reason)
+		}
+	} else if m.saturated && now.Sub(m.lastSign) >= saturationHold {
+		m.saturated = false
+		log.Printf("%s: leaving saturated state: accepting new sessions", m.name)
+	}
+	return m.saturated
+}
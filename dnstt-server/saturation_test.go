@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestSaturationMonitorChannel(t *testing.T) {
+	var logBuf syncBuffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	m := newSaturationMonitor("test")
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		elapsed   time.Duration
+		chFull    bool
+		saturated bool
+	}{
+		{0, false, false},
+		// Full, but not for long enough.
+		{100 * time.Millisecond, true, false},
+		{500 * time.Millisecond, false, false},
+		{600 * time.Millisecond, true, false},
+		{1500 * time.Millisecond, true, false},
+		// Full for saturationHold.
+		{1600 * time.Millisecond, true, true},
+		// Not full, but not for long enough to leave.
+		{1700 * time.Millisecond, false, true},
+		{2500 * time.Millisecond, false, true},
+		// Nothing for saturationHold.
+		{2600 * time.Millisecond, false, false},
+	} {
+		if saturated := m.Check(now.Add(test.elapsed), test.chFull); saturated != test.saturated {
+			t.Errorf("%v full=%v: got %v, expected %v", test.elapsed, test.chFull, saturated, test.saturated)
+		}
+	}
+	s := logBuf.String()
+	if !strings.Contains(s, "test: entering saturated state: response queue full") ||
+		!strings.Contains(s, "test: leaving saturated state") {
+		t.Errorf("unexpected log %q", s)
+	}
+}
+
+func TestRecvLoopSaturation(t *testing.T) {
+	defer func(saved bool) { saturationServfail = saved }(saturationServfail)
+	defer func(saved int) { maxTunnelGoroutines = saved }(maxTunnelGoroutines)
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	domain := mustParseName("t.example.com")
+	established := turbotunnel.ClientID{1, 2, 3, 4, 5, 6, 7, 8}
+	newcomer := turbotunnel.ClientID{8, 7, 6, 5, 4, 3, 2, 1}
+	pconn := newFakePacketConn()
+	defer pconn.Close()
+	conn := newTestKCPConn(t, 0x01020304, established, pconn)
+	defer conn.Close()
+	sessions.Add(conn)
+	defer sessions.Remove(conn)
+
+	saturationServfail = true
+	// No room for a new session.
+	maxTunnelGoroutines = int(tunnelGoroutines.Value()) + 1
+	tunnelGoroutines.Add(1)
+	defer tunnelGoroutines.Add(-1)
+
+	dnsConn, ch, ttConn, stop := startRecvLoop(domain, 1000)
+	defer stop()
+
+	before := queriesSaturated.Value()
+	rec := injectQuery(t, dnsConn, ch, domain, newcomer, []byte("new"))
+	if rec.Resp.Rcode() != dns.RcodeServerFailure {
+		t.Errorf("new client: expected SERVFAIL, got %+v", rec.Resp)
+	}
+	if n := queriesSaturated.Value() - before; n != 1 {
+		t.Errorf("counted %d saturated queries, expected 1", n)
+	}
+	// A ClientID with a session is served as usual.
+	rec = injectQuery(t, dnsConn, ch, domain, established, []byte("old"))
+	if rec.Resp.Rcode() != dns.RcodeNoError {
+		t.Errorf("established client: expected NOERROR, got %+v", rec.Resp)
+	}
+	var buf [1000]byte
+	n, addr, err := ttConn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != established || string(buf[:n]) != "old" {
+		t.Errorf("got packet %+q from %v, expected %+q from %v", buf[:n], addr, "old", established)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// sendPool sends responses from a fixed number of worker goroutines, so that
+// one slow WriteTo does not hold up the responses queued behind it. All the
+// responses for one ClientID go to the same worker, which sends them in the
+// order they were submitted. (Responses that are not for a tunnel query have
+// the zero ClientID, so they all share one worker.)
+type sendPool struct {
+	queues []chan *record
+	wg     sync.WaitGroup
+	// failed is closed, and err set, when a worker stops because of a
+	// fatal error.
+	failed   chan struct{}
+	err      error
+	failOnce sync.Once
+}
+
+// newSendPool starts workers worker goroutines, each with a queue of length
+// queueLen, that call send for every record submitted to them. Each worker has
+// its own error policy: send's errors are checked by a loopErrors, and a fatal
+// error stops the worker and the pool.
+func newSendPool(workers, queueLen int, send func(*record, *loopErrors) error) *sendPool {
+	pool := &sendPool{
+		queues: make([]chan *record, workers),
+		failed: make(chan struct{}),
+	}
+	for i := range pool.queues {
+		queue := make(chan *record, queueLen)
+		pool.queues[i] = queue
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			loopErrs := newLoopErrors("WriteTo")
+			for rec := range queue {
+				if err := send(rec, loopErrs); err != nil {
+					pool.failOnce.Do(func() {
+						pool.err = err
+						close(pool.failed)
+					})
+					return
+				}
+			}
+		}()
+	}
+	return pool
+}
+
+// Submit queues rec to be sent by the worker for its ClientID, and returns
+// true. If that worker's queue is full, it returns false without queuing rec.
+func (pool *sendPool) Submit(rec *record) bool {
+	select {
+	case pool.queues[pool.worker(rec.ClientID)] <- rec:
+		return true
+	default:
+		return false
+	}
+}
+
+// worker returns the index of the worker that sends the responses for
+// clientID.
+func (pool *sendPool) worker(clientID turbotunnel.ClientID) int {
+	h := fnv.New32a()
+	h.Write(clientID[:])
+	return int(h.Sum32() % uint32(len(pool.queues)))
+}
+
+// Err returns the fatal error that stopped a worker, or nil if there has been
+// none.
+func (pool *sendPool) Err() error {
+	select {
+	case <-pool.failed:
+		return pool.err
+	default:
+		return nil
+	}
+}
+
+// Close stops accepting records and waits for the workers to send the ones
+// already queued. Submit must not be called after Close.
+func (pool *sendPool) Close() {
+	for _, queue := range pool.queues {
+		close(queue)
+	}
+	pool.wg.Wait()
+}
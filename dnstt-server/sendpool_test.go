@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// differentWorkers returns two ClientIDs that pool sends from different
+// workers.
+func differentWorkers(t *testing.T, pool *sendPool) (turbotunnel.ClientID, turbotunnel.ClientID) {
+	a := turbotunnel.ClientID{}
+	for i := 1; i < 256; i++ {
+		b := turbotunnel.ClientID{byte(i)}
+		if pool.worker(a) != pool.worker(b) {
+			return a, b
+		}
+	}
+	t.Fatal("all ClientIDs map to the same worker")
+	panic("unreachable")
+}
+
+func TestSendPool(t *testing.T) {
+	blocked := make(chan struct{}, 10)
+	release := make(chan struct{})
+	sent := make(chan *record, 10)
+	var slow turbotunnel.ClientID
+	pool := newSendPool(2, 4, func(rec *record, loopErrs *loopErrors) error {
+		if rec.ClientID == slow {
+			blocked <- struct{}{}
+			<-release
+		}
+		sent <- rec
+		return nil
+	})
+	slow, fast := differentWorkers(t, pool)
+
+	// While the worker for one ClientID is blocked in a send, responses
+	// for a ClientID on another worker are still sent.
+	var slowRecs []*record
+	for i := 0; i < 3; i++ {
+		rec := &record{ClientID: slow}
+		slowRecs = append(slowRecs, rec)
+		if !pool.Submit(rec) {
+			t.Fatalf("Submit %d failed", i)
+		}
+	}
+	fastRec := &record{ClientID: fast}
+	pool.Submit(fastRec)
+	select {
+	case rec := <-sent:
+		if rec != fastRec {
+			t.Fatalf("sent %+v while the slow worker was blocked", rec)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a send from the other worker")
+	}
+
+	// The blocked worker's queue fills up: one record is being sent and
+	// 4 are queued.
+	<-blocked
+	for i := 0; i < 2; i++ {
+		rec := &record{ClientID: slow}
+		slowRecs = append(slowRecs, rec)
+		if !pool.Submit(rec) {
+			t.Fatalf("Submit failed with %d records queued", len(slowRecs)-2)
+		}
+	}
+	if pool.Submit(&record{ClientID: slow}) {
+		t.Fatal("Submit succeeded with full queue")
+	}
+
+	// When unblocked, the worker sends its responses in order.
+	close(release)
+	pool.Close()
+	for i, expected := range slowRecs {
+		if rec := <-sent; rec != expected {
+			t.Errorf("record %d sent out of order", i)
+		}
+	}
+	if err := pool.Err(); err != nil {
+		t.Errorf("Err returned %v", err)
+	}
+}
+
+func TestSendPoolError(t *testing.T) {
+	errFatal := errors.New("fatal")
+	pool := newSendPool(2, 4, func(rec *record, loopErrs *loopErrors) error {
+		return errFatal
+	})
+	if err := pool.Err(); err != nil {
+		t.Fatalf("Err returned %v before any send", err)
+	}
+	pool.Submit(&record{})
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.Err() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the pool to fail")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := pool.Err(); err != errFatal {
+		t.Errorf("Err returned %v, expected %v", err, errFatal)
+	}
+	pool.Close()
+}
+
+// submitAddr is a net.Addr that records when and in what order a record was
+// submitted to a sendPool.
+type submitAddr struct {
+	seq  int
+	time time.Time
+}
+
+func (addr submitAddr) Network() string { return "submit" }
+func (addr submitAddr) String() string  { return fmt.Sprintf("submit-%d", addr.seq) }
+
+// benchmarkSendPoolSlowWrite submits responses for 16 ClientIDs to a sendPool
+// at a steady rate, with every 251st send blocking for 1 ms as if on a full
+// socket buffer, and reports the 90th and 99th percentiles of the time from
+// Submit to the end of the send. With 1 worker, as when sendLoop sends its own
+// responses, every slow send delays all the responses behind it; with more
+// workers, it delays only those that share its worker. Compare with
+// "go test -run=^$ -bench=SendPool".
+func benchmarkSendPoolSlowWrite(b *testing.B, workers int) {
+	latencies := make(chan time.Duration, b.N)
+	pool := newSendPool(workers, sendQueueLen, func(rec *record, loopErrs *loopErrors) error {
+		addr := rec.Addr.(submitAddr)
+		if addr.seq%251 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		latencies <- time.Since(addr.time)
+		return nil
+	})
+	b.ResetTimer()
+	next := time.Now()
+	for i := 0; i < b.N; i++ {
+		// Spin rather than sleep: sleeps this short are not precise.
+		for time.Now().Before(next) {
+			runtime.Gosched()
+		}
+		next = next.Add(20 * time.Microsecond)
+		rec := &record{ClientID: turbotunnel.ClientID{byte(i % 16)}}
+		rec.Addr = submitAddr{i, time.Now()}
+		for !pool.Submit(rec) {
+			runtime.Gosched()
+		}
+	}
+	pool.Close()
+	b.StopTimer()
+	close(latencies)
+	sorted := make([]time.Duration, 0, b.N)
+	for d := range latencies {
+		sorted = append(sorted, d)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	b.ReportMetric(float64(sorted[len(sorted)*90/100].Nanoseconds()), "p90-ns")
+	b.ReportMetric(float64(sorted[len(sorted)*99/100].Nanoseconds()), "p99-ns")
+}
+
+func BenchmarkSendPoolSlowWrite1(b *testing.B) { benchmarkSendPoolSlowWrite(b, 1) }
+func BenchmarkSendPoolSlowWrite8(b *testing.B) { benchmarkSendPoolSlowWrite(b, 8) }
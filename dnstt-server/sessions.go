@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// sessions is the registry of all open KCP sessions and their streams. It is
+// used to close the sessions of banned ClientIDs, and to export the current
+// set of sessions for debugging.
+var sessions = newSessionRegistry()
+
+// sessionEntry is the state of one open KCP session in a sessionRegistry.
+type sessionEntry struct {
+	conn    *kcp.UDPSession
+	started time.Time
+	// If not nil, where acceptStreams logs the progress of the session's
+	// handshake. Set before acceptStreams starts.
+	handshake *handshakeTrace
+	// Protected by the sessionRegistry's lock.
+	streams map[*streamEntry]struct{}
+}
+
+// streamEntry is the state of one open smux stream in a sessionRegistry.
+type streamEntry struct {
+	id      uint32
+	started time.Time
+	// Counts of bytes copied in each direction.
+	Upstream   counter
+	Downstream counter
+	// Protected by the sessionRegistry's lock.
+	upstreamAddr string
+	tag          string
+}
+
+// sessionRegistry is a set of open KCP sessions and their streams. Its methods
+// are safe to call from multiple goroutines.
+type sessionRegistry struct {
+	sessions map[*kcp.UDPSession]*sessionEntry
+	// Number of sessions in sessions with each ClientID.
+	clientIDs map[turbotunnel.ClientID]int
+	// If not nil, the source of the outgoing queue lengths in Snapshot.
+	queues *turbotunnel.QueuePacketConn
+	lock   sync.Mutex
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions:  make(map[*kcp.UDPSession]*sessionEntry),
+		clientIDs: make(map[turbotunnel.ClientID]int),
+	}
+}
+
+// sessionClientID returns the ClientID of conn. Sessions accepted from a
+// turbotunnel.QueuePacketConn have their ClientID as their remote address.
+func sessionClientID(conn *kcp.UDPSession) (turbotunnel.ClientID, bool) {
+	clientID, ok := conn.RemoteAddr().(turbotunnel.ClientID)
+	return clientID, ok
+}
+
+// Add adds conn to the registry, and returns its entry.
+func (r *sessionRegistry) Add(conn *kcp.UDPSession) *sessionEntry {
+	entry := &sessionEntry{
+		conn:    conn,
+		started: time.Now(),
+		streams: make(map[*streamEntry]struct{}),
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sessions[conn] = entry
+	if clientID, ok := sessionClientID(conn); ok {
+		r.clientIDs[clientID]++
+	}
+	return entry
+}
+
+// Remove removes conn, and any of its streams that remain, from the registry.
+func (r *sessionRegistry) Remove(conn *kcp.UDPSession) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.sessions[conn]; !ok {
+		return
+	}
+	delete(r.sessions, conn)
+	if clientID, ok := sessionClientID(conn); ok {
+		r.clientIDs[clientID]--
+		if r.clientIDs[clientID] == 0 {
+			delete(r.clientIDs, clientID)
+		}
+	}
+}
+
+// SetQueues makes Snapshot report the number of packets waiting in ttConn's
+// outgoing queue for each session's ClientID.
+func (r *sessionRegistry) SetQueues(ttConn *turbotunnel.QueuePacketConn) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.queues = ttConn
+}
+
+// Len returns the number of sessions in the registry.
+func (r *sessionRegistry) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.sessions)
+}
+
+// HasClientID returns true if the registry has an open session for
+// clientID.
+func (r *sessionRegistry) HasClientID(clientID turbotunnel.ClientID) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.clientIDs[clientID] > 0
+}
+
+// AddStream adds a stream with the given ID to session, and returns its
+// entry.
+func (r *sessionRegistry) AddStream(session *sessionEntry, id uint32) *streamEntry {
+	entry := &streamEntry{
+		id:      id,
+		started: time.Now(),
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	session.streams[entry] = struct{}{}
+	return entry
+}
+
+// RemoveStream removes stream from session.
+func (r *sessionRegistry) RemoveStream(session *sessionEntry, stream *streamEntry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(session.streams, stream)
+}
+
+// SetStreamInfo records the upstream address and tag of stream.
+func (r *sessionRegistry) SetStreamInfo(stream *streamEntry, upstreamAddr, tag string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	stream.upstreamAddr = upstreamAddr
+	stream.tag = tag
+}
+
+// CloseClientID closes all the open sessions of clientID, and returns how many
+// there were. The sessions remain in the registry until their owners Remove
+// them.
+func (r *sessionRegistry) CloseClientID(clientID turbotunnel.ClientID) int {
+	var conns []*kcp.UDPSession
+	r.lock.Lock()
+	for conn := range r.sessions {
+		if id, ok := sessionClientID(conn); ok && id == clientID {
+			conns = append(conns, conn)
+		}
+	}
+	r.lock.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+// sessionInfo and streamInfo are the JSON representation of the registry
+// written by WriteJSON.
+type sessionInfo struct {
+	Conv          string       `json:"conv"`
+	ClientID      string       `json:"client_id"`
+	AgeSeconds    float64      `json:"age_seconds"`
+	QueuedPackets int          `json:"queued_packets"`
+	Streams       []streamInfo `json:"streams"`
+}
+
+type streamInfo struct {
+	ID              uint32  `json:"id"`
+	AgeSeconds      float64 `json:"age_seconds"`
+	Upstream        string  `json:"upstream"`
+	Tag             string  `json:"tag,omitempty"`
+	UpstreamBytes   uint64  `json:"upstream_bytes"`
+	DownstreamBytes uint64  `json:"downstream_bytes"`
+}
+
+// Snapshot returns a description of every session in the registry and each
+// of its streams, sorted by conv and stream ID.
+func (r *sessionRegistry) Snapshot(now time.Time) []sessionInfo {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var queueLengths map[net.Addr]int
+	if r.queues != nil {
+		queueLengths = r.queues.OutgoingQueueLengths()
+	}
+	result := make([]sessionInfo, 0, len(r.sessions))
+	for conn, session := range r.sessions {
+		info := sessionInfo{
+			Conv:          fmt.Sprintf("%08x", conn.GetConv()),
+			ClientID:      conn.RemoteAddr().String(),
+			AgeSeconds:    now.Sub(session.started).Seconds(),
+			QueuedPackets: queueLengths[conn.RemoteAddr()],
+			Streams:       make([]streamInfo, 0, len(session.streams)),
+		}
+		for stream := range session.streams {
+			info.Streams = append(info.Streams, streamInfo{
+				ID:              stream.id,
+				AgeSeconds:      now.Sub(stream.started).Seconds(),
+				Upstream:        stream.upstreamAddr,
+				Tag:             stream.tag,
+				UpstreamBytes:   stream.Upstream.Value(),
+				DownstreamBytes: stream.Downstream.Value(),
+			})
+		}
+		sort.Slice(info.Streams, func(i, j int) bool { return info.Streams[i].ID < info.Streams[j].ID })
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Conv < result[j].Conv })
+	return result
+}
+
+// WriteJSON writes the result of Snapshot to w as a JSON array.
+func (r *sessionRegistry) WriteJSON(w io.Writer, now time.Time) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.Snapshot(now))
+}
+
+// handleDebugSessions is the HTTP handler for /debug/sessions. It refuses
+// requests that do not come from a loopback address.
+func handleDebugSessions(w http.ResponseWriter, req *http.Request) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	sessions.WriteJSON(w, time.Now())
+}
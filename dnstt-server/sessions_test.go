@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestSessionRegistrySnapshot(t *testing.T) {
+	clientID := turbotunnel.NewClientID()
+	pconn := newFakePacketConn()
+	defer pconn.Close()
+	conn := newTestKCPConn(t, 0xfedcba98, clientID, pconn)
+	defer conn.Close()
+
+	r := newSessionRegistry()
+	session := r.Add(conn)
+	s3 := r.AddStream(session, 3)
+	s1 := r.AddStream(session, 1)
+	r.SetStreamInfo(s3, "127.0.0.1:8000", "web")
+	s3.Upstream.Add(10)
+	s3.Downstream.Add(20)
+
+	now := session.started.Add(5 * time.Second)
+	snapshot := r.Snapshot(now)
+	if len(snapshot) != 1 {
+		t.Fatalf("got %d sessions, expected 1", len(snapshot))
+	}
+	info := snapshot[0]
+	if info.Conv != "fedcba98" || info.ClientID != clientID.String() || info.AgeSeconds < 5 || len(info.Streams) != 2 {
+		t.Fatalf("unexpected session %+v", info)
+	}
+	if info.Streams[0].ID != 1 || info.Streams[0].Upstream != "" {
+		t.Errorf("unexpected first stream %+v", info.Streams[0])
+	}
+	if got, expected := info.Streams[1], (streamInfo{
+		ID:              3,
+		AgeSeconds:      now.Sub(s3.started).Seconds(),
+		Upstream:        "127.0.0.1:8000",
+		Tag:             "web",
+		UpstreamBytes:   10,
+		DownstreamBytes: 20,
+	}); got != expected {
+		t.Errorf("got second stream %+v, expected %+v", got, expected)
+	}
+
+	r.RemoveStream(session, s1)
+	if n := len(r.Snapshot(now)[0].Streams); n != 1 {
+		t.Errorf("%d streams after RemoveStream, expected 1", n)
+	}
+	if !r.HasClientID(clientID) {
+		t.Errorf("HasClientID false for open session")
+	}
+	r.Remove(conn)
+	if n := len(r.Snapshot(now)); n != 0 {
+		t.Errorf("%d sessions after Remove, expected 0", n)
+	}
+	if r.HasClientID(clientID) {
+		t.Errorf("HasClientID true after Remove")
+	}
+	// A second Remove is harmless.
+	r.Remove(conn)
+}
+
+func TestSessionRegistrySnapshotQueuedPackets(t *testing.T) {
+	clientID := turbotunnel.NewClientID()
+	pconn := newFakePacketConn()
+	defer pconn.Close()
+	conn := newTestKCPConn(t, 0x01234567, clientID, pconn)
+	defer conn.Close()
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	defer ttConn.Close()
+
+	r := newSessionRegistry()
+	r.Add(conn)
+	now := time.Now()
+	// Without SetQueues, nothing is reported.
+	ttConn.WriteTo([]byte("a"), clientID)
+	if n := r.Snapshot(now)[0].QueuedPackets; n != 0 {
+		t.Errorf("without SetQueues, %d queued packets, expected 0", n)
+	}
+	r.SetQueues(ttConn)
+	ttConn.WriteTo([]byte("b"), clientID)
+	ttConn.Stash([]byte("c"), clientID)
+	ttConn.WriteTo([]byte("x"), turbotunnel.NewClientID())
+	if n := r.Snapshot(now)[0].QueuedPackets; n != 3 {
+		t.Errorf("%d queued packets, expected 3", n)
+	}
+	<-ttConn.OutgoingQueue(clientID)
+	if n := r.Snapshot(now)[0].QueuedPackets; n != 2 {
+		t.Errorf("after dequeue, %d queued packets, expected 2", n)
+	}
+}
+
+func TestHandleDebugSessions(t *testing.T) {
+	for _, test := range []struct {
+		remoteAddr string
+		status     int
+	}{
+		{"127.0.0.1:1234", http.StatusOK},
+		{"[::1]:1234", http.StatusOK},
+		{"192.0.2.1:1234", http.StatusForbidden},
+		{"[2001:db8::1]:1234", http.StatusForbidden},
+		{"garbage", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("GET", "/debug/sessions", nil)
+		req.RemoteAddr = test.remoteAddr
+		w := httptest.NewRecorder()
+		handleDebugSessions(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, expected %d", test.remoteAddr, w.Code, test.status)
+			continue
+		}
+		if w.Code == http.StatusOK {
+			var snapshot []sessionInfo
+			if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil {
+				t.Errorf("%s: cannot parse response: %v", test.remoteAddr, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsdMaxDatagram is the greatest number of bytes of metric lines that
+// pushStatsd puts in one UDP datagram. A single line that is longer is sent
+// alone.
+const statsdMaxDatagram = 1400
+
+// statsdNameEscaper replaces the characters that have a meaning in the StatsD
+// line format, and whitespace, in metric names and label values.
+var statsdNameEscaper = strings.NewReplacer(
+	":", "_", "|", "_", "@", "_", "#", "_",
+	" ", "_", "\t", "_", "\n", "_",
+)
+
+// statsdExporter computes StatsD metric lines from a metricsRegistry. StatsD
+// counters are increments, so it remembers the value of every counter at the
+// time of the previous call to Lines.
+type statsdExporter struct {
+	registry *metricsRegistry
+	last     map[string]float64
+}
+
+func newStatsdExporter(registry *metricsRegistry) *statsdExporter {
+	return &statsdExporter{
+		registry: registry,
+		last:     make(map[string]float64),
+	}
+}
+
+// counterLine returns the line for a counter named name, whose value is now
+// value, or "" if it has not changed since the last call.
+func (e *statsdExporter) counterLine(name string, value float64) string {
+	delta := value - e.last[name]
+	e.last[name] = value
+	if delta == 0 {
+		return ""
+	}
+	return name + ":" + strconv.FormatFloat(delta, 'g', -1, 64) + "|c"
+}
+
+// Lines returns a StatsD line for every metric in the registry. Names are the
+// same as the Prometheus names; each label value of a family member is
+// appended to the name after a dot. Gauges are sent every time, and counters
+// as the increase since the previous call, when there is one. Histograms are
+// sent as the two counters NAME_count and NAME_sum.
+func (e *statsdExporter) Lines() []string {
+	var lines []string
+	add := func(line string) {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	for _, entry := range e.registry.Snapshot() {
+		name := statsdNameEscaper.Replace(entry.Name)
+		switch {
+		case entry.Histograms != nil:
+			for _, h := range entry.Histograms() {
+				member := name
+				for _, labelValue := range h.LabelValues {
+					member += "." + statsdNameEscaper.Replace(labelValue)
+				}
+				add(e.counterLine(member+"_count", float64(h.Counts[len(h.Counts)-1])))
+				add(e.counterLine(member+"_sum", float64(h.Sum)))
+			}
+		case entry.Values != nil:
+			for _, v := range entry.Values() {
+				member := name + "." + statsdNameEscaper.Replace(v.LabelValue)
+				if entry.Type == "counter" {
+					add(e.counterLine(member, v.Value))
+				} else {
+					add(member + ":" + strconv.FormatFloat(v.Value, 'g', -1, 64) + "|g")
+				}
+			}
+		case entry.Type == "counter":
+			add(e.counterLine(name, entry.Value()))
+		default:
+			add(name + ":" + strconv.FormatFloat(entry.Value(), 'g', -1, 64) + "|g")
+		}
+	}
+	return lines
+}
+
+// writeStatsdDatagrams writes lines to w, separated by newlines, in as few
+// writes as possible without making any longer than statsdMaxDatagram.
+func writeStatsdDatagrams(w io.Writer, lines []string) error {
+	var buf bytes.Buffer
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		_, err := w.Write(buf.Bytes())
+		buf.Reset()
+		return err
+	}
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > statsdMaxDatagram {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	return flush()
+}
+
+// pushStatsd sends the metrics in the registry to conn every interval, until
+// done is closed. Errors are logged, and do not stop the pushes, so that the
+// server does not depend on the StatsD server being up.
+func pushStatsd(conn net.Conn, interval time.Duration, done <-chan struct{}) {
+	exporter := newStatsdExporter(metrics)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := writeStatsdDatagrams(conn, exporter.Lines())
+			if err != nil {
+				log.Printf("pushing metrics to StatsD: %v", err)
+			}
+		}
+	}
+}
+
+// startStatsd opens a UDP socket to the StatsD server at addr and runs
+// pushStatsd on it in a separate goroutine. As with startMetrics, failure is
+// an error only if strictAuxListeners is set.
+func startStatsd(addr string, interval time.Duration) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		if strictAuxListeners {
+			return err
+		}
+		log.Printf("warning: cannot open StatsD socket, continuing without it: %v", err)
+		return nil
+	}
+	go pushStatsd(conn, interval, nil)
+	return nil
+}
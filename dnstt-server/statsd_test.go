@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdExporter(t *testing.T) {
+	r := newMetricsRegistry()
+	c := r.NewCounter("test_total", "A counter.")
+	g := r.NewGauge("test_gauge", "A gauge.")
+	v := r.NewCounterVec("test_labeled_total", "A labeled counter.", "reason", 10)
+	h := r.NewHistogramVec("test_size_bytes", "A histogram.", []uint64{10, 100}, "rcode")
+	e := newStatsdExporter(r)
+
+	c.Add(3)
+	g.Add(-2)
+	v.With("a b").Inc()
+	h.With("NOERROR").Observe(50)
+	h.With("NOERROR").Observe(500)
+	expected := []string{
+		"test_gauge:-2|g",
+		"test_labeled_total.a_b:1|c",
+		"test_size_bytes.NOERROR_count:2|c",
+		"test_size_bytes.NOERROR_sum:550|c",
+		"test_total:3|c",
+	}
+	if lines := e.Lines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("first push: got %+q, expected %+q", lines, expected)
+	}
+
+	// Counters are sent as increments, and not at all if unchanged.
+	// Gauges are always sent.
+	c.Inc()
+	expected = []string{
+		"test_gauge:-2|g",
+		"test_total:1|c",
+	}
+	if lines := e.Lines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("second push: got %+q, expected %+q", lines, expected)
+	}
+}
+
+// datagramRecorder is an io.Writer that records each Write separately.
+type datagramRecorder [][]byte
+
+func (d *datagramRecorder) Write(p []byte) (int, error) {
+	*d = append(*d, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func TestWriteStatsdDatagrams(t *testing.T) {
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, "dnstt_test_metric_with_a_long_name:12345|c")
+	}
+	var d datagramRecorder
+	if err := writeStatsdDatagrams(&d, lines); err != nil {
+		t.Fatal(err)
+	}
+	if len(d) < 2 {
+		t.Fatalf("%d datagrams, expected more than 1", len(d))
+	}
+	var all []string
+	for _, p := range d {
+		if len(p) > statsdMaxDatagram {
+			t.Errorf("datagram of %d bytes, greater than %d", len(p), statsdMaxDatagram)
+		}
+		all = append(all, strings.Split(string(p), "\n")...)
+	}
+	if !reflect.DeepEqual(all, lines) {
+		t.Errorf("lines were not preserved across datagrams")
+	}
+
+	d = nil
+	if err := writeStatsdDatagrams(&d, nil); err != nil || len(d) != 0 {
+		t.Errorf("no lines: %d datagrams, error %v", len(d), err)
+	}
+}
+
+func TestPushStatsd(t *testing.T) {
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("udp", ln.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go pushStatsd(conn, 10*time.Millisecond, done)
+
+	// Gauges are sent on every push.
+	ln.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var buf [statsdMaxDatagram]byte
+		n, _, err := ln.ReadFrom(buf[:])
+		if err != nil {
+			t.Fatalf("no datagram contained dnstt_sessions_active: %v", err)
+		}
+		if bytes.Contains(buf[:n], []byte("\ndnstt_sessions_active:")) ||
+			bytes.HasPrefix(buf[:n], []byte("dnstt_sessions_active:")) {
+			break
+		}
+	}
+}
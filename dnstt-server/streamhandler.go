@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/xtaci/smux"
+	"www.bamsoftware.com/git/dnstt.git/internal/registry"
+)
+
+// streamHandlerFunc is the type of streamHandler.
+type streamHandlerFunc func(stream *smux.Stream, conv uint32, streamID uint32) error
+
+// streamHandlers maps names to the functions given to registerStreamHandler.
+var streamHandlers = registry.New("stream handler")
+
+// registerStreamHandler makes a custom stream handler available to the
+// -stream-handler option under name. newHandler receives the configuration
+// string that follows the name in -stream-handler NAME:CONFIG, and returns the
+// function that becomes streamHandler, and which must meet the requirements
+// given there: among them, it must close the stream. registerStreamHandler
+// panics if name is already registered.
+//
+// As with registerTransport, a stream handler that is not part of this
+// repository is compiled in by adding to this main package a file whose init
+// function calls registerStreamHandler. The handler itself may live in any
+// package.
+func registerStreamHandler(name string, newHandler func(config string) (streamHandlerFunc, error)) {
+	streamHandlers.Register(name, newHandler)
+}
+
+// openStreamHandler returns the stream handler named by spec, which has the
+// form NAME or NAME:CONFIG, as for the -stream-handler option.
+func openStreamHandler(spec string) (streamHandlerFunc, error) {
+	name, config := registry.SplitSpec(spec)
+	newHandler, err := streamHandlers.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return newHandler.(func(config string) (streamHandlerFunc, error))(config)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// newGreetStreamHandler returns an example stream handler that serves streams
+// in-process, with no upstream: it reads a name and answers with config
+// followed by the name. It refuses the name "nobody", closing the stream
+// without answering.
+func newGreetStreamHandler(config string) (streamHandlerFunc, error) {
+	if config == "" {
+		return nil, fmt.Errorf("missing greeting")
+	}
+	return func(stream *smux.Stream, conv uint32, streamID uint32) error {
+		defer stream.Close()
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var buf [100]byte
+		n, err := stream.Read(buf[:])
+		if err != nil {
+			return err
+		}
+		if string(buf[:n]) == "nobody" {
+			return fmt.Errorf("refused %q", buf[:n])
+		}
+		_, err = fmt.Fprintf(stream, "%s, %s (stream %08x:%d)", config, buf[:n], conv, streamID)
+		return err
+	}, nil
+}
+
+func TestOpenStreamHandler(t *testing.T) {
+	defer streamHandlers.Unregister("greet")
+	registerStreamHandler("greet", newGreetStreamHandler)
+
+	if handler, err := openStreamHandler("greet:hello"); err != nil || handler == nil {
+		t.Errorf("got %v, %v", handler, err)
+	}
+	if _, err := openStreamHandler("greet"); err == nil || !strings.Contains(err.Error(), "missing greeting") {
+		t.Errorf("no config: got %v", err)
+	}
+	if _, err := openStreamHandler("other"); err == nil || !strings.Contains(err.Error(), "available: greet") {
+		t.Errorf("unknown stream handler: got %v", err)
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	defer streamHandlers.Unregister("greet")
+	registerStreamHandler("greet", newGreetStreamHandler)
+	handler, err := openStreamHandler("greet:hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved streamHandlerFunc, savedName string) {
+		streamHandler, streamHandlerName = saved, savedName
+	}(streamHandler, streamHandlerName)
+	streamHandler, streamHandlerName = handler, "greet"
+	var logBuf syncBuffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	// Nothing listens upstream; the handler replaces dialing it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := ln.Addr().String()
+	ln.Close()
+	sess, _, stop := startTestTunnel(t, upstream)
+	defer stop()
+
+	for _, test := range []struct {
+		name     string
+		expected string
+	}{
+		{"tunnel", "hello, tunnel (stream "},
+		{"nobody", ""},
+	} {
+		stream, err := sess.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Close()
+		if _, err := stream.Write([]byte(test.name)); err != nil {
+			t.Fatal(err)
+		}
+		stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+		// The handler closes the stream after answering.
+		reply, err := ioutil.ReadAll(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(reply), test.expected) || (test.expected == "" && len(reply) != 0) {
+			t.Errorf("%q: got %+q", test.name, reply)
+		}
+	}
+
+	// An error from the handler is logged under the handler's name.
+	expected := `stream handler "greet": refused "nobody"`
+	for i := 0; !strings.Contains(logBuf.String(), expected) && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := logBuf.String(); !strings.Contains(s, expected) || strings.Contains(s, "handleStream:") {
+		t.Errorf("log lacks %q or mentions handleStream:\n%s", expected, s)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+// streamPool runs functions on a fixed number of worker goroutines, with a
+// bounded queue of functions waiting for a worker. It is an alternative to
+// starting a new goroutine for every stream. Its methods are safe to call from
+// multiple goroutines.
+type streamPool struct {
+	queue chan func()
+}
+
+// newStreamPool starts workers worker goroutines, which take functions from a
+// queue of length queueLen. The workers run for the life of the program.
+func newStreamPool(workers, queueLen int) *streamPool {
+	pool := &streamPool{
+		queue: make(chan func(), queueLen),
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for f := range pool.queue {
+				f()
+			}
+		}()
+	}
+	return pool
+}
+
+// Submit queues f to be run by a worker, and returns true. If the queue is
+// full, it returns false without queuing f.
+func (pool *streamPool) Submit(f func()) bool {
+	select {
+	case pool.queue <- f:
+		return true
+	default:
+		return false
+	}
+}
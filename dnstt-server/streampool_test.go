@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamPool(t *testing.T) {
+	const workers = 2
+	const queueLen = 3
+	pool := newStreamPool(workers, queueLen)
+
+	// Fill the workers with functions that block until release is closed.
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var done sync.WaitGroup
+	blocker := func() {
+		defer done.Done()
+		started <- struct{}{}
+		<-release
+	}
+	for i := 0; i < workers; i++ {
+		done.Add(1)
+		if !pool.Submit(blocker) {
+			t.Fatalf("Submit %d failed with idle workers", i)
+		}
+	}
+	for i := 0; i < workers; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for worker %d to start", i)
+		}
+	}
+
+	// Now the queue fills up, and Submit fails after that.
+	ran := make(chan struct{}, queueLen)
+	for i := 0; i < queueLen; i++ {
+		done.Add(1)
+		if !pool.Submit(func() { defer done.Done(); ran <- struct{}{} }) {
+			t.Fatalf("Submit failed with %d functions queued", i)
+		}
+	}
+	if pool.Submit(func() { t.Error("ran function that was not queued") }) {
+		t.Fatalf("Submit succeeded with full queue")
+	}
+	select {
+	case <-ran:
+		t.Fatalf("queued function ran while all workers were busy")
+	default:
+	}
+
+	// When the workers are free, the queued functions run.
+	close(release)
+	done.Wait()
+	if len(ran) != queueLen {
+		t.Errorf("%d queued functions ran, expected %d", len(ran), queueLen)
+	}
+}
+
+// The two benchmarks below compare the cost of handling many short tasks with
+// a goroutine per task and with a streamPool. Compare them with
+//	go test -run=^$ -bench=Stream -benchmem
+// Streams are usually long-lived, so the per-task overhead is seldom
+// significant; the pool's real effect is to limit concurrency.
+
+func BenchmarkStreamGoroutinePerTask(b *testing.B) {
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+	for i := 0; i < b.N; i++ {
+		go wg.Done()
+	}
+	wg.Wait()
+}
+
+func BenchmarkStreamPool(b *testing.B) {
+	pool := newStreamPool(64, 1024)
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+	for i := 0; i < b.N; i++ {
+		for !pool.Submit(wg.Done) {
+			time.Sleep(time.Microsecond)
+		}
+	}
+	wg.Wait()
+}
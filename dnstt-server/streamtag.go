@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	// The longest stream tag a client may send with -stream-tags.
+	maxStreamTagLen = 32
+
+	// The maximum number of distinct stream tags for which we keep
+	// separate metrics.
+	maxStreamTagMetrics = 100
+)
+
+// Per-tag byte counts for streams that have a tag.
+var (
+	upstreamBytesByTag = metrics.NewCounterVec("dnstt_tag_upstream_bytes_total",
+		"Stream bytes sent from clients to the upstream, by stream tag.",
+		"tag", maxStreamTagMetrics)
+	downstreamBytesByTag = metrics.NewCounterVec("dnstt_tag_downstream_bytes_total",
+		"Stream bytes sent from the upstream to clients, by stream tag.",
+		"tag", maxStreamTagMetrics)
+)
+
+// readStreamTag reads the tag that a client sends at the beginning of every
+// stream when -stream-tags is in use: a length octet, followed by that many
+// bytes of tag. A length of 0 means the stream has no tag. The returned tag is
+// sanitized with sanitizeStreamTag.
+func readStreamTag(r io.Reader) (string, error) {
+	var length [1]byte
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return "", err
+	}
+	if int(length[0]) > maxStreamTagLen {
+		return "", fmt.Errorf("stream tag length %d is greater than %d", length[0], maxStreamTagLen)
+	}
+	tag := make([]byte, int(length[0]))
+	_, err = io.ReadFull(r, tag)
+	if err != nil {
+		return "", err
+	}
+	return sanitizeStreamTag(tag), nil
+}
+
+// sanitizeStreamTag replaces every byte of tag that is not an ASCII letter,
+// digit, '-', '.', or '_' with '_', making it safe to use in log messages and
+// metric labels.
+func sanitizeStreamTag(tag []byte) string {
+	sanitized := make([]byte, len(tag))
+	for i, b := range tag {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '.', b == '_':
+			sanitized[i] = b
+		default:
+			sanitized[i] = '_'
+		}
+	}
+	return string(sanitized)
+}
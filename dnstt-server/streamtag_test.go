@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestReadStreamTag(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		tag   string
+		err   bool
+	}{
+		{"\x00", "", false},
+		{"\x06tenant", "tenant", false},
+		{"\x06tenantDATA", "tenant", false},
+		{"\x07a b\"c\n\xff", "a_b_c__", false},
+		{"\x20" + strings.Repeat("x", 32), strings.Repeat("x", 32), false},
+		{"\x21" + strings.Repeat("x", 33), "", true},
+		{"", "", true},
+		{"\x06ten", "", true},
+	} {
+		tag, err := readStreamTag(strings.NewReader(test.input))
+		if (err != nil) != test.err || tag != test.tag {
+			t.Errorf("%+q returned (%+q, %v), expected (%+q, error=%v)",
+				test.input, tag, err, test.tag, test.err)
+		}
+	}
+
+	// Stream data after the tag is left unread.
+	r := strings.NewReader("\x03tagDATA")
+	readStreamTag(r)
+	rest, _ := ioutil.ReadAll(r)
+	if string(rest) != "DATA" {
+		t.Errorf("after tag, %+q remains, expected %+q", rest, "DATA")
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	r := newMetricsRegistry()
+	v := r.NewCounterVec("bytes_total", "Bytes.", "tag", 3)
+	// A real value, whatever it is, is not confused with the combined
+	// values beyond the limit.
+	v.With("_other").Add(5)
+	v.With("a").Add(1)
+	v.With("b").Add(2)
+	// Beyond the limit, values are combined.
+	v.With("c").Add(3)
+	v.With("d").Add(4)
+	v.With("a").Add(10)
+
+	var buf bytes.Buffer
+	if err := r.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP bytes_overflow_total Like bytes_total, combined for the values of tag beyond the first 3.
+# TYPE bytes_overflow_total counter
+bytes_overflow_total 7
+# HELP bytes_total Bytes.
+# TYPE bytes_total counter
+bytes_total{tag="_other"} 5
+bytes_total{tag="a"} 11
+bytes_total{tag="b"} 2
+`
+	if buf.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+const (
+	// The maximum size of a response sent over TCP. TCP responses are not
+	// subject to the UDP limits of maxUDPPayload and -max-response-size;
+	// only to the 16-bit length prefix.
+	tcpResponseSizeLimit = 0xffff
+
+	// Close a DNS over TCP connection on which no query has arrived, or
+	// a response has been blocked from being written, for this long. RFC
+	// 7766 section 6.2.3 recommends that servers not keep idle
+	// connections open indefinitely.
+	tcpIdleTimeout = 2 * time.Minute
+
+	// After a transient error from Accept, such as running out of file
+	// descriptors, wait this long before calling Accept again, rather
+	// than retrying in a tight loop.
+	tcpAcceptErrorDelay = 100 * time.Millisecond
+)
+
+// tcpAddr is the address of one TCP connection accepted by a tcpPacketConn.
+// Two connections from the same remote address have different tcpAddrs. ip is
+// the IP address part of remote, or "" if it has none.
+type tcpAddr struct {
+	id     uint64
+	remote string
+	ip     string
+}
+
+func (addr tcpAddr) Network() string { return "tcp" }
+func (addr tcpAddr) String() string  { return fmt.Sprintf("%s#%d", addr.remote, addr.id) }
+
+// remoteIP returns the IP address part of remote, an "IP:port" address such
+// as http.Request.RemoteAddr, or "" if it does not have one.
+func remoteIP(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// tcpPacketConn is a net.PacketConn that carries DNS messages over TCP
+// connections, or over TLS connections for DNS over TLS, each message prefixed
+// by a 16-bit length as in RFC 1035 section 4.2.2. ReadFrom returns the DNS
+// messages received from all TCP connections, each tagged with a tcpAddr for
+// the connection it came from. WriteTo sends a DNS message back over the TCP
+// connection identified by the tcpAddr.
+//
+// Responses sent on a tcpPacketConn may be as large as tcpResponseSizeLimit;
+// see connResponseSizeLimit.
+type tcpPacketConn struct {
+	*turbotunnel.QueuePacketConn
+	ln     net.Listener
+	nextID uint64
+}
+
+// newTCPPacketConn accepts DNS over TCP connections on ln, and returns a
+// tcpPacketConn through which to exchange the DNS messages they carry. Closing
+// the tcpPacketConn closes ln.
+func newTCPPacketConn(ln net.Listener) *tcpPacketConn {
+	c := &tcpPacketConn{
+		// Forget the outgoing queue of a TCP connection some time
+		// after it has closed.
+		QueuePacketConn: turbotunnel.NewQueuePacketConn(ln.Addr(), 1*time.Minute),
+		ln:              ln,
+	}
+	go func() {
+		loopErrs := newLoopErrors("TCP Accept")
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if err := loopErrs.Check(err, time.Now()); err != nil {
+					log.Printf("TCP listener: %v", err)
+					break
+				}
+				time.Sleep(tcpAcceptErrorDelay)
+				continue
+			}
+			loopErrs.Success()
+			go c.handle(conn)
+		}
+		c.Close()
+	}()
+	return c
+}
+
+// writeFull writes all of p to w, calling Write again after a short write. It
+// returns the number of bytes written, which is less than len(p) only if it
+// also returns an error.
+func writeFull(w io.Writer, p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		m, err := w.Write(p[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// handle exchanges DNS messages over one TCP connection, until the connection
+// is closed or has been idle for tcpIdleTimeout.
+func (c *tcpPacketConn) handle(conn net.Conn) {
+	defer conn.Close()
+	addr := tcpAddr{
+		id:     atomic.AddUint64(&c.nextID, 1),
+		remote: conn.RemoteAddr().String(),
+		ip:     remoteIP(conn.RemoteAddr().String()),
+	}
+	if conn, ok := conn.(*tls.Conn); ok {
+		if err := dotHandshake(conn, addr); err != nil {
+			return
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			var p []byte
+			var ok bool
+			select {
+			case <-done:
+				return
+			case p, ok = <-c.OutgoingQueue(addr):
+				if !ok {
+					// The queue expired; get a new one.
+					continue
+				}
+			}
+			msg := make([]byte, 2+len(p))
+			binary.BigEndian.PutUint16(msg, uint16(len(p)))
+			copy(msg[2:], p)
+			// Don't let a client that stops reading hold the
+			// connection open forever.
+			conn.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+			n, err := writeFull(conn, msg)
+			if err != nil {
+				// Most likely the client closed the
+				// connection before reading the whole
+				// response.
+				tcpWritesFailed.Inc()
+				log.Printf("%v: wrote %d of %d bytes of response: %v", addr, n, len(msg), err)
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	br := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		var length uint16
+		err := binary.Read(br, binary.BigEndian, &length)
+		if err != nil {
+			// Includes io.EOF on a clean close.
+			return
+		}
+		p := make([]byte, int(length))
+		_, err = io.ReadFull(br, p)
+		if err != nil {
+			return
+		}
+		c.QueueIncoming(p, addr)
+	}
+}
+
+// Close closes the tcpPacketConn and its listener.
+func (c *tcpPacketConn) Close() error {
+	c.ln.Close()
+	return c.QueuePacketConn.Close()
+}
+
+// isStreamConn returns true if dnsConn is a tcpPacketConn or dohPacketConn,
+// which carry DNS messages over TCP rather than in UDP datagrams.
+func isStreamConn(dnsConn net.PacketConn) bool {
+	switch dnsConn.(type) {
+	case *tcpPacketConn, *dohPacketConn:
+		return true
+	}
+	return false
+}
+
+// connResponseSizeLimit returns the maximum size of a response sent on
+// dnsConn: tcpResponseSizeLimit for a stream transport (see isStreamConn),
+// otherwise responseSizeLimit().
+func connResponseSizeLimit(dnsConn net.PacketConn) int {
+	if isStreamConn(dnsConn) {
+		return tcpResponseSizeLimit
+	}
+	return responseSizeLimit()
+}
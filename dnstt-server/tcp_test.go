@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// startTCPPacketConn returns a tcpPacketConn listening on a loopback address.
+func startTCPPacketConn(t *testing.T) *tcpPacketConn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTCPPacketConn(ln)
+}
+
+// readTCPMessage reads one length-prefixed DNS message from r.
+func readTCPMessage(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, int(length))
+	if _, err := io.ReadFull(r, p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestTCPPacketConn(t *testing.T) {
+	conn := startTCPPacketConn(t)
+	defer conn.Close()
+
+	c, err := net.Dial("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// A message may arrive in pieces, and a zero-length message is a
+	// message like any other.
+	for _, piece := range []string{"\x00", "\x05que", "ry\x00\x00"} {
+		if _, err := c.Write([]byte(piece)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var buf [100]byte
+	for _, expected := range []string{"query", ""} {
+		n, addr, err := conn.ReadFrom(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], []byte(expected)) {
+			t.Fatalf("got %+q, expected %+q", buf[:n], expected)
+		}
+		if _, ok := addr.(tcpAddr); !ok {
+			t.Fatalf("address %v has type %T, expected tcpAddr", addr, addr)
+		}
+	}
+
+	// Send another query, and answer it. The response goes back over the
+	// same TCP connection, with a length prefix.
+	if _, err := c.Write([]byte("\x00\x06query2")); err != nil {
+		t.Fatal(err)
+	}
+	_, addr, err := conn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo([]byte("response"), addr); err != nil {
+		t.Fatal(err)
+	}
+	if p := readTCPMessage(t, c); !bytes.Equal(p, []byte("response")) {
+		t.Fatalf("got %+q, expected %+q", p, "response")
+	}
+
+	// A second connection gets a different address.
+	c2, err := net.Dial("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if _, err := c2.Write([]byte("\x00\x06query3")); err != nil {
+		t.Fatal(err)
+	}
+	_, addr2, err := conn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr2 == addr {
+		t.Fatalf("second connection has the same address %v", addr)
+	}
+	// But the two have the same source for -query-cost-sample.
+	if source, source2 := queryCostSource(addr), queryCostSource(addr2); source != "127.0.0.1" || source2 != source {
+		t.Fatalf("sources %q and %q, expected %q", source, source2, "127.0.0.1")
+	}
+}
+
+// shortWriter accepts at most max bytes per call to Write.
+type shortWriter struct {
+	bytes.Buffer
+	max int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return w.Buffer.Write(p)
+}
+
+// flakyListener is a net.Listener whose Accept returns each of errs in turn,
+// then net.ErrClosed.
+type flakyListener struct {
+	net.Listener
+	errs    []error
+	accepts int
+}
+
+func (ln *flakyListener) Accept() (net.Conn, error) {
+	ln.accepts++
+	if len(ln.errs) == 0 {
+		return nil, net.ErrClosed
+	}
+	err := ln.errs[0]
+	ln.errs = ln.errs[1:]
+	return nil, err
+}
+
+func TestTCPPacketConnAcceptErrors(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	ln := &flakyListener{Listener: inner, errs: []error{emfile, emfile, emfile}}
+
+	// Transient errors are retried after a delay; any other error closes
+	// the tcpPacketConn.
+	start := time.Now()
+	conn := newTCPPacketConn(ln)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf [10]byte
+	if _, _, err := conn.ReadFrom(buf[:]); err == nil {
+		t.Fatal("ReadFrom did not fail after Accept failed")
+	}
+	if elapsed := time.Since(start); elapsed < 3*tcpAcceptErrorDelay {
+		t.Errorf("retried transient errors after %v, expected at least %v", elapsed, 3*tcpAcceptErrorDelay)
+	}
+	if ln.accepts != 4 {
+		t.Errorf("Accept called %d times, expected 4", ln.accepts)
+	}
+}
+
+func TestWriteFull(t *testing.T) {
+	msg := bytes.Repeat([]byte("0123456789"), 10)
+	w := &shortWriter{max: 7}
+	n, err := writeFull(w, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(msg) || !bytes.Equal(w.Bytes(), msg) {
+		t.Fatalf("wrote %d bytes %+q, expected %+q", n, w.Bytes(), msg)
+	}
+
+	// A writer that makes no progress is an error, not an endless loop.
+	w = &shortWriter{max: 0}
+	if n, err := writeFull(w, msg); n != 0 || err != io.ErrShortWrite {
+		t.Fatalf("got (%d, %v), expected (0, %v)", n, err, io.ErrShortWrite)
+	}
+}
+
+func TestTCPPacketConnSlowClient(t *testing.T) {
+	conn := startTCPPacketConn(t)
+	defer conn.Close()
+	// net.Pipe has no buffering: each Write returns only after the client
+	// has read all of it, however many reads that takes.
+	client, server := net.Pipe()
+	defer client.Close()
+	go conn.handle(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Write([]byte("\x00\x05query")); err != nil {
+		t.Fatal(err)
+	}
+	var buf [100]byte
+	_, addr, err := conn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := bytes.Repeat([]byte("response"), 5000)
+	if _, err := conn.WriteTo(response, addr); err != nil {
+		t.Fatal(err)
+	}
+	// Read a few bytes at a time.
+	var received bytes.Buffer
+	for received.Len() < 2+len(response) {
+		n, err := client.Read(buf[:13])
+		if err != nil {
+			t.Fatal(err)
+		}
+		received.Write(buf[:n])
+	}
+	if p := readTCPMessage(t, &received); !bytes.Equal(p, response) {
+		t.Fatalf("got %d bytes, expected %d", len(p), len(response))
+	}
+}
+
+func TestTCPPacketConnClientDisconnect(t *testing.T) {
+	var logBuf syncBuffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	conn := startTCPPacketConn(t)
+	defer conn.Close()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		conn.handle(server)
+		close(done)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Write([]byte("\x00\x05query")); err != nil {
+		t.Fatal(err)
+	}
+	var buf [100]byte
+	_, addr, err := conn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := tcpWritesFailed.Value()
+	if _, err := conn.WriteTo(bytes.Repeat([]byte("response"), 100), addr); err != nil {
+		t.Fatal(err)
+	}
+	// Read part of the response, then hang up.
+	if _, err := io.ReadFull(client, buf[:10]); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handle did not return after the client disconnected")
+	}
+	// The writer may finish after the reader.
+	for i := 0; tcpWritesFailed.Value() == before && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := tcpWritesFailed.Value() - before; n != 1 {
+		t.Errorf("counted %d failed writes, expected 1", n)
+	}
+	if !strings.Contains(logBuf.String(), "wrote 10 of 802 bytes of response") {
+		t.Errorf("unexpected log %q", logBuf.String())
+	}
+}
+
+func TestConnResponseSizeLimit(t *testing.T) {
+	conn := startTCPPacketConn(t)
+	defer conn.Close()
+	if limit := connResponseSizeLimit(conn); limit != tcpResponseSizeLimit {
+		t.Errorf("TCP: got %d, expected %d", limit, tcpResponseSizeLimit)
+	}
+	pconn := newFakePacketConn()
+	defer pconn.Close()
+	if limit := connResponseSizeLimit(pconn); limit != responseSizeLimit() {
+		t.Errorf("other: got %d, expected %d", limit, responseSizeLimit())
+	}
+	if !isStreamConn(conn) || isStreamConn(pconn) {
+		t.Errorf("isStreamConn: got %v for TCP and %v for other", isStreamConn(conn), isStreamConn(pconn))
+	}
+}
+
+// Queries over TCP need not advertise a UDP payload size, or any EDNS at all.
+func TestRecvLoopTCPNoEDNS(t *testing.T) {
+	conn := startTCPPacketConn(t)
+	defer conn.Close()
+	domain := mustParseName("t.example.com")
+	ttConn := turbotunnel.NewQueuePacketConn(turbotunnel.DummyAddr{}, 0)
+	ch := make(chan *record, 100)
+	go recvLoop(domain, conn, ttConn, ch, 1000, nil)
+
+	c, err := net.Dial("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, additional := range [][]dns.RR{
+		nil,
+		{{Name: dns.Name{}, Type: dns.RRTypeOPT, Class: 512}},
+	} {
+		query := tunnelQuery([]byte("CLIENTIDpayload"), domain)
+		query.Additional = additional
+		buf, err := query.WireFormat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := make([]byte, 2+len(buf))
+		binary.BigEndian.PutUint16(msg, uint16(len(buf)))
+		copy(msg[2:], buf)
+		if _, err := c.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case rec := <-ch:
+			if rec.Resp.Rcode() != dns.RcodeNoError {
+				t.Errorf("%d additional RRs: RCODE %d, expected %d", len(additional), rec.Resp.Rcode(), dns.RcodeNoError)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a record")
+		}
+	}
+}
+
+func TestSendResponseTCP(t *testing.T) {
+	conn := startTCPPacketConn(t)
+	defer conn.Close()
+	c, err := net.Dial("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("\x00\x05query")); err != nil {
+		t.Fatal(err)
+	}
+	var buf [100]byte
+	_, addr, err := conn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A response too large for UDP is sent whole over TCP.
+	name := mustParseName("t.example.com")
+	payload := make([]byte, computeMaxEncodedPayload(tcpResponseSizeLimit))
+	rec := &record{
+		Resp: &dns.Message{
+			Flags:    0x8000,
+			Question: []dns.Question{{Name: name, Type: dns.RRTypeTXT, Class: dns.ClassIN}},
+			Answer: []dns.RR{
+				{Name: name, Type: dns.RRTypeTXT, Class: dns.ClassIN, Data: dns.EncodeRDataTXT(payload)},
+			},
+		},
+		Addr: addr,
+	}
+	if err := sendResponse(conn, rec, newLoopErrors("WriteTo"), realClock{}); err != nil {
+		t.Fatal(err)
+	}
+	p := readTCPMessage(t, c)
+	if len(p) <= responseSizeLimit() || len(p) > tcpResponseSizeLimit {
+		t.Errorf("response of %d bytes, expected between %d and %d", len(p), responseSizeLimit(), tcpResponseSizeLimit)
+	}
+	resp, err := dns.MessageFromWireFormat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Flags&0x0200 != 0 {
+		t.Errorf("response is truncated")
+	}
+}
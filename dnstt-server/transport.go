@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+
+	"www.bamsoftware.com/git/dnstt.git/internal/registry"
+)
+
+// transports maps names to the listen functions given to registerTransport.
+var transports = registry.New("transport")
+
+// registerTransport makes a custom transport available to the -transport
+// option under name. listen receives the configuration string that follows
+// the name in -transport NAME:CONFIG, and returns a net.PacketConn on which the
+// server receives queries and sends responses, alongside any -udp, -tcp, and
+// -ws listeners. registerTransport panics if name is already registered.
+//
+// A transport that is not part of this repository (for example one that
+// carries DNS messages in ICMP echo payloads, for research) is compiled in by
+// adding to this main package a file whose init function calls
+// registerTransport. The transport itself may live in any package.
+//
+// The server uses only the methods of net.PacketConn, and makes no other
+// assumption that it is a UDP socket. A net.PacketConn for a transport must
+// meet these requirements:
+//
+// ReadFrom returns one DNS query per call. Queries longer than maxQuerySize
+// bytes may be truncated, as a UDP socket would do. The returned net.Addr
+// identifies the requester: passed to WriteTo, it must send to the same
+// requester. Its String method is used in logs, and need not be an IP address
+// and port. ReadFrom may be called from only one goroutine.
+//
+// WriteTo sends one DNS response per call, of at most responseSizeLimit bytes
+// (so at most maxUDPPayload bytes, or less with -max-response-size). It may be
+// called from several goroutines at once, with -send-workers, and some time
+// after the corresponding query was read (normally no more than
+// maxResponseDelay), so addresses must stay valid at least that long.
+// Delivery need not be reliable: the tunnel recovers lost responses as it does
+// over UDP.
+//
+// Errors from either method that are timeouts (net.Error with Timeout true),
+// or one of transientErrnos, are logged and retried. Any other error from
+// ReadFrom stops the server; Close must make a blocked ReadFrom return such an
+// error.
+//
+// LocalAddr is compared with the upstream address to detect forwarding loops;
+// if it does not return an "IP:port" string, the check skips it.
+func registerTransport(name string, listen func(config string) (net.PacketConn, error)) {
+	transports.Register(name, listen)
+}
+
+// openTransport opens the transport named by spec, which has the form NAME or
+// NAME:CONFIG, as for the -transport option.
+func openTransport(spec string) (net.PacketConn, error) {
+	name, config := registry.SplitSpec(spec)
+	listen, err := transports.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return listen.(func(config string) (net.PacketConn, error))(config)
+}
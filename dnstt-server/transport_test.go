@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/noise"
+)
+
+// icmpAddr is an address that is not an IP address and port, like one that a
+// transport over ICMP echo might use.
+type icmpAddr struct {
+	peer string
+	id   uint16
+}
+
+func (addr icmpAddr) Network() string { return "icmp" }
+func (addr icmpAddr) String() string  { return fmt.Sprintf("%s/%d", addr.peer, addr.id) }
+
+func TestOpenTransport(t *testing.T) {
+	defer transports.Unregister("test")
+
+	var gotConfig string
+	conn := newFakePacketConn()
+	registerTransport("test", func(config string) (net.PacketConn, error) {
+		gotConfig = config
+		return conn, nil
+	})
+	if c, err := openTransport("test:eth0:1"); err != nil || c != conn || gotConfig != "eth0:1" {
+		t.Errorf("got %v, %v, config %+q", c, err, gotConfig)
+	}
+	if _, err := openTransport("test"); err != nil || gotConfig != "" {
+		t.Errorf("no config: got %v, config %+q", err, gotConfig)
+	}
+	if _, err := openTransport("other:x"); err == nil || !strings.Contains(err.Error(), "available: test") {
+		t.Errorf("unknown transport: got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering twice: expected panic")
+		}
+	}()
+	registerTransport("test", nil)
+}
+
+// run serves a custom transport whose addresses are not IP addresses, sending
+// each response to the address its query came from.
+func TestRunTransport(t *testing.T) {
+	keys := &noise.LocalKeyProvider{}
+	if err := keys.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	domain := mustParseName("t.example.com")
+	dnsConn := newFakePacketConn()
+	done := make(chan error)
+	go func() {
+		done <- run(keys, domain, newUpstreamDialer("127.0.0.1:1", 0), []net.PacketConn{dnsConn})
+	}()
+
+	addrs := []net.Addr{icmpAddr{"192.0.2.1", 1}, icmpAddr{"192.0.2.1", 2}}
+	for i, addr := range addrs {
+		query := tunnelQuery([]byte(fmt.Sprintf("CLIENTI%d", i)), domain)
+		query.ID = uint16(i)
+		buf, _ := query.WireFormat()
+		dnsConn.Inject(buf, addr)
+	}
+	for range addrs {
+		var m taggedMessage
+		select {
+		case m = <-dnsConn.Written:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a response")
+		}
+		resp, err := dns.MessageFromWireFormat(m.P)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(resp.ID) >= len(addrs) || m.Addr != addrs[resp.ID] {
+			t.Errorf("response %d sent to %v", resp.ID, m.Addr)
+		}
+	}
+
+	dnsConn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("run did not return after its conn was closed")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// pktinfoConn is a net.PacketConn for a UDP socket that uses IP_PKTINFO (or
+// IPV6_PKTINFO, or IP_RECVDSTADDR on BSD) control messages to choose the source
+// address of the packets it sends. ReadFrom returns addresses of type
+// pktinfoAddr, which remember the address each packet was sent to; WriteTo a
+// pktinfoAddr sends from that address, or from source if it is not nil.
+//
+// Without pktinfoConn, a socket bound to a wildcard address on a host with
+// more than one address sends from whatever address the kernel's routing
+// chooses, which is not necessarily the one the query was sent to. Resolvers
+// discard responses from an unexpected address.
+//
+// Control messages are supported on Linux, macOS, and the BSDs, but not on
+// Windows, where newPktinfoConn returns an error. Only the source address, not
+// the source port, can be chosen this way.
+type pktinfoConn struct {
+	*net.UDPConn
+	source net.IP
+	read   func(b []byte) (int, net.IP, net.Addr, error)
+	write  func(b []byte, src net.IP, addr net.Addr) (int, error)
+}
+
+// pktinfoAddr is the address a pktinfoConn received a packet from, along with
+// the local address it was sent to.
+type pktinfoAddr struct {
+	net.Addr
+	dst net.IP
+}
+
+// newPktinfoConn returns a pktinfoConn wrapping conn. If source is nil,
+// responses are sent from the address that the query was received at;
+// otherwise they are sent from source, which must be an address of the local
+// host of the same family as conn's local address.
+func newPktinfoConn(conn *net.UDPConn, source net.IP) (*pktinfoConn, error) {
+	c := &pktinfoConn{UDPConn: conn, source: source}
+	if conn.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		p := ipv4.NewPacketConn(conn)
+		err := p.SetControlMessage(ipv4.FlagDst, true)
+		if err != nil {
+			return nil, err
+		}
+		c.read = func(b []byte) (int, net.IP, net.Addr, error) {
+			n, cm, addr, err := p.ReadFrom(b)
+			var dst net.IP
+			if cm != nil {
+				dst = cm.Dst
+			}
+			return n, dst, addr, err
+		}
+		c.write = func(b []byte, src net.IP, addr net.Addr) (int, error) {
+			var cm *ipv4.ControlMessage
+			if src != nil {
+				cm = &ipv4.ControlMessage{Src: src}
+			}
+			return p.WriteTo(b, cm, addr)
+		}
+	} else {
+		p := ipv6.NewPacketConn(conn)
+		err := p.SetControlMessage(ipv6.FlagDst, true)
+		if err != nil {
+			return nil, err
+		}
+		c.read = func(b []byte) (int, net.IP, net.Addr, error) {
+			n, cm, addr, err := p.ReadFrom(b)
+			var dst net.IP
+			if cm != nil {
+				dst = cm.Dst
+			}
+			return n, dst, addr, err
+		}
+		c.write = func(b []byte, src net.IP, addr net.Addr) (int, error) {
+			var cm *ipv6.ControlMessage
+			if src != nil {
+				cm = &ipv6.ControlMessage{Src: src}
+			}
+			return p.WriteTo(b, cm, addr)
+		}
+	}
+	return c, nil
+}
+
+// ReadFrom reads a packet, and returns its source address as a pktinfoAddr.
+func (c *pktinfoConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, dst, addr, err := c.read(b)
+	if err != nil {
+		return n, addr, err
+	}
+	return n, pktinfoAddr{addr, dst}, nil
+}
+
+// WriteTo sends a packet to addr, from c.source if it is set, or else from the
+// address that addr's query was sent to, if addr is a pktinfoAddr.
+func (c *pktinfoConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	src := c.source
+	if a, ok := addr.(pktinfoAddr); ok {
+		if src == nil {
+			src = a.dst
+		}
+		addr = a.Addr
+	}
+	return c.write(b, src, addr)
+}
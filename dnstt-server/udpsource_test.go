@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// exchangeVia sends a packet to addr from a new socket, has conn echo it back,
+// and returns the address that the echo came from.
+func exchangeVia(t *testing.T, conn net.PacketConn, addr *net.UDPAddr) *net.UDPAddr {
+	t.Helper()
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.WriteTo([]byte("query"), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf [100]byte
+	n, from, err := conn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(buf[:n], from); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, replyFrom, err := client.ReadFromUDP(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return replyFrom
+}
+
+func TestPktinfoConn(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+	// Use a second loopback address, so that the reply's source address
+	// is not the one the kernel would choose anyway.
+	dst := &net.UDPAddr{IP: net.IP{127, 0, 0, 2}, Port: port}
+
+	// Without -udp-source, the kernel chooses the source address, which
+	// is not the one the query was sent to.
+	if from := exchangeVia(t, udpConn, dst); from.IP.Equal(dst.IP) {
+		t.Errorf("plain socket: reply came from %v, expected another address", from)
+	}
+
+	// Responses come from the address the query was sent to.
+	conn, err := newPktinfoConn(udpConn, nil)
+	if err != nil {
+		t.Skipf("control messages not supported: %v", err)
+	}
+	if from := exchangeVia(t, conn, dst); !from.IP.Equal(dst.IP) || from.Port != port {
+		t.Errorf("reply came from %v, expected %v", from, dst)
+	}
+
+	// Responses come from a fixed address.
+	source := net.IP{127, 0, 0, 3}
+	conn, err = newPktinfoConn(udpConn, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := exchangeVia(t, conn, dst); !from.IP.Equal(source) || from.Port != port {
+		t.Errorf("reply came from %v, expected %v:%d", from, source, port)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// upstreamDialer dials TCP connections to the upstream address.
+//
+// By default, the host part of the upstream address is resolved anew on every
+// dial, so that the server follows changes in the upstream's DNS records.
+// If resolveInterval is positive, the results of resolution are instead cached
+// and reused for that long.
+//
+// If upstreamSticky is set, the host is always resolved by upstreamDialer
+// itself, and the resolved addresses are tried in an order that depends on the
+// ClientID being served; see stickyOrder.
+//
+// Unless upstreamSticky is set, upstreamDialer logs a message whenever the IP
+// address it connects to differs from the one it connected to previously.
+//
+// If resolving the host fails after it has succeeded before, upstreamDialer
+// keeps using the addresses from the last successful resolution (or, when it
+// does not resolve the host itself, the address it last connected to), so that
+// a resolver outage does not take down a working upstream. It logs a message
+// when that starts and when resolution works again.
+type upstreamDialer struct {
+	addr            string
+	resolveInterval time.Duration
+	// The function used to resolve the host; net.DefaultResolver's
+	// LookupIPAddr unless changed for testing.
+	lookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	// Cached host:port strings with resolved IP addresses, and the time
+	// they were resolved; only used when resolveInterval is positive.
+	cached     []string
+	resolvedAt time.Time
+	// The remote address of the most recent successful dial.
+	lastRemote string
+	// Whether the last attempt to resolve the host failed, and stale
+	// addresses are in use.
+	stale bool
+	lock  sync.Mutex
+}
+
+// newUpstreamDialer returns an upstreamDialer for the host:port string addr.
+func newUpstreamDialer(addr string, resolveInterval time.Duration) *upstreamDialer {
+	return &upstreamDialer{
+		addr:            addr,
+		resolveInterval: resolveInterval,
+		lookupIPAddr:    net.DefaultResolver.LookupIPAddr,
+	}
+}
+
+// String returns the upstream address as it was given.
+func (d *upstreamDialer) String() string {
+	return d.addr
+}
+
+// resolve returns a list of host:port strings to try dialing, from the cache
+// if it is fresh enough. If resolution fails, it returns the stale cached
+// addresses, if there are any, and does not try again for resolveInterval.
+func (d *upstreamDialer) resolve(ctx context.Context, now time.Time) ([]string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.cached != nil && now.Sub(d.resolvedAt) < d.resolveInterval {
+		return d.cached, nil
+	}
+	host, port, err := net.SplitHostPort(d.addr)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	ipAddrs, err := d.lookupIPAddr(ctx, host)
+	if err == nil {
+		for _, ipAddr := range ipAddrs {
+			addrs = append(addrs, net.JoinHostPort(ipAddr.String(), port))
+		}
+		if len(addrs) == 0 {
+			err = fmt.Errorf("no addresses for %s", host)
+		}
+	}
+	if err != nil {
+		if d.cached == nil {
+			return nil, err
+		}
+		d.markStale(err, fmt.Sprintf("%v", d.cached))
+		d.resolvedAt = now
+		return d.cached, nil
+	}
+	d.markFresh()
+	d.cached = addrs
+	d.resolvedAt = now
+	return addrs, nil
+}
+
+// markStale counts a failure to resolve the host, after which stale addresses
+// are used instead, and logs it if it is the first failure since the last
+// success. d.lock must be held.
+func (d *upstreamDialer) markStale(err error, stale string) {
+	upstreamStaleResolutions.Inc()
+	if !d.stale {
+		log.Printf("upstream %s: cannot resolve (%v); using %s until it resolves again", d.addr, err, stale)
+		d.stale = true
+	}
+}
+
+// markFresh logs that the host resolves again, if the last attempt failed.
+// d.lock must be held.
+func (d *upstreamDialer) markFresh() {
+	if d.stale {
+		log.Printf("upstream %s resolves again", d.addr)
+		d.stale = false
+	}
+}
+
+// isDNSError returns true if err is an error from net.Dial that comes from
+// resolving the host.
+func isDNSError(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		_, ok = opErr.Err.(*net.DNSError)
+		return ok
+	}
+	return false
+}
+
+// stickyOrder returns a copy of addrs, ordered by a hash of clientID and each
+// address (rendezvous hashing). The order for a given clientID does not depend
+// on the order of addrs, and adding or removing an address changes which
+// address is first only for the clientIDs for which it is or was first.
+func stickyOrder(addrs []string, clientID turbotunnel.ClientID) []string {
+	weights := make(map[string]uint64, len(addrs))
+	for _, addr := range addrs {
+		h := fnv.New64a()
+		h.Write(clientID[:])
+		h.Write([]byte(addr))
+		weights[addr] = h.Sum64()
+	}
+	ordered := append([]string(nil), addrs...)
+	sort.Slice(ordered, func(i, j int) bool {
+		if weights[ordered[i]] != weights[ordered[j]] {
+			return weights[ordered[i]] > weights[ordered[j]]
+		}
+		return ordered[i] < ordered[j]
+	})
+	return ordered
+}
+
+// Dial connects to the upstream address using dialer. clientID is the client
+// on whose behalf the connection is made; it matters only with upstreamSticky.
+func (d *upstreamDialer) Dial(dialer *net.Dialer, clientID turbotunnel.ClientID) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if d.resolveInterval > 0 || upstreamSticky {
+		ctx, cancel := context.WithTimeout(context.Background(), dialer.Timeout)
+		defer cancel()
+		var addrs []string
+		addrs, err = d.resolve(ctx, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if upstreamSticky {
+			addrs = stickyOrder(addrs, clientID)
+		}
+		// Try each address in turn, as net.Dial would.
+		for _, addr := range addrs {
+			conn, err = dialer.DialContext(ctx, "tcp", addr)
+			if err == nil {
+				break
+			}
+		}
+	} else {
+		conn, err = dialer.Dial("tcp", d.addr)
+		d.lock.Lock()
+		if isDNSError(err) && d.lastRemote != "" {
+			// Fall back to the address of the last successful
+			// dial.
+			lastRemote := d.lastRemote
+			d.markStale(err, lastRemote)
+			d.lock.Unlock()
+			conn, err = dialer.Dial("tcp", lastRemote)
+		} else {
+			if err == nil {
+				d.markFresh()
+			}
+			d.lock.Unlock()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	remote := conn.RemoteAddr().String()
+	d.lock.Lock()
+	if !upstreamSticky && d.lastRemote != "" && d.lastRemote != remote {
+		log.Printf("upstream %s now resolves to %s (was %s)", d.addr, remote, d.lastRemote)
+	}
+	d.lastRemote = remote
+	d.lock.Unlock()
+
+	return conn, nil
+}
+
+// Loops returns a description of every address in listeners that is also an
+// address that d would connect to, meaning that streams would be forwarded
+// back into this server (or into another listener on the same port). A
+// listener on an unspecified address (0.0.0.0 or ::) matches an upstream
+// address on the same port that is a loopback address or one of localIPs.
+func (d *upstreamDialer) Loops(ctx context.Context, listeners []net.Addr, localIPs []net.IP) ([]string, error) {
+	addrs, err := d.resolve(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var loops []string
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(host)
+		for _, listener := range listeners {
+			lhost, lport, err := net.SplitHostPort(listener.String())
+			if err != nil || lport != port {
+				continue
+			}
+			lip := net.ParseIP(lhost)
+			if lip == nil {
+				continue
+			}
+			if lip.Equal(ip) || (lip.IsUnspecified() && isLocalIP(ip, localIPs)) {
+				loops = append(loops, fmt.Sprintf("upstream %s (%s) is the address of the %s listener %s",
+					d.addr, addr, listener.Network(), listener))
+			}
+		}
+	}
+	return loops, nil
+}
+
+// isLocalIP returns true if ip is a loopback or unspecified address, or is one
+// of localIPs.
+func isLocalIP(ip net.IP, localIPs []net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	for _, localIP := range localIPs {
+		if localIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUpstreamLoops logs a warning for every listener in dnsConns that has
+// an address upstream would connect to (see upstreamDialer.Loops), or returns
+// an error for the first one if upstreamLoopFatal is set. A failure to resolve
+// the upstream address is only logged: it may be temporary, and it will be
+// reported again when a stream tries to connect.
+func checkUpstreamLoops(upstream *upstreamDialer, dnsConns []net.PacketConn) error {
+	var listeners []net.Addr
+	for _, dnsConn := range dnsConns {
+		listeners = append(listeners, dnsConn.LocalAddr())
+	}
+	var localIPs []net.IP
+	if ifAddrs, err := net.InterfaceAddrs(); err == nil {
+		for _, ifAddr := range ifAddrs {
+			if ipNet, ok := ifAddr.(*net.IPNet); ok {
+				localIPs = append(localIPs, ipNet.IP)
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamDialTimeout)
+	defer cancel()
+	loops, err := upstream.Loops(ctx, listeners, localIPs)
+	if err != nil {
+		log.Printf("cannot check upstream %s against listeners: %v", upstream, err)
+		return nil
+	}
+	for _, loop := range loops {
+		if upstreamLoopFatal {
+			return fmt.Errorf("%s", loop)
+		}
+		log.Printf("WARNING: %s; streams will loop back into this server", loop)
+	}
+	return nil
+}
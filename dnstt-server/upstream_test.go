@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestStickyOrder(t *testing.T) {
+	addrs := []string{"192.0.2.1:80", "192.0.2.2:80", "192.0.2.3:80", "192.0.2.4:80"}
+	reversed := []string{addrs[3], addrs[2], addrs[1], addrs[0]}
+	first := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		clientID := turbotunnel.ClientID{byte(i), byte(i >> 8)}
+		ordered := stickyOrder(addrs, clientID)
+		// The order depends only on the ClientID.
+		if other := stickyOrder(reversed, clientID); !reflect.DeepEqual(ordered, other) {
+			t.Fatalf("%v: order depends on input order: %v %v", clientID, ordered, other)
+		}
+		first[ordered[0]]++
+
+		// Removing an address that was not first does not change
+		// which is first.
+		if removed := stickyOrder(ordered[:len(ordered)-1], clientID); removed[0] != ordered[0] {
+			t.Errorf("%v: removing %s changed first from %s to %s", clientID, ordered[len(ordered)-1], ordered[0], removed[0])
+		}
+	}
+	// Different ClientIDs are spread across the addresses.
+	for _, addr := range addrs {
+		if first[addr] == 0 {
+			t.Errorf("%s is never first: %v", addr, first)
+		}
+	}
+	if !reflect.DeepEqual(addrs, []string{"192.0.2.1:80", "192.0.2.2:80", "192.0.2.3:80", "192.0.2.4:80"}) {
+		t.Errorf("stickyOrder modified its input: %v", addrs)
+	}
+}
+
+func TestUpstreamDialerSticky(t *testing.T) {
+	defer func(saved bool) { upstreamSticky = saved }(upstreamSticky)
+	upstreamSticky = true
+
+	// Listen on the same port at two loopback addresses, and have the
+	// upstream host resolve to both of them.
+	ln1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln1.Close()
+	port := ln1.Addr().(*net.TCPAddr).Port
+	ln2, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", strconv.Itoa(port)))
+	if err != nil {
+		t.Skipf("cannot listen on a second loopback address: %v", err)
+	}
+	defer ln2.Close()
+	go acceptAndClose(ln1)
+	go acceptAndClose(ln2)
+
+	d := newUpstreamDialer(net.JoinHostPort("upstream.example", strconv.Itoa(port)), 0)
+	// Resolve to the addresses in a different order every time, as a
+	// round-robin DNS server would.
+	lookups := 0
+	d.lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		ipAddrs := []net.IPAddr{{IP: net.IP{127, 0, 0, 1}}, {IP: net.IP{127, 0, 0, 2}}}
+		if lookups%2 == 0 {
+			ipAddrs[0], ipAddrs[1] = ipAddrs[1], ipAddrs[0]
+		}
+		return ipAddrs, nil
+	}
+
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	remotes := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		clientID := turbotunnel.ClientID{byte(i)}
+		var remote string
+		// Several streams of the same client go to the same address.
+		for j := 0; j < 4; j++ {
+			conn, err := d.Dial(&dialer, clientID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if j == 0 {
+				remote = conn.RemoteAddr().String()
+			} else if conn.RemoteAddr().String() != remote {
+				t.Errorf("%v: stream %d went to %s, not %s", clientID, j, conn.RemoteAddr(), remote)
+			}
+			conn.Close()
+		}
+		remotes[remote] = true
+	}
+	if len(remotes) != 2 {
+		t.Errorf("clients used only %v", remotes)
+	}
+}
+
+// acceptAndClose accepts connections on ln and closes them, until ln is closed.
+func acceptAndClose(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}
+}
+
+// When re-resolution fails, the dialer keeps using the last addresses that
+// resolved.
+func TestUpstreamDialerStale(t *testing.T) {
+	var logBuf syncBuffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go acceptAndClose(ln)
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	d := newUpstreamDialer(net.JoinHostPort("upstream.example", strconv.Itoa(port)), time.Minute)
+	var lookupErr error
+	lookups := 0
+	d.lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		return []net.IPAddr{{IP: net.IP{127, 0, 0, 1}}}, nil
+	}
+	now := time.Now()
+
+	// Nothing resolved yet: the error is returned.
+	lookupErr = errors.New("resolver down")
+	if _, err := d.resolve(context.Background(), now); err == nil {
+		t.Fatalf("no error before the first resolution")
+	}
+
+	lookupErr = nil
+	expected := []string{ln.Addr().String()}
+	if addrs, err := d.resolve(context.Background(), now); err != nil || !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("got %+q, %v", addrs, err)
+	}
+
+	// The cache expires and resolution fails, twice: the stale addresses
+	// are used, and the failure is logged once.
+	before := upstreamStaleResolutions.Value()
+	lookupErr = errors.New("resolver down")
+	for i := 1; i <= 2; i++ {
+		now = now.Add(time.Minute)
+		if addrs, err := d.resolve(context.Background(), now); err != nil || !reflect.DeepEqual(addrs, expected) {
+			t.Fatalf("failure %d: got %+q, %v", i, addrs, err)
+		}
+	}
+	// A failure is not retried until the interval has passed again.
+	n := lookups
+	if _, err := d.resolve(context.Background(), now.Add(time.Second)); err != nil || lookups != n {
+		t.Errorf("retried after %d lookups, error %v", lookups-n, err)
+	}
+	if c := upstreamStaleResolutions.Value() - before; c != 2 {
+		t.Errorf("counted %d stale resolutions, expected 2", c)
+	}
+	if c := strings.Count(logBuf.String(), "cannot resolve (resolver down)"); c != 1 {
+		t.Errorf("logged %d failures, expected 1:\n%s", c, logBuf.String())
+	}
+	// Dials still work.
+	conn, err := d.Dial(&net.Dialer{Timeout: 5 * time.Second}, turbotunnel.ClientID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// An empty answer is a failure too.
+	lookupErr = nil
+	d.lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return nil, nil
+	}
+	now = now.Add(time.Minute)
+	if addrs, err := d.resolve(context.Background(), now); err != nil || !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("empty answer: got %+q, %v", addrs, err)
+	}
+
+	d.lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.IP{127, 0, 0, 2}}}, nil
+	}
+	now = now.Add(time.Minute)
+	expected = []string{net.JoinHostPort("127.0.0.2", strconv.Itoa(port))}
+	if addrs, err := d.resolve(context.Background(), now); err != nil || !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("recovered: got %+q, %v", addrs, err)
+	}
+	if !strings.Contains(logBuf.String(), "resolves again") {
+		t.Errorf("recovery not logged:\n%s", logBuf.String())
+	}
+}
+
+// Without -upstream-resolve-interval, a failure to resolve the host falls back
+// to the address of the last successful dial.
+func TestUpstreamDialerStaleDefault(t *testing.T) {
+	var logBuf syncBuffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go acceptAndClose(ln)
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	// A resolver that always fails.
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, errors.New("resolver down")
+			},
+		},
+	}
+	d := newUpstreamDialer(net.JoinHostPort("upstream.example", port), 0)
+
+	// Nothing dialed yet: the error is returned.
+	if _, err := d.Dial(dialer, turbotunnel.ClientID{}); err == nil || !isDNSError(err) {
+		t.Fatalf("got %v, expected a DNS error", err)
+	}
+
+	// Dial once by address, as if the host had resolved, to have a last
+	// good address.
+	d.addr = ln.Addr().String()
+	conn, err := d.Dial(dialer, turbotunnel.ClientID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	d.addr = net.JoinHostPort("upstream.example", port)
+	before := upstreamStaleResolutions.Value()
+	conn, err = d.Dial(dialer, turbotunnel.ClientID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != ln.Addr().String() {
+		t.Errorf("dialed %v, expected %v", conn.RemoteAddr(), ln.Addr())
+	}
+	conn.Close()
+	if c := upstreamStaleResolutions.Value() - before; c != 1 {
+		t.Errorf("counted %d stale resolutions, expected 1", c)
+	}
+	if !strings.Contains(logBuf.String(), "using "+ln.Addr().String()) {
+		t.Errorf("fallback not logged:\n%s", logBuf.String())
+	}
+}
+
+func TestUpstreamDialerLoops(t *testing.T) {
+	d := newUpstreamDialer("upstream.example:53", 0)
+	d.lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.IP{127, 0, 0, 1}}, {IP: net.IP{192, 0, 2, 5}}}, nil
+	}
+	localIPs := []net.IP{{192, 0, 2, 5}}
+
+	for _, test := range []struct {
+		listener net.Addr
+		loops    int
+	}{
+		// Same address and port.
+		{&net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 53}, 1},
+		{&net.TCPAddr{IP: net.IP{192, 0, 2, 5}, Port: 53}, 1},
+		// A wildcard listener covers both upstream addresses, which
+		// are local.
+		{&net.UDPAddr{IP: net.IPv4zero, Port: 53}, 2},
+		{&net.UDPAddr{IP: net.IPv6unspecified, Port: 53}, 2},
+		// Different port or address.
+		{&net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 5353}, 0},
+		{&net.UDPAddr{IP: net.IP{198, 51, 100, 1}, Port: 53}, 0},
+		// Not an IP address.
+		{turbotunnel.DummyAddr{}, 0},
+	} {
+		loops, err := d.Loops(context.Background(), []net.Addr{test.listener}, localIPs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(loops) != test.loops {
+			t.Errorf("%v: got %+q, expected %d loops", test.listener, loops, test.loops)
+		}
+	}
+
+	// A wildcard listener does not match an upstream that is not local.
+	d.lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.IP{198, 51, 100, 1}}}, nil
+	}
+	loops, err := d.Loops(context.Background(), []net.Addr{&net.UDPAddr{IP: net.IPv4zero, Port: 53}}, localIPs)
+	if err != nil || len(loops) != 0 {
+		t.Errorf("remote upstream: got %+q, %v", loops, err)
+	}
+}
+
+func TestCheckUpstreamLoops(t *testing.T) {
+	defer func(saved bool) { upstreamLoopFatal = saved }(upstreamLoopFatal)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	upstream := newUpstreamDialer(conn.LocalAddr().String(), 0)
+
+	upstreamLoopFatal = false
+	if err := checkUpstreamLoops(upstream, []net.PacketConn{conn}); err != nil {
+		t.Errorf("not fatal: got error %v", err)
+	}
+	upstreamLoopFatal = true
+	err = checkUpstreamLoops(upstream, []net.PacketConn{conn})
+	if err == nil || !strings.Contains(err.Error(), conn.LocalAddr().String()) {
+		t.Errorf("fatal: got error %v, expected one naming %s", err, conn.LocalAddr())
+	}
+}
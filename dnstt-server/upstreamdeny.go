@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// defaultDeniedUpstreamRanges are the address ranges that
+// -deny-private-upstream refuses by default: RFC 1918 private, loopback,
+// link-local, unspecified, and IPv6 unique local addresses.
+const defaultDeniedUpstreamRanges = "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,127.0.0.0/8,169.254.0.0/16,0.0.0.0/8,::1/128,::/128,fc00::/7,fe80::/10"
+
+// parseIPRanges parses a comma-separated list of CIDR ranges. A bare IP address
+// is a range containing only that address. It is an error for the list to be
+// empty.
+func parseIPRanges(s string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %+q", field)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, ipNet)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no ranges given")
+	}
+	return ranges, nil
+}
+
+// deniedRange returns the first of ranges that contains ip, or nil if none
+// does. An IPv4-mapped IPv6 address is treated as the IPv4 address.
+func deniedRange(ip net.IP, ranges []*net.IPNet) *net.IPNet {
+	for _, ipNet := range ranges {
+		if ipNet.Contains(ip) {
+			return ipNet
+		}
+	}
+	return nil
+}
+
+// denyUpstreamControl returns a function for the Control field of a
+// net.Dialer that refuses to connect to any address in ranges. Because Control
+// sees the address after name resolution, the check applies to every address
+// that a host name resolves to, at the time of each connection.
+func denyUpstreamControl(ranges []*net.IPNet) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return fmt.Errorf("upstream address %s is not an IP address", host)
+		}
+		if ipNet := deniedRange(ip, ranges); ipNet != nil {
+			upstreamDenied.Inc()
+			return fmt.Errorf("upstream address %s is in denied range %s", ip, ipNet)
+		}
+		return nil
+	}
+}
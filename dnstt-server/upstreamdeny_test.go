@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseIPRanges(t *testing.T) {
+	ranges, err := parseIPRanges(" 10.0.0.0/8, 192.0.2.1,,2001:db8::/32 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var strs []string
+	for _, ipNet := range ranges {
+		strs = append(strs, ipNet.String())
+	}
+	if s := strings.Join(strs, ","); s != "10.0.0.0/8,192.0.2.1/32,2001:db8::/32" {
+		t.Errorf("got %s", s)
+	}
+	for _, s := range []string{"", " , ", "10.0.0.0/33", "example.com", "10.0.0.0/8,x"} {
+		if _, err := parseIPRanges(s); err == nil {
+			t.Errorf("%+q: expected error", s)
+		}
+	}
+	if _, err := parseIPRanges(defaultDeniedUpstreamRanges); err != nil {
+		t.Errorf("default ranges: %v", err)
+	}
+}
+
+func TestDeniedRange(t *testing.T) {
+	ranges, err := parseIPRanges(defaultDeniedUpstreamRanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		ip     string
+		denied bool
+	}{
+		// Private.
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"fd00::1", true},
+		// Loopback.
+		{"127.0.0.1", true},
+		{"127.255.0.1", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		// Link-local and unspecified.
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		// Public.
+		{"172.32.0.1", false},
+		{"192.0.2.1", false},
+		{"8.8.8.8", false},
+		{"2001:db8::1", false},
+		{"::ffff:8.8.8.8", false},
+	} {
+		if ipNet := deniedRange(net.ParseIP(test.ip), ranges); (ipNet != nil) != test.denied {
+			t.Errorf("%s: got %v, expected denied %v", test.ip, ipNet, test.denied)
+		}
+	}
+	if ipNet := deniedRange(net.ParseIP("127.0.0.1"), nil); ipNet != nil {
+		t.Errorf("no ranges: got %v", ipNet)
+	}
+}
+
+func TestDenyUpstreamControl(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// Loopback is denied, and counted, even through a host name.
+	ranges, err := parseIPRanges(defaultDeniedUpstreamRanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := net.Dialer{Control: denyUpstreamControl(ranges)}
+	before := upstreamDenied.Value()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	for _, addr := range []string{ln.Addr().String(), net.JoinHostPort("localhost", port)} {
+		conn, err := dialer.Dial("tcp4", addr)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: connection was not refused", addr)
+		} else if !strings.Contains(err.Error(), "denied range") {
+			t.Errorf("%s: unexpected error %v", addr, err)
+		}
+	}
+	if n := upstreamDenied.Value() - before; n != 2 {
+		t.Errorf("counted %d, expected 2", n)
+	}
+
+	// Addresses outside the ranges are allowed.
+	ranges, err = parseIPRanges("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer = net.Dialer{Control: denyUpstreamControl(ranges)}
+	conn, err := dialer.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("allowed address: %v", err)
+	}
+	conn.Close()
+}
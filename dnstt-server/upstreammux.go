@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/xtaci/smux"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// upstreamMux carries every stream to the upstream over one shared TCP
+// connection, rather than a TCP connection per stream. The shared connection
+// is an smux (version 2) session, in which the server is the smux client. The
+// upstream must be an smux server that accepts streams, such as a program
+// using github.com/xtaci/smux's smux.Server, or a bridge in front of the real
+// backend. Every stream begins with a header that identifies the tunnel
+// stream it carries:
+//
+//	+----------+------+-----------+---------+-----+
+//	| ClientID | conv | stream ID | tag len | tag |
+//	+----------+------+-----------+---------+-----+
+//	      8        4        4          1     0–32
+//
+// conv and stream ID are big-endian. The tag is the stream's -stream-tags tag,
+// and is empty if -stream-tags is not in use. After the header, the stream
+// carries the tunnel stream's data in both directions. smux has no half-close,
+// so when either side closes, the whole stream is closed.
+//
+// The shared connection is dialed when first needed, and dialed again when
+// needed after it fails.
+type upstreamMux struct {
+	dialer *upstreamDialer
+	conn   *muxConn
+	sess   *smux.Session
+	lock   sync.Mutex
+}
+
+// muxConn is the connection under an upstreamMux session. smux does not close
+// a session when its connection fails (for example, when the upstream closes
+// the connection), so muxConn records failures in failed.
+type muxConn struct {
+	net.Conn
+	failed chan struct{}
+	once   sync.Once
+}
+
+func (c *muxConn) fail() {
+	c.once.Do(func() { close(c.failed) })
+}
+
+func (c *muxConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.fail()
+	}
+	return n, err
+}
+
+func (c *muxConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.fail()
+	}
+	return n, err
+}
+
+// newUpstreamMux returns an upstreamMux whose connection is dialed by dialer.
+func newUpstreamMux(dialer *upstreamDialer) *upstreamMux {
+	return &upstreamMux{dialer: dialer}
+}
+
+// session returns the shared smux session, dialing it first if there is none
+// or the previous one has failed. The dial happens without m.lock held, so
+// that a slow dial does not hold up streams that find a live session. If
+// several goroutines dial at once, the first to finish publishes its session,
+// and the others close theirs and use it.
+func (m *upstreamMux) session(dialer *net.Dialer, clientID turbotunnel.ClientID) (*smux.Session, error) {
+	m.lock.Lock()
+	sess := m.live()
+	m.lock.Unlock()
+	if sess != nil {
+		return sess, nil
+	}
+
+	conn, sess, err := m.dial(dialer, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if live := m.live(); live != nil {
+		// Another goroutine won.
+		sess.Close()
+		conn.Close()
+		return live, nil
+	}
+	m.conn = conn
+	m.sess = sess
+	return sess, nil
+}
+
+// live returns the shared smux session if it has not failed, or else nil.
+// m.lock must be held.
+func (m *upstreamMux) live() *smux.Session {
+	if m.sess == nil {
+		return nil
+	}
+	select {
+	case <-m.conn.failed:
+		m.sess.Close()
+		return nil
+	default:
+	}
+	if m.sess.IsClosed() {
+		return nil
+	}
+	return m.sess
+}
+
+// dial makes a new connection to the upstream and starts an smux session on
+// it.
+func (m *upstreamMux) dial(dialer *net.Dialer, clientID turbotunnel.ClientID) (*muxConn, *smux.Session, error) {
+	tcpConn, err := m.dialer.Dial(dialer, clientID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if configureUpstreamConn != nil {
+		err := configureUpstreamConn(tcpConn)
+		if err != nil {
+			tcpConn.Close()
+			return nil, nil, fmt.Errorf("configure upstream: %v", err)
+		}
+	}
+	conn := &muxConn{Conn: tcpConn, failed: make(chan struct{})}
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = 2
+	sess, err := smux.Client(conn, smuxConfig)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, sess, nil
+}
+
+// OpenStream opens a stream in the shared session and writes its header.
+func (m *upstreamMux) OpenStream(dialer *net.Dialer, clientID turbotunnel.ClientID, conv, streamID uint32, tag string) (*smux.Stream, error) {
+	sess, err := m.session(dialer, clientID)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := sess.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, 17+len(tag))
+	header = append(header, clientID[:]...)
+	header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[8:12], conv)
+	binary.BigEndian.PutUint32(header[12:16], streamID)
+	header = append(header, byte(len(tag)))
+	header = append(header, tag...)
+	_, err = stream.Write(header)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
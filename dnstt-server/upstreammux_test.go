@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// muxBackend is an upstream that speaks the upstreamMux protocol. It echoes
+// the data of every stream, and records the headers of streams and the
+// number of connections.
+type muxBackend struct {
+	ln      net.Listener
+	conns   []net.Conn
+	headers [][]byte
+	lock    sync.Mutex
+}
+
+func startMuxBackend(t *testing.T) *muxBackend {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &muxBackend{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b.lock.Lock()
+			b.conns = append(b.conns, conn)
+			b.lock.Unlock()
+			smuxConfig := smux.DefaultConfig()
+			smuxConfig.Version = 2
+			sess, err := smux.Server(conn, smuxConfig)
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := sess.AcceptStream()
+					if err != nil {
+						return
+					}
+					go b.echo(stream)
+				}
+			}()
+		}
+	}()
+	return b
+}
+
+func (b *muxBackend) echo(stream *smux.Stream) {
+	defer stream.Close()
+	header := make([]byte, 17)
+	if _, err := io.ReadFull(stream, header); err != nil {
+		return
+	}
+	tag := make([]byte, int(header[16]))
+	if _, err := io.ReadFull(stream, tag); err != nil {
+		return
+	}
+	b.lock.Lock()
+	b.headers = append(b.headers, append(header, tag...))
+	b.lock.Unlock()
+	io.Copy(stream, stream)
+}
+
+// numConns returns the number of connections the backend has accepted.
+func (b *muxBackend) numConns() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.conns)
+}
+
+// exchange writes a message on stream and reads it back.
+func exchange(t *testing.T, stream *smux.Stream, msg string) {
+	t.Helper()
+	if _, err := stream.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("sent %+q, got back %+q", msg, buf)
+	}
+}
+
+func TestUpstreamMux(t *testing.T) {
+	defer func(saved *upstreamMux) { sharedUpstream = saved }(sharedUpstream)
+	backend := startMuxBackend(t)
+	defer backend.ln.Close()
+	sharedUpstream = newUpstreamMux(newUpstreamDialer(backend.ln.Addr().String(), 0))
+
+	// Two streams share one upstream connection.
+	stream1, stop1 := startHandleStreamWith(t, nil)
+	defer stop1()
+	exchange(t, stream1, "hello 1")
+	stream2, stop2 := startHandleStreamWith(t, nil)
+	defer stop2()
+	exchange(t, stream2, "hello 2")
+	if n := backend.numConns(); n != 1 {
+		t.Errorf("backend got %d connections, expected 1", n)
+	}
+
+	// Every stream starts with a header giving the ClientID, conv, stream
+	// ID, and tag of the tunnel stream.
+	backend.lock.Lock()
+	headers := backend.headers
+	backend.lock.Unlock()
+	if len(headers) != 2 {
+		t.Fatalf("backend got %d headers, expected 2", len(headers))
+	}
+	for _, header := range headers {
+		expected := []byte{1, 2, 3, 4, 5, 6, 7, 8, 1, 2, 3, 4, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(expected[12:16], stream1.ID())
+		if !bytes.Equal(header, expected) {
+			t.Errorf("header %x, expected %x", header, expected)
+		}
+	}
+
+	// If the shared connection fails, the next stream dials a new one.
+	backend.lock.Lock()
+	backend.conns[0].Close()
+	backend.lock.Unlock()
+	select {
+	case <-sharedUpstream.conn.failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the shared connection to fail")
+	}
+	stream3, stop3 := startHandleStreamWith(t, nil)
+	defer stop3()
+	exchange(t, stream3, "hello 3")
+	if n := backend.numConns(); n != 2 {
+		t.Errorf("backend got %d connections, expected 2", n)
+	}
+}
+
+func TestUpstreamMuxTag(t *testing.T) {
+	defer func(saved *upstreamMux) { sharedUpstream = saved }(sharedUpstream)
+	backend := startMuxBackend(t)
+	defer backend.ln.Close()
+	sharedUpstream = newUpstreamMux(newUpstreamDialer(backend.ln.Addr().String(), 0))
+
+	stream, err := sharedUpstream.OpenStream(&net.Dialer{Timeout: 5 * time.Second}, [8]byte{9}, 0xaabbccdd, 5, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	exchange(t, stream, "data")
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	expected := []byte{9, 0, 0, 0, 0, 0, 0, 0, 0xaa, 0xbb, 0xcc, 0xdd, 0, 0, 0, 5, 3, 'w', 'e', 'b'}
+	if len(backend.headers) != 1 || !bytes.Equal(backend.headers[0], expected) {
+		t.Errorf("headers %x, expected %x", backend.headers, expected)
+	}
+}
+
+func TestUpstreamMuxSlowDial(t *testing.T) {
+	defer func(saved func(net.Conn) error) { configureUpstreamConn = saved }(configureUpstreamConn)
+	backend := startMuxBackend(t)
+	defer backend.ln.Close()
+	mux := newUpstreamMux(newUpstreamDialer(backend.ln.Addr().String(), 0))
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+
+	// The first dial stalls until released.
+	release := make(chan struct{})
+	var calls int32
+	configureUpstreamConn = func(conn net.Conn) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+		}
+		return nil
+	}
+	slow := make(chan *smux.Stream, 1)
+	go func() {
+		stream, err := mux.OpenStream(dialer, [8]byte{1}, 1, 1, "")
+		if err != nil {
+			t.Error(err)
+		}
+		slow <- stream
+	}()
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Another stream does not wait for the stalled dial.
+	fast := make(chan *smux.Stream, 1)
+	go func() {
+		stream, err := mux.OpenStream(dialer, [8]byte{2}, 2, 1, "")
+		if err != nil {
+			t.Error(err)
+		}
+		fast <- stream
+	}()
+	select {
+	case stream := <-fast:
+		if stream == nil {
+			t.FailNow()
+		}
+		defer stream.Close()
+		exchange(t, stream, "fast")
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("stream waited for another stream's dial")
+	}
+
+	// The stalled dial lost the race; its session is closed, and its
+	// stream goes over the session that won.
+	close(release)
+	stream := <-slow
+	if stream == nil {
+		t.FailNow()
+	}
+	defer stream.Close()
+	exchange(t, stream, "slow")
+	mux.lock.Lock()
+	sess := mux.sess
+	mux.lock.Unlock()
+	if n := sess.NumStreams(); n != 2 {
+		t.Errorf("shared session has %d streams, expected 2", n)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+const (
+	// How long the WebSocket HTTP server waits for a client to send the
+	// headers of its upgrade request, and how long it keeps open an HTTP
+	// connection that is idle before an upgrade. Without these, a client
+	// could hold a connection, and its goroutine, open indefinitely by
+	// sending slowly or not at all.
+	wsReadHeaderTimeout = 5 * time.Second
+	wsIdleTimeout       = 2 * time.Minute
+)
+
+// wsAddr is the address of one WebSocket connection accepted by a
+// wsPacketConn. Two connections from the same remote address have different
+// wsAddrs. ip is the IP address part of remote, or "" if it has none.
+type wsAddr struct {
+	id     uint64
+	remote string
+	ip     string
+}
+
+func (addr wsAddr) Network() string { return "websocket" }
+func (addr wsAddr) String() string  { return fmt.Sprintf("%s#%d", addr.remote, addr.id) }
+
+// wsPacketConn is a net.PacketConn that carries DNS messages over WebSocket
+// connections, for use with CDNs that only pass HTTP and WebSocket through to
+// an origin server. Each binary WebSocket message contains one DNS message,
+// prefixed by a 16-bit length as in DNS over TCP. ReadFrom returns the DNS
+// messages received from all WebSocket connections, each tagged with a wsAddr
+// for the connection it came from. WriteTo sends a DNS message back over the
+// WebSocket connection identified by the wsAddr.
+//
+// The WebSocket library takes care of answering pings and close messages.
+type wsPacketConn struct {
+	*turbotunnel.QueuePacketConn
+	ln     net.Listener
+	nextID uint64
+}
+
+// newWSPacketConn starts an HTTP server on ln that accepts WebSocket
+// connections at path, and returns a wsPacketConn through which to exchange
+// the DNS messages they carry. Closing the wsPacketConn closes ln.
+func newWSPacketConn(ln net.Listener, path string) *wsPacketConn {
+	c := &wsPacketConn{
+		// Forget the outgoing queue of a WebSocket connection some time
+		// after it has closed.
+		QueuePacketConn: turbotunnel.NewQueuePacketConn(ln.Addr(), 1*time.Minute),
+		ln:              ln,
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Server{
+		// Do not check the Origin header, which non-browser clients
+		// do not send.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   c.handle,
+	})
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: wsReadHeaderTimeout,
+		IdleTimeout:       wsIdleTimeout,
+	}
+	go func() {
+		err := server.Serve(ln)
+		if err != nil {
+			log.Printf("WebSocket server: %v", err)
+		}
+		c.Close()
+	}()
+	return c
+}
+
+// handle exchanges DNS messages over one WebSocket connection, until the
+// connection is closed.
+func (c *wsPacketConn) handle(ws *websocket.Conn) {
+	defer ws.Close()
+	// A DNS message of the maximum length, plus its length prefix.
+	ws.MaxPayloadBytes = 2 + 0xffff
+	addr := wsAddr{
+		id:     atomic.AddUint64(&c.nextID, 1),
+		remote: ws.Request().RemoteAddr,
+		ip:     remoteIP(ws.Request().RemoteAddr),
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			var p []byte
+			var ok bool
+			select {
+			case <-done:
+				return
+			case p, ok = <-c.OutgoingQueue(addr):
+				if !ok {
+					// The queue expired; get a new one.
+					continue
+				}
+			}
+			msg := make([]byte, 2+len(p))
+			binary.BigEndian.PutUint16(msg, uint16(len(p)))
+			copy(msg[2:], p)
+			// Don't let a client that stops reading hold the
+			// connection open forever.
+			ws.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+			err := websocket.Message.Send(ws, msg)
+			if err != nil {
+				ws.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		var msg []byte
+		err := websocket.Message.Receive(ws, &msg)
+		if err == websocket.ErrFrameTooLarge {
+			continue
+		} else if err != nil {
+			// Includes io.EOF on a clean close.
+			return
+		}
+		if len(msg) < 2 || int(binary.BigEndian.Uint16(msg)) != len(msg)-2 {
+			log.Printf("%v: bad length prefix in WebSocket message of %d bytes", addr, len(msg))
+			continue
+		}
+		c.QueueIncoming(msg[2:], addr)
+	}
+}
+
+// Close closes the wsPacketConn and its listener.
+func (c *wsPacketConn) Close() error {
+	c.ln.Close()
+	return c.QueuePacketConn.Close()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestWSPacketConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newWSPacketConn(ln, "/dns")
+	defer conn.Close()
+
+	ws, err := websocket.Dial("ws://"+ln.Addr().String()+"/dns", "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// A message with a bad length prefix is ignored.
+	if err := websocket.Message.Send(ws, []byte("\x00\x05abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := websocket.Message.Send(ws, []byte("\x00\x05query")); err != nil {
+		t.Fatal(err)
+	}
+	var buf [100]byte
+	n, addr, err := conn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], []byte("query")) {
+		t.Fatalf("got %+q, expected %+q", buf[:n], "query")
+	}
+	if _, ok := addr.(wsAddr); !ok {
+		t.Fatalf("address %v has type %T, expected wsAddr", addr, addr)
+	}
+
+	// A response written to the address goes back over the same
+	// WebSocket connection, with a length prefix.
+	if _, err := conn.WriteTo([]byte("response"), addr); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg []byte
+	if err := websocket.Message.Receive(ws, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, []byte("\x00\x08response")) {
+		t.Fatalf("got %+q, expected %+q", msg, "\x00\x08response")
+	}
+
+	// A second connection gets a different address.
+	ws2, err := websocket.Dial("ws://"+ln.Addr().String()+"/dns", "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws2.Close()
+	if err := websocket.Message.Send(ws2, []byte("\x00\x06query2")); err != nil {
+		t.Fatal(err)
+	}
+	_, addr2, err := conn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr2 == addr {
+		t.Fatalf("second connection has the same address %v", addr)
+	}
+}
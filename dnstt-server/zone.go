@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+// zone is a set of static resource records, loaded from a file named by the
+// -zone option, that responseFor answers alongside the tunnel. It is not
+// modified after being loaded, so its methods are safe to call from multiple
+// goroutines.
+type zone struct {
+	// records maps a lowercased owner name, then a TYPE, to the records
+	// with that owner and TYPE.
+	records map[string]map[uint16][]dns.RR
+}
+
+// zoneKey returns the key under which records for name are stored in a zone.
+func zoneKey(name dns.Name) string {
+	return strings.ToLower(name.String())
+}
+
+// Lookup returns the records in z whose owner name is name (ignoring case) and
+// whose TYPE is rrType. The second return value indicates whether there are
+// any records for name at all, of any TYPE.
+func (z *zone) Lookup(name dns.Name, rrType uint16) ([]dns.RR, bool) {
+	types, ok := z.records[zoneKey(name)]
+	if !ok {
+		return nil, false
+	}
+	return types[rrType], true
+}
+
+// zoneTypes are the TYPEs that may appear in a zone file.
+var zoneTypes = map[string]uint16{
+	"A":    dns.RRTypeA,
+	"AAAA": dns.RRTypeAAAA,
+	"MX":   dns.RRTypeMX,
+	"NS":   dns.RRTypeNS,
+	"TXT":  dns.RRTypeTXT,
+}
+
+// readZoneFile opens filename and parses it with parseZone.
+func readZoneFile(filename string, domain dns.Name) (*zone, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z, err := parseZone(f, domain)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", filename, err)
+	}
+	return z, nil
+}
+
+// parseZone parses a zone in a subset of the master file format of RFC 1035
+// section 5.1. Each record must be on a single line (parentheses are not
+// supported); the only directive is $TTL. Names not ending in '.' are relative
+// to domain, and "@" stands for domain itself. An owner name may be omitted
+// by starting the line with whitespace, to mean the owner of the previous
+// record. The TTL and the class (which must be IN) are optional, in either
+// order; a missing TTL is that of the last $TTL directive, or responseTTL. All
+// owner names must be domain or a subdomain of it. The supported TYPEs are
+// those in zoneTypes.
+func parseZone(r io.Reader, domain dns.Name) (*zone, error) {
+	z := &zone{records: make(map[string]map[uint16][]dns.RR)}
+	defaultTTL := uint32(responseTTL)
+	var owner dns.Name
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := s.Text()
+		fields, err := zoneFields(line)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %v", lineNum, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		if strings.EqualFold(fields[0], "$TTL") {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%d: $TTL needs one argument", lineNum)
+			}
+			ttl, err := strconv.ParseUint(fields[1], 10, 31)
+			if err != nil {
+				return nil, fmt.Errorf("%d: bad TTL %+q", lineNum, fields[1])
+			}
+			defaultTTL = uint32(ttl)
+			continue
+		} else if strings.HasPrefix(fields[0], "$") {
+			return nil, fmt.Errorf("%d: unsupported directive %+q", lineNum, fields[0])
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			owner, err = zoneName(fields[0], domain)
+			if err != nil {
+				return nil, fmt.Errorf("%d: %v", lineNum, err)
+			}
+			if _, ok := owner.TrimSuffix(domain); !ok {
+				return nil, fmt.Errorf("%d: %s is not in the domain %s", lineNum, owner, domain)
+			}
+			fields = fields[1:]
+		} else if owner == nil {
+			return nil, fmt.Errorf("%d: no previous owner name", lineNum)
+		}
+
+		ttl := defaultTTL
+		for i := 0; i < 2 && len(fields) > 0; i++ {
+			if strings.EqualFold(fields[0], "IN") {
+				fields = fields[1:]
+			} else if n, err := strconv.ParseUint(fields[0], 10, 31); err == nil {
+				ttl = uint32(n)
+				fields = fields[1:]
+			}
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("%d: missing TYPE", lineNum)
+		}
+		rrType, ok := zoneTypes[strings.ToUpper(fields[0])]
+		if !ok {
+			return nil, fmt.Errorf("%d: unsupported TYPE %+q", lineNum, fields[0])
+		}
+		data, err := zoneRData(rrType, fields[1:], domain)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s: %v", lineNum, fields[0], err)
+		}
+
+		key := zoneKey(owner)
+		if z.records[key] == nil {
+			z.records[key] = make(map[uint16][]dns.RR)
+		}
+		z.records[key][rrType] = append(z.records[key][rrType], dns.RR{
+			Name:  owner,
+			Type:  rrType,
+			Class: dns.ClassIN,
+			TTL:   ttl,
+			Data:  data,
+		})
+	}
+	return z, s.Err()
+}
+
+// zoneFields splits a line of a zone file into whitespace-separated fields,
+// dropping any comment that starts with ';'. A field may be a string in
+// double quotes, which may contain whitespace, ';', and backslash escapes of
+// the next character; the quotes are kept, so that callers can distinguish
+// quoted from unquoted fields.
+func zoneFields(line string) ([]string, error) {
+	var fields []string
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == ';':
+			return fields, nil
+		case c == '"':
+			var b strings.Builder
+			b.WriteByte('"')
+			i++
+			for {
+				if i >= len(line) {
+					return nil, fmt.Errorf("unterminated string")
+				}
+				if line[i] == '"' {
+					i++
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				b.WriteByte(line[i])
+				i++
+			}
+			b.WriteByte('"')
+			fields = append(fields, b.String())
+		default:
+			j := i
+			for j < len(line) && line[j] != ' ' && line[j] != '\t' && line[j] != ';' {
+				j++
+			}
+			fields = append(fields, line[i:j])
+			i = j
+		}
+	}
+	return fields, nil
+}
+
+// zoneName parses a name from a zone file. "@" is domain; a name that does not
+// end in '.' is relative to domain.
+func zoneName(s string, domain dns.Name) (dns.Name, error) {
+	if s == "@" {
+		return domain, nil
+	}
+	if strings.HasSuffix(s, ".") {
+		return dns.ParseName(s)
+	}
+	if len(domain) > 0 {
+		s += "." + domain.String()
+	}
+	return dns.ParseName(s)
+}
+
+// zoneRData encodes the RDATA of a record of type rrType from the fields that
+// follow the TYPE in a zone file.
+func zoneRData(rrType uint16, fields []string, domain dns.Name) ([]byte, error) {
+	switch rrType {
+	case dns.RRTypeA, dns.RRTypeAAAA:
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("need one address")
+		}
+		ip := net.ParseIP(fields[0])
+		if rrType == dns.RRTypeA {
+			ip = ip.To4()
+		} else if ip.To4() != nil {
+			ip = nil
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("bad address %+q", fields[0])
+		}
+		return ip, nil
+	case dns.RRTypeMX:
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("need a preference and a name")
+		}
+		preference, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad preference %+q", fields[0])
+		}
+		name, err := zoneName(fields[1], domain)
+		if err != nil {
+			return nil, err
+		}
+		return dns.EncodeRDataMX(uint16(preference), name), nil
+	case dns.RRTypeNS:
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("need one name")
+		}
+		name, err := zoneName(fields[0], domain)
+		if err != nil {
+			return nil, err
+		}
+		return dns.EncodeRDataNS(name), nil
+	case dns.RRTypeTXT:
+		// Each field is one character-string.
+		// https://tools.ietf.org/html/rfc1035#section-3.3.14
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("need at least one string")
+		}
+		var data []byte
+		for _, field := range fields {
+			if len(field) >= 2 && field[0] == '"' && field[len(field)-1] == '"' {
+				field = field[1 : len(field)-1]
+			}
+			if len(field) > 255 {
+				return nil, fmt.Errorf("string of %d bytes is longer than 255", len(field))
+			}
+			data = append(data, byte(len(field)))
+			data = append(data, field...)
+		}
+		return data, nil
+	}
+	panic(fmt.Sprintf("unexpected TYPE %d", rrType))
+}
+
+// looksLikeTunnelName returns true if prefix, the part of a query name before
+// the tunnel domain, decodes as base32 to enough bytes to hold a ClientID, so
+// that responseFor must pass the query to the tunnel rather than answer it from
+// the zone.
+func looksLikeTunnelName(prefix dns.Name) bool {
+	encoded := bytes.ToUpper(bytes.Join(prefix, nil))
+	payload := make([]byte, base32Encoding.DecodedLen(len(encoded)))
+	n, err := base32Encoding.Decode(payload, encoded)
+	return err == nil && n >= len(turbotunnel.ClientID{})
+}
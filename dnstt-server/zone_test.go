@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"www.bamsoftware.com/git/dnstt.git/dns"
+	"www.bamsoftware.com/git/dnstt.git/turbotunnel"
+)
+
+func TestParseZone(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	z, err := parseZone(strings.NewReader(`; comment
+$TTL 300
+@		IN MX 10 mail.example.com.
+		TXT "v=spf1 -all" "second string" ; comment
+www	60 IN	A 192.0.2.1
+		IN 30 AAAA 2001:db8::1
+WWW.t.example.com.	60 A 192.0.2.2
+ns		NS ns.other
+txt		TXT "a \"quoted\" ; string"
+`), domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		rrType uint16
+		ttl    uint32
+		data   [][]byte
+	}{
+		{"t.example.com", dns.RRTypeMX, 300, [][]byte{dns.EncodeRDataMX(10, mustParseName("mail.example.com"))}},
+		{"t.example.com", dns.RRTypeTXT, 300, [][]byte{[]byte("\x0bv=spf1 -all\x0dsecond string")}},
+		{"www.t.example.com", dns.RRTypeA, 60, [][]byte{net.IPv4(192, 0, 2, 1).To4(), net.IPv4(192, 0, 2, 2).To4()}},
+		{"Www.T.example.com", dns.RRTypeAAAA, 30, [][]byte{net.ParseIP("2001:db8::1")}},
+		{"ns.t.example.com", dns.RRTypeNS, 300, [][]byte{dns.EncodeRDataNS(mustParseName("ns.other.t.example.com"))}},
+		{"txt.t.example.com", dns.RRTypeTXT, 300, [][]byte{[]byte("\x13a \"quoted\" ; string")}},
+	} {
+		rrs, ok := z.Lookup(mustParseName(test.name), test.rrType)
+		if !ok || len(rrs) != len(test.data) {
+			t.Errorf("%s %d: got %+v", test.name, test.rrType, rrs)
+			continue
+		}
+		for i, rr := range rrs {
+			if rr.Class != dns.ClassIN || rr.TTL != test.ttl || !bytes.Equal(rr.Data, test.data[i]) {
+				t.Errorf("%s %d: record %d is %+v", test.name, test.rrType, i, rr)
+			}
+		}
+	}
+
+	// The name exists, without records of the TYPE.
+	if rrs, ok := z.Lookup(mustParseName("www.t.example.com"), dns.RRTypeTXT); !ok || len(rrs) != 0 {
+		t.Errorf("NODATA: got %+v %v", rrs, ok)
+	}
+	// The name does not exist.
+	if rrs, ok := z.Lookup(mustParseName("mail.t.example.com"), dns.RRTypeA); ok || len(rrs) != 0 {
+		t.Errorf("NXDOMAIN: got %+v %v", rrs, ok)
+	}
+
+	for _, contents := range []string{
+		"www.example.com. A 192.0.2.1\n",
+		"www A 2001:db8::1\n",
+		"www AAAA 192.0.2.1\n",
+		"www CNAME other\n",
+		"www CH A 192.0.2.1\n",
+		"www\n",
+		" A 192.0.2.1\n",
+		"@ MX mail\n",
+		"@ TXT \"unterminated\n",
+		"$ORIGIN example.com.\n",
+		"$TTL x\n",
+	} {
+		if _, err := parseZone(strings.NewReader(contents), domain); err == nil {
+			t.Errorf("%+q: expected error", contents)
+		}
+	}
+}
+
+func TestResponseForZone(t *testing.T) {
+	defer func(saved *zone) { serveZone = saved }(serveZone)
+
+	domain := mustParseName("t.example.com")
+	payload := []byte("CLIENTIDpayload")
+	tunnel := tunnelName(payload, domain)
+	var err error
+	// A zone with a record that shadows a tunnel name.
+	serveZone, err = parseZone(strings.NewReader(`
+@	TXT "apex"
+www	A 192.0.2.1
+`+tunnel.String()+`.	TXT "shadow"
+`+tunnel.String()+`.	A 192.0.2.2
+`), domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(name string, qtype uint16) *dns.Message {
+		q := nsQuery(mustParseName(name))
+		q.Question[0].Type = qtype
+		return q
+	}
+
+	// Names in the zone are answered from it, with the case of the
+	// question.
+	for _, test := range []struct {
+		name   string
+		rrType uint16
+		data   []byte
+	}{
+		{"T.example.com", dns.RRTypeTXT, []byte("\x04apex")},
+		{"wWw.t.example.com", dns.RRTypeA, net.IPv4(192, 0, 2, 1).To4()},
+		// Not a tunnel QTYPE, so not a tunnel query.
+		{tunnel.String(), dns.RRTypeA, net.IPv4(192, 0, 2, 2).To4()},
+	} {
+		resp, p := responseFor(query(test.name, test.rrType), domain)
+		if resp == nil || resp.Rcode() != dns.RcodeNoError || resp.Flags&0x0400 == 0 || p != nil {
+			t.Errorf("%s: expected authoritative NOERROR, got %+v", test.name, resp)
+			continue
+		}
+		if len(resp.Answer) != 1 ||
+			resp.Answer[0].Name.String() != test.name ||
+			resp.Answer[0].Type != test.rrType ||
+			!bytes.Equal(resp.Answer[0].Data, test.data) {
+			t.Errorf("%s: bad answer %+v", test.name, resp.Answer)
+		}
+		if isTunnelResponse(resp) {
+			t.Errorf("%s: zone response looks like a tunnel response", test.name)
+		}
+	}
+
+	// A name in the zone without records of the QTYPE gets NODATA.
+	resp, p := responseFor(query("www.t.example.com", dns.RRTypeTXT), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNoError || len(resp.Answer) != 0 || p != nil {
+		t.Errorf("NODATA: got %+v", resp)
+	} else if len(resp.Authority) != 1 || resp.Authority[0].Type != dns.RRTypeSOA || isTunnelResponse(resp) {
+		t.Errorf("NODATA: Authority %+v", resp.Authority)
+	}
+	// A name not in the zone gets NXDOMAIN as before.
+	resp, _ = responseFor(query("mail.t.example.com", dns.RRTypeA), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNameError {
+		t.Errorf("NXDOMAIN: got %+v", resp)
+	}
+
+	// A tunnel query goes to the tunnel, even though its name is in the
+	// zone.
+	resp, p = responseFor(tunnelQuery(payload, domain), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNoError || len(resp.Answer) != 0 || !bytes.Equal(p, payload) {
+		t.Errorf("tunnel query got %+v, payload %+q", resp, p)
+	}
+	// And so does one whose name is not.
+	other := []byte("CLIENTIDother")
+	resp, p = responseFor(tunnelQuery(other, domain), domain)
+	if resp == nil || resp.Rcode() != dns.RcodeNoError || len(resp.Answer) != 0 || !bytes.Equal(p, other) {
+		t.Errorf("tunnel query got %+v, payload %+q", resp, p)
+	}
+}
+
+func TestResponseForZoneShuffle(t *testing.T) {
+	defer func(saved *zone) { serveZone = saved }(serveZone)
+	defer func(saved bool) { shuffleRRs = saved }(shuffleRRs)
+
+	domain := mustParseName("t.example.com")
+	var err error
+	serveZone, err = parseZone(strings.NewReader(`
+www	A 192.0.2.1
+www	A 192.0.2.2
+www	A 192.0.2.3
+www	A 192.0.2.4
+`), domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// answerOrder returns the last octets of the addresses in the answer,
+	// in order.
+	answerOrder := func() string {
+		q := nsQuery(mustParseName("www.t.example.com"))
+		q.Question[0].Type = dns.RRTypeA
+		resp, _ := responseFor(q, domain)
+		if resp == nil || len(resp.Answer) != 4 {
+			t.Fatalf("bad response %+v", resp)
+		}
+		var order []byte
+		for _, rr := range resp.Answer {
+			order = append(order, '0'+rr.Data[3])
+		}
+		return string(order)
+	}
+
+	// By default, always the order of the file.
+	for i := 0; i < 20; i++ {
+		if order := answerOrder(); order != "1234" {
+			t.Fatalf("got order %s, expected 1234", order)
+		}
+	}
+
+	// With shuffleRRs, the same RRs in varying orders. The chance of
+	// seeing only one order in 100 tries is negligible.
+	shuffleRRs = true
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		order := answerOrder()
+		sorted := []byte(order)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		if string(sorted) != "1234" {
+			t.Fatalf("got order %s, expected a permutation of 1234", order)
+		}
+		seen[order] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("saw only orders %v", seen)
+	}
+	// The zone itself is not reordered.
+	shuffleRRs = false
+	if order := answerOrder(); order != "1234" {
+		t.Errorf("after shuffling, got order %s, expected 1234", order)
+	}
+}
+
+// A NODATA from the zone, for a tunnel QTYPE, is not a tunnel response, so
+// recvLoop must not turn it into NXDOMAIN for lack of a ClientID.
+func TestRecvLoopZoneNoData(t *testing.T) {
+	defer func(saved *zone) { serveZone = saved }(serveZone)
+
+	domain := mustParseName("t.example.com")
+	var err error
+	serveZone, err = parseZone(strings.NewReader("www A 192.0.2.1\n"), domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsConn, ch, _, stop := startRecvLoop(domain, 1000)
+	defer stop()
+
+	query := nsQuery(mustParseName("www.t.example.com"))
+	query.Question[0].Type = dns.RRTypeTXT
+	buf, err := query.WireFormat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsConn.Inject(buf, turbotunnel.DummyAddr{})
+	select {
+	case rec := <-ch:
+		if rec.Resp.Rcode() != dns.RcodeNoError || len(rec.Resp.Answer) != 0 {
+			t.Errorf("expected NODATA, got %+v", rec.Resp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a record")
+	}
+}
+
+func TestLooksLikeTunnelName(t *testing.T) {
+	domain := mustParseName("t.example.com")
+	for _, test := range []struct {
+		prefix dns.Name
+		ok     bool
+	}{
+		{dns.Name{}, false},
+		{mustParseName("www"), false},
+		{mustParseName("mail.www"), false},
+		{mustParseName("aaaaaaaaaaaa"), false},
+		{mustParseName("aaaaaaaaaaaaa"), true},
+	} {
+		if ok := looksLikeTunnelName(test.prefix); ok != test.ok {
+			t.Errorf("%s: got %v, expected %v", test.prefix, ok, test.ok)
+		}
+	}
+	prefix, _ := tunnelName([]byte("CLIENTID"), domain).TrimSuffix(domain)
+	if !looksLikeTunnelName(prefix) {
+		t.Errorf("%s: expected true", prefix)
+	}
+}
@@ -6,4 +6,5 @@ require (
 	github.com/flynn/noise v1.0.0
 	github.com/xtaci/kcp-go/v5 v5.6.1
 	github.com/xtaci/smux v1.5.15
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 )
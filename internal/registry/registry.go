@@ -0,0 +1,84 @@
+// Package registry keeps the named implementations that programs embedding
+// dnstt add at the server's extension points, such as the custom transports of
+// the -transport option and the key providers of the -key-provider option,
+// which are selected on the command line with a NAME:CONFIG string.
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Registry maps names to implementations of one kind. It is safe for
+// concurrent use.
+type Registry struct {
+	kind  string
+	lock  sync.Mutex
+	items map[string]interface{}
+}
+
+// New returns an empty Registry for implementations of kind, a noun used in
+// panic and error messages, such as "transport".
+func New(kind string) *Registry {
+	return &Registry{
+		kind:  kind,
+		items: make(map[string]interface{}),
+	}
+}
+
+// Register adds v under name. It panics if name is already registered.
+func (r *Registry) Register(name string, v interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.items[name]; ok {
+		panic(fmt.Sprintf("%s %q registered twice", r.kind, name))
+	}
+	r.items[name] = v
+}
+
+// Unregister removes name, if it is registered. It is meant for tests.
+func (r *Registry) Unregister(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.items, name)
+}
+
+// Names returns the registered names, in sorted order.
+func (r *Registry) Names() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var names []string
+	for name := range r.items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns what is registered under name, or an error that lists the
+// names that are registered.
+func (r *Registry) Lookup(name string) (interface{}, error) {
+	r.lock.Lock()
+	v, ok := r.items[name]
+	r.lock.Unlock()
+	if ok {
+		return v, nil
+	}
+	names := r.Names()
+	if len(names) == 0 {
+		return nil, fmt.Errorf("unknown %s %q (this build has no %ss)", r.kind, name, r.kind)
+	}
+	return nil, fmt.Errorf("unknown %s %q (available: %s)", r.kind, name, strings.Join(names, ", "))
+}
+
+// SplitSpec splits a command-line specification of the form NAME or
+// NAME:CONFIG into NAME and CONFIG, which is empty if there is no colon. CONFIG
+// may itself contain colons.
+func SplitSpec(spec string) (name, config string) {
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		return spec[:i], spec[i+1:]
+	}
+	return spec, ""
+}
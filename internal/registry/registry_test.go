@@ -0,0 +1,52 @@
+package registry
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := New("widget")
+	if _, err := r.Lookup("a"); err == nil || !strings.Contains(err.Error(), "this build has no widgets") {
+		t.Errorf("empty: got %v", err)
+	}
+	r.Register("b", 2)
+	r.Register("a", 1)
+	if names := r.Names(); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("Names returned %+q", names)
+	}
+	if v, err := r.Lookup("a"); err != nil || v != 1 {
+		t.Errorf("a: got %v, %v", v, err)
+	}
+	if _, err := r.Lookup("c"); err == nil || err.Error() != `unknown widget "c" (available: a, b)` {
+		t.Errorf("unknown: got %v", err)
+	}
+	r.Unregister("b")
+	if _, err := r.Lookup("b"); err == nil {
+		t.Errorf("unregistered: expected error")
+	}
+
+	defer func() {
+		if p := recover(); p != `widget "a" registered twice` {
+			t.Errorf("registering twice: got panic %v", p)
+		}
+	}()
+	r.Register("a", 3)
+}
+
+func TestSplitSpec(t *testing.T) {
+	for _, test := range []struct {
+		spec, name, config string
+	}{
+		{"name", "name", ""},
+		{"name:", "name", ""},
+		{"name:config", "name", "config"},
+		{"name:eth0:1", "name", "eth0:1"},
+		{":config", "", "config"},
+	} {
+		if name, config := SplitSpec(test.spec); name != test.name || config != test.config {
+			t.Errorf("%+q: got (%+q, %+q), expected (%+q, %+q)", test.spec, name, config, test.name, test.config)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package noise
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/flynn/noise"
+	"www.bamsoftware.com/git/dnstt.git/internal/registry"
+)
+
+// KeyProvider holds a server's static X25519 private key and does the
+// Diffie–Hellman operations that use it. With a KeyProvider other than
+// LocalKeyProvider, the private key need never be in the memory of the server
+// process: it may live in an HSM (for example through PKCS#11) or in a cloud
+// key management service that can do X25519 key agreement.
+//
+// The server calls either Generate (to make a new key, in -gen-key mode) or
+// LoadPrivate (to use an existing one), once, before calling Pubkey or DH. DH
+// may be called from many goroutines at once, one call per handshake.
+//
+// Providers outside this repository make themselves available by calling
+// RegisterKeyProvider from an init function, in a package that is linked into
+// the server (for example by a file in the server's main package that does
+// nothing but import the provider's package for its side effects).
+type KeyProvider interface {
+	// Generate creates a new private key, which the provider stores in
+	// whatever way it stores keys.
+	Generate() error
+	// LoadPrivate makes an existing private key ready for use.
+	LoadPrivate() error
+	// Pubkey returns the KeyLen-byte public key that corresponds to the
+	// private key.
+	Pubkey() []byte
+	// DH returns the X25519 shared secret of the private key and pubkey,
+	// a KeyLen-byte public key from a client.
+	DH(pubkey []byte) ([]byte, error)
+}
+
+// LocalKeyProvider is a KeyProvider that keeps the private key in memory. It
+// is what the server uses with the -privkey and -privkey-file options.
+type LocalKeyProvider struct {
+	Privkey []byte
+	pubkey  []byte
+}
+
+// Generate sets p.Privkey to a new random private key.
+func (p *LocalKeyProvider) Generate() error {
+	privkey, _, err := GenerateKeypair()
+	if err != nil {
+		return err
+	}
+	p.Privkey = privkey
+	p.pubkey = PubkeyFromPrivkey(privkey)
+	return nil
+}
+
+// LoadPrivate checks that p.Privkey has the right length.
+func (p *LocalKeyProvider) LoadPrivate() error {
+	if len(p.Privkey) != KeyLen {
+		return fmt.Errorf("private key must be %d bytes, not %d", KeyLen, len(p.Privkey))
+	}
+	p.pubkey = PubkeyFromPrivkey(p.Privkey)
+	return nil
+}
+
+// Pubkey returns the public key of p.Privkey, as computed by Generate or
+// LoadPrivate.
+func (p *LocalKeyProvider) Pubkey() []byte {
+	return p.pubkey
+}
+
+// DH computes the shared secret of p.Privkey and pubkey.
+func (p *LocalKeyProvider) DH(pubkey []byte) ([]byte, error) {
+	return noise.DH25519.DH(p.Privkey, pubkey)
+}
+
+// keyProviders maps names to the open functions given to RegisterKeyProvider.
+var keyProviders = registry.New("key provider")
+
+// RegisterKeyProvider makes a KeyProvider available under name, to be created
+// by OpenKeyProvider. open receives a provider-specific configuration string,
+// such as a key label or a URL; it should check the configuration and make any
+// connection it needs, but not yet load or generate a key. RegisterKeyProvider
+// panics if name is already registered.
+func RegisterKeyProvider(name string, open func(config string) (KeyProvider, error)) {
+	keyProviders.Register(name, open)
+}
+
+// KeyProviders returns the names of the registered key providers, in sorted
+// order.
+func KeyProviders() []string {
+	return keyProviders.Names()
+}
+
+// OpenKeyProvider creates a KeyProvider of the registered type name, with the
+// given configuration. The error for an unknown name lists the registered
+// names.
+func OpenKeyProvider(name, config string) (KeyProvider, error) {
+	open, err := keyProviders.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return open.(func(config string) (KeyProvider, error))(config)
+}
+
+// providerDH is a noise.DHFunc that does X25519 as noise.DH25519 does, except
+// that DH with the private key placeholder is done by a KeyProvider. The
+// placeholder stands in for the static private key in noise.Config; it is
+// recognized by identity, not by value, so that no ephemeral key can be
+// mistaken for it.
+type providerDH struct {
+	keys        KeyProvider
+	placeholder []byte
+}
+
+func (dh *providerDH) isPlaceholder(privkey []byte) bool {
+	return len(privkey) == len(dh.placeholder) && &privkey[0] == &dh.placeholder[0]
+}
+
+func (dh *providerDH) GenerateKeypair(random io.Reader) (noise.DHKey, error) {
+	return noise.DH25519.GenerateKeypair(random)
+}
+
+func (dh *providerDH) DH(privkey, pubkey []byte) ([]byte, error) {
+	if dh.isPlaceholder(privkey) {
+		shared, err := dh.keys.DH(pubkey)
+		if err == nil && len(shared) != dh.DHLen() {
+			err = errors.New("key provider returned a shared secret of the wrong length")
+		}
+		return shared, err
+	}
+	return noise.DH25519.DH(privkey, pubkey)
+}
+
+func (dh *providerDH) DHLen() int     { return noise.DH25519.DHLen() }
+func (dh *providerDH) DHName() string { return noise.DH25519.DHName() }
+
+// NewServerKeyProvider is like NewServer, but the server's static private key
+// is used only through keys.
+func NewServerKeyProvider(rwc io.ReadWriteCloser, keys KeyProvider) (io.ReadWriteCloser, error) {
+	dh := &providerDH{keys: keys, placeholder: make([]byte, KeyLen)}
+	return newServer(rwc, noise.DHKey{Private: dh.placeholder, Public: keys.Pubkey()}, dh)
+}
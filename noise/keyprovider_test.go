@@ -0,0 +1,132 @@
+package noise
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// countingKeyProvider is a KeyProvider that wraps a LocalKeyProvider, counts
+// its DH calls, and optionally fails them, the way a provider backed by an HSM
+// might.
+type countingKeyProvider struct {
+	LocalKeyProvider
+	calls uint32
+	err   error
+}
+
+func (p *countingKeyProvider) DH(pubkey []byte) ([]byte, error) {
+	atomic.AddUint32(&p.calls, 1)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.LocalKeyProvider.DH(pubkey)
+}
+
+// handshakeKeyProvider runs NewClientSuite and NewServerKeyProvider on the two
+// ends of a pipe, and returns the resulting client and server, or the first
+// error.
+func handshakeKeyProvider(suite string, keys KeyProvider) (io.ReadWriteCloser, io.ReadWriteCloser, error) {
+	c, s := net.Pipe()
+	type result struct {
+		rw  io.ReadWriteCloser
+		err error
+	}
+	ch := make(chan result)
+	go func() {
+		rw, err := NewServerKeyProvider(s, keys)
+		if err != nil {
+			s.Close()
+		}
+		ch <- result{rw, err}
+	}()
+	client, clientErr := NewClientSuite(c, keys.Pubkey(), suite)
+	if clientErr != nil {
+		c.Close()
+	}
+	r := <-ch
+	if clientErr != nil {
+		return nil, nil, clientErr
+	}
+	return client, r.rw, r.err
+}
+
+func TestHandshakeKeyProvider(t *testing.T) {
+	for _, suite := range Suites {
+		keys := &countingKeyProvider{}
+		if err := keys.Generate(); err != nil {
+			t.Fatal(err)
+		}
+		client, server, err := handshakeKeyProvider(suite, keys)
+		if err != nil {
+			t.Errorf("%s: %v", suite, err)
+			continue
+		}
+		go client.Write([]byte("hello"))
+		var buf [5]byte
+		if _, err := io.ReadFull(server, buf[:]); err != nil || string(buf[:]) != "hello" {
+			t.Errorf("%s: read %+q, %v", suite, buf, err)
+		}
+		client.Close()
+		server.Close()
+		// The static private key was used only through the provider.
+		if keys.calls == 0 {
+			t.Errorf("%s: provider DH was not called", suite)
+		}
+	}
+
+	// An error from the provider fails the handshake.
+	keys := &countingKeyProvider{err: errors.New("HSM unavailable")}
+	if err := keys.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := handshakeKeyProvider(DefaultSuite, keys); err == nil {
+		t.Errorf("failing provider: expected error")
+	}
+}
+
+func TestLocalKeyProvider(t *testing.T) {
+	privkey, pubkey, err := GenerateKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &LocalKeyProvider{Privkey: privkey}
+	if err := keys.LoadPrivate(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys.Pubkey(), pubkey) {
+		t.Errorf("got pubkey %x, expected %x", keys.Pubkey(), pubkey)
+	}
+	if err := (&LocalKeyProvider{Privkey: privkey[:KeyLen-1]}).LoadPrivate(); err == nil {
+		t.Errorf("short private key: expected error")
+	}
+}
+
+func TestRegisterKeyProvider(t *testing.T) {
+	defer keyProviders.Unregister("test")
+
+	var gotConfig string
+	RegisterKeyProvider("test", func(config string) (KeyProvider, error) {
+		gotConfig = config
+		return &LocalKeyProvider{}, nil
+	})
+	if names := KeyProviders(); !reflect.DeepEqual(names, []string{"test"}) {
+		t.Errorf("KeyProviders returned %+q", names)
+	}
+	if _, err := OpenKeyProvider("test", "label=a:b"); err != nil || gotConfig != "label=a:b" {
+		t.Errorf("OpenKeyProvider: %v, config %+q", err, gotConfig)
+	}
+	if _, err := OpenKeyProvider("other", ""); err == nil {
+		t.Errorf("unknown provider: expected error")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering twice: expected panic")
+		}
+	}()
+	RegisterKeyProvider("test", nil)
+}
@@ -2,6 +2,13 @@
 // Noise_NK_25519_ChaChaPoly_BLAKE2s. It encodes Noise messages onto a reliable
 // stream using 16-bit length prefixes.
 //
+// A client may instead use the alternate cipher suite 25519_AESGCM_SHA256 (see
+// Suites). A server accepts either, telling them apart by which one
+// successfully decrypts the client's first handshake message, so no extra
+// negotiation is needed on the wire. The alternate suite exists so that if
+// ChaChaPoly or BLAKE2s is ever found weak, clients can move to the other
+// suite without a coordinated change of every client and server at once.
+//
 // https://noiseprotocol.org/noise.html
 package noise
 
@@ -22,8 +29,21 @@ import (
 // The length of public and private keys as returned by GenerateKeypair.
 const KeyLen = 32
 
-// cipherSuite represents 25519_ChaChaPoly_BLAKE2s.
-var cipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+// DefaultSuite is the name of the cipher suite that clients use unless told
+// otherwise.
+const DefaultSuite = "25519_ChaChaPoly_BLAKE2s"
+
+// cipherSuites maps the names of supported cipher suites to their
+// implementations. All use the same DH function, so that a server keypair
+// works with any of them.
+var cipherSuites = map[string]noise.CipherSuite{
+	DefaultSuite:          noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s),
+	"25519_AESGCM_SHA256": noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA256),
+}
+
+// Suites lists the names of the supported cipher suites, in the order that
+// NewServer tries them, DefaultSuite first.
+var Suites = []string{DefaultSuite, "25519_AESGCM_SHA256"}
 
 // readMessage reads a length-prefixed message from r. It returns a nil error
 // only when a complete message was read. It returns io.EOF only when there were
@@ -126,21 +146,38 @@ func (s *socket) Write(p []byte) (int, error) {
 }
 
 // newConfig instantiates configuration settings that are common to clients and
-// servers.
-func newConfig(initiator bool) noise.Config {
+// servers, for the named cipher suite. If dh is not nil, it replaces the
+// suite's DH function.
+func newConfig(initiator bool, suite string, dh noise.DHFunc) (noise.Config, error) {
+	cipherSuite, ok := cipherSuites[suite]
+	if !ok {
+		return noise.Config{}, fmt.Errorf("unknown cipher suite %q", suite)
+	}
+	if dh != nil {
+		cipherSuite = noise.NewCipherSuite(dh, cipherSuite, cipherSuite)
+	}
 	return noise.Config{
 		CipherSuite: cipherSuite,
 		Pattern:     noise.HandshakeNK,
 		Initiator:   initiator,
 		Prologue:    []byte("dnstt 2020-04-13"),
-	}
+	}, nil
 }
 
 // NewClient wraps an io.ReadWriteCloser in a Noise protocol as a client, and
 // returns after completing the handshake. It returns a non-nil error if there
 // is an error during the handshake.
 func NewClient(rwc io.ReadWriteCloser, serverPubkey []byte) (io.ReadWriteCloser, error) {
-	config := newConfig(true)
+	return NewClientSuite(rwc, serverPubkey, DefaultSuite)
+}
+
+// NewClientSuite is like NewClient, but uses the named cipher suite, which must
+// be one of Suites.
+func NewClientSuite(rwc io.ReadWriteCloser, serverPubkey []byte, suite string) (io.ReadWriteCloser, error) {
+	config, err := newConfig(true, suite, nil)
+	if err != nil {
+		return nil, err
+	}
 	config.PeerStatic = serverPubkey
 	handshakeState, err := noise.NewHandshakeState(config)
 	if err != nil {
@@ -173,25 +210,44 @@ func NewClient(rwc io.ReadWriteCloser, serverPubkey []byte) (io.ReadWriteCloser,
 	return newSocket(rwc, recvCipher, sendCipher), nil
 }
 
-// NewClient wraps an io.ReadWriteCloser in a Noise protocol as a server, and
+// NewServer wraps an io.ReadWriteCloser in a Noise protocol as a server, and
 // returns after completing the handshake. It returns a non-nil error if there
-// is an error during the handshake.
+// is an error during the handshake. The client may use any of Suites.
 func NewServer(rwc io.ReadWriteCloser, serverPrivkey, serverPubkey []byte) (io.ReadWriteCloser, error) {
-	config := newConfig(false)
-	config.StaticKeypair = noise.DHKey{Private: serverPrivkey, Public: serverPubkey}
-	handshakeState, err := noise.NewHandshakeState(config)
-	if err != nil {
-		return nil, err
-	}
+	return newServer(rwc, noise.DHKey{Private: serverPrivkey, Public: serverPubkey}, nil)
+}
 
+// newServer is NewServer with the server's static keypair given as a DHKey.
+// If dh is not nil, it replaces the DH function of every cipher suite.
+func newServer(rwc io.ReadWriteCloser, staticKeypair noise.DHKey, dh noise.DHFunc) (io.ReadWriteCloser, error) {
 	// -> e, es
 	msg, err := readMessage(rwc)
 	if err != nil {
 		return nil, err
 	}
-	payload, _, _, err := handshakeState.ReadMessage(nil, msg)
-	if err != nil {
-		return nil, err
+	// The message's payload is empty, but it is still encrypted and
+	// authenticated under a key that depends on the protocol name. Only
+	// the client's cipher suite decrypts it successfully.
+	var handshakeState *noise.HandshakeState
+	var payload []byte
+	for _, suite := range Suites {
+		config, err := newConfig(false, suite, dh)
+		if err != nil {
+			return nil, err
+		}
+		config.StaticKeypair = staticKeypair
+		handshakeState, err = noise.NewHandshakeState(config)
+		if err != nil {
+			return nil, err
+		}
+		payload, _, _, err = handshakeState.ReadMessage(nil, msg)
+		if err == nil {
+			break
+		}
+		handshakeState = nil
+	}
+	if handshakeState == nil {
+		return nil, errors.New("handshake message does not match any cipher suite")
 	}
 	if len(payload) != 0 {
 		return nil, errors.New("unexpected server payload")
@@ -3,6 +3,7 @@ package noise
 import (
 	"bytes"
 	"io"
+	"net"
 	"testing"
 )
 
@@ -100,3 +101,70 @@ func TestReadKey(t *testing.T) {
 		}
 	}
 }
+
+// handshake runs NewClientSuite and NewServer on the two ends of a pipe, and
+// returns the resulting client and server, or the first error.
+func handshake(t *testing.T, suite string, serverPubkeyForClient []byte) (io.ReadWriteCloser, io.ReadWriteCloser, error) {
+	privkey, pubkey, err := GenerateKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverPubkeyForClient == nil {
+		serverPubkeyForClient = pubkey
+	}
+	c, s := net.Pipe()
+	type result struct {
+		rw  io.ReadWriteCloser
+		err error
+	}
+	ch := make(chan result)
+	go func() {
+		rw, err := NewServer(s, privkey, pubkey)
+		if err != nil {
+			s.Close()
+		}
+		ch <- result{rw, err}
+	}()
+	client, clientErr := NewClientSuite(c, serverPubkeyForClient, suite)
+	if clientErr != nil {
+		c.Close()
+	}
+	r := <-ch
+	if clientErr != nil {
+		return nil, nil, clientErr
+	}
+	return client, r.rw, r.err
+}
+
+func TestHandshakeSuites(t *testing.T) {
+	for _, suite := range Suites {
+		client, server, err := handshake(t, suite, nil)
+		if err != nil {
+			t.Errorf("%s: %v", suite, err)
+			continue
+		}
+		go client.Write([]byte("hello"))
+		var buf [5]byte
+		if _, err := io.ReadFull(server, buf[:]); err != nil || string(buf[:]) != "hello" {
+			t.Errorf("%s: read %+q, %v", suite, buf, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	if _, _, err := handshake(t, "25519_ChaChaPoly_SHA512", nil); err == nil {
+		t.Errorf("unknown suite: expected error")
+	}
+	// With the wrong server public key, no suite matches.
+	_, wrongPubkey, err := GenerateKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, suite := range Suites {
+		if _, _, err := handshake(t, suite, wrongPubkey); err == nil {
+			t.Errorf("%s with wrong pubkey: expected error", suite)
+		}
+	}
+}
@@ -45,8 +45,19 @@ type QueuePacketConn struct {
 // NewQueuePacketConn makes a new QueuePacketConn, set to track recent peers
 // for at least a duration of timeout.
 func NewQueuePacketConn(localAddr net.Addr, timeout time.Duration) *QueuePacketConn {
+	return newQueuePacketConn(localAddr, NewRemoteMap(timeout))
+}
+
+// NewQueuePacketConnFunc makes a new QueuePacketConn that tracks each recent
+// peer for at least the duration that timeoutFor returns for its address, as
+// with NewRemoteMapFunc.
+func NewQueuePacketConnFunc(localAddr net.Addr, timeoutFor func(addr net.Addr) time.Duration) *QueuePacketConn {
+	return newQueuePacketConn(localAddr, NewRemoteMapFunc(timeoutFor))
+}
+
+func newQueuePacketConn(localAddr net.Addr, remotes *RemoteMap) *QueuePacketConn {
 	return &QueuePacketConn{
-		remotes:   NewRemoteMap(timeout),
+		remotes:   remotes,
 		localAddr: localAddr,
 		recvQueue: make(chan taggedPacket, queueSize),
 		closed:    make(chan struct{}),
@@ -93,6 +104,20 @@ func (c *QueuePacketConn) Unstash(addr net.Addr) <-chan []byte {
 	return c.remotes.Unstash(addr)
 }
 
+// RemoteStats returns the number of remote peer addresses currently being
+// tracked, and the total number of addresses that have been forgotten because
+// they were idle for longer than their timeout.
+func (c *QueuePacketConn) RemoteStats() (live int, expired uint64) {
+	return c.remotes.Stats()
+}
+
+// OutgoingQueueLengths returns the number of packets waiting to be sent to each
+// remote peer address currently being tracked, counting both the outgoing queue
+// and the stash.
+func (c *QueuePacketConn) OutgoingQueueLengths() map[net.Addr]int {
+	return c.remotes.QueueLengths()
+}
+
 // ReadFrom returns a packet and address previously stored by QueueIncoming.
 func (c *QueuePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 	select {
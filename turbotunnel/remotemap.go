@@ -10,12 +10,24 @@ import (
 // remoteRecord is a record of a recently seen remote peer, with the time it was
 // last seen and queues of outgoing packets.
 type remoteRecord struct {
-	Addr      net.Addr
-	LastSeen  time.Time
+	Addr     net.Addr
+	LastSeen time.Time
+	// Timeout is how long after LastSeen the record expires, or 0 if it
+	// never expires.
+	Timeout   time.Duration
 	SendQueue chan []byte
 	Stash     chan []byte
 }
 
+// expires returns the time at which record expires, and false if it never
+// does.
+func (record *remoteRecord) expires() (time.Time, bool) {
+	if record.Timeout <= 0 {
+		return time.Time{}, false
+	}
+	return record.LastSeen.Add(record.Timeout), true
+}
+
 // RemoteMap manages a mapping of live remote peers, keyed by address, to their
 // respective send queues. Each peer has two queues: a primary send queue, and a
 // "stash". The primary send queue is returned by the SendQueue method. The
@@ -28,8 +40,14 @@ type RemoteMap struct {
 	// We use an inner structure to avoid exposing public heap.Interface
 	// functions to users of remoteMap.
 	inner remoteMapInner
-	// Synchronizes access to inner.
+	// Total number of records removed by expiry.
+	expired uint64
+	// Synchronizes access to inner and expired.
 	lock sync.Mutex
+	// timeoutFor returns the timeout of the peer with a given address.
+	timeoutFor func(addr net.Addr) time.Duration
+	// wake is signaled when a record may now be the next to expire.
+	wake chan struct{}
 }
 
 // NewRemoteMap creates a RemoteMap that expires peers after a timeout.
@@ -43,32 +61,81 @@ type RemoteMap struct {
 // instantiate a new send queue, and if the peer is ever seen again with a
 // matching address, we'll deliver them.
 func NewRemoteMap(timeout time.Duration) *RemoteMap {
+	if timeout <= 0 {
+		return NewRemoteMapFunc(nil)
+	}
+	return NewRemoteMapFunc(func(net.Addr) time.Duration { return timeout })
+}
+
+// NewRemoteMapFunc creates a RemoteMap that expires each peer after the
+// timeout that timeoutFor returns for the peer's address. timeoutFor is called
+// every time a peer is seen, so the timeout of a peer may change over its
+// lifetime. A timeout of 0 means the peer never expires. If timeoutFor is nil,
+// no peers expire.
+func NewRemoteMapFunc(timeoutFor func(addr net.Addr) time.Duration) *RemoteMap {
 	m := &RemoteMap{
 		inner: remoteMapInner{
 			byAge:  make([]*remoteRecord, 0),
 			byAddr: make(map[net.Addr]int),
 		},
+		timeoutFor: timeoutFor,
+		wake:       make(chan struct{}, 1),
 	}
-	if timeout > 0 {
-		go func() {
-			for {
-				time.Sleep(timeout / 2)
-				now := time.Now()
-				m.lock.Lock()
-				m.inner.removeExpired(now, timeout)
-				m.lock.Unlock()
-			}
-		}()
+	if timeoutFor != nil {
+		go m.expireLoop()
 	}
 	return m
 }
 
+// expireLoop removes each record from the map when it expires.
+func (m *RemoteMap) expireLoop() {
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-timer.C:
+		case <-m.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		now := time.Now()
+		m.lock.Lock()
+		m.expired += uint64(m.inner.removeExpired(now))
+		next, ok := m.inner.nextExpiry()
+		m.lock.Unlock()
+		if ok {
+			timer.Reset(next.Sub(now))
+		} else {
+			// Nothing to expire until woken.
+			timer.Reset(time.Duration(1<<63 - 1))
+		}
+	}
+}
+
+// lookup calls m.inner.Lookup with the current time and timeout for addr, and
+// wakes expireLoop if that makes the next expiry sooner. m.lock must be held.
+func (m *RemoteMap) lookup(addr net.Addr) *remoteRecord {
+	var timeout time.Duration
+	if m.timeoutFor != nil {
+		timeout = m.timeoutFor(addr)
+	}
+	prev, prevOK := m.inner.nextExpiry()
+	record := m.inner.Lookup(addr, time.Now(), timeout)
+	if next, ok := m.inner.nextExpiry(); ok && (!prevOK || next.Before(prev)) {
+		select {
+		case m.wake <- struct{}{}:
+		default:
+		}
+	}
+	return record
+}
+
 // SendQueue returns the send queue corresponding to addr, creating it if
 // necessary.
 func (m *RemoteMap) SendQueue(addr net.Addr) chan []byte {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	return m.inner.Lookup(addr, time.Now()).SendQueue
+	return m.lookup(addr).SendQueue
 }
 
 // Stash places p in the stash corresponding to addr, if the stash is not
@@ -78,7 +145,7 @@ func (m *RemoteMap) Stash(addr net.Addr, p []byte) bool {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	select {
-	case m.inner.Lookup(addr, time.Now()).Stash <- p:
+	case m.lookup(addr).Stash <- p:
 		return true
 	default:
 		return false
@@ -89,11 +156,32 @@ func (m *RemoteMap) Stash(addr net.Addr, p []byte) bool {
 func (m *RemoteMap) Unstash(addr net.Addr) <-chan []byte {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	return m.inner.Lookup(addr, time.Now()).Stash
+	return m.lookup(addr).Stash
+}
+
+// Stats returns the number of peers currently in the map, and the total number
+// of peers that have ever been removed from the map because of the timeout.
+func (m *RemoteMap) Stats() (live int, expired uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.inner.Len(), m.expired
+}
+
+// QueueLengths returns the number of packets waiting in the send queue and
+// stash of each peer currently in the map. Unlike SendQueue, it does not
+// refresh the peers' last-seen times.
+func (m *RemoteMap) QueueLengths() map[net.Addr]int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	lengths := make(map[net.Addr]int, len(m.inner.byAge))
+	for _, record := range m.inner.byAge {
+		lengths[record.Addr] = len(record.SendQueue) + len(record.Stash)
+	}
+	return lengths
 }
 
 // remoteMapInner is the inner type of RemoteMap, implementing heap.Interface.
-// byAge is the backing store, a heap ordered by LastSeen time, to facilitate
+// byAge is the backing store, a heap ordered by expiry time, to facilitate
 // expiring old records. byAddr is a map from addresses to heap indices, to
 // allow looking up by address. Unlike RemoteMap, remoteMapInner requires
 // external synchonization.
@@ -102,31 +190,49 @@ type remoteMapInner struct {
 	byAddr map[net.Addr]int
 }
 
-// removeExpired removes all records whose LastSeen timestamp is more than
-// timeout in the past.
-func (inner *remoteMapInner) removeExpired(now time.Time, timeout time.Duration) {
-	for len(inner.byAge) > 0 && now.Sub(inner.byAge[0].LastSeen) >= timeout {
+// removeExpired removes all records that have expired as of now. It returns
+// the number of records removed.
+func (inner *remoteMapInner) removeExpired(now time.Time) int {
+	n := 0
+	for len(inner.byAge) > 0 {
+		expires, ok := inner.byAge[0].expires()
+		if !ok || now.Before(expires) {
+			break
+		}
 		record := heap.Pop(inner).(*remoteRecord)
 		close(record.SendQueue)
+		n++
 	}
+	return n
+}
+
+// nextExpiry returns the time at which the next record will expire, and false
+// if no record will ever expire.
+func (inner *remoteMapInner) nextExpiry() (time.Time, bool) {
+	if len(inner.byAge) == 0 {
+		return time.Time{}, false
+	}
+	return inner.byAge[0].expires()
 }
 
 // Lookup finds the existing record corresponding to addr, or creates a new
-// one if none exists yet. It updates the record's LastSeen time and returns the
-// record.
-func (inner *remoteMapInner) Lookup(addr net.Addr, now time.Time) *remoteRecord {
+// one if none exists yet. It updates the record's LastSeen time and Timeout,
+// and returns the record.
+func (inner *remoteMapInner) Lookup(addr net.Addr, now time.Time, timeout time.Duration) *remoteRecord {
 	var record *remoteRecord
 	i, ok := inner.byAddr[addr]
 	if ok {
 		// Found one, update its LastSeen.
 		record = inner.byAge[i]
 		record.LastSeen = now
+		record.Timeout = timeout
 		heap.Fix(inner, i)
 	} else {
 		// Not found, create a new one.
 		record = &remoteRecord{
 			Addr:      addr,
 			LastSeen:  now,
+			Timeout:   timeout,
 			SendQueue: make(chan []byte, queueSize),
 			Stash:     make(chan []byte, 1),
 		}
@@ -144,8 +250,15 @@ func (inner *remoteMapInner) Len() int {
 	return len(inner.byAge)
 }
 
+// Less orders records by the time they expire, with records that never expire
+// last.
 func (inner *remoteMapInner) Less(i, j int) bool {
-	return inner.byAge[i].LastSeen.Before(inner.byAge[j].LastSeen)
+	ei, oki := inner.byAge[i].expires()
+	ej, okj := inner.byAge[j].expires()
+	if !oki || !okj {
+		return oki && !okj
+	}
+	return ei.Before(ej)
 }
 
 func (inner *remoteMapInner) Swap(i, j int) {
@@ -0,0 +1,149 @@
+package turbotunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type testAddr string
+
+func (addr testAddr) Network() string { return "test" }
+func (addr testAddr) String() string  { return string(addr) }
+
+// waitClosed waits for ch to be closed, discarding anything in it, and returns
+// false if that does not happen within timeout.
+func waitClosed(ch chan []byte, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func TestRemoteMapInnerExpiry(t *testing.T) {
+	inner := remoteMapInner{
+		byAge:  make([]*remoteRecord, 0),
+		byAddr: make(map[net.Addr]int),
+	}
+	now := time.Now()
+	// Records expire in the order of their expiry times, not the order in
+	// which they were seen.
+	never := inner.Lookup(testAddr("never"), now, 0)
+	slow := inner.Lookup(testAddr("slow"), now, 3*time.Second)
+	fast := inner.Lookup(testAddr("fast"), now, 1*time.Second)
+	medium := inner.Lookup(testAddr("medium"), now, 2*time.Second)
+
+	for _, test := range []struct {
+		elapsed time.Duration
+		removed int
+		closed  *remoteRecord
+		next    time.Duration
+	}{
+		{500 * time.Millisecond, 0, nil, 1 * time.Second},
+		{1500 * time.Millisecond, 1, fast, 2 * time.Second},
+		{2 * time.Second, 1, medium, 3 * time.Second},
+		{10 * time.Second, 1, slow, -1},
+		{time.Hour, 0, nil, -1},
+	} {
+		if n := inner.removeExpired(now.Add(test.elapsed)); n != test.removed {
+			t.Errorf("%v: removed %d, expected %d", test.elapsed, n, test.removed)
+		}
+		if test.closed != nil && !waitClosed(test.closed.SendQueue, time.Second) {
+			t.Errorf("%v: %v was not closed", test.elapsed, test.closed.Addr)
+		}
+		next, ok := inner.nextExpiry()
+		if test.next < 0 {
+			if ok {
+				t.Errorf("%v: next expiry %v, expected none", test.elapsed, next.Sub(now))
+			}
+		} else if !ok || !next.Equal(now.Add(test.next)) {
+			t.Errorf("%v: next expiry %v %v, expected %v", test.elapsed, next.Sub(now), ok, test.next)
+		}
+	}
+	// The record that never expires is all that is left.
+	if inner.Len() != 1 || inner.byAge[0] != never {
+		t.Errorf("remaining records %v", inner.byAge)
+	}
+
+	// Being seen again postpones a record's expiry, and may change its
+	// timeout.
+	now = now.Add(time.Hour)
+	inner.Lookup(testAddr("a"), now, 1*time.Second)
+	inner.Lookup(testAddr("b"), now, 2*time.Second)
+	inner.Lookup(testAddr("a"), now.Add(1500*time.Millisecond), 1*time.Second)
+	inner.Lookup(testAddr("b"), now, 1*time.Minute)
+	if n := inner.removeExpired(now.Add(2 * time.Second)); n != 0 {
+		t.Errorf("removed %d records that were seen again", n)
+	}
+	if next, ok := inner.nextExpiry(); !ok || !next.Equal(now.Add(2500*time.Millisecond)) {
+		t.Errorf("next expiry %v %v, expected %v", next.Sub(now), ok, 2500*time.Millisecond)
+	}
+}
+
+func TestRemoteMapExpiry(t *testing.T) {
+	timeouts := map[net.Addr]time.Duration{
+		testAddr("slow"):  time.Hour,
+		testAddr("fast"):  50 * time.Millisecond,
+		testAddr("never"): 0,
+	}
+	m := NewRemoteMapFunc(func(addr net.Addr) time.Duration { return timeouts[addr] })
+
+	m.SendQueue(testAddr("never"))
+	slow := m.SendQueue(testAddr("slow"))
+	slow <- []byte("packet")
+	if !m.Stash(testAddr("slow"), []byte("stashed")) {
+		t.Fatal("stash failed")
+	}
+	// expireLoop is now waiting for the slow peer's timeout. A peer with a
+	// shorter timeout must wake it, or else the fast peer would not expire
+	// for an hour.
+	time.Sleep(10 * time.Millisecond)
+	fast := m.SendQueue(testAddr("fast"))
+	if !waitClosed(fast, 5*time.Second) {
+		t.Fatal("fast peer did not expire")
+	}
+
+	if live, expired := m.Stats(); live != 2 || expired != 1 {
+		t.Errorf("Stats: got %d live, %d expired, expected 2, 1", live, expired)
+	}
+	lengths := m.QueueLengths()
+	expected := map[net.Addr]int{testAddr("slow"): 2, testAddr("never"): 0}
+	if len(lengths) != len(expected) {
+		t.Errorf("QueueLengths: got %v, expected %v", lengths, expected)
+	}
+	for addr, n := range expected {
+		if lengths[addr] != n {
+			t.Errorf("QueueLengths: got %v, expected %v", lengths, expected)
+		}
+	}
+
+	// A peer seen again after it expired gets a new queue.
+	if m.SendQueue(testAddr("fast")) == fast {
+		t.Error("expired peer got its old queue")
+	}
+	if live, expired := m.Stats(); live != 3 || expired != 1 {
+		t.Errorf("Stats: got %d live, %d expired, expected 3, 1", live, expired)
+	}
+}
+
+func TestRemoteMapNoTimeout(t *testing.T) {
+	m := NewRemoteMap(0)
+	queue := m.SendQueue(testAddr("peer"))
+	queue <- []byte("packet")
+	if m.SendQueue(testAddr("peer")) != queue {
+		t.Error("got a different queue for the same peer")
+	}
+	if live, expired := m.Stats(); live != 1 || expired != 0 {
+		t.Errorf("Stats: got %d live, %d expired, expected 1, 0", live, expired)
+	}
+	if lengths := m.QueueLengths(); len(lengths) != 1 || lengths[testAddr("peer")] != 1 {
+		t.Errorf("QueueLengths: got %v", lengths)
+	}
+}